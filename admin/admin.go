@@ -0,0 +1,212 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/vela-games/circleci-runner-autoscaler/workers"
+)
+
+// Registry knows every dispatched worker and controls them by resource class
+type Registry interface {
+	Status() []workers.WorkerStatus
+	WakeResourceClass(class string) int
+	PauseResourceClass(class string) int
+	ResumeResourceClass(class string) int
+	LimitResourceClassCapacity(class string, max int32, until time.Time) int
+	ClearResourceClassCapacityLimit(class string) int
+}
+
+// Handler serves the admin API, every request needs the token as bearer token:
+//
+//	GET    /workers                          lists the workers and what they're doing
+//	POST   /classes/<class>/pause            stops scaling the resource class
+//	POST   /classes/<class>/resume           starts scaling the resource class again
+//	POST   /classes/<class>/reconcile        scales the resource class right away
+//	PUT    /classes/<class>/capacity         limits the capacity of the resource class for a while
+//	DELETE /classes/<class>/capacity         removes the capacity limit
+type Handler struct {
+	Token    string
+	Registry Registry
+
+	// Defaults to time.Now
+	Now func() time.Time
+}
+
+type workerResponse struct {
+	Type               string     `json:"type"`
+	Kind               string     `json:"kind,omitempty"`
+	Backend            string     `json:"backend,omitempty"`
+	Target             string     `json:"target,omitempty"`
+	ResourceClass      string     `json:"resourceClass,omitempty"`
+	Paused             bool       `json:"paused"`
+	Quarantined        bool       `json:"quarantined"`
+	Panics             int        `json:"panics"`
+	LastPanic          string     `json:"lastPanic,omitempty"`
+	LastDecision       string     `json:"lastDecision,omitempty"`
+	LastDecisionAt     *time.Time `json:"lastDecisionAt,omitempty"`
+	LastError          string     `json:"lastError,omitempty"`
+	LastErrorAt        *time.Time `json:"lastErrorAt,omitempty"`
+	PendingCapacity    int32      `json:"pendingCapacity"`
+	CapacityLimit      *int32     `json:"capacityLimit,omitempty"`
+	CapacityLimitUntil *time.Time `json:"capacityLimitUntil,omitempty"`
+}
+
+type capacityRequest struct {
+	Max *int32 `json:"max"`
+	// How long the limit lasts, e.g. "2h"
+	Duration string `json:"duration"`
+}
+
+type actionResponse struct {
+	ResourceClass string `json:"resourceClass"`
+	Workers       int    `json:"workers"`
+}
+
+func (h *Handler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		rw.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(rw, http.StatusUnauthorized, "invalid or missing bearer token")
+		return
+	}
+
+	if r.URL.Path == "/workers" {
+		if r.Method != http.MethodGet {
+			writeError(rw, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		h.listWorkers(rw)
+		return
+	}
+
+	// Resource classes contain a slash, so the action is the last path segment
+	path, ok := strings.CutPrefix(r.URL.Path, "/classes/")
+	i := strings.LastIndex(path, "/")
+	if !ok || i <= 0 {
+		writeError(rw, http.StatusNotFound, "not found")
+		return
+	}
+	class, action := path[:i], path[i+1:]
+
+	switch {
+	case action == "pause" && r.Method == http.MethodPost:
+		h.act(rw, class, h.Registry.PauseResourceClass(class))
+	case action == "resume" && r.Method == http.MethodPost:
+		h.act(rw, class, h.Registry.ResumeResourceClass(class))
+	case action == "reconcile" && r.Method == http.MethodPost:
+		h.act(rw, class, h.Registry.WakeResourceClass(class))
+	case action == "capacity" && r.Method == http.MethodPut:
+		h.limitCapacity(rw, r, class)
+	case action == "capacity" && r.Method == http.MethodDelete:
+		h.act(rw, class, h.Registry.ClearResourceClassCapacityLimit(class))
+	case action == "pause" || action == "resume" || action == "reconcile" || action == "capacity":
+		writeError(rw, http.StatusMethodNotAllowed, "method not allowed")
+	default:
+		writeError(rw, http.StatusNotFound, "not found")
+	}
+}
+
+func (h *Handler) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && h.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(h.Token)) == 1
+}
+
+func (h *Handler) listWorkers(rw http.ResponseWriter) {
+	response := []workerResponse{}
+	for _, status := range h.Registry.Status() {
+		worker := workerResponse{
+			Type:        fmt.Sprintf("%T", status.Worker),
+			Paused:      status.Paused,
+			Quarantined: status.Quarantined,
+			Panics:      status.Panics,
+			LastPanic:   status.LastPanic,
+		}
+
+		if kinded, ok := status.Worker.(workers.KindedWorker); ok {
+			worker.Kind = string(kinded.Kind())
+		}
+
+		if reporter, ok := status.Worker.(workers.Reporter); ok {
+			report := reporter.Report()
+			worker.Backend = report.Backend
+			worker.Target = report.Target
+			worker.ResourceClass = report.ResourceClass
+			worker.LastDecision = report.LastDecision
+			worker.LastDecisionAt = timePointer(report.LastDecisionAt)
+			worker.LastError = report.LastError
+			worker.LastErrorAt = timePointer(report.LastErrorAt)
+			worker.PendingCapacity = report.PendingCapacity
+			worker.CapacityLimit = report.CapacityLimit
+			worker.CapacityLimitUntil = timePointer(report.CapacityLimitUntil)
+		}
+
+		response = append(response, worker)
+	}
+
+	writeJSON(rw, http.StatusOK, response)
+}
+
+func (h *Handler) limitCapacity(rw http.ResponseWriter, r *http.Request, class string) {
+	var request capacityRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		writeError(rw, http.StatusBadRequest, fmt.Sprintf("invalid body: %v", err))
+		return
+	}
+
+	if request.Max == nil || *request.Max < 0 {
+		writeError(rw, http.StatusBadRequest, "max must be set and can't be negative")
+		return
+	}
+
+	duration, err := time.ParseDuration(request.Duration)
+	if err != nil || duration <= 0 {
+		writeError(rw, http.StatusBadRequest, "duration must be a positive duration, e.g. 2h")
+		return
+	}
+
+	now := time.Now
+	if h.Now != nil {
+		now = h.Now
+	}
+
+	until := now().Add(duration)
+	count := h.Registry.LimitResourceClassCapacity(class, *request.Max, until)
+	log.Printf("admin: limited capacity of %v to %v until %v", class, *request.Max, until.Format(time.RFC3339))
+	h.act(rw, class, count)
+}
+
+// act responds with how many workers an action applied to, there's nothing to act on if none did
+func (h *Handler) act(rw http.ResponseWriter, class string, count int) {
+	if count == 0 {
+		writeError(rw, http.StatusNotFound, fmt.Sprintf("no scaling worker supporting this action for resource class %v", class))
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, actionResponse{ResourceClass: class, Workers: count})
+}
+
+func timePointer(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func writeJSON(rw http.ResponseWriter, status int, body any) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	if err := json.NewEncoder(rw).Encode(body); err != nil {
+		log.Printf("admin: error writing response: %v", err)
+	}
+}
+
+func writeError(rw http.ResponseWriter, status int, message string) {
+	writeJSON(rw, status, map[string]string{"error": message})
+}
@@ -0,0 +1,167 @@
+package admin_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vela-games/circleci-runner-autoscaler/admin"
+	"github.com/vela-games/circleci-runner-autoscaler/workers"
+	"gotest.tools/v3/assert"
+)
+
+type registryTest struct {
+	status  []workers.WorkerStatus
+	classes []string
+	calls   []string
+	max     int32
+	until   time.Time
+}
+
+func (r *registryTest) Status() []workers.WorkerStatus {
+	return r.status
+}
+
+func (r *registryTest) count(call string, class string) int {
+	r.calls = append(r.calls, call+" "+class)
+	for _, c := range r.classes {
+		if c == class {
+			return 1
+		}
+	}
+	return 0
+}
+
+func (r *registryTest) WakeResourceClass(class string) int {
+	return r.count("wake", class)
+}
+
+func (r *registryTest) PauseResourceClass(class string) int {
+	return r.count("pause", class)
+}
+
+func (r *registryTest) ResumeResourceClass(class string) int {
+	return r.count("resume", class)
+}
+
+func (r *registryTest) LimitResourceClassCapacity(class string, max int32, until time.Time) int {
+	r.max = max
+	r.until = until
+	return r.count("limit", class)
+}
+
+func (r *registryTest) ClearResourceClassCapacityLimit(class string) int {
+	return r.count("clear", class)
+}
+
+func request(handler http.Handler, method string, path string, token string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestHandler(t *testing.T) {
+	now := time.Date(2023, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	t.Run("it should reject requests without the bearer token", func(t *testing.T) {
+		handler := &admin.Handler{Token: "token", Registry: &registryTest{}}
+
+		assert.Equal(t, http.StatusUnauthorized, request(handler, http.MethodGet, "/workers", "", "").Code)
+		assert.Equal(t, http.StatusUnauthorized, request(handler, http.MethodGet, "/workers", "other", "").Code)
+	})
+
+	t.Run("it should list workers with their reports", func(t *testing.T) {
+		paused := &workers.AWSScalingWorker{
+			ResourceClass: "vela-games/large",
+			Target:        "eu-west-1",
+		}
+		paused.LimitCapacity(3, time.Now().Add(time.Hour))
+
+		handler := &admin.Handler{
+			Token: "token",
+			Registry: &registryTest{
+				status: []workers.WorkerStatus{
+					{Worker: &workers.AWSDiscoveryWorker{}},
+					{Worker: paused, Paused: true, Panics: 1, LastPanic: "runtime error"},
+				},
+			},
+		}
+
+		rec := request(handler, http.MethodGet, "/workers", "token", "")
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var response []map[string]any
+		assert.NilError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+		assert.Equal(t, 2, len(response))
+
+		assert.Equal(t, "discovery", response[0]["kind"])
+		assert.Equal(t, "aws", response[0]["backend"])
+		assert.Equal(t, "default", response[0]["target"])
+
+		assert.Equal(t, "scaling", response[1]["kind"])
+		assert.Equal(t, "vela-games/large", response[1]["resourceClass"])
+		assert.Equal(t, "eu-west-1", response[1]["target"])
+		assert.Equal(t, true, response[1]["paused"])
+		assert.Equal(t, float64(1), response[1]["panics"])
+		assert.Equal(t, float64(3), response[1]["capacityLimit"])
+	})
+
+	t.Run("it should control resource classes", func(t *testing.T) {
+		registry := &registryTest{classes: []string{"vela-games/large"}}
+		handler := &admin.Handler{
+			Token:    "token",
+			Registry: registry,
+			Now: func() time.Time {
+				return now
+			},
+		}
+
+		assert.Equal(t, http.StatusOK, request(handler, http.MethodPost, "/classes/vela-games/large/pause", "token", "").Code)
+		assert.Equal(t, http.StatusOK, request(handler, http.MethodPost, "/classes/vela-games/large/resume", "token", "").Code)
+		assert.Equal(t, http.StatusOK, request(handler, http.MethodPost, "/classes/vela-games/large/reconcile", "token", "").Code)
+		assert.Equal(t, http.StatusOK, request(handler, http.MethodPut, "/classes/vela-games/large/capacity", "token", `{"max":2,"duration":"90m"}`).Code)
+		assert.Equal(t, http.StatusOK, request(handler, http.MethodDelete, "/classes/vela-games/large/capacity", "token", "").Code)
+
+		assert.DeepEqual(t, []string{
+			"pause vela-games/large",
+			"resume vela-games/large",
+			"wake vela-games/large",
+			"limit vela-games/large",
+			"clear vela-games/large",
+		}, registry.calls)
+		assert.Equal(t, int32(2), registry.max)
+		assert.Equal(t, now.Add(90*time.Minute), registry.until)
+	})
+
+	t.Run("it should reject invalid requests", func(t *testing.T) {
+		registry := &registryTest{classes: []string{"vela-games/large"}}
+		handler := &admin.Handler{Token: "token", Registry: registry}
+
+		tests := []struct {
+			method string
+			path   string
+			body   string
+			want   int
+		}{
+			{http.MethodPost, "/classes/vela-games/unknown/pause", "", http.StatusNotFound},
+			{http.MethodGet, "/classes/vela-games/large/pause", "", http.StatusMethodNotAllowed},
+			{http.MethodPost, "/classes/vela-games/large/scale", "", http.StatusNotFound},
+			{http.MethodPost, "/classes/large", "", http.StatusNotFound},
+			{http.MethodPost, "/workers", "", http.StatusMethodNotAllowed},
+			{http.MethodPut, "/classes/vela-games/large/capacity", `{"max":-1,"duration":"1h"}`, http.StatusBadRequest},
+			{http.MethodPut, "/classes/vela-games/large/capacity", `{"max":1}`, http.StatusBadRequest},
+			{http.MethodPut, "/classes/vela-games/large/capacity", `{"max":1,"duration":"1h","min":1}`, http.StatusBadRequest},
+		}
+
+		for _, tt := range tests {
+			assert.Equal(t, tt.want, request(handler, tt.method, tt.path, "token", tt.body).Code, "%v %v %v", tt.method, tt.path, tt.body)
+		}
+	})
+}
@@ -0,0 +1,178 @@
+package budget
+
+import (
+	"log"
+	"math"
+	"sync"
+)
+
+// Budget caps the capacity the scaling workers can ask for, across every resource class and per resource class.
+// Capacity is measured in cost units, every instance or pod of a resource class costs its weight.
+//
+// Workers claim capacity before scaling out and get what fits in the budget. Usage is tracked per group of a class,
+// e.g. its ASG or Deployment, so a class scaling a fallback group keeps paying for the instances of the first one.
+// Budget left over by a class goes to whoever claims it first, except that with Queue set the demand a class
+// couldn't get is kept aside for it, and classes with a lower priority can't use it.
+type Budget struct {
+	// Units available across every resource class, 0 means no global limit
+	Limit float64
+	// Units available to a single resource class
+	ClassLimits map[string]float64
+	// Cost units of a resource class or instance type, 1 if neither is set
+	Weights map[string]float64
+	// Higher priorities are served first when the budget is contested, 0 if not set
+	Priorities map[string]int
+	// Keep the demand that didn't fit queued for the class instead of rejecting it
+	Queue bool
+
+	// Called when a claim doesn't get all the capacity it asked for, defaults to logging a warning
+	OnExhausted func(Exhausted)
+
+	mu       sync.Mutex
+	usage    map[usageKey]float64
+	queued   map[string]float64
+	detached map[string]detachedInstance
+}
+
+// detachedInstance is an instance that isn't in any group anymore but still runs
+type detachedInstance struct {
+	class  string
+	weight float64
+}
+
+// usageKey is a group of instances or pods of a resource class
+type usageKey struct {
+	class string
+	group string
+}
+
+// Exhausted describes a claim the budget couldn't fully grant
+type Exhausted struct {
+	ResourceClass string
+	Current       int32
+	Desired       int32
+	Granted       int32
+}
+
+func (b *Budget) Weight(class string, instanceType string) float64 {
+	if weight, ok := b.Weights[class]; ok {
+		return weight
+	}
+	if weight, ok := b.Weights[instanceType]; ok {
+		return weight
+	}
+	return 1
+}
+
+// Detach records an instance that left a group of the resource class but still runs, e.g. an interrupted spot
+// instance its ASG launched a replacement for. It counts in the usage of the class until it's Released.
+func (b *Budget) Detach(class string, instance string, weight float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.init()
+
+	b.detached[instance] = detachedInstance{class, weight}
+}
+
+// Release forgets a detached instance once it's terminated
+func (b *Budget) Release(instance string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.init()
+
+	delete(b.detached, instance)
+}
+
+// Update records the capacity a group of a resource class is using and drops the queued demand of the class,
+// e.g. when it has no unclaimed tasks. It also gives back what a failed scale-out claimed.
+func (b *Budget) Update(class string, group string, current int32, weight float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.init()
+
+	b.usage[usageKey{class, group}] = float64(current) * weight
+	delete(b.queued, class)
+}
+
+// Claim asks for a group of the resource class to go from its current capacity to the desired one,
+// and returns the capacity it can scale to without going over the budget. The capacity granted counts as used
+// right away, workers that fail to scale out Update the group back to the capacity it really has.
+func (b *Budget) Claim(class string, group string, current int32, desired int32, weight float64) int32 {
+	b.mu.Lock()
+	b.init()
+
+	key := usageKey{class, group}
+	b.usage[key] = float64(current) * weight
+	delete(b.queued, class)
+	if desired <= current || weight <= 0 {
+		b.usage[key] = float64(desired) * math.Max(weight, 0)
+		b.mu.Unlock()
+		return desired
+	}
+
+	available := math.Inf(1)
+	if b.Limit > 0 {
+		available = b.Limit
+		for _, usage := range b.usage {
+			available -= usage
+		}
+		for _, instance := range b.detached {
+			available -= instance.weight
+		}
+
+		priority := b.Priorities[class]
+		for other, queued := range b.queued {
+			if b.Priorities[other] > priority {
+				available -= queued
+			}
+		}
+	}
+
+	if classLimit, ok := b.ClassLimits[class]; ok {
+		classUsage := 0.0
+		for other, usage := range b.usage {
+			if other.class == class {
+				classUsage += usage
+			}
+		}
+		for _, instance := range b.detached {
+			if instance.class == class {
+				classUsage += instance.weight
+			}
+		}
+		available = math.Min(available, classLimit-classUsage)
+	}
+
+	granted := desired
+	if extra := math.Floor(available / weight); extra < float64(desired-current) {
+		granted = current + int32(math.Max(extra, 0))
+	}
+
+	b.usage[key] = float64(granted) * weight
+	if granted < desired && b.Queue {
+		b.queued[class] = float64(desired-granted) * weight
+	}
+	b.mu.Unlock()
+
+	if granted < desired {
+		b.exhausted(Exhausted{ResourceClass: class, Current: current, Desired: desired, Granted: granted})
+	}
+
+	return granted
+}
+
+func (b *Budget) exhausted(e Exhausted) {
+	if b.OnExhausted != nil {
+		b.OnExhausted(e)
+		return
+	}
+	log.Printf("WARNING: budget exhausted for %v, wanted capacity %v but got %v", e.ResourceClass, e.Desired, e.Granted)
+}
+
+func (b *Budget) init() {
+	if b.usage == nil {
+		b.usage = map[usageKey]float64{}
+		b.queued = map[string]float64{}
+		b.detached = map[string]detachedInstance{}
+	}
+}
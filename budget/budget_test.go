@@ -0,0 +1,135 @@
+package budget_test
+
+import (
+	"testing"
+
+	"github.com/vela-games/circleci-runner-autoscaler/budget"
+	"gotest.tools/v3/assert"
+)
+
+func TestBudget(t *testing.T) {
+	t.Run("it should grant claims that fit in the global budget", func(t *testing.T) {
+		b := &budget.Budget{Limit: 10}
+
+		assert.Equal(t, int32(6), b.Claim("vela-games/small", "runners", 2, 6, 1))
+		assert.Equal(t, int32(4), b.Claim("vela-games/large", "runners", 0, 10, 1))
+		assert.Equal(t, int32(0), b.Claim("vela-games/medium", "runners", 0, 1, 1))
+	})
+
+	t.Run("it should free the budget when a class scales in", func(t *testing.T) {
+		b := &budget.Budget{Limit: 10}
+
+		assert.Equal(t, int32(10), b.Claim("vela-games/small", "runners", 0, 10, 1))
+		b.Update("vela-games/small", "runners", 3, 1)
+		assert.Equal(t, int32(7), b.Claim("vela-games/large", "runners", 0, 8, 1))
+	})
+
+	t.Run("it should weigh capacity by class or instance type", func(t *testing.T) {
+		b := &budget.Budget{
+			Limit: 20,
+			Weights: map[string]float64{
+				"vela-games/gpu": 8,
+				"c5.2xlarge":     2,
+			},
+		}
+
+		assert.Equal(t, 8.0, b.Weight("vela-games/gpu", "g4dn.xlarge"))
+		assert.Equal(t, 2.0, b.Weight("vela-games/large", "c5.2xlarge"))
+		assert.Equal(t, 1.0, b.Weight("vela-games/small", "t3.small"))
+
+		assert.Equal(t, int32(2), b.Claim("vela-games/gpu", "runners", 0, 5, 8))
+		assert.Equal(t, int32(2), b.Claim("vela-games/large", "runners", 0, 5, 2))
+	})
+
+	t.Run("it should cap classes at their own limit", func(t *testing.T) {
+		b := &budget.Budget{
+			ClassLimits: map[string]float64{
+				"vela-games/large": 3,
+			},
+		}
+
+		assert.Equal(t, int32(3), b.Claim("vela-games/large", "runners", 1, 10, 1))
+		assert.Equal(t, int32(50), b.Claim("vela-games/small", "runners", 0, 50, 1))
+	})
+
+	t.Run("it should count every group of a class against its limit", func(t *testing.T) {
+		b := &budget.Budget{
+			ClassLimits: map[string]float64{
+				"vela-games/large": 5,
+			},
+		}
+
+		assert.Equal(t, int32(3), b.Claim("vela-games/large", "primary", 1, 3, 1))
+		// The primary group keeps its instances when the class fails over
+		assert.Equal(t, int32(2), b.Claim("vela-games/large", "fallback", 0, 4, 1))
+	})
+
+	t.Run("it should give back the claim of a failed scale out", func(t *testing.T) {
+		b := &budget.Budget{Limit: 10}
+
+		assert.Equal(t, int32(8), b.Claim("vela-games/small", "runners", 2, 8, 1))
+		b.Update("vela-games/small", "runners", 2, 1)
+		assert.Equal(t, int32(8), b.Claim("vela-games/large", "runners", 0, 8, 1))
+	})
+
+	t.Run("it should count detached instances until they're released", func(t *testing.T) {
+		b := &budget.Budget{
+			ClassLimits: map[string]float64{
+				"vela-games/large": 5,
+			},
+			OnExhausted: func(e budget.Exhausted) {},
+		}
+
+		assert.Equal(t, int32(5), b.Claim("vela-games/large", "runners", 3, 5, 1))
+		b.Detach("vela-games/large", "i-1", 1)
+		b.Detach("vela-games/large", "i-2", 1)
+		// The ASG is back to 3 after launching the replacements
+		b.Update("vela-games/large", "runners", 3, 1)
+		assert.Equal(t, int32(3), b.Claim("vela-games/large", "runners", 3, 5, 1))
+
+		b.Release("i-1")
+		assert.Equal(t, int32(4), b.Claim("vela-games/large", "runners", 3, 5, 1))
+	})
+
+	t.Run("it should keep queued demand for classes with a higher priority", func(t *testing.T) {
+		var warnings []budget.Exhausted
+		b := &budget.Budget{
+			Limit: 10,
+			Queue: true,
+			Priorities: map[string]int{
+				"vela-games/release": 10,
+			},
+			OnExhausted: func(e budget.Exhausted) {
+				warnings = append(warnings, e)
+			},
+		}
+
+		assert.Equal(t, int32(10), b.Claim("vela-games/nightly", "runners", 0, 10, 1))
+		assert.Equal(t, int32(0), b.Claim("vela-games/release", "runners", 0, 4, 1))
+
+		// Nightly scales in, but what it frees is queued for release
+		b.Update("vela-games/nightly", "runners", 6, 1)
+		assert.Equal(t, int32(6), b.Claim("vela-games/nightly", "runners", 6, 10, 1))
+		assert.Equal(t, int32(4), b.Claim("vela-games/release", "runners", 0, 4, 1))
+
+		assert.DeepEqual(t, []budget.Exhausted{
+			{ResourceClass: "vela-games/release", Current: 0, Desired: 4, Granted: 0},
+			{ResourceClass: "vela-games/nightly", Current: 6, Desired: 10, Granted: 6},
+		}, warnings)
+	})
+
+	t.Run("it should hand the budget to whoever claims first without queueing", func(t *testing.T) {
+		b := &budget.Budget{
+			Limit: 10,
+			Priorities: map[string]int{
+				"vela-games/release": 10,
+			},
+			OnExhausted: func(e budget.Exhausted) {},
+		}
+
+		assert.Equal(t, int32(10), b.Claim("vela-games/nightly", "runners", 0, 10, 1))
+		assert.Equal(t, int32(0), b.Claim("vela-games/release", "runners", 0, 4, 1))
+		b.Update("vela-games/nightly", "runners", 6, 1)
+		assert.Equal(t, int32(10), b.Claim("vela-games/nightly", "runners", 6, 10, 1))
+	})
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	ci_client "github.com/vela-games/circleci-runner-autoscaler/client"
+	autoscaler_config "github.com/vela-games/circleci-runner-autoscaler/config"
+	"github.com/vela-games/circleci-runner-autoscaler/services"
+	"github.com/vela-games/circleci-runner-autoscaler/workers"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// collectingDispatcher keeps the workers discovery starts instead of running them
+type collectingDispatcher struct {
+	workers []workers.Worker
+}
+
+func (d *collectingDispatcher) Start(ctx context.Context, worker workers.Worker) {
+	d.workers = append(d.workers, worker)
+}
+
+// cli has the clients the subcommands work with
+type cli struct {
+	config         *autoscaler_config.Configuration
+	circleCiClient *ci_client.ClientWithResponses
+	targets        []services.AutoScalingTarget
+	gcpTargets     []services.ManagedInstanceGroupsTarget
+	azureTargets   []services.ScaleSetsTarget
+	dockerEngine   services.ContainersAPI
+	k8sClient      kubernetes.Interface
+	dynamicClient  dynamic.Interface
+	k8sErr         error
+}
+
+func newCli(ctx context.Context, verbose bool) (*cli, error) {
+	// Workers log every step, which drowns the output of the subcommands
+	if !verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	config, err := autoscaler_config.GetConfig()
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	targets, err := initAwsServices(ctx, config.AwsTargets)
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize AWS SDK: %w", err)
+	}
+
+	circleCiClient, err := initCircleCIClient(config.CircleToken)
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize CircleCI Client: %w", err)
+	}
+
+	var gcpTargets []services.ManagedInstanceGroupsTarget
+	if len(config.GcpProjects) > 0 {
+		gcpTargets, err = initGcpServices(ctx, config.GcpProjects)
+		if err != nil {
+			return nil, fmt.Errorf("unable to initialize Compute Engine client: %w", err)
+		}
+	}
+
+	var azureTargets []services.ScaleSetsTarget
+	if len(config.AzureSubscriptions) > 0 {
+		azureTargets, err = initAzureServices(config.AzureSubscriptions)
+		if err != nil {
+			return nil, fmt.Errorf("unable to initialize Azure compute client: %w", err)
+		}
+	}
+
+	var dockerEngine services.ContainersAPI
+	if config.DockerHost != "" {
+		dockerEngine, err = services.NewDockerEngine(config.DockerHost)
+		if err != nil {
+			return nil, fmt.Errorf("unable to initialize Docker client: %w", err)
+		}
+	}
+
+	c := &cli{
+		config:         config,
+		circleCiClient: circleCiClient,
+		targets:        targets,
+		gcpTargets:     gcpTargets,
+		azureTargets:   azureTargets,
+		dockerEngine:   dockerEngine,
+	}
+
+	if config.KubernetesScalerEnabled {
+		c.k8sClient, c.k8sErr = initK8sClient()
+		if c.k8sErr == nil && config.KubernetesRunnerPoolsEnabled {
+			c.dynamicClient, c.k8sErr = initK8sDynamicClient()
+		}
+	}
+
+	return c, nil
+}
+
+// discover runs discovery once and returns the scaling workers it would start
+func (c *cli) discover(ctx context.Context) []workers.Worker {
+	dispatcher := &collectingDispatcher{}
+
+	awsDiscoveryWorker := &workers.AWSDiscoveryWorker{
+		Namespace:      c.config.CircleResourceNamespace,
+		Targets:        c.targets,
+		CircleCiClient: c.circleCiClient,
+		Config:         c.config,
+		Dispatcher:     dispatcher,
+	}
+	awsDiscoveryWorker.Handle(ctx)
+
+	if c.config.Ec2ScalerEnabled {
+		ec2DiscoveryWorker := &workers.EC2DiscoveryWorker{
+			Namespace:      c.config.CircleResourceNamespace,
+			Targets:        c.targets,
+			CircleCiClient: c.circleCiClient,
+			MaxInstances:   c.config.Ec2MaxInstances,
+			IdleTimeout:    c.config.Ec2IdleTimeout,
+			LaunchTimeout:  c.config.AwsLaunchTimeout,
+			Dispatcher:     dispatcher,
+		}
+		ec2DiscoveryWorker.Handle(ctx)
+	}
+
+	if len(c.gcpTargets) > 0 {
+		gcpDiscoveryWorker := &workers.GCPDiscoveryWorker{
+			Namespace:      c.config.CircleResourceNamespace,
+			Targets:        c.gcpTargets,
+			CircleCiClient: c.circleCiClient,
+			MaxInstances:   c.config.GcpMaxInstances,
+			Dispatcher:     dispatcher,
+		}
+		gcpDiscoveryWorker.Handle(ctx)
+	}
+
+	if len(c.azureTargets) > 0 {
+		azureDiscoveryWorker := &workers.AzureDiscoveryWorker{
+			Namespace:      c.config.CircleResourceNamespace,
+			Targets:        c.azureTargets,
+			CircleCiClient: c.circleCiClient,
+			MaxInstances:   c.config.AzureMaxInstances,
+			Dispatcher:     dispatcher,
+		}
+		azureDiscoveryWorker.Handle(ctx)
+	}
+
+	if c.dockerEngine != nil {
+		dockerDiscoveryWorker := &workers.DockerDiscoveryWorker{
+			Namespace:         c.config.CircleResourceNamespace,
+			Target:            c.config.DockerHost,
+			ContainersService: c.dockerEngine,
+			CircleCiClient:    c.circleCiClient,
+			Images:            c.config.DockerImages,
+			RunnerTokens:      c.config.DockerRunnerTokens,
+			MaxContainers:     c.config.DockerMaxContainers,
+			IdleTimeout:       c.config.DockerIdleTimeout,
+			LaunchTimeout:     c.config.DockerLaunchTimeout,
+			Dispatcher:        dispatcher,
+		}
+		dockerDiscoveryWorker.Handle(ctx)
+	}
+
+	if c.k8sClient != nil {
+		k8sDiscoveryWorker := &workers.K8sDiscoveryWorker{
+			Namespace:         c.config.CircleResourceNamespace,
+			K8sNamespace:      c.config.KubernetesNamespace,
+			ClientSet:         c.k8sClient,
+			CircleCiClient:    c.circleCiClient,
+			CheckNodeCapacity: c.config.KubernetesCheckNodeCapacity,
+			PriorityClasses:   c.config.KubernetesPriorityClasses,
+			Dispatcher:        dispatcher,
+		}
+		k8sDiscoveryWorker.Handle(ctx)
+	}
+
+	if c.dynamicClient != nil {
+		runnerPoolDiscoveryWorker := &workers.RunnerPoolDiscoveryWorker{
+			Namespace:         c.config.CircleResourceNamespace,
+			K8sNamespace:      c.config.KubernetesNamespace,
+			DynamicClient:     c.dynamicClient,
+			ClientSet:         c.k8sClient,
+			CircleCiClient:    c.circleCiClient,
+			CheckNodeCapacity: c.config.KubernetesCheckNodeCapacity,
+			PriorityClasses:   c.config.KubernetesPriorityClasses,
+			Dispatcher:        dispatcher,
+		}
+		runnerPoolDiscoveryWorker.Handle(ctx)
+	}
+
+	return dispatcher.workers
+}
+
+func validateCommand(args []string) error {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	verbose := flags.Bool("v", false, "print the worker logs")
+	flags.Parse(args)
+
+	ctx := context.Background()
+	c, err := newCli(ctx, *verbose)
+	if err != nil {
+		return err
+	}
+
+	failed := false
+	check := func(name string, err error) {
+		if err != nil {
+			failed = true
+			fmt.Printf("FAIL  %v: %v\n", name, err)
+			return
+		}
+		fmt.Printf("ok    %v\n", name)
+	}
+
+	check("configuration", nil)
+
+	namespace := c.config.CircleResourceNamespace
+	runners, err := c.circleCiClient.GetRunnersWithResponse(ctx, &ci_client.GetRunnersParams{
+		Namespace: &namespace,
+	})
+	if err == nil && runners.StatusCode() != 200 {
+		err = fmt.Errorf("got %v code instead of 200", runners.StatusCode())
+	}
+	check("CircleCI token", err)
+
+	for _, target := range c.targets {
+		_, err := target.Client.DescribeAutoScalingGroups(ctx, &autoscaling.DescribeAutoScalingGroupsInput{
+			MaxRecords: aws.Int32(1),
+		})
+		check("AWS target "+target.Name, err)
+	}
+
+	if c.config.KubernetesScalerEnabled {
+		err := c.k8sErr
+		if err == nil {
+			_, err = c.k8sClient.BatchV1().CronJobs(c.config.KubernetesNamespace).List(ctx, v1.ListOptions{Limit: 1})
+		}
+		check("Kubernetes namespace "+c.config.KubernetesNamespace, err)
+	}
+
+	fmt.Println()
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, "RESOURCE CLASS\tBACKEND\tTARGET")
+	for _, worker := range c.discover(ctx) {
+		if reporter, ok := worker.(workers.Reporter); ok {
+			report := reporter.Report()
+			fmt.Fprintf(out, "%v\t%v\t%v\n", report.ResourceClass, report.Backend, report.Target)
+		}
+	}
+	out.Flush()
+
+	if failed {
+		return fmt.Errorf("validation failed")
+	}
+	return nil
+}
+
+// classStatus is a line of the status command
+type classStatus struct {
+	workers.ClassState
+	Error string `json:"error,omitempty"`
+}
+
+func statusCommand(args []string) error {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	output := flags.String("o", "table", "output format, table or json")
+	class := flags.String("class", "", "only print this resource class")
+	verbose := flags.Bool("v", false, "print the worker logs")
+	flags.Parse(args)
+
+	if *output != "table" && *output != "json" {
+		return fmt.Errorf("unknown output format %v", *output)
+	}
+
+	ctx := context.Background()
+	c, err := newCli(ctx, *verbose)
+	if err != nil {
+		return err
+	}
+
+	statuses := []classStatus{}
+	for _, worker := range c.discover(ctx) {
+		inspector, ok := worker.(workers.Inspector)
+		if !ok {
+			continue
+		}
+
+		if classWorker, ok := worker.(workers.ResourceClassWorker); ok && *class != "" && classWorker.ResourceClassName() != *class {
+			continue
+		}
+
+		state, err := inspector.Inspect(ctx)
+		status := classStatus{ClassState: state}
+		if err != nil {
+			status.Error = err.Error()
+		}
+		statuses = append(statuses, status)
+	}
+
+	if *output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(statuses)
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, "RESOURCE CLASS\tBACKEND\tTARGET\tGROUP\tUNCLAIMED\tRUNNING\tRUNNERS\tDESIRED\tREADY\tMIN\tMAX\tERROR")
+	for _, s := range statuses {
+		fmt.Fprintf(out, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", s.ResourceClass, s.Backend, s.Target, s.Group,
+			s.UnclaimedTasks, s.RunningTasks, s.Runners, s.DesiredCapacity, s.Ready, s.MinSize, s.MaxSize, s.Error)
+	}
+	return out.Flush()
+}
+
+func simulateCommand(args []string) error {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	class := flags.String("class", "", "resource class to simulate, e.g. vela-games/large")
+	verbose := flags.Bool("v", false, "print the worker logs")
+	flags.Parse(args)
+
+	if *class == "" {
+		return fmt.Errorf("-class is required")
+	}
+
+	ctx := context.Background()
+	c, err := newCli(ctx, *verbose)
+	if err != nil {
+		return err
+	}
+
+	for _, worker := range c.discover(ctx) {
+		classWorker, ok := worker.(workers.ResourceClassWorker)
+		if !ok || classWorker.ResourceClassName() != *class {
+			continue
+		}
+
+		switch scaling := worker.(type) {
+		case *workers.AWSScalingWorker:
+			scaling.DryRun = true
+		case *workers.K8sScalingWorker:
+			scaling.DryRun = true
+		case *workers.K8sDeploymentScalingWorker:
+			scaling.DryRun = true
+		case *workers.RunnerPoolScalingWorker:
+			scaling.DryRun = true
+		case *workers.EC2ScalingWorker:
+			scaling.DryRun = true
+		case *workers.GCPScalingWorker:
+			scaling.DryRun = true
+		case *workers.AzureScalingWorker:
+			scaling.DryRun = true
+		case *workers.DockerScalingWorker:
+			scaling.DryRun = true
+		default:
+			return fmt.Errorf("%T doesn't support dry runs", worker)
+		}
+
+		worker.Handle(ctx)
+
+		report := worker.(workers.Reporter).Report()
+		fmt.Printf("resource class: %v\nbackend:        %v\ntarget:         %v\ndecision:       %v\n", report.ResourceClass, report.Backend, report.Target, report.LastDecision)
+		if report.LastError != "" {
+			fmt.Printf("error:          %v\n", report.LastError)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("discovery didn't find the resource class %v", *class)
+}
@@ -1,12 +1,137 @@
 package config
 
-import "github.com/kelseyhightower/envconfig"
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
 
 type Configuration struct {
+	// Optional YAML or JSON file with settings, environment variables take precedence over it. Only the settings
+	// tagged reload are applied when it changes, changes to the others are logged and need a restart.
+	ConfigFile string `split_words:"true"`
+
 	KubernetesScalerEnabled bool   `split_words:"true" default:"true"`
 	KubernetesNamespace     string `split_words:"true" default:"circleci-runners"`
-	CircleToken             string `split_words:"true" required:"true"`
-	CircleResourceNamespace string `split_words:"true" required:"true"`
+	CircleToken             string `split_words:"true"`
+	CircleResourceNamespace string `split_words:"true"`
+
+	// Scale the RunnerPools of the Kubernetes namespace, needs the RunnerPool CRD of the Helm chart
+	KubernetesRunnerPoolsEnabled bool `split_words:"true" default:"false"`
+	// Pass the scale event, resource class and name prefix to the runner containers as environment variables
+	KubernetesInjectRunnerEnv bool `split_words:"true" default:"false"`
+	// Runner jobs are always limited to the ResourceQuotas of the namespace, this also limits them to the node capacity
+	KubernetesCheckNodeCapacity bool `split_words:"true" default:"false"`
+
+	// PriorityClass of the runner pods by resource class. When the cluster can't fit the runners of every resource
+	// class, it's split by the BudgetPriorities and BudgetWeights of the classes.
+	KubernetesPriorityClasses map[string]string `split_words:"true"`
+
+	// How often each kind of worker runs, plus up to DispatcherJitter of the interval at random
+	DiscoveryInterval time.Duration `split_words:"true" default:"30s"`
+	ScalingInterval   time.Duration `split_words:"true" default:"5s"`
+	JanitorInterval   time.Duration `split_words:"true" default:"1m"`
+	DispatcherJitter  float64       `split_words:"true" default:"0.2"`
+
+	// Panicking workers are restarted with exponential backoff and quarantined after WorkerQuarantineAfter panics in a row
+	WorkerRestartBackoff    time.Duration `split_words:"true" default:"10s"`
+	WorkerMaxRestartBackoff time.Duration `split_words:"true" default:"5m"`
+	WorkerQuarantineAfter   int           `split_words:"true" default:"5"`
+
+	// Listen for CircleCI webhooks to scale right away instead of waiting for the next tick
+	WebhookEnabled       bool   `split_words:"true" default:"false"`
+	WebhookListenAddress string `split_words:"true" default:":8080"`
+	WebhookSecret        string `split_words:"true"`
+
+	// Admin API to inspect and control the workers, authenticated with AdminToken as bearer token
+	AdminEnabled       bool   `split_words:"true" default:"false"`
+	AdminListenAddress string `split_words:"true" default:":8081"`
+	AdminToken         string `split_words:"true"`
+
+	// Cost units every scaling worker draws from before scaling out, 0 disables the global budget. Weights give
+	// the cost of an instance or pod of a resource class or instance type, 1 by default.
+	BudgetLimit           float64            `split_words:"true"`
+	BudgetClassLimits     map[string]float64 `split_words:"true"`
+	BudgetWeights         map[string]float64 `split_words:"true"`
+	BudgetPriorities      map[string]int     `split_words:"true"`
+	BudgetExhaustedAction string             `split_words:"true" default:"queue"`
+
+	// Accounts and regions to manage ASGs in, as "region" or "role-arn@region". Defaults to the account and region of the environment
+	AwsTargets []string `split_words:"true"`
+
+	// How runners are matched to instances: instance-id, private-dns or tag:<key>
+	AwsRunnerMatch        string  `split_words:"true" default:"instance-id" reload:"true"`
+	AwsReadinessThreshold float64 `split_words:"true" default:"1" reload:"true"`
+
+	AwsScaleOutCooldown       time.Duration            `split_words:"true" default:"1m" reload:"true"`
+	AwsScaleOutCooldowns      map[string]time.Duration `split_words:"true" reload:"true"`
+	AwsMaxFailedActivities    int                      `split_words:"true" default:"3" reload:"true"`
+	AwsFailedActivitiesWindow time.Duration            `split_words:"true" default:"15m" reload:"true"`
+
+	// SQS queue EventBridge sends the EC2 spot interruption warnings and rebalance recommendations to
+	AwsInterruptionQueueUrl string `split_words:"true"`
+
+	// Hold terminating instances with a lifecycle hook until their runner is idle, for up to AwsDrainMaxWait
+	AwsDrainEnabled  bool          `split_words:"true" default:"false"`
+	AwsDrainHookName string        `split_words:"true" default:"circleci-runner-drain"`
+	AwsDrainMaxWait  time.Duration `split_words:"true" default:"3h"`
+
+	// Launch the runners of the launch templates tagged with a resource class, without an ASG
+	Ec2ScalerEnabled bool          `split_words:"true" default:"false"`
+	Ec2MaxInstances  int32         `split_words:"true" default:"5"`
+	Ec2IdleTimeout   time.Duration `split_words:"true" default:"10m"`
+
+	// GCP projects to scale managed instance groups in, none means the GCP backend is disabled
+	GcpProjects     []string `split_words:"true"`
+	GcpMaxInstances int32    `split_words:"true" default:"5"`
+
+	// Azure subscriptions to scale VM scale sets in, none means the Azure backend is disabled
+	AzureSubscriptions []string `split_words:"true"`
+	AzureMaxInstances  int32    `split_words:"true" default:"5"`
+
+	// Docker-compatible engine to start runner containers on, e.g. unix:///var/run/docker.sock, none means the
+	// Docker backend is disabled. The image and runner token of every resource class are set by class name.
+	DockerHost          string            `split_words:"true"`
+	DockerImages        map[string]string `split_words:"true"`
+	DockerRunnerTokens  map[string]string `split_words:"true"`
+	DockerMaxContainers int32             `split_words:"true" default:"5"`
+	DockerIdleTimeout   time.Duration     `split_words:"true" default:"10m"`
+	DockerLaunchTimeout time.Duration     `split_words:"true" default:"5m"`
+
+	AwsFallbackGroups           map[string]string `split_words:"true" reload:"true"`
+	AwsFallbackRecoveryInterval time.Duration     `split_words:"true" default:"30m" reload:"true"`
+	AwsLaunchTimeout            time.Duration     `split_words:"true" default:"10m" reload:"true"`
+
+	PredictiveScalingEnabled   bool          `split_words:"true" default:"false"`
+	PredictiveHistoryPath      string        `split_words:"true" default:"/var/lib/circleci-runner-autoscaler/history.json"`
+	PredictiveHistoryRetention time.Duration `split_words:"true" default:"672h"`
+	PredictiveLookahead        time.Duration `split_words:"true" default:"15m"`
+	PredictiveMinSeasons       int           `split_words:"true" default:"2"`
+
+	// Per resource class overrides, only available in the configuration file
+	ResourceClasses map[string]ResourceClassConfiguration `ignored:"true" reload:"true"`
+}
+
+// ResourceClassConfiguration overrides the global AWS scaling settings for a single resource class
+type ResourceClassConfiguration struct {
+	Cooldown            *Duration `json:"cooldown,omitempty"`
+	MaxFailedActivities *int      `json:"maxFailedActivities,omitempty"`
+	FallbackGroup       *string   `json:"fallbackGroup,omitempty"`
+	ReadinessThreshold  *float64  `json:"readinessThreshold,omitempty"`
+}
+
+// AwsScalingSettings are the settings the AWS scaling worker of a resource class runs with
+type AwsScalingSettings struct {
+	Cooldown                 time.Duration
+	MaxFailedActivities      int
+	FailedActivitiesWindow   time.Duration
+	FallbackGroup            string
+	FallbackRecoveryInterval time.Duration
+	LaunchTimeout            time.Duration
+	ReadinessThreshold       float64
 }
 
 func GetConfig() (*Configuration, error) {
@@ -17,5 +142,168 @@ func GetConfig() (*Configuration, error) {
 		return nil, err
 	}
 
+	if autoScalerConfig.ConfigFile != "" {
+		return LoadFile(autoScalerConfig.ConfigFile)
+	}
+
+	if err := autoScalerConfig.Validate(); err != nil {
+		return nil, err
+	}
+
 	return &autoScalerConfig, nil
 }
+
+// Validate checks the settings are usable, wherever they came from
+func (c *Configuration) Validate() error {
+	if c.CircleToken == "" {
+		return fmt.Errorf("required key APP_CIRCLE_TOKEN missing value")
+	}
+
+	if c.CircleResourceNamespace == "" {
+		return fmt.Errorf("required key APP_CIRCLE_RESOURCE_NAMESPACE missing value")
+	}
+
+	for name, interval := range map[string]time.Duration{
+		"discoveryInterval": c.DiscoveryInterval,
+		"scalingInterval":   c.ScalingInterval,
+		"janitorInterval":   c.JanitorInterval,
+	} {
+		if interval <= 0 {
+			return fmt.Errorf("%v must be positive, got %v", name, interval)
+		}
+	}
+
+	if c.WebhookEnabled && c.WebhookSecret == "" {
+		return fmt.Errorf("required key APP_WEBHOOK_SECRET missing value, it's needed to verify webhook deliveries")
+	}
+
+	if c.AdminEnabled && c.AdminToken == "" {
+		return fmt.Errorf("required key APP_ADMIN_TOKEN missing value, it's needed to authenticate admin requests")
+	}
+
+	if c.BudgetLimit < 0 {
+		return fmt.Errorf("budgetLimit can't be negative, got %v", c.BudgetLimit)
+	}
+
+	if c.BudgetExhaustedAction != "queue" && c.BudgetExhaustedAction != "reject" {
+		return fmt.Errorf("budgetExhaustedAction must be queue or reject, got %v", c.BudgetExhaustedAction)
+	}
+
+	if c.DispatcherJitter < 0 {
+		return fmt.Errorf("dispatcherJitter can't be negative, got %v", c.DispatcherJitter)
+	}
+
+	if c.AwsDrainEnabled && (c.AwsDrainMaxWait <= 0 || c.AwsDrainMaxWait > 48*time.Hour) {
+		return fmt.Errorf("awsDrainMaxWait must be positive and at most 48h, the longest an ASG holds an instance, got %v", c.AwsDrainMaxWait)
+	}
+
+	if c.Ec2ScalerEnabled && (c.Ec2MaxInstances < 0 || c.Ec2IdleTimeout <= 0) {
+		return fmt.Errorf("ec2MaxInstances can't be negative and ec2IdleTimeout must be positive, got %v and %v", c.Ec2MaxInstances, c.Ec2IdleTimeout)
+	}
+
+	if len(c.GcpProjects) > 0 && c.GcpMaxInstances < 0 {
+		return fmt.Errorf("gcpMaxInstances can't be negative, got %v", c.GcpMaxInstances)
+	}
+
+	if len(c.AzureSubscriptions) > 0 && c.AzureMaxInstances < 0 {
+		return fmt.Errorf("azureMaxInstances can't be negative, got %v", c.AzureMaxInstances)
+	}
+
+	if c.DockerHost != "" {
+		if !strings.HasPrefix(c.DockerHost, "unix://") && !strings.HasPrefix(c.DockerHost, "tcp://") {
+			return fmt.Errorf("dockerHost must start with unix:// or tcp://, got %v", c.DockerHost)
+		}
+		if len(c.DockerImages) == 0 {
+			return fmt.Errorf("dockerImages must have the image of at least one resource class when dockerHost is set")
+		}
+		if c.DockerMaxContainers < 0 || c.DockerIdleTimeout <= 0 {
+			return fmt.Errorf("dockerMaxContainers can't be negative and dockerIdleTimeout must be positive, got %v and %v", c.DockerMaxContainers, c.DockerIdleTimeout)
+		}
+	}
+
+	if _, _, err := c.RunnerMatch(); err != nil {
+		return err
+	}
+
+	if c.AwsReadinessThreshold <= 0 || c.AwsReadinessThreshold > 1 {
+		return fmt.Errorf("awsReadinessThreshold must be greater than 0 and at most 1, got %v", c.AwsReadinessThreshold)
+	}
+
+	for class, classConfig := range c.ResourceClasses {
+		if classConfig.ReadinessThreshold != nil && (*classConfig.ReadinessThreshold <= 0 || *classConfig.ReadinessThreshold > 1) {
+			return fmt.Errorf("resourceClasses.%v.readinessThreshold must be greater than 0 and at most 1, got %v", class, *classConfig.ReadinessThreshold)
+		}
+
+		if classConfig.Cooldown != nil && classConfig.Cooldown.Duration < 0 {
+			return fmt.Errorf("resourceClasses.%v.cooldown can't be negative", class)
+		}
+	}
+
+	return nil
+}
+
+// AwsScalingSettings returns the settings for the resource class. Per resource class settings from the
+// environment win over the ones in the configuration file, which win over the global ones.
+func (c *Configuration) AwsScalingSettings(resourceClass string) AwsScalingSettings {
+	settings := AwsScalingSettings{
+		Cooldown:                 c.AwsScaleOutCooldown,
+		MaxFailedActivities:      c.AwsMaxFailedActivities,
+		FailedActivitiesWindow:   c.AwsFailedActivitiesWindow,
+		FallbackRecoveryInterval: c.AwsFallbackRecoveryInterval,
+		LaunchTimeout:            c.AwsLaunchTimeout,
+		ReadinessThreshold:       c.AwsReadinessThreshold,
+	}
+
+	if classConfig, ok := c.ResourceClasses[resourceClass]; ok {
+		if classConfig.Cooldown != nil {
+			settings.Cooldown = classConfig.Cooldown.Duration
+		}
+		if classConfig.MaxFailedActivities != nil {
+			settings.MaxFailedActivities = *classConfig.MaxFailedActivities
+		}
+		if classConfig.FallbackGroup != nil {
+			settings.FallbackGroup = *classConfig.FallbackGroup
+		}
+		if classConfig.ReadinessThreshold != nil {
+			settings.ReadinessThreshold = *classConfig.ReadinessThreshold
+		}
+	}
+
+	if cooldown, ok := c.AwsScaleOutCooldowns[resourceClass]; ok {
+		settings.Cooldown = cooldown
+	}
+
+	if fallbackGroup, ok := c.AwsFallbackGroups[resourceClass]; ok {
+		settings.FallbackGroup = fallbackGroup
+	}
+
+	return settings
+}
+
+// RestartSettings returns the settings that differ from the running configuration but are only read at startup
+func (c *Configuration) RestartSettings(running *Configuration) []string {
+	var settings []string
+	value, runningValue := reflect.ValueOf(c).Elem(), reflect.ValueOf(running).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if field.Name == "ConfigFile" || field.Tag.Get("reload") == "true" {
+			continue
+		}
+		if !reflect.DeepEqual(value.Field(i).Interface(), runningValue.Field(i).Interface()) {
+			settings = append(settings, strings.ToLower(field.Name[:1])+field.Name[1:])
+		}
+	}
+	return settings
+}
+
+// RunnerMatch parses AwsRunnerMatch, either instance-id, private-dns or tag:<key>
+func (c *Configuration) RunnerMatch() (string, string, error) {
+	switch {
+	case c.AwsRunnerMatch == "instance-id", c.AwsRunnerMatch == "private-dns":
+		return c.AwsRunnerMatch, "", nil
+	case strings.HasPrefix(c.AwsRunnerMatch, "tag:"):
+		return "tag", strings.TrimPrefix(c.AwsRunnerMatch, "tag:"), nil
+	}
+
+	return "", "", fmt.Errorf("unknown runner match %q", c.AwsRunnerMatch)
+}
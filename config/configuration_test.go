@@ -0,0 +1,202 @@
+package config_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vela-games/circleci-runner-autoscaler/config"
+	"gotest.tools/v3/assert"
+)
+
+func writeConfigFile(t *testing.T, path string, content string) {
+	assert.NilError(t, os.WriteFile(path, []byte(content), 0644))
+}
+
+func TestLoadFile(t *testing.T) {
+	t.Run("it should load settings from a YAML file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		writeConfigFile(t, path, `
+circleToken: token
+circleResourceNamespace: vela-games
+kubernetesScalerEnabled: false
+awsTargets:
+- eu-west-1
+- arn:aws:iam::123456789012:role/runners@us-east-1
+awsScaleOutCooldown: 2m
+awsFallbackGroups:
+  vela-games/large: large-on-demand
+resourceClasses:
+  vela-games/large:
+    cooldown: 5m
+    readinessThreshold: 0.5
+`)
+
+		c, err := config.LoadFile(path)
+		assert.NilError(t, err)
+
+		assert.Equal(t, "token", c.CircleToken)
+		assert.Equal(t, false, c.KubernetesScalerEnabled)
+		assert.Equal(t, "circleci-runners", c.KubernetesNamespace)
+		assert.DeepEqual(t, []string{"eu-west-1", "arn:aws:iam::123456789012:role/runners@us-east-1"}, c.AwsTargets)
+
+		assert.DeepEqual(t, config.AwsScalingSettings{
+			Cooldown:                 5 * time.Minute,
+			MaxFailedActivities:      3,
+			FailedActivitiesWindow:   15 * time.Minute,
+			FallbackGroup:            "large-on-demand",
+			FallbackRecoveryInterval: 30 * time.Minute,
+			LaunchTimeout:            10 * time.Minute,
+			ReadinessThreshold:       0.5,
+		}, c.AwsScalingSettings("vela-games/large"))
+		assert.Equal(t, 2*time.Minute, c.AwsScalingSettings("vela-games/small").Cooldown)
+	})
+
+	t.Run("it should let environment variables override the file", func(t *testing.T) {
+		t.Setenv("APP_CIRCLE_TOKEN", "env-token")
+		t.Setenv("APP_AWS_SCALE_OUT_COOLDOWN", "30s")
+
+		path := filepath.Join(t.TempDir(), "config.json")
+		writeConfigFile(t, path, `{"circleToken": "file-token", "circleResourceNamespace": "vela-games", "awsScaleOutCooldown": "2m"}`)
+
+		c, err := config.LoadFile(path)
+		assert.NilError(t, err)
+
+		assert.Equal(t, "env-token", c.CircleToken)
+		assert.Equal(t, 30*time.Second, c.AwsScaleOutCooldown)
+	})
+
+	t.Run("it should load large numbers", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		writeConfigFile(t, path, "circleToken: token\ncircleResourceNamespace: vela-games\nawsMaxFailedActivities: 1000000\nbudgetLimit: 2500000\n")
+
+		c, err := config.LoadFile(path)
+		assert.NilError(t, err)
+
+		assert.Equal(t, 1000000, c.AwsMaxFailedActivities)
+		assert.Equal(t, 2500000.0, c.BudgetLimit)
+	})
+
+	t.Run("it should reject invalid files", func(t *testing.T) {
+		tests := map[string]string{
+			"unknown setting":            "circleToken: token\ncircleResourceNamespace: vela-games\nunknownSetting: true\n",
+			"wrong type":                 "circleToken: token\ncircleResourceNamespace: vela-games\nawsMaxFailedActivities: many\n",
+			"duration as a number":       "circleToken: token\ncircleResourceNamespace: vela-games\nawsLaunchTimeout: 10\n",
+			"unknown class setting":      "circleToken: token\ncircleResourceNamespace: vela-games\nresourceClasses:\n  vela-games/large:\n    coldown: 5m\n",
+			"invalid readiness":          "circleToken: token\ncircleResourceNamespace: vela-games\nawsReadinessThreshold: 2\n",
+			"invalid runner match":       "circleToken: token\ncircleResourceNamespace: vela-games\nawsRunnerMatch: hostname\n",
+			"docker host without scheme": "circleToken: token\ncircleResourceNamespace: vela-games\ndockerHost: /var/run/docker.sock\ndockerImages:\n  vela-games/linux-large: circleci/runner-agent:machine-3\n",
+			"docker host without images": "circleToken: token\ncircleResourceNamespace: vela-games\ndockerHost: unix:///var/run/docker.sock\n",
+			"missing required settings":  "kubernetesScalerEnabled: false\n",
+		}
+
+		for name, content := range tests {
+			t.Run(name, func(t *testing.T) {
+				path := filepath.Join(t.TempDir(), "config.yaml")
+				writeConfigFile(t, path, content)
+
+				_, err := config.LoadFile(path)
+				assert.Assert(t, err != nil)
+			})
+		}
+	})
+
+	t.Run("it should load the limits of the backends", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		writeConfigFile(t, path, "circleToken: token\ncircleResourceNamespace: vela-games\nec2ScalerEnabled: true\nec2MaxInstances: 20\ngcpMaxInstances: 30\nazureMaxInstances: 40\ndockerMaxContainers: 50\n")
+
+		c, err := config.LoadFile(path)
+		assert.NilError(t, err)
+
+		assert.Equal(t, int32(20), c.Ec2MaxInstances)
+		assert.Equal(t, int32(30), c.GcpMaxInstances)
+		assert.Equal(t, int32(40), c.AzureMaxInstances)
+		assert.Equal(t, int32(50), c.DockerMaxContainers)
+	})
+
+	t.Run("it should reject negative limits of the backends", func(t *testing.T) {
+		tests := map[string]struct {
+			content string
+			err     string
+		}{
+			"ec2": {
+				content: "circleToken: token\ncircleResourceNamespace: vela-games\nec2ScalerEnabled: true\nec2MaxInstances: -1\n",
+				err:     "ec2MaxInstances can't be negative and ec2IdleTimeout must be positive, got -1 and 10m0s",
+			},
+			"gcp": {
+				content: "circleToken: token\ncircleResourceNamespace: vela-games\ngcpProjects: [vela-runners]\ngcpMaxInstances: -1\n",
+				err:     "gcpMaxInstances can't be negative, got -1",
+			},
+			"azure": {
+				content: "circleToken: token\ncircleResourceNamespace: vela-games\nazureSubscriptions: [00000000-0000-0000-0000-000000000000]\nazureMaxInstances: -1\n",
+				err:     "azureMaxInstances can't be negative, got -1",
+			},
+			"docker": {
+				content: "circleToken: token\ncircleResourceNamespace: vela-games\ndockerHost: unix:///var/run/docker.sock\ndockerImages:\n  vela-games/linux-large: circleci/runner-agent:machine-3\ndockerMaxContainers: -1\n",
+				err:     "dockerMaxContainers can't be negative and dockerIdleTimeout must be positive, got -1 and 10m0s",
+			},
+		}
+
+		for name, test := range tests {
+			t.Run(name, func(t *testing.T) {
+				path := filepath.Join(t.TempDir(), "config.yaml")
+				writeConfigFile(t, path, test.content)
+
+				_, err := config.LoadFile(path)
+				assert.ErrorContains(t, err, test.err)
+			})
+		}
+	})
+
+	t.Run("it should reject numbers that don't fit in the setting", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		writeConfigFile(t, path, "circleToken: token\ncircleResourceNamespace: vela-games\nec2MaxInstances: 3000000000\n")
+
+		_, err := config.LoadFile(path)
+		assert.ErrorContains(t, err, "ec2MaxInstances: 3000000000 doesn't fit in int32")
+	})
+}
+
+func TestWatcher(t *testing.T) {
+	t.Run("it should only apply valid changes", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		writeConfigFile(t, path, "circleToken: token\ncircleResourceNamespace: vela-games\n")
+
+		changes := make(chan *config.Configuration, 10)
+		watcher := &config.Watcher{
+			Path:     path,
+			Interval: 10 * time.Millisecond,
+			OnChange: func(c *config.Configuration) {
+				changes <- c
+			},
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go watcher.Watch(ctx)
+
+		time.Sleep(50 * time.Millisecond)
+		writeConfigFile(t, path, "circleToken: token\ncircleResourceNamespace: vela-games\nawsReadinessThreshold: 2\n")
+		time.Sleep(50 * time.Millisecond)
+		writeConfigFile(t, path, "circleToken: token\ncircleResourceNamespace: vela-games\nawsReadinessThreshold: 0.5\n")
+
+		select {
+		case c := <-changes:
+			assert.Equal(t, 0.5, c.AwsReadinessThreshold)
+		case <-time.After(5 * time.Second):
+			t.Fatal("configuration change wasn't applied")
+		}
+
+		assert.Equal(t, 0, len(changes))
+	})
+}
+
+func TestRestartSettings(t *testing.T) {
+	running := &config.Configuration{AwsScaleOutCooldown: time.Minute, ScalingInterval: 5 * time.Second, GcpProjects: []string{"vela-runners"}}
+	changed := &config.Configuration{AwsScaleOutCooldown: 2 * time.Minute, ScalingInterval: 10 * time.Second, GcpProjects: []string{"vela-runners"}}
+
+	// The AWS scaling settings are reloaded, the others aren't
+	assert.DeepEqual(t, []string{"scalingInterval"}, changed.RestartSettings(running))
+}
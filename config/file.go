@@ -0,0 +1,211 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"sigs.k8s.io/yaml"
+)
+
+// Same word splitting envconfig uses for split_words, so we know which environment variable overrides a setting
+var gatherRegexp = regexp.MustCompile("([^A-Z]+|[A-Z]+[^A-Z]+|[A-Z]+)")
+var acronymRegexp = regexp.MustCompile("([A-Z]+)([A-Z][^A-Z]+)")
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Duration is a time.Duration written as a string like "5m" in the configuration file
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("durations must be strings like \"5m\": %w", err)
+	}
+
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	d.Duration = duration
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// LoadFile loads the configuration from a YAML or JSON file. Settings use the configuration field names in camelCase,
+// e.g. awsScaleOutCooldown, and environment variables still take precedence over them.
+func LoadFile(path string) (*Configuration, error) {
+	var autoScalerConfig Configuration
+
+	err := envconfig.Process("app", &autoScalerConfig)
+	if err != nil {
+		return nil, err
+	}
+	autoScalerConfig.ConfigFile = path
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+
+	var settings map[string]json.RawMessage
+	if err := json.Unmarshal(jsonData, &settings); err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+
+	for key, raw := range settings {
+		if err := autoScalerConfig.set(key, raw); err != nil {
+			return nil, fmt.Errorf("%v: %v: %w", path, key, err)
+		}
+	}
+
+	if err := autoScalerConfig.Validate(); err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+
+	return &autoScalerConfig, nil
+}
+
+// set applies a setting from the configuration file unless its environment variable is set
+func (c *Configuration) set(key string, raw json.RawMessage) error {
+	if key == "resourceClasses" {
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.DisallowUnknownFields()
+		return decoder.Decode(&c.ResourceClasses)
+	}
+
+	value := reflect.ValueOf(c).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if field.Name == "ConfigFile" || field.Tag.Get("ignored") == "true" || !strings.EqualFold(field.Name, key) {
+			continue
+		}
+
+		if _, ok := os.LookupEnv(envKey(field.Name)); ok {
+			return nil
+		}
+
+		var fileValue interface{}
+		if err := json.Unmarshal(raw, &fileValue); err != nil {
+			return err
+		}
+
+		parsed, err := parseValue(field.Type, fileValue)
+		if err != nil {
+			return err
+		}
+
+		value.Field(i).Set(parsed)
+		return nil
+	}
+
+	return fmt.Errorf("unknown setting")
+}
+
+func envKey(fieldName string) string {
+	var name []string
+	for _, words := range gatherRegexp.FindAllStringSubmatch(fieldName, -1) {
+		if m := acronymRegexp.FindStringSubmatch(words[0]); len(m) == 3 {
+			name = append(name, m[1], m[2])
+		} else {
+			name = append(name, words[0])
+		}
+	}
+
+	return "APP_" + strings.ToUpper(strings.Join(name, "_"))
+}
+
+// parseValue converts a value decoded from the file to the type of the configuration field
+func parseValue(t reflect.Type, fileValue interface{}) (reflect.Value, error) {
+	switch t.Kind() {
+	case reflect.Slice:
+		items, ok := fileValue.([]interface{})
+		if !ok {
+			return reflect.Value{}, fmt.Errorf("expected a list")
+		}
+
+		slice := reflect.MakeSlice(t, 0, len(items))
+		for _, item := range items {
+			parsed, err := parseValue(t.Elem(), item)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			slice = reflect.Append(slice, parsed)
+		}
+		return slice, nil
+	case reflect.Map:
+		items, ok := fileValue.(map[string]interface{})
+		if !ok {
+			return reflect.Value{}, fmt.Errorf("expected a map")
+		}
+
+		m := reflect.MakeMapWithSize(t, len(items))
+		for k, item := range items {
+			parsed, err := parseValue(t.Elem(), item)
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("%v: %w", k, err)
+			}
+			m.SetMapIndex(reflect.ValueOf(k), parsed)
+		}
+		return m, nil
+	}
+
+	s := fmt.Sprint(fileValue)
+	if f, ok := fileValue.(float64); ok {
+		// JSON numbers are decoded as floats, which fmt prints as 1e+06 once they're large
+		s = strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	switch {
+	case t == durationType:
+		if _, ok := fileValue.(string); !ok {
+			return reflect.Value{}, fmt.Errorf("durations must be strings like \"5m\"")
+		}
+		d, err := time.ParseDuration(s)
+		return reflect.ValueOf(d), err
+	case t.Kind() == reflect.String:
+		if _, ok := fileValue.(string); !ok {
+			return reflect.Value{}, fmt.Errorf("expected a string")
+		}
+		return reflect.ValueOf(s).Convert(t), nil
+	case t.Kind() == reflect.Bool:
+		b, ok := fileValue.(bool)
+		if !ok {
+			return reflect.Value{}, fmt.Errorf("expected a boolean")
+		}
+		return reflect.ValueOf(b), nil
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		v := reflect.New(t).Elem()
+		if v.OverflowInt(i) {
+			return reflect.Value{}, fmt.Errorf("%v doesn't fit in %v", i, t)
+		}
+		v.SetInt(i)
+		return v, nil
+	case t.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		return reflect.ValueOf(f), err
+	}
+
+	return reflect.Value{}, fmt.Errorf("unsupported setting type %v", t)
+}
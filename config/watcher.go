@@ -0,0 +1,67 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Watcher polls the configuration file and calls OnChange with the new configuration every time it changes.
+// Polling instead of inotify keeps it working with ConfigMap volumes, where kubelet swaps a symlink.
+type Watcher struct {
+	Path     string
+	Interval time.Duration
+	OnChange func(*Configuration)
+	// Optional, the configuration the autoscaler started with. Changes to the settings it doesn't reload are logged.
+	Running *Configuration
+
+	lastContent []byte
+}
+
+// Watch blocks until ctx is done. Configurations that don't load or don't validate are logged and ignored,
+// workers keep running with the last good one.
+func (w *Watcher) Watch(ctx context.Context) {
+	if w.lastContent == nil {
+		w.lastContent, _ = os.ReadFile(w.Path)
+	}
+
+	for {
+		select {
+		case <-time.After(w.Interval):
+			w.check()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (w *Watcher) check() {
+	content, err := os.ReadFile(w.Path)
+	if err != nil {
+		log.Printf("error reading configuration file %v: %v", w.Path, err)
+		return
+	}
+
+	if bytes.Equal(content, w.lastContent) {
+		return
+	}
+	w.lastContent = content
+
+	autoScalerConfig, err := LoadFile(w.Path)
+	if err != nil {
+		log.Printf("ignoring invalid configuration file: %v", err)
+		return
+	}
+
+	if w.Running != nil {
+		if settings := autoScalerConfig.RestartSettings(w.Running); len(settings) > 0 {
+			log.Printf("warning: configuration file %v changed %v, which only apply after a restart", w.Path, strings.Join(settings, ", "))
+		}
+	}
+
+	log.Printf("configuration file %v changed, applying it", w.Path)
+	w.OnChange(autoScalerConfig)
+}
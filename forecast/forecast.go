@@ -0,0 +1,57 @@
+package forecast
+
+import (
+	"math"
+	"time"
+)
+
+// Forecaster predicts the demand of a resource class using seasonal averages of the hourly
+// demand peaks recorded for the same weekday and hour on previous weeks
+type Forecaster struct {
+	Store Store
+
+	// How far ahead of now we look when predicting demand
+	Lookahead time.Duration
+	// Minimum amount of previous weeks with history for a weekday and hour before we trust its average
+	MinSeasons int
+}
+
+// Observe records the demand of the resource class at time t
+func (f *Forecaster) Observe(resourceClass string, t time.Time, demand int) error {
+	return f.Store.Observe(resourceClass, t, demand)
+}
+
+// Predict returns the highest expected demand for the resource class between now and now+Lookahead.
+// Only hours before the current one are used, so demand observed right now never feeds its own prediction.
+func (f *Forecaster) Predict(resourceClass string, now time.Time) int {
+	peaks := f.Store.Peaks(resourceClass)
+	currentHour := now.Truncate(time.Hour)
+
+	prediction := 0
+	for hour := currentHour; !hour.After(now.Add(f.Lookahead)); hour = hour.Add(time.Hour) {
+		total := 0
+		seasons := 0
+		for h, demand := range peaks {
+			if !h.Before(currentHour) {
+				continue
+			}
+
+			h = h.In(now.Location())
+			if h.Weekday() == hour.Weekday() && h.Hour() == hour.Hour() {
+				total += demand
+				seasons++
+			}
+		}
+
+		if seasons == 0 || seasons < f.MinSeasons {
+			continue
+		}
+
+		average := int(math.Ceil(float64(total) / float64(seasons)))
+		if average > prediction {
+			prediction = average
+		}
+	}
+
+	return prediction
+}
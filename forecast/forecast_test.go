@@ -0,0 +1,147 @@
+package forecast_test
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/vela-games/circleci-runner-autoscaler/forecast"
+	"gotest.tools/v3/assert"
+)
+
+const resourceClass = "vela-games/my-resource-class"
+
+type sample struct {
+	At     time.Time
+	Demand int
+}
+
+type simulationStep struct {
+	At        time.Time
+	Demand    int
+	Predicted int
+}
+
+// loadSeries reads a recorded series of queue depths from testdata
+func loadSeries(t *testing.T, name string) []sample {
+	f, err := os.Open(filepath.Join("testdata", name))
+	assert.NilError(t, err)
+	defer f.Close()
+
+	records, err := csv.NewReader(f).ReadAll()
+	assert.NilError(t, err)
+
+	var series []sample
+	for _, record := range records[1:] {
+		at, err := time.Parse(time.RFC3339, record[0])
+		assert.NilError(t, err)
+
+		demand, err := strconv.Atoi(record[1])
+		assert.NilError(t, err)
+
+		series = append(series, sample{At: at, Demand: demand})
+	}
+
+	return series
+}
+
+// simulate replays the series through the forecaster the same way the scaling worker does,
+// asking for a prediction before recording what was observed at each point in time
+func simulate(series []sample, forecaster *forecast.Forecaster) []simulationStep {
+	var steps []simulationStep
+	for _, s := range series {
+		predicted := forecaster.Predict(resourceClass, s.At)
+		forecaster.Observe(resourceClass, s.At, s.Demand)
+
+		steps = append(steps, simulationStep{At: s.At, Demand: s.Demand, Predicted: predicted})
+	}
+
+	return steps
+}
+
+func newForecaster(t *testing.T) *forecast.Forecaster {
+	store, err := forecast.NewFileStore("", 4*7*24*time.Hour)
+	assert.NilError(t, err)
+
+	return &forecast.Forecaster{
+		Store:      store,
+		Lookahead:  30 * time.Minute,
+		MinSeasons: 2,
+	}
+}
+
+func TestForecaster(t *testing.T) {
+	series := loadSeries(t, "queue_depth.csv")
+	lastWeek := series[0].At.Add(3 * 7 * 24 * time.Hour)
+
+	t.Run("it should not predict anything without enough history", func(t *testing.T) {
+		steps := simulate(series, newForecaster(t))
+
+		for _, step := range steps {
+			if step.At.Before(series[0].At.Add(13 * 24 * time.Hour)) {
+				assert.Equal(t, 0, step.Predicted, "unexpected prediction at %v", step.At)
+			}
+		}
+	})
+
+	t.Run("it should predict the weekday spikes ahead of time", func(t *testing.T) {
+		steps := simulate(series, newForecaster(t))
+
+		for i, step := range steps {
+			if step.At.Before(lastWeek) || step.Demand <= 1 {
+				continue
+			}
+
+			// The step before the spike starts should already expect it
+			assert.Assert(t, steps[i-1].Predicted >= step.Demand, "at %v predicted %v but demand was %v", steps[i-1].At, steps[i-1].Predicted, step.Demand)
+		}
+	})
+
+	t.Run("it should not predict demand at quiet times", func(t *testing.T) {
+		steps := simulate(series, newForecaster(t))
+
+		for _, step := range steps {
+			if step.At.Before(lastWeek) || step.At.Weekday() != time.Saturday {
+				continue
+			}
+
+			assert.Assert(t, step.Predicted <= 1, "at %v predicted %v", step.At, step.Predicted)
+		}
+	})
+}
+
+func TestFileStore(t *testing.T) {
+	t.Run("it should persist the hourly peaks", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "history.json")
+		now := time.Date(2022, 5, 2, 9, 10, 0, 0, time.UTC)
+
+		store, err := forecast.NewFileStore(path, 24*time.Hour)
+		assert.NilError(t, err)
+
+		assert.NilError(t, store.Observe(resourceClass, now, 3))
+		assert.NilError(t, store.Observe(resourceClass, now.Add(10*time.Minute), 5))
+		assert.NilError(t, store.Observe(resourceClass, now.Add(20*time.Minute), 2))
+
+		reopened, err := forecast.NewFileStore(path, 24*time.Hour)
+		assert.NilError(t, err)
+
+		assert.DeepEqual(t, map[time.Time]int{
+			time.Unix(now.Truncate(time.Hour).Unix(), 0): 5,
+		}, reopened.Peaks(resourceClass))
+	})
+
+	t.Run("it should drop peaks older than the retention", func(t *testing.T) {
+		now := time.Date(2022, 5, 2, 9, 10, 0, 0, time.UTC)
+
+		store, err := forecast.NewFileStore("", 24*time.Hour)
+		assert.NilError(t, err)
+
+		assert.NilError(t, store.Observe(resourceClass, now, 3))
+		assert.NilError(t, store.Observe(resourceClass, now.Add(48*time.Hour), 1))
+
+		assert.Equal(t, 1, len(store.Peaks(resourceClass)))
+	})
+}
@@ -0,0 +1,149 @@
+package forecast
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Store keeps the observed demand of every resource class, aggregated by hour
+type Store interface {
+	// Observe records demand for the resource class at time t, keeping the peak for the hour
+	Observe(resourceClass string, t time.Time, demand int) error
+	// Peaks returns the hourly demand peaks recorded for the resource class, keyed by the start of the hour
+	Peaks(resourceClass string) map[time.Time]int
+}
+
+// FileStore is an embedded Store that keeps the history in memory and persists it as a JSON file.
+// If Path is empty nothing is written to disk.
+type FileStore struct {
+	Path      string
+	Retention time.Duration
+
+	mu    sync.Mutex
+	peaks map[string]map[int64]int
+}
+
+// NewFileStore opens the history stored at path, creating an empty one if the file doesn't exist
+func NewFileStore(path string, retention time.Duration) (*FileStore, error) {
+	s := &FileStore{
+		Path:      path,
+		Retention: retention,
+		peaks:     map[string]map[int64]int{},
+	}
+
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var stored map[string]map[string]int
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+
+	for class, hours := range stored {
+		s.peaks[class] = map[int64]int{}
+		for hour, demand := range hours {
+			unix, err := strconv.ParseInt(hour, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			s.peaks[class][unix] = demand
+		}
+	}
+
+	return s, nil
+}
+
+func (s *FileStore) Observe(resourceClass string, t time.Time, demand int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.peaks == nil {
+		s.peaks = map[string]map[int64]int{}
+	}
+
+	hours, ok := s.peaks[resourceClass]
+	if !ok {
+		hours = map[int64]int{}
+		s.peaks[resourceClass] = hours
+	}
+
+	hour := t.Truncate(time.Hour).Unix()
+	if peak, ok := hours[hour]; ok && peak >= demand {
+		return nil
+	}
+	hours[hour] = demand
+
+	// Only a new peak changes the history, so that's the only time we prune and persist it
+	if s.Retention > 0 {
+		oldest := t.Add(-s.Retention).Unix()
+		for h := range hours {
+			if h < oldest {
+				delete(hours, h)
+			}
+		}
+	}
+
+	return s.persist()
+}
+
+func (s *FileStore) Peaks(resourceClass string) map[time.Time]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peaks := map[time.Time]int{}
+	for hour, demand := range s.peaks[resourceClass] {
+		peaks[time.Unix(hour, 0)] = demand
+	}
+
+	return peaks
+}
+
+// persist writes the history to a temporary file and renames it so a crash never leaves a partial file behind
+func (s *FileStore) persist() error {
+	if s.Path == "" {
+		return nil
+	}
+
+	stored := map[string]map[string]int{}
+	for class, hours := range s.peaks {
+		stored[class] = map[string]int{}
+		for hour, demand := range hours {
+			stored[class][strconv.FormatInt(hour, 10)] = demand
+		}
+	}
+
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.Path)
+}
@@ -11,8 +11,135 @@ data "aws_iam_policy_document" "circleci-runners-autoscaler-pd" {
 
     actions = [
         "autoscaling:*",
+        "ec2:DescribeInstances",
     ]
   }
+
+  statement {
+    sid    = "AllowDescribeLaunchTemplates"
+    effect = "Allow"
+
+    resources = [
+      "*"
+    ]
+
+    actions = [
+      "ec2:DescribeLaunchTemplates",
+    ]
+  }
+
+  # Runners can only be launched and tagged with the managed-by tag, and only instances with it can be terminated
+  statement {
+    sid    = "AllowLaunchManagedRunners"
+    effect = "Allow"
+
+    resources = [
+      "arn:aws:ec2:*:*:instance/*"
+    ]
+
+    actions = [
+      "ec2:RunInstances",
+    ]
+
+    condition {
+      test     = "StringEquals"
+      variable = "aws:RequestTag/managed-by"
+
+      values = [
+        "circleci-runner-autoscaler"
+      ]
+    }
+  }
+
+  statement {
+    sid    = "AllowLaunchTemplateResources"
+    effect = "Allow"
+
+    not_resources = [
+      "arn:aws:ec2:*:*:instance/*"
+    ]
+
+    actions = [
+      "ec2:RunInstances",
+    ]
+  }
+
+  statement {
+    sid    = "AllowTagManagedRunnersOnLaunch"
+    effect = "Allow"
+
+    resources = [
+      "arn:aws:ec2:*:*:instance/*"
+    ]
+
+    actions = [
+      "ec2:CreateTags",
+    ]
+
+    condition {
+      test     = "StringEquals"
+      variable = "ec2:CreateAction"
+
+      values = [
+        "RunInstances"
+      ]
+    }
+  }
+
+  statement {
+    sid    = "AllowTerminateManagedRunners"
+    effect = "Allow"
+
+    resources = [
+      "arn:aws:ec2:*:*:instance/*"
+    ]
+
+    actions = [
+      "ec2:TerminateInstances",
+    ]
+
+    condition {
+      test     = "StringEquals"
+      variable = "ec2:ResourceTag/managed-by"
+
+      values = [
+        "circleci-runner-autoscaler"
+      ]
+    }
+  }
+
+  dynamic "statement" {
+    for_each = length(var.runner_instance_role_arns) > 0 ? [1] : []
+
+    content {
+      sid       = "AllowPassRunnerRoles"
+      effect    = "Allow"
+      resources = var.runner_instance_role_arns
+      actions   = ["iam:PassRole"]
+    }
+  }
+
+  dynamic "statement" {
+    for_each = length(var.interruption_queue_arns) > 0 ? [1] : []
+
+    content {
+      sid       = "AllowInterruptionQueues"
+      effect    = "Allow"
+      resources = var.interruption_queue_arns
+      actions   = ["sqs:ReceiveMessage", "sqs:DeleteMessage"]
+    }
+  }
+
+  dynamic "statement" {
+    for_each = length(var.assume_role_arns) > 0 ? [1] : []
+
+    content {
+      sid       = "AllowAssumeTargetRoles"
+      effect    = "Allow"
+      resources = var.assume_role_arns
+      actions   = ["sts:AssumeRole"]
+    }
+  }
 }
 
 resource "aws_iam_policy" "circleci-runners-autoscaler-policy" {
@@ -1,3 +1,18 @@
 variable "oidc_issuers" {
   default = [""]
 }
+
+variable "assume_role_arns" {
+  description = "Roles in other accounts the autoscaler can assume to manage their ASGs"
+  default     = []
+}
+
+variable "interruption_queue_arns" {
+  description = "SQS queues EventBridge sends the EC2 spot interruption and rebalance events to"
+  default     = []
+}
+
+variable "runner_instance_role_arns" {
+  description = "Roles of the instance profiles set in the launch templates the autoscaler launches runners from"
+  default     = []
+}
@@ -4,27 +4,78 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/vela-games/circleci-runner-autoscaler/admin"
+	"github.com/vela-games/circleci-runner-autoscaler/budget"
 	autoscaler_config "github.com/vela-games/circleci-runner-autoscaler/config"
+	"github.com/vela-games/circleci-runner-autoscaler/forecast"
+	"github.com/vela-games/circleci-runner-autoscaler/services"
+	"github.com/vela-games/circleci-runner-autoscaler/webhook"
 
 	ci_client "github.com/vela-games/circleci-runner-autoscaler/client"
 	"github.com/vela-games/circleci-runner-autoscaler/workers"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 
-	_ "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
 	"github.com/deepmap/oapi-codegen/pkg/securityprovider"
 	"golang.org/x/sync/errgroup"
+	compute "google.golang.org/api/compute/v1"
 )
 
+const usage = `Usage: circleci-runner-autoscaler [command] [flags]
+
+Commands:
+  run        run the autoscaler, the default
+  validate   check the configuration and credentials and list the resource classes discovery finds
+  status     print the state of every resource class
+  simulate   run one scaling pass for a resource class without scaling and print the decision
+`
+
 func main() {
+	command, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	var err error
+	switch command {
+	case "run":
+		run()
+	case "validate":
+		err = validateCommand(args)
+	case "status":
+		err = statusCommand(args)
+	case "simulate":
+		err = simulateCommand(args)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run() {
 	config, err := autoscaler_config.GetConfig()
 	if err != nil {
 		log.Panicf("cannot get configuration: %v", err)
@@ -32,7 +83,7 @@ func main() {
 
 	group, ctx := errgroup.WithContext(context.Background())
 
-	asgAwsService, err := initAwsService(ctx)
+	asgAwsTargets, err := initAwsServices(ctx, config.AwsTargets)
 	if err != nil {
 		log.Fatalf("unable to initialize AWS SDK, %v", err)
 	}
@@ -42,33 +93,234 @@ func main() {
 		log.Fatalf("unable to initialize CircleCI Client: %v", err)
 	}
 
+	var forecaster *forecast.Forecaster
+	if config.PredictiveScalingEnabled {
+		forecaster, err = initForecaster(config)
+		if err != nil {
+			log.Fatalf("unable to initialize demand forecaster: %v", err)
+		}
+	}
+
+	var spendBudget *budget.Budget
+	if config.BudgetLimit > 0 || len(config.BudgetClassLimits) > 0 {
+		spendBudget = &budget.Budget{
+			Limit:       config.BudgetLimit,
+			ClassLimits: config.BudgetClassLimits,
+			Weights:     config.BudgetWeights,
+			Priorities:  config.BudgetPriorities,
+			Queue:       config.BudgetExhaustedAction == "queue",
+		}
+	}
+
 	workerDispatcher := &workers.WorkerDispatcher{
-		RunEvery: 5 * time.Second,
-		Group:    group,
+		RunEvery: config.ScalingInterval,
+		Intervals: map[workers.WorkerKind]time.Duration{
+			workers.KindDiscovery: config.DiscoveryInterval,
+			workers.KindScaling:   config.ScalingInterval,
+			workers.KindJanitor:   config.JanitorInterval,
+		},
+		Jitter:            config.DispatcherJitter,
+		RestartBackoff:    config.WorkerRestartBackoff,
+		MaxRestartBackoff: config.WorkerMaxRestartBackoff,
+		QuarantineAfter:   config.WorkerQuarantineAfter,
+		Group:             group,
+	}
+
+	var interruptions *workers.Interruptions
+	if config.AwsInterruptionQueueUrl != "" {
+		sqsClient, err := initSqsClient(ctx, config.AwsInterruptionQueueUrl)
+		if err != nil {
+			log.Fatalf("unable to initialize SQS client: %v", err)
+		}
+
+		interruptions = &workers.Interruptions{}
+		workerDispatcher.Start(ctx, &workers.AWSInterruptionWorker{
+			QueueURL:      config.AwsInterruptionQueueUrl,
+			SQSClient:     sqsClient,
+			WaitTime:      10 * time.Second,
+			Targets:       asgAwsTargets,
+			Interruptions: interruptions,
+			Budget:        spendBudget,
+		})
 	}
 
 	awsDiscoveryWorker := &workers.AWSDiscoveryWorker{
 		Namespace:      config.CircleResourceNamespace,
-		AsgAwsService:  asgAwsService,
+		Targets:        asgAwsTargets,
 		CircleCiClient: circleCiClient,
+		Forecaster:     forecaster,
+		Budget:         spendBudget,
+		Interruptions:  interruptions,
+		Config:         config,
 		Dispatcher:     workerDispatcher,
 	}
 	workerDispatcher.Start(ctx, awsDiscoveryWorker)
 
+	if config.AwsDrainEnabled {
+		mode, tagKey, _ := config.RunnerMatch()
+		workerDispatcher.Start(ctx, &workers.AWSDrainWorker{
+			Targets:        asgAwsTargets,
+			CircleCiClient: circleCiClient,
+			Matcher: &workers.RunnerMatcher{
+				Mode:   workers.RunnerMatchMode(mode),
+				TagKey: tagKey,
+			},
+			Namespace: config.CircleResourceNamespace,
+			HookName:  config.AwsDrainHookName,
+			// A few missed janitor runs don't let the instances go
+			HeartbeatTimeout: 5 * config.JanitorInterval,
+			MaxWait:          config.AwsDrainMaxWait,
+		})
+	}
+
+	if config.Ec2ScalerEnabled {
+		mode, tagKey, _ := config.RunnerMatch()
+		workerDispatcher.Start(ctx, &workers.EC2DiscoveryWorker{
+			Namespace:      config.CircleResourceNamespace,
+			Targets:        asgAwsTargets,
+			CircleCiClient: circleCiClient,
+			Budget:         spendBudget,
+			Interruptions:  interruptions,
+			MaxInstances:   config.Ec2MaxInstances,
+			IdleTimeout:    config.Ec2IdleTimeout,
+			LaunchTimeout:  config.AwsLaunchTimeout,
+			Matcher: &workers.RunnerMatcher{
+				Mode:   workers.RunnerMatchMode(mode),
+				TagKey: tagKey,
+			},
+			Dispatcher: workerDispatcher,
+		})
+	}
+
+	if len(config.GcpProjects) > 0 {
+		gcpTargets, err := initGcpServices(ctx, config.GcpProjects)
+		if err != nil {
+			log.Fatalf("unable to initialize Compute Engine client: %v", err)
+		}
+
+		workerDispatcher.Start(ctx, &workers.GCPDiscoveryWorker{
+			Namespace:      config.CircleResourceNamespace,
+			Targets:        gcpTargets,
+			CircleCiClient: circleCiClient,
+			Budget:         spendBudget,
+			MaxInstances:   config.GcpMaxInstances,
+			Dispatcher:     workerDispatcher,
+		})
+	}
+
+	if len(config.AzureSubscriptions) > 0 {
+		azureTargets, err := initAzureServices(config.AzureSubscriptions)
+		if err != nil {
+			log.Fatalf("unable to initialize Azure compute client: %v", err)
+		}
+
+		workerDispatcher.Start(ctx, &workers.AzureDiscoveryWorker{
+			Namespace:      config.CircleResourceNamespace,
+			Targets:        azureTargets,
+			CircleCiClient: circleCiClient,
+			Budget:         spendBudget,
+			MaxInstances:   config.AzureMaxInstances,
+			Dispatcher:     workerDispatcher,
+		})
+	}
+
+	if config.DockerHost != "" {
+		dockerEngine, err := services.NewDockerEngine(config.DockerHost)
+		if err != nil {
+			log.Fatalf("unable to initialize Docker client: %v", err)
+		}
+
+		workerDispatcher.Start(ctx, &workers.DockerDiscoveryWorker{
+			Namespace:         config.CircleResourceNamespace,
+			Target:            config.DockerHost,
+			ContainersService: dockerEngine,
+			CircleCiClient:    circleCiClient,
+			Budget:            spendBudget,
+			Images:            config.DockerImages,
+			RunnerTokens:      config.DockerRunnerTokens,
+			MaxContainers:     config.DockerMaxContainers,
+			IdleTimeout:       config.DockerIdleTimeout,
+			LaunchTimeout:     config.DockerLaunchTimeout,
+			Dispatcher:        workerDispatcher,
+		})
+	}
+
+	if config.ConfigFile != "" {
+		configWatcher := &autoscaler_config.Watcher{
+			Path:     config.ConfigFile,
+			Interval: 10 * time.Second,
+			OnChange: awsDiscoveryWorker.Reconfigure,
+			Running:  config,
+		}
+		group.Go(func() error {
+			configWatcher.Watch(ctx)
+			return nil
+		})
+	}
+
+	if config.WebhookEnabled {
+		mux := http.NewServeMux()
+		mux.Handle("/webhook", &webhook.Handler{
+			Secret: config.WebhookSecret,
+			Waker:  workerDispatcher,
+		})
+		serve(ctx, group, "webhook", config.WebhookListenAddress, mux)
+	}
+
+	if config.AdminEnabled {
+		serve(ctx, group, "admin API", config.AdminListenAddress, &admin.Handler{
+			Token:    config.AdminToken,
+			Registry: workerDispatcher,
+		})
+	}
+
 	if config.KubernetesScalerEnabled {
 		k8sClient, err := initK8sClient()
 		if err != nil {
 			log.Fatalf("unable to initialize k8s Client: %v", err)
 		}
 
+		// Shared by every Kubernetes resource class, whether it's scaled from a CronJob, PodTemplate or RunnerPool
+		classScheduler := &workers.ClassScheduler{
+			Priorities: config.BudgetPriorities,
+			Weights:    config.BudgetWeights,
+		}
+
 		k8sDiscoveryWorker := &workers.K8sDiscoveryWorker{
-			Namespace:      config.CircleResourceNamespace,
-			K8sNamespace:   config.KubernetesNamespace,
-			ClientSet:      k8sClient,
-			CircleCiClient: circleCiClient,
-			Dispatcher:     workerDispatcher,
+			Namespace:         config.CircleResourceNamespace,
+			K8sNamespace:      config.KubernetesNamespace,
+			ClientSet:         k8sClient,
+			InjectRunnerEnv:   config.KubernetesInjectRunnerEnv,
+			CheckNodeCapacity: config.KubernetesCheckNodeCapacity,
+			Scheduler:         classScheduler,
+			PriorityClasses:   config.KubernetesPriorityClasses,
+			CircleCiClient:    circleCiClient,
+			Budget:            spendBudget,
+			Dispatcher:        workerDispatcher,
 		}
 		workerDispatcher.Start(ctx, k8sDiscoveryWorker)
+
+		if config.KubernetesRunnerPoolsEnabled {
+			dynamicClient, err := initK8sDynamicClient()
+			if err != nil {
+				log.Fatalf("unable to initialize k8s dynamic Client: %v", err)
+			}
+
+			runnerPoolDiscoveryWorker := &workers.RunnerPoolDiscoveryWorker{
+				Namespace:         config.CircleResourceNamespace,
+				K8sNamespace:      config.KubernetesNamespace,
+				DynamicClient:     dynamicClient,
+				InjectRunnerEnv:   config.KubernetesInjectRunnerEnv,
+				CheckNodeCapacity: config.KubernetesCheckNodeCapacity,
+				Scheduler:         classScheduler,
+				PriorityClasses:   config.KubernetesPriorityClasses,
+				ClientSet:         k8sClient,
+				CircleCiClient:    circleCiClient,
+				Budget:            spendBudget,
+				Dispatcher:        workerDispatcher,
+			}
+			workerDispatcher.Start(ctx, runnerPoolDiscoveryWorker)
+		}
 	}
 
 	subscribeToSyscallSignal(group)
@@ -87,6 +339,30 @@ func subscribeToSyscallSignal(group *errgroup.Group) {
 	})
 }
 
+// serve runs an HTTP server until the context is done
+func serve(ctx context.Context, group *errgroup.Group, name string, address string, handler http.Handler) {
+	server := &http.Server{
+		Addr:              address,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	group.Go(func() error {
+		log.Printf("%v listening on %v", name, address)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			return fmt.Errorf("%v server: %w", name, err)
+		}
+		return nil
+	})
+
+	group.Go(func() error {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return server.Shutdown(shutdownCtx)
+	})
+}
+
 func initK8sClient() (*kubernetes.Clientset, error) {
 	config, err := rest.InClusterConfig()
 	if err != nil {
@@ -101,13 +377,141 @@ func initK8sClient() (*kubernetes.Clientset, error) {
 	return clientset, nil
 }
 
-func initAwsService(ctx context.Context) (*autoscaling.Client, error) {
-	cfg, err := config.LoadDefaultConfig(ctx)
+func initK8sDynamicClient() (dynamic.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return dynamic.NewForConfig(config)
+}
+
+func initAwsServices(ctx context.Context, targets []string) ([]services.AutoScalingTarget, error) {
+	if len(targets) == 0 {
+		cfg, err := initAwsConfig(ctx, "", "")
+		if err != nil {
+			return nil, err
+		}
+
+		return []services.AutoScalingTarget{
+			{
+				Name:      "default",
+				Client:    autoscaling.NewFromConfig(cfg),
+				EC2Client: ec2.NewFromConfig(cfg),
+			},
+		}, nil
+	}
+
+	var autoScalingTargets []services.AutoScalingTarget
+	for _, target := range targets {
+		// Targets are either a region or a role ARN to assume followed by @ and the region
+		roleArn, region := "", target
+		if i := strings.LastIndex(target, "@"); i != -1 {
+			roleArn, region = target[:i], target[i+1:]
+		}
+
+		cfg, err := initAwsConfig(ctx, roleArn, region)
+		if err != nil {
+			return nil, fmt.Errorf("target %v: %w", target, err)
+		}
+
+		autoScalingTargets = append(autoScalingTargets, services.AutoScalingTarget{
+			Name:      target,
+			Client:    autoscaling.NewFromConfig(cfg),
+			EC2Client: ec2.NewFromConfig(cfg),
+		})
+	}
+
+	return autoScalingTargets, nil
+}
+
+// initGcpServices returns a target for every project, using the application default credentials
+func initGcpServices(ctx context.Context, projects []string) ([]services.ManagedInstanceGroupsTarget, error) {
+	service, err := compute.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []services.ManagedInstanceGroupsTarget
+	for _, project := range projects {
+		targets = append(targets, services.ManagedInstanceGroupsTarget{
+			Name:   project,
+			Client: &services.ComputeGroups{Project: project, Service: service},
+		})
+	}
+	return targets, nil
+}
+
+// initAzureServices returns a target for every subscription, using the default Azure credential chain
+func initAzureServices(subscriptions []string) ([]services.ScaleSetsTarget, error) {
+	credential, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []services.ScaleSetsTarget
+	for _, subscription := range subscriptions {
+		scaleSets, err := armcompute.NewVirtualMachineScaleSetsClient(subscription, credential, nil)
+		if err != nil {
+			return nil, fmt.Errorf("subscription %v: %w", subscription, err)
+		}
+		vms, err := armcompute.NewVirtualMachineScaleSetVMsClient(subscription, credential, nil)
+		if err != nil {
+			return nil, fmt.Errorf("subscription %v: %w", subscription, err)
+		}
+
+		targets = append(targets, services.ScaleSetsTarget{
+			Name:   subscription,
+			Client: &services.ComputeScaleSets{ScaleSets: scaleSets, VMs: vms},
+		})
+	}
+	return targets, nil
+}
+
+// initSqsClient returns a client for the region of the queue, e.g. https://sqs.us-east-1.amazonaws.com/123456789012/queue
+func initSqsClient(ctx context.Context, queueUrl string) (*sqs.Client, error) {
+	region := ""
+	if host, _, ok := strings.Cut(strings.TrimPrefix(queueUrl, "https://"), "/"); ok && strings.HasPrefix(host, "sqs.") {
+		region = strings.Split(host, ".")[1]
+	}
+
+	cfg, err := initAwsConfig(ctx, "", region)
+	if err != nil {
+		return nil, err
+	}
+
+	return sqs.NewFromConfig(cfg), nil
+}
+
+func initAwsConfig(ctx context.Context, roleArn string, region string) (aws.Config, error) {
+	var opts []func(*config.LoadOptions) error
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return cfg, err
+	}
+
+	if roleArn != "" {
+		cfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), roleArn))
+	}
+
+	return cfg, nil
+}
+
+func initForecaster(config *autoscaler_config.Configuration) (*forecast.Forecaster, error) {
+	store, err := forecast.NewFileStore(config.PredictiveHistoryPath, config.PredictiveHistoryRetention)
 	if err != nil {
 		return nil, err
 	}
 
-	return autoscaling.NewFromConfig(cfg), nil
+	return &forecast.Forecaster{
+		Store:      store,
+		Lookahead:  config.PredictiveLookahead,
+		MinSeasons: config.PredictiveMinSeasons,
+	}, nil
 }
 
 func initCircleCIClient(circleToken string) (*ci_client.ClientWithResponses, error) {
@@ -0,0 +1,144 @@
+package services
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+)
+
+// ScaleSet is an Azure virtual machine scale set
+type ScaleSet struct {
+	Name          string
+	ResourceGroup string
+	Capacity      int32
+	Tags          map[string]string
+
+	// VM size and tier of the scale set, e.g. Standard_D8s_v5 and Standard
+	SKU  string
+	Tier string
+}
+
+// ScaleSetVM is a VM of a scale set
+type ScaleSetVM struct {
+	// Resource name, e.g. runners_3, and the computer name the VM has as hostname, e.g. runners000003
+	Name         string
+	ComputerName string
+	// Provisioning state of the VM, e.g. Creating, Succeeded or Deleting
+	ProvisioningState string
+}
+
+// ScaleSetsAPI manages the VM scale sets of an Azure subscription
+type ScaleSetsAPI interface {
+	ListScaleSets(ctx context.Context) ([]ScaleSet, error)
+	GetScaleSet(ctx context.Context, resourceGroup string, name string) (ScaleSet, error)
+	ListVMs(ctx context.Context, set ScaleSet) ([]ScaleSetVM, error)
+	SetCapacity(ctx context.Context, set ScaleSet, capacity int32) error
+}
+
+// ScaleSetsTarget is an Azure subscription whose scale sets are managed through Client
+type ScaleSetsTarget struct {
+	// Human readable name used in logs, the subscription id
+	Name   string
+	Client ScaleSetsAPI
+}
+
+// ComputeScaleSets implements ScaleSetsAPI with the Azure compute API
+type ComputeScaleSets struct {
+	ScaleSets *armcompute.VirtualMachineScaleSetsClient
+	VMs       *armcompute.VirtualMachineScaleSetVMsClient
+}
+
+func (c *ComputeScaleSets) ListScaleSets(ctx context.Context) ([]ScaleSet, error) {
+	var sets []ScaleSet
+	pager := c.ScaleSets.NewListAllPager(nil)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, set := range page.Value {
+			scaleSet, err := scaleSet(set)
+			if err != nil {
+				return nil, err
+			}
+			sets = append(sets, scaleSet)
+		}
+	}
+	return sets, nil
+}
+
+func (c *ComputeScaleSets) GetScaleSet(ctx context.Context, resourceGroup string, name string) (ScaleSet, error) {
+	response, err := c.ScaleSets.Get(ctx, resourceGroup, name, nil)
+	if err != nil {
+		return ScaleSet{}, err
+	}
+	return scaleSet(&response.VirtualMachineScaleSet)
+}
+
+func (c *ComputeScaleSets) ListVMs(ctx context.Context, set ScaleSet) ([]ScaleSetVM, error) {
+	var vms []ScaleSetVM
+	pager := c.VMs.NewListPager(set.ResourceGroup, set.Name, nil)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, vm := range page.Value {
+			scaleSetVM := ScaleSetVM{Name: value(vm.Name)}
+			if vm.Properties != nil {
+				scaleSetVM.ProvisioningState = value(vm.Properties.ProvisioningState)
+				if vm.Properties.OSProfile != nil {
+					scaleSetVM.ComputerName = value(vm.Properties.OSProfile.ComputerName)
+				}
+			}
+			vms = append(vms, scaleSetVM)
+		}
+	}
+	return vms, nil
+}
+
+// SetCapacity starts the update of the capacity without waiting for the VMs, they take minutes to come up
+func (c *ComputeScaleSets) SetCapacity(ctx context.Context, set ScaleSet, capacity int32) error {
+	_, err := c.ScaleSets.BeginUpdate(ctx, set.ResourceGroup, set.Name, armcompute.VirtualMachineScaleSetUpdate{
+		SKU: &armcompute.SKU{
+			Name:     to.Ptr(set.SKU),
+			Tier:     to.Ptr(set.Tier),
+			Capacity: to.Ptr(int64(capacity)),
+		},
+	}, nil)
+	return err
+}
+
+func scaleSet(set *armcompute.VirtualMachineScaleSet) (ScaleSet, error) {
+	id, err := arm.ParseResourceID(value(set.ID))
+	if err != nil {
+		return ScaleSet{}, fmt.Errorf("parsing id of scale set %v: %w", value(set.Name), err)
+	}
+
+	scaleSet := ScaleSet{
+		Name:          value(set.Name),
+		ResourceGroup: id.ResourceGroupName,
+		Tags:          map[string]string{},
+	}
+	for key, tag := range set.Tags {
+		scaleSet.Tags[key] = value(tag)
+	}
+	if set.SKU != nil {
+		scaleSet.Capacity = int32(value(set.SKU.Capacity))
+		scaleSet.SKU = value(set.SKU.Name)
+		scaleSet.Tier = value(set.SKU.Tier)
+	}
+	return scaleSet, nil
+}
+
+// value returns what p points to, or the zero value if it's nil
+func value[T any](p *T) T {
+	var v T
+	if p != nil {
+		v = *p
+	}
+	return v
+}
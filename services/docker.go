@@ -0,0 +1,267 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Engine API version the requests are made with, supported by Docker 20.10 and Podman 3 onwards
+const dockerAPIVersion = "v1.41"
+
+// Container is a container of a Docker-compatible engine
+type Container struct {
+	ID   string
+	Name string
+	// State of the container, e.g. created, running, exited or dead
+	State   string
+	Image   string
+	Labels  map[string]string
+	Created time.Time
+}
+
+// ContainerSpec is what a runner container is started with
+type ContainerSpec struct {
+	Name   string
+	Image  string
+	Env    []string
+	Labels map[string]string
+}
+
+// ContainersAPI manages the containers of a Docker-compatible engine
+type ContainersAPI interface {
+	// ListContainers returns the containers with all the labels, whatever their state
+	ListContainers(ctx context.Context, labels map[string]string) ([]Container, error)
+	// RunContainer creates and starts a container that's removed once it exits, pulling its image if it's missing
+	RunContainer(ctx context.Context, spec ContainerSpec) (string, error)
+	// StopContainer stops the container, giving it the timeout to exit before it's killed
+	StopContainer(ctx context.Context, id string, timeout time.Duration) error
+	RemoveContainer(ctx context.Context, id string) error
+}
+
+// DockerEngine implements ContainersAPI with the Engine API of Docker, or of Podman's compatible service
+type DockerEngine struct {
+	client  *http.Client
+	baseURL string
+}
+
+// NewDockerEngine returns a client for the engine at host, either a unix socket such as unix:///var/run/docker.sock
+// or a tcp://host:port address
+func NewDockerEngine(host string) (*DockerEngine, error) {
+	scheme, address, ok := strings.Cut(host, "://")
+	if !ok {
+		return nil, fmt.Errorf("docker host %q has no scheme, expected unix:// or tcp://", host)
+	}
+
+	switch scheme {
+	case "unix":
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", address)
+			},
+		}
+		// The host of the URL is ignored when dialing the socket
+		return &DockerEngine{client: &http.Client{Transport: transport}, baseURL: "http://docker"}, nil
+	case "tcp", "http":
+		return &DockerEngine{client: &http.Client{}, baseURL: "http://" + address}, nil
+	}
+
+	return nil, fmt.Errorf("docker host %q has an unsupported scheme %v, expected unix:// or tcp://", host, scheme)
+}
+
+func (d *DockerEngine) ListContainers(ctx context.Context, labels map[string]string) ([]Container, error) {
+	var labelFilters []string
+	for key, value := range labels {
+		labelFilters = append(labelFilters, key+"="+value)
+	}
+	filters, err := json.Marshal(map[string][]string{"label": labelFilters})
+	if err != nil {
+		return nil, err
+	}
+
+	var summaries []struct {
+		Id      string
+		Names   []string
+		Image   string
+		State   string
+		Labels  map[string]string
+		Created int64
+	}
+	query := url.Values{"all": {"true"}, "filters": {string(filters)}}
+	if err := d.do(ctx, http.MethodGet, "/containers/json?"+query.Encode(), nil, &summaries); err != nil {
+		return nil, fmt.Errorf("listing containers: %w", err)
+	}
+
+	var containers []Container
+	for _, summary := range summaries {
+		container := Container{
+			ID:      summary.Id,
+			State:   summary.State,
+			Image:   summary.Image,
+			Labels:  summary.Labels,
+			Created: time.Unix(summary.Created, 0),
+		}
+		if len(summary.Names) > 0 {
+			container.Name = strings.TrimPrefix(summary.Names[0], "/")
+		}
+		containers = append(containers, container)
+	}
+	return containers, nil
+}
+
+func (d *DockerEngine) RunContainer(ctx context.Context, spec ContainerSpec) (string, error) {
+	id, err := d.createContainer(ctx, spec)
+	var apiErr *dockerError
+	if errors.As(err, &apiErr) && apiErr.status == http.StatusNotFound {
+		if err := d.pullImage(ctx, spec.Image); err != nil {
+			return "", err
+		}
+		id, err = d.createContainer(ctx, spec)
+	}
+	if err != nil {
+		return "", fmt.Errorf("creating container %v: %w", spec.Name, err)
+	}
+
+	if err := d.do(ctx, http.MethodPost, "/containers/"+id+"/start", nil, nil); err != nil {
+		return id, fmt.Errorf("starting container %v: %w", spec.Name, err)
+	}
+	return id, nil
+}
+
+func (d *DockerEngine) StopContainer(ctx context.Context, id string, timeout time.Duration) error {
+	query := url.Values{"t": {fmt.Sprint(int(timeout.Seconds()))}}
+	err := d.do(ctx, http.MethodPost, "/containers/"+id+"/stop?"+query.Encode(), nil, nil)
+	if ignoreGone(err) != nil {
+		return fmt.Errorf("stopping container %v: %w", id, err)
+	}
+	return nil
+}
+
+func (d *DockerEngine) RemoveContainer(ctx context.Context, id string) error {
+	err := d.do(ctx, http.MethodDelete, "/containers/"+id+"?force=true", nil, nil)
+	if ignoreGone(err) != nil {
+		return fmt.Errorf("removing container %v: %w", id, err)
+	}
+	return nil
+}
+
+func (d *DockerEngine) createContainer(ctx context.Context, spec ContainerSpec) (string, error) {
+	body := map[string]interface{}{
+		"Image":  spec.Image,
+		"Env":    spec.Env,
+		"Labels": spec.Labels,
+		"HostConfig": map[string]interface{}{
+			"AutoRemove": true,
+		},
+	}
+	var created struct {
+		Id string
+	}
+	query := url.Values{"name": {spec.Name}}
+	if err := d.do(ctx, http.MethodPost, "/containers/create?"+query.Encode(), body, &created); err != nil {
+		return "", err
+	}
+	return created.Id, nil
+}
+
+// pullImage pulls the image, waiting for the pull to finish
+func (d *DockerEngine) pullImage(ctx context.Context, image string) error {
+	query := url.Values{"fromImage": {image}}
+	response, err := d.request(ctx, http.MethodPost, "/images/create?"+query.Encode(), nil)
+	if err != nil {
+		return fmt.Errorf("pulling image %v: %w", image, err)
+	}
+	defer response.Body.Close()
+
+	// The progress is streamed as JSON messages, failures after the pull started come as a message with an error
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var message struct {
+			Error string `json:"error"`
+		}
+		if err := decoder.Decode(&message); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("pulling image %v: %w", image, err)
+		}
+		if message.Error != "" {
+			return fmt.Errorf("pulling image %v: %v", image, message.Error)
+		}
+	}
+}
+
+// do sends the request with body encoded as JSON, and decodes the response into out if it's not nil
+func (d *DockerEngine) do(ctx context.Context, method string, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	response, err := d.request(ctx, method, path, reader)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if out == nil || response.StatusCode == http.StatusNoContent || response.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(out)
+}
+
+// request sends the request, and turns responses with an error code into a dockerError
+func (d *DockerEngine) request(ctx context.Context, method string, path string, body io.Reader) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, method, d.baseURL+"/"+dockerAPIVersion+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= 400 {
+		defer response.Body.Close()
+		var message struct {
+			Message string `json:"message"`
+		}
+		_ = json.NewDecoder(response.Body).Decode(&message)
+		return nil, &dockerError{status: response.StatusCode, message: message.Message}
+	}
+	return response, nil
+}
+
+// dockerError is an error the engine answered with
+type dockerError struct {
+	status  int
+	message string
+}
+
+func (e *dockerError) Error() string {
+	return fmt.Sprintf("got %v code: %v", e.status, e.message)
+}
+
+// ignoreGone drops the errors of containers that don't exist anymore, or are being removed already
+func ignoreGone(err error) error {
+	var apiErr *dockerError
+	if errors.As(err, &apiErr) && (apiErr.status == http.StatusNotFound || apiErr.status == http.StatusConflict) {
+		return nil
+	}
+	return err
+}
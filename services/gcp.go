@@ -0,0 +1,160 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+// ManagedInstanceGroup is a zonal or regional managed instance group, with the labels and machine type of its
+// instance template as groups have no labels of their own
+type ManagedInstanceGroup struct {
+	Name string
+	// Zone of a zonal group or region of a regional one
+	Location   string
+	Regional   bool
+	TargetSize int32
+
+	Labels      map[string]string
+	MachineType string
+}
+
+// ManagedInstance is an instance of a managed instance group
+type ManagedInstance struct {
+	Name string
+	// What the group is doing with the instance, e.g. NONE once it's running or CREATING
+	CurrentAction string
+	// Status of the instance, e.g. RUNNING
+	Status string
+}
+
+// ManagedInstanceGroupsAPI manages the instance groups of a GCP project
+type ManagedInstanceGroupsAPI interface {
+	ListGroups(ctx context.Context) ([]ManagedInstanceGroup, error)
+	GetGroup(ctx context.Context, location string, regional bool, name string) (ManagedInstanceGroup, error)
+	ListInstances(ctx context.Context, group ManagedInstanceGroup) ([]ManagedInstance, error)
+	Resize(ctx context.Context, group ManagedInstanceGroup, size int32) error
+}
+
+// ManagedInstanceGroupsTarget is a GCP project whose managed instance groups are managed through Client
+type ManagedInstanceGroupsTarget struct {
+	// Human readable name used in logs, the project id
+	Name   string
+	Client ManagedInstanceGroupsAPI
+}
+
+// ComputeGroups implements ManagedInstanceGroupsAPI with the Compute Engine API
+type ComputeGroups struct {
+	Project string
+	Service *compute.Service
+}
+
+func (c *ComputeGroups) ListGroups(ctx context.Context) ([]ManagedInstanceGroup, error) {
+	var groups []ManagedInstanceGroup
+	templates := map[string]*compute.InstanceTemplate{}
+	err := c.Service.InstanceGroupManagers.AggregatedList(c.Project).Pages(ctx, func(page *compute.InstanceGroupManagerAggregatedList) error {
+		for _, scoped := range page.Items {
+			for _, manager := range scoped.InstanceGroupManagers {
+				group, err := c.group(ctx, manager, templates)
+				if err != nil {
+					// A group whose template can't be read doesn't hide the others
+					log.Printf("skipping instance group %v: %v", manager.Name, err)
+					continue
+				}
+				groups = append(groups, group)
+			}
+		}
+		return nil
+	})
+	return groups, err
+}
+
+func (c *ComputeGroups) GetGroup(ctx context.Context, location string, regional bool, name string) (ManagedInstanceGroup, error) {
+	var manager *compute.InstanceGroupManager
+	var err error
+	if regional {
+		manager, err = c.Service.RegionInstanceGroupManagers.Get(c.Project, location, name).Context(ctx).Do()
+	} else {
+		manager, err = c.Service.InstanceGroupManagers.Get(c.Project, location, name).Context(ctx).Do()
+	}
+	if err != nil {
+		return ManagedInstanceGroup{}, err
+	}
+	return c.group(ctx, manager, map[string]*compute.InstanceTemplate{})
+}
+
+func (c *ComputeGroups) ListInstances(ctx context.Context, group ManagedInstanceGroup) ([]ManagedInstance, error) {
+	var instances []ManagedInstance
+	add := func(managed []*compute.ManagedInstance) {
+		for _, instance := range managed {
+			instances = append(instances, ManagedInstance{
+				Name:          path.Base(instance.Instance),
+				CurrentAction: instance.CurrentAction,
+				Status:        instance.InstanceStatus,
+			})
+		}
+	}
+
+	if group.Regional {
+		err := c.Service.RegionInstanceGroupManagers.ListManagedInstances(c.Project, group.Location, group.Name).Pages(ctx, func(page *compute.RegionInstanceGroupManagersListInstancesResponse) error {
+			add(page.ManagedInstances)
+			return nil
+		})
+		return instances, err
+	}
+
+	err := c.Service.InstanceGroupManagers.ListManagedInstances(c.Project, group.Location, group.Name).Pages(ctx, func(page *compute.InstanceGroupManagersListManagedInstancesResponse) error {
+		add(page.ManagedInstances)
+		return nil
+	})
+	return instances, err
+}
+
+func (c *ComputeGroups) Resize(ctx context.Context, group ManagedInstanceGroup, size int32) error {
+	var err error
+	if group.Regional {
+		_, err = c.Service.RegionInstanceGroupManagers.Resize(c.Project, group.Location, group.Name, int64(size)).Context(ctx).Do()
+	} else {
+		_, err = c.Service.InstanceGroupManagers.Resize(c.Project, group.Location, group.Name, int64(size)).Context(ctx).Do()
+	}
+	return err
+}
+
+// group converts the group manager, looking up its instance template unless it's in the cache already
+func (c *ComputeGroups) group(ctx context.Context, manager *compute.InstanceGroupManager, templates map[string]*compute.InstanceTemplate) (ManagedInstanceGroup, error) {
+	group := ManagedInstanceGroup{
+		Name:       manager.Name,
+		Location:   path.Base(manager.Zone),
+		TargetSize: int32(manager.TargetSize),
+	}
+	if manager.Region != "" {
+		group.Location = path.Base(manager.Region)
+		group.Regional = true
+	}
+
+	template, ok := templates[manager.InstanceTemplate]
+	if !ok {
+		var err error
+		// Templates are either global or regional, e.g. .../regions/europe-west1/instanceTemplates/runner
+		name := path.Base(manager.InstanceTemplate)
+		if parts := strings.Split(manager.InstanceTemplate, "/"); len(parts) > 3 && parts[len(parts)-4] == "regions" {
+			template, err = c.Service.RegionInstanceTemplates.Get(c.Project, parts[len(parts)-3], name).Context(ctx).Do()
+		} else {
+			template, err = c.Service.InstanceTemplates.Get(c.Project, name).Context(ctx).Do()
+		}
+		if err != nil {
+			return group, fmt.Errorf("getting instance template of %v: %w", manager.Name, err)
+		}
+		templates[manager.InstanceTemplate] = template
+	}
+
+	if template.Properties != nil {
+		group.Labels = template.Properties.Labels
+		group.MachineType = template.Properties.MachineType
+	}
+	return group, nil
+}
@@ -0,0 +1,95 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	signatureHeader = "circleci-signature"
+	eventTypeHeader = "circleci-event-type"
+
+	// Webhook deliveries are small, anything bigger than this isn't coming from CircleCI
+	maxBodySize = 1 << 20
+)
+
+// Events that trigger a scaling run, a finished job or workflow is usually followed by more work being queued
+var scalingEvents = map[string]bool{
+	"workflow-completed": true,
+	"job-completed":      true,
+}
+
+// Waker runs scaling workers outside their regular tick
+type Waker interface {
+	WakeResourceClass(class string) int
+}
+
+// Handler receives CircleCI webhook deliveries and wakes up the scaling worker of the resource class given in the
+// resource_class query parameter of the webhook URL, or every scaling worker if there's none, as the payloads
+// don't say which resource class the job ran on.
+type Handler struct {
+	Secret string
+	Waker  Waker
+}
+
+func (h *Handler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(rw, r.Body, maxBodySize))
+	if err != nil {
+		http.Error(rw, "cannot read body", http.StatusBadRequest)
+		return
+	}
+
+	if !h.validSignature(r.Header.Get(signatureHeader), body) {
+		log.Printf("webhook delivery with an invalid signature from %v", r.RemoteAddr)
+		http.Error(rw, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	eventType := r.Header.Get(eventTypeHeader)
+	if !scalingEvents[eventType] {
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	class := r.URL.Query().Get("resource_class")
+	woken := h.Waker.WakeResourceClass(class)
+	log.Printf("webhook %v woke up %v scaling workers", eventType, woken)
+
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+// validSignature checks the circleci-signature header, a comma separated list of versioned signatures
+// of which we only understand v1, the hex encoded HMAC-SHA256 of the body
+func (h *Handler) validSignature(header string, body []byte) bool {
+	mac := hmac.New(sha256.New, []byte(h.Secret))
+	mac.Write(body)
+	expected := mac.Sum(nil)
+
+	for _, signature := range strings.Split(header, ",") {
+		version, value, found := strings.Cut(strings.TrimSpace(signature), "=")
+		if !found || version != "v1" {
+			continue
+		}
+
+		decoded, err := hex.DecodeString(value)
+		if err != nil {
+			continue
+		}
+
+		if hmac.Equal(decoded, expected) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,120 @@
+package webhook_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/vela-games/circleci-runner-autoscaler/webhook"
+	"gotest.tools/v3/assert"
+)
+
+type wakerTest struct {
+	classes []string
+}
+
+func (w *wakerTest) WakeResourceClass(class string) int {
+	w.classes = append(w.classes, class)
+	return 1
+}
+
+func sign(secret string, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestHandler(t *testing.T) {
+	body := `{"type":"job-completed","job":{"name":"build","status":"success"}}`
+
+	tests := []struct {
+		name       string
+		method     string
+		url        string
+		signature  string
+		eventType  string
+		wantStatus int
+		wantWoken  []string
+	}{
+		{
+			name:       "it should wake up the scaling worker of the resource class",
+			method:     http.MethodPost,
+			url:        "/webhook?resource_class=vela-games/large",
+			signature:  sign("secret", body),
+			eventType:  "job-completed",
+			wantStatus: http.StatusAccepted,
+			wantWoken:  []string{"vela-games/large"},
+		},
+		{
+			name:       "it should wake up every scaling worker without a resource class",
+			method:     http.MethodPost,
+			url:        "/webhook",
+			signature:  sign("secret", body),
+			eventType:  "workflow-completed",
+			wantStatus: http.StatusAccepted,
+			wantWoken:  []string{""},
+		},
+		{
+			name:       "it should accept any valid v1 signature",
+			method:     http.MethodPost,
+			url:        "/webhook",
+			signature:  "v2=abcd, v1=00ff," + sign("secret", body),
+			eventType:  "job-completed",
+			wantStatus: http.StatusAccepted,
+			wantWoken:  []string{""},
+		},
+		{
+			name:       "it should reject deliveries signed with another secret",
+			method:     http.MethodPost,
+			url:        "/webhook",
+			signature:  sign("other", body),
+			eventType:  "job-completed",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "it should reject deliveries without a signature",
+			method:     http.MethodPost,
+			url:        "/webhook",
+			eventType:  "job-completed",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "it should ignore other events",
+			method:     http.MethodPost,
+			url:        "/webhook",
+			signature:  sign("secret", body),
+			eventType:  "ping",
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "it should only accept POST",
+			method:     http.MethodGet,
+			url:        "/webhook",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			waker := &wakerTest{}
+			handler := &webhook.Handler{
+				Secret: "secret",
+				Waker:  waker,
+			}
+
+			req := httptest.NewRequest(tt.method, tt.url, strings.NewReader(body))
+			req.Header.Set("circleci-signature", tt.signature)
+			req.Header.Set("circleci-event-type", tt.eventType)
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.DeepEqual(t, tt.wantWoken, waker.classes)
+		})
+	}
+}
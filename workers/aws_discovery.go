@@ -6,27 +6,89 @@ import (
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	"github.com/vela-games/circleci-runner-autoscaler/budget"
 	"github.com/vela-games/circleci-runner-autoscaler/client"
+	"github.com/vela-games/circleci-runner-autoscaler/config"
+	"github.com/vela-games/circleci-runner-autoscaler/forecast"
 	"github.com/vela-games/circleci-runner-autoscaler/services"
 )
 
 type AWSDiscoveryWorker struct {
 	Dispatcher Dispatcher
 
+	// ASGs are discovered in every target, if there are none AsgAwsService and Ec2AwsService are used
+	Targets        []services.AutoScalingTarget
 	AsgAwsService  services.AutoScalingAPI
+	Ec2AwsService  services.EC2API
 	CircleCiClient client.ClientWithResponsesInterface
+	Forecaster     *forecast.Forecaster
+	Budget         *budget.Budget
+	// Optional, instances EC2 is taking back aren't counted as ready runners
+	Interruptions *Interruptions
+
+	// Scaling settings for the resource classes, can be changed with Reconfigure
+	Config *config.Configuration
 
 	Namespace                 string
 	childWorkersResourceClass []string
+	childWorkers              []*AWSScalingWorker
+
+	pendingConfiguration
+	reporter
+}
+
+func (w *AWSDiscoveryWorker) Kind() WorkerKind {
+	return KindDiscovery
+}
+
+func (w *AWSDiscoveryWorker) Report() WorkerReport {
+	report := w.snapshot()
+	report.Backend = "aws"
+	report.Target = "default"
+	if len(w.Targets) > 0 {
+		var names []string
+		for _, target := range w.Targets {
+			names = append(names, target.Name)
+		}
+		report.Target = strings.Join(names, ",")
+	}
+	return report
 }
 
 // This will discover new resource classes on circleci and start the scaling worker for each one of them
 func (w *AWSDiscoveryWorker) Handle(ctx context.Context) {
+	if c := w.take(); c != nil {
+		w.Config = c
+		for _, sc := range w.childWorkers {
+			sc.Reconfigure(c)
+		}
+	}
+
+	targets := w.Targets
+	if len(targets) == 0 {
+		targets = []services.AutoScalingTarget{
+			{
+				Name:      "default",
+				Client:    w.AsgAwsService,
+				EC2Client: w.Ec2AwsService,
+			},
+		}
+	}
 
+	for _, target := range targets {
+		w.discover(ctx, target)
+	}
+	w.decided("scaling %v resource classes", len(w.childWorkersResourceClass))
+}
+
+// discover starts scaling workers for the resource classes found in the target account and region.
+// If a resource class has ASGs in several targets only the first one found is scaled.
+func (w *AWSDiscoveryWorker) discover(ctx context.Context, target services.AutoScalingTarget) {
 	// Get all autoscaling groups on AWS account
-	asg, err := w.AsgAwsService.DescribeAutoScalingGroups(ctx, &autoscaling.DescribeAutoScalingGroupsInput{})
+	asg, err := target.Client.DescribeAutoScalingGroups(ctx, &autoscaling.DescribeAutoScalingGroupsInput{})
 	if err != nil {
-		log.Printf("error getting autoscaling groups: %v", err)
+		log.Printf("error getting autoscaling groups from %v: %v", target.Name, err)
+		w.failed("getting autoscaling groups from %v: %v", target.Name, err)
 		return
 	}
 
@@ -54,12 +116,23 @@ func (w *AWSDiscoveryWorker) Handle(ctx context.Context) {
 
 				if !found {
 					w.childWorkersResourceClass = append(w.childWorkersResourceClass, className)
-					log.Printf("Found new resource class %v, starting scaling worker for it", className)
+					log.Printf("Found new resource class %v in %v, starting scaling worker for it", className, target.Name)
 					sc := &AWSScalingWorker{
 						ResourceClass:  className,
-						AsgAwsService:  w.AsgAwsService,
+						Target:         target.Name,
+						AsgAwsService:  target.Client,
 						CircleCiClient: w.CircleCiClient,
+						Forecaster:     w.Forecaster,
+						Budget:         w.Budget,
+						Matcher: &RunnerMatcher{
+							Ec2AwsService: target.EC2Client,
+							Interruptions: w.Interruptions,
+						},
+					}
+					if w.Config != nil {
+						sc.applyConfiguration(w.Config)
 					}
+					w.childWorkers = append(w.childWorkers, sc)
 					w.Dispatcher.Start(ctx, sc)
 				}
 			}
@@ -2,10 +2,15 @@ package workers_test
 
 import (
 	"context"
+	"net/http"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
 	"github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	circleci_client "github.com/vela-games/circleci-runner-autoscaler/client"
+	"github.com/vela-games/circleci-runner-autoscaler/config"
+	"github.com/vela-games/circleci-runner-autoscaler/services"
 	"github.com/vela-games/circleci-runner-autoscaler/workers"
 	"gotest.tools/v3/assert"
 )
@@ -15,29 +20,73 @@ func stringPointer(s string) *string {
 }
 
 type WorkerDispatcherTest struct {
-	Count int
+	Count    int
+	Workers  []workers.Worker
+	Contexts []context.Context
 }
 
 func (d *WorkerDispatcherTest) Start(ctx context.Context, w workers.Worker) {
 	d.Count = d.Count + 1
+	d.Workers = append(d.Workers, w)
+	d.Contexts = append(d.Contexts, ctx)
 }
 
 type mockDescribeAutoScalingGroupsAPI func(ctx context.Context, params *autoscaling.DescribeAutoScalingGroupsInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingGroupsOutput, error)
+type mockDescribeScalingActivitiesAPI func(ctx context.Context, params *autoscaling.DescribeScalingActivitiesInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeScalingActivitiesOutput, error)
 type mockSetDesiredCapacityAPI func(ctx context.Context, params *autoscaling.SetDesiredCapacityInput, optFns ...func(*autoscaling.Options)) (*autoscaling.SetDesiredCapacityOutput, error)
+type mockDescribeLifecycleHooksAPI func(ctx context.Context, params *autoscaling.DescribeLifecycleHooksInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeLifecycleHooksOutput, error)
+type mockPutLifecycleHookAPI func(ctx context.Context, params *autoscaling.PutLifecycleHookInput, optFns ...func(*autoscaling.Options)) (*autoscaling.PutLifecycleHookOutput, error)
+type mockRecordLifecycleActionHeartbeatAPI func(ctx context.Context, params *autoscaling.RecordLifecycleActionHeartbeatInput, optFns ...func(*autoscaling.Options)) (*autoscaling.RecordLifecycleActionHeartbeatOutput, error)
+type mockCompleteLifecycleActionAPI func(ctx context.Context, params *autoscaling.CompleteLifecycleActionInput, optFns ...func(*autoscaling.Options)) (*autoscaling.CompleteLifecycleActionOutput, error)
+type mockDetachInstancesAPI func(ctx context.Context, params *autoscaling.DetachInstancesInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DetachInstancesOutput, error)
 
 type mockAutoScalingGroupsAPI struct {
-	MockDescribeAutoScalingGroupsAPI mockDescribeAutoScalingGroupsAPI
-	MockSetDesiredCapacityAPI        mockSetDesiredCapacityAPI
+	MockDescribeAutoScalingGroupsAPI      mockDescribeAutoScalingGroupsAPI
+	MockDescribeScalingActivitiesAPI      mockDescribeScalingActivitiesAPI
+	MockSetDesiredCapacityAPI             mockSetDesiredCapacityAPI
+	MockDescribeLifecycleHooksAPI         mockDescribeLifecycleHooksAPI
+	MockPutLifecycleHookAPI               mockPutLifecycleHookAPI
+	MockRecordLifecycleActionHeartbeatAPI mockRecordLifecycleActionHeartbeatAPI
+	MockCompleteLifecycleActionAPI        mockCompleteLifecycleActionAPI
+	MockDetachInstancesAPI                mockDetachInstancesAPI
 }
 
 func (m mockAutoScalingGroupsAPI) DescribeAutoScalingGroups(ctx context.Context, params *autoscaling.DescribeAutoScalingGroupsInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
 	return m.MockDescribeAutoScalingGroupsAPI(ctx, params, optFns...)
 }
 
+// DescribeScalingActivities reports no activities unless the test mocks it
+func (m mockAutoScalingGroupsAPI) DescribeScalingActivities(ctx context.Context, params *autoscaling.DescribeScalingActivitiesInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeScalingActivitiesOutput, error) {
+	if m.MockDescribeScalingActivitiesAPI == nil {
+		return &autoscaling.DescribeScalingActivitiesOutput{}, nil
+	}
+	return m.MockDescribeScalingActivitiesAPI(ctx, params, optFns...)
+}
+
 func (m mockAutoScalingGroupsAPI) SetDesiredCapacity(ctx context.Context, params *autoscaling.SetDesiredCapacityInput, optFns ...func(*autoscaling.Options)) (*autoscaling.SetDesiredCapacityOutput, error) {
 	return m.MockSetDesiredCapacityAPI(ctx, params, optFns...)
 }
 
+func (m mockAutoScalingGroupsAPI) DescribeLifecycleHooks(ctx context.Context, params *autoscaling.DescribeLifecycleHooksInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeLifecycleHooksOutput, error) {
+	return m.MockDescribeLifecycleHooksAPI(ctx, params, optFns...)
+}
+
+func (m mockAutoScalingGroupsAPI) PutLifecycleHook(ctx context.Context, params *autoscaling.PutLifecycleHookInput, optFns ...func(*autoscaling.Options)) (*autoscaling.PutLifecycleHookOutput, error) {
+	return m.MockPutLifecycleHookAPI(ctx, params, optFns...)
+}
+
+func (m mockAutoScalingGroupsAPI) RecordLifecycleActionHeartbeat(ctx context.Context, params *autoscaling.RecordLifecycleActionHeartbeatInput, optFns ...func(*autoscaling.Options)) (*autoscaling.RecordLifecycleActionHeartbeatOutput, error) {
+	return m.MockRecordLifecycleActionHeartbeatAPI(ctx, params, optFns...)
+}
+
+func (m mockAutoScalingGroupsAPI) CompleteLifecycleAction(ctx context.Context, params *autoscaling.CompleteLifecycleActionInput, optFns ...func(*autoscaling.Options)) (*autoscaling.CompleteLifecycleActionOutput, error) {
+	return m.MockCompleteLifecycleActionAPI(ctx, params, optFns...)
+}
+
+func (m mockAutoScalingGroupsAPI) DetachInstances(ctx context.Context, params *autoscaling.DetachInstancesInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DetachInstancesOutput, error) {
+	return m.MockDetachInstancesAPI(ctx, params, optFns...)
+}
+
 func TestAWSDiscoveryWorker(t *testing.T) {
 	t.Run("it should only start scaling worker once", func(t *testing.T) {
 		dispatcher := &WorkerDispatcherTest{}
@@ -69,11 +118,14 @@ func TestAWSDiscoveryWorker(t *testing.T) {
 		}
 
 		discovery.AsgAwsService = asgClient
+		discovery.Ec2AwsService = mockEC2API{}
 
 		discovery.Handle(context.TODO())
 		discovery.Handle(context.TODO())
 
 		assert.Equal(t, 1, dispatcher.Count)
+		// Runners can be matched by private DNS name or tag without targets too
+		assert.Assert(t, dispatcher.Workers[0].(*workers.AWSScalingWorker).Matcher.Ec2AwsService != nil)
 	})
 
 	t.Run("it should start two scaling runners", func(t *testing.T) {
@@ -120,4 +172,121 @@ func TestAWSDiscoveryWorker(t *testing.T) {
 		assert.Equal(t, 2, dispatcher.Count)
 	})
 
+	t.Run("it should start scaling workers with the client of the target the ASG was found in", func(t *testing.T) {
+		dispatcher := &WorkerDispatcherTest{}
+
+		newTargetClient := func(classes ...string) mockAutoScalingGroupsAPI {
+			return mockAutoScalingGroupsAPI{
+				MockDescribeAutoScalingGroupsAPI: func(ctx context.Context, params *autoscaling.DescribeAutoScalingGroupsInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+					output := &autoscaling.DescribeAutoScalingGroupsOutput{}
+					for _, class := range classes {
+						output.AutoScalingGroups = append(output.AutoScalingGroups, types.AutoScalingGroup{
+							AutoScalingGroupName: stringPointer(class),
+							Tags: []types.TagDescription{
+								{
+									Key:   stringPointer("resource-class"),
+									Value: stringPointer(class),
+								},
+							},
+						})
+					}
+					return output, nil
+				},
+			}
+		}
+
+		discovery := workers.AWSDiscoveryWorker{
+			Dispatcher: dispatcher,
+			Namespace:  "vela-games",
+			Targets: []services.AutoScalingTarget{
+				{
+					Name:   "eu-west-1",
+					Client: newTargetClient("vela-games/resource-class"),
+				},
+				{
+					Name:   "arn:aws:iam::123456789012:role/runners@us-east-1",
+					Client: newTargetClient("vela-games/resource-class", "vela-games/resource-class-2"),
+				},
+			},
+		}
+
+		discovery.Handle(context.TODO())
+		discovery.Handle(context.TODO())
+
+		assert.Equal(t, 2, dispatcher.Count)
+
+		targets := map[string]string{}
+		for _, w := range dispatcher.Workers {
+			sc := w.(*workers.AWSScalingWorker)
+			targets[sc.ResourceClass] = sc.Target
+		}
+
+		assert.DeepEqual(t, map[string]string{
+			"vela-games/resource-class":   "eu-west-1",
+			"vela-games/resource-class-2": "arn:aws:iam::123456789012:role/runners@us-east-1",
+		}, targets)
+	})
+
+	t.Run("it should apply configuration changes to running scaling workers", func(t *testing.T) {
+		dispatcher := &WorkerDispatcherTest{}
+
+		discovery := workers.AWSDiscoveryWorker{
+			Dispatcher: dispatcher,
+			Namespace:  "vela-games",
+			Config: &config.Configuration{
+				AwsScaleOutCooldown: time.Minute,
+				AwsRunnerMatch:      "instance-id",
+			},
+			CircleCiClient: &mockCircleCiClient{
+				MockGetUnclaimedTasksWithResponse: func(ctx context.Context, params *circleci_client.GetUnclaimedTasksParams, reqEditors ...circleci_client.RequestEditorFn) (*circleci_client.GetUnclaimedTasksResponse, error) {
+					return &circleci_client.GetUnclaimedTasksResponse{
+						HTTPResponse: &http.Response{
+							StatusCode: 200,
+						},
+						JSON200: &circleci_client.UnclaimedTaskCount{
+							UnclaimedTaskCount: intPointer(0),
+						},
+					}, nil
+				},
+			},
+			AsgAwsService: mockAutoScalingGroupsAPI{
+				MockDescribeAutoScalingGroupsAPI: func(ctx context.Context, params *autoscaling.DescribeAutoScalingGroupsInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+					return &autoscaling.DescribeAutoScalingGroupsOutput{
+						AutoScalingGroups: []types.AutoScalingGroup{
+							{
+								AutoScalingGroupName: stringPointer("vela-games/resource-class"),
+								Tags: []types.TagDescription{
+									{
+										Key:   stringPointer("resource-class"),
+										Value: stringPointer("vela-games/resource-class"),
+									},
+								},
+							},
+						},
+					}, nil
+				},
+			},
+		}
+
+		discovery.Handle(context.TODO())
+		sc := dispatcher.Workers[0].(*workers.AWSScalingWorker)
+		assert.Equal(t, time.Minute, sc.Cooldown)
+
+		discovery.Reconfigure(&config.Configuration{
+			AwsScaleOutCooldown: time.Minute,
+			AwsRunnerMatch:      "tag:Name",
+			ResourceClasses: map[string]config.ResourceClassConfiguration{
+				"vela-games/resource-class": {
+					Cooldown: &config.Duration{Duration: 5 * time.Minute},
+				},
+			},
+		})
+		discovery.Handle(context.TODO())
+		sc.Handle(context.TODO())
+
+		assert.Equal(t, 1, dispatcher.Count)
+		assert.Equal(t, 5*time.Minute, sc.Cooldown)
+		assert.Equal(t, workers.MatchTag, sc.Matcher.Mode)
+	})
+
 }
@@ -0,0 +1,357 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	circleci_client "github.com/vela-games/circleci-runner-autoscaler/client"
+	"github.com/vela-games/circleci-runner-autoscaler/services"
+)
+
+const (
+	DefaultDrainHookName = "circleci-runner-drain"
+
+	// RunnerStateTag is set by a runner on its own instance, "idle" once it finished a task and "busy" when it
+	// takes one, so its instance can be let go while other tasks of the resource class are running
+	RunnerStateTag  = "runner-state"
+	runnerStateIdle = "idle"
+
+	terminatingTransition = "autoscaling:EC2_INSTANCE_TERMINATING"
+	lifecycleContinue     = "CONTINUE"
+)
+
+// AWSDrainWorker puts a termination lifecycle hook on the runner ASGs, and holds the instances in Terminating:Wait
+// until their runner is known to be idle, so scale-ins and rebalancing don't kill the CI tasks running on them. After MaxWait
+// the instance is let go either way.
+type AWSDrainWorker struct {
+	// ASGs are drained in every target, if there are none AsgAwsService and Ec2AwsService are used
+	Targets        []services.AutoScalingTarget
+	AsgAwsService  services.AutoScalingAPI
+	Ec2AwsService  services.EC2API
+	CircleCiClient circleci_client.ClientWithResponsesInterface
+	// How runners are matched to instances, by instance id if not set. The EC2 client of each target is used.
+	Matcher *RunnerMatcher
+
+	// Resource class namespace whose ASGs are drained
+	Namespace string
+	// Lifecycle hook put on the ASGs, DefaultDrainHookName if not set
+	HookName string
+	// Instances are let go if the autoscaler doesn't check on them for this long, 5 minutes if not set
+	HeartbeatTimeout time.Duration
+	// Longest an instance waits for its runner to finish, the ASG can't hold it for more than 48 hours
+	MaxWait time.Duration
+
+	TimestampGenerator func() int64
+
+	// Only decide which instances to let go, without touching the ASGs
+	DryRun bool
+
+	// ASGs the hook is known to be on, and when each instance was first seen waiting
+	hooked   map[string]bool
+	draining map[string]time.Time
+
+	reporter
+}
+
+func (w *AWSDrainWorker) Kind() WorkerKind {
+	return KindJanitor
+}
+
+func (w *AWSDrainWorker) Report() WorkerReport {
+	report := w.snapshot()
+	report.Backend = "aws"
+	report.Target = "default"
+	if len(w.Targets) > 0 {
+		var names []string
+		for _, target := range w.Targets {
+			names = append(names, target.Name)
+		}
+		report.Target = strings.Join(names, ",")
+	}
+	return report
+}
+
+func (w *AWSDrainWorker) Handle(ctx context.Context) {
+	if w.hooked == nil {
+		w.hooked = map[string]bool{}
+		w.draining = map[string]time.Time{}
+	}
+
+	targets := w.Targets
+	if len(targets) == 0 {
+		targets = []services.AutoScalingTarget{
+			{
+				Name:      "default",
+				Client:    w.AsgAwsService,
+				EC2Client: w.Ec2AwsService,
+			},
+		}
+	}
+
+	seen := map[string]bool{}
+	waiting, released := 0, 0
+	for _, target := range targets {
+		groups, err := target.Client.DescribeAutoScalingGroups(ctx, &autoscaling.DescribeAutoScalingGroupsInput{})
+		if err != nil {
+			log.Printf("error getting autoscaling groups from %v: %v", target.Name, err)
+			w.failed("getting autoscaling groups from %v: %v", target.Name, err)
+			// Instances we can't see this time are still draining
+			for instanceID := range w.draining {
+				seen[instanceID] = true
+			}
+			continue
+		}
+
+		for _, group := range groups.AutoScalingGroups {
+			class := groupResourceClass(group)
+			if class == "" || strings.Split(class, "/")[0] != w.Namespace {
+				continue
+			}
+
+			if err := w.ensureHook(ctx, target, group); err != nil {
+				log.Printf("error putting lifecycle hook on %v: %v", aws.ToString(group.AutoScalingGroupName), err)
+				w.failed("putting lifecycle hook on %v: %v", aws.ToString(group.AutoScalingGroupName), err)
+				continue
+			}
+
+			groupWaiting, groupReleased := w.drain(ctx, target, group, class, seen)
+			waiting += groupWaiting
+			released += groupReleased
+		}
+	}
+
+	for instanceID := range w.draining {
+		if !seen[instanceID] {
+			delete(w.draining, instanceID)
+		}
+	}
+
+	if w.DryRun {
+		w.decided("dry run: %v instances waiting for their runner, would let go of %v", waiting, released)
+		return
+	}
+	w.decided("%v instances waiting for their runner, let go of %v", waiting, released)
+}
+
+// ensureHook puts the termination lifecycle hook on the ASG unless it's already there
+func (w *AWSDrainWorker) ensureHook(ctx context.Context, target services.AutoScalingTarget, group types.AutoScalingGroup) error {
+	groupName := aws.ToString(group.AutoScalingGroupName)
+	if w.hooked[target.Name+"/"+groupName] {
+		return nil
+	}
+
+	hooks, err := target.Client.DescribeLifecycleHooks(ctx, &autoscaling.DescribeLifecycleHooksInput{
+		AutoScalingGroupName: aws.String(groupName),
+		LifecycleHookNames:   []string{w.hookName()},
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(hooks.LifecycleHooks) == 0 {
+		log.Printf("putting lifecycle hook %v on %v", w.hookName(), groupName)
+		if w.DryRun {
+			return nil
+		}
+
+		_, err = target.Client.PutLifecycleHook(ctx, &autoscaling.PutLifecycleHookInput{
+			AutoScalingGroupName: aws.String(groupName),
+			LifecycleHookName:    aws.String(w.hookName()),
+			LifecycleTransition:  aws.String(terminatingTransition),
+			HeartbeatTimeout:     aws.Int32(int32(w.heartbeatTimeout().Seconds())),
+			// If the autoscaler is gone the instances are terminated as if there was no hook
+			DefaultResult: aws.String(lifecycleContinue),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	w.hooked[target.Name+"/"+groupName] = true
+	return nil
+}
+
+// drain lets go of the instances of the ASG waiting on the hook whose runner is idle, and keeps the others waiting
+func (w *AWSDrainWorker) drain(ctx context.Context, target services.AutoScalingTarget, group types.AutoScalingGroup, class string, seen map[string]bool) (int, int) {
+	groupName := aws.ToString(group.AutoScalingGroupName)
+	now := w.now()
+
+	var instanceIDs []string
+	for _, instance := range group.Instances {
+		if instance.LifecycleState != types.LifecycleStateTerminatingWait {
+			continue
+		}
+		instanceID := aws.ToString(instance.InstanceId)
+		instanceIDs = append(instanceIDs, instanceID)
+		seen[instanceID] = true
+		if _, ok := w.draining[instanceID]; !ok {
+			w.draining[instanceID] = now
+		}
+	}
+	if len(instanceIDs) == 0 {
+		return 0, 0
+	}
+
+	busy, err := w.busyInstances(ctx, target, class, instanceIDs)
+	if err != nil {
+		log.Printf("error checking the runners of %v, keeping its instances waiting: %v", groupName, err)
+		w.failed("checking the runners of %v: %v", groupName, err)
+		busy = map[string]bool{}
+		for _, instanceID := range instanceIDs {
+			busy[instanceID] = true
+		}
+	}
+
+	released := 0
+	for _, instanceID := range instanceIDs {
+		waited := now.Sub(w.draining[instanceID])
+		if busy[instanceID] && (w.MaxWait <= 0 || waited < w.MaxWait) {
+			log.Printf("%v: instance %v is terminating but its runner is busy, waiting for it", class, instanceID)
+			if !w.DryRun {
+				_, err := target.Client.RecordLifecycleActionHeartbeat(ctx, &autoscaling.RecordLifecycleActionHeartbeatInput{
+					AutoScalingGroupName: aws.String(groupName),
+					LifecycleHookName:    aws.String(w.hookName()),
+					InstanceId:           aws.String(instanceID),
+				})
+				if err != nil {
+					log.Printf("error recording lifecycle heartbeat of %v: %v", instanceID, err)
+					w.failed("recording lifecycle heartbeat of %v: %v", instanceID, err)
+				}
+			}
+			continue
+		}
+
+		if busy[instanceID] {
+			log.Printf("%v: instance %v waited %v for its runner, letting it go", class, instanceID, waited)
+		} else {
+			log.Printf("%v: instance %v has no runner or it's idle, letting it go", class, instanceID)
+		}
+		released++
+		if w.DryRun {
+			continue
+		}
+
+		_, err := target.Client.CompleteLifecycleAction(ctx, &autoscaling.CompleteLifecycleActionInput{
+			AutoScalingGroupName:  aws.String(groupName),
+			LifecycleHookName:     aws.String(w.hookName()),
+			InstanceId:            aws.String(instanceID),
+			LifecycleActionResult: aws.String(lifecycleContinue),
+		})
+		if err != nil {
+			log.Printf("error completing lifecycle action of %v: %v", instanceID, err)
+			w.failed("completing lifecycle action of %v: %v", instanceID, err)
+			released--
+			continue
+		}
+		delete(w.draining, instanceID)
+	}
+
+	return len(instanceIDs), released
+}
+
+// busyInstances returns which of the instances may have a runner running a task. Instances without a runner are
+// let go right away, but CircleCI only tells how many tasks of the resource class are running, so while any is
+// running instances with a runner are held until it says it's idle.
+func (w *AWSDrainWorker) busyInstances(ctx context.Context, target services.AutoScalingTarget, class string, instanceIDs []string) (map[string]bool, error) {
+	running, err := runningTasks(ctx, w.CircleCiClient, class)
+	if err != nil {
+		return nil, err
+	}
+
+	busy := map[string]bool{}
+	if running == 0 {
+		return busy, nil
+	}
+
+	runners, err := classRunners(ctx, w.CircleCiClient, class)
+	if err != nil {
+		return nil, err
+	}
+
+	matcher := &RunnerMatcher{Ec2AwsService: target.EC2Client}
+	if w.Matcher != nil {
+		matcher.Mode = w.Matcher.Mode
+		matcher.TagKey = w.Matcher.TagKey
+	}
+	names, err := matcher.instanceNames(ctx, instanceIDs)
+	if err != nil {
+		return nil, fmt.Errorf("describing instances: %w", err)
+	}
+
+	var withRunner []string
+	for _, instanceID := range instanceIDs {
+		for _, runner := range runners {
+			if matchesAny(runner, names[instanceID]) {
+				busy[instanceID] = true
+				withRunner = append(withRunner, instanceID)
+				break
+			}
+		}
+	}
+	if len(withRunner) == 0 || target.EC2Client == nil {
+		return busy, nil
+	}
+
+	paginator := ec2.NewDescribeInstancesPaginator(target.EC2Client, &ec2.DescribeInstancesInput{
+		InstanceIds: withRunner,
+	})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("describing instances: %w", err)
+		}
+		for _, reservation := range output.Reservations {
+			for _, instance := range reservation.Instances {
+				if runnerIdle(instance.Tags) {
+					delete(busy, aws.ToString(instance.InstanceId))
+				}
+			}
+		}
+	}
+	return busy, nil
+}
+
+// runnerIdle tells if the runner of an instance with the tags said it's not running a task
+func runnerIdle(tags []ec2types.Tag) bool {
+	for _, tag := range tags {
+		if aws.ToString(tag.Key) == RunnerStateTag {
+			return aws.ToString(tag.Value) == runnerStateIdle
+		}
+	}
+	return false
+}
+
+func (w *AWSDrainWorker) hookName() string {
+	if w.HookName == "" {
+		return DefaultDrainHookName
+	}
+	return w.HookName
+}
+
+func (w *AWSDrainWorker) heartbeatTimeout() time.Duration {
+	// AWS takes between 30 seconds and 2 hours
+	switch {
+	case w.HeartbeatTimeout <= 0:
+		return 5 * time.Minute
+	case w.HeartbeatTimeout < 30*time.Second:
+		return 30 * time.Second
+	case w.HeartbeatTimeout > 2*time.Hour:
+		return 2 * time.Hour
+	}
+	return w.HeartbeatTimeout
+}
+
+func (w *AWSDrainWorker) now() time.Time {
+	if w.TimestampGenerator != nil {
+		return time.Unix(w.TimestampGenerator(), 0)
+	}
+	return time.Now()
+}
@@ -0,0 +1,259 @@
+package workers_test
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	circleci_client "github.com/vela-games/circleci-runner-autoscaler/client"
+	"github.com/vela-games/circleci-runner-autoscaler/workers"
+	"gotest.tools/v3/assert"
+)
+
+// drainingASG records what the drain worker does to the lifecycle hook of the runners ASG
+type drainingASG struct {
+	hooks      []string
+	described  int
+	heartbeats []string
+	completed  []string
+}
+
+func (a *drainingASG) client(states map[string]types.LifecycleState) *mockAutoScalingGroupsAPI {
+	return &mockAutoScalingGroupsAPI{
+		MockDescribeAutoScalingGroupsAPI: func(ctx context.Context, params *autoscaling.DescribeAutoScalingGroupsInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+			group := types.AutoScalingGroup{
+				AutoScalingGroupName: stringPointer("vela-games/runners"),
+				Tags:                 []types.TagDescription{{Key: stringPointer("resource-class"), Value: stringPointer("vela-games/runners")}},
+			}
+			for instanceID, state := range states {
+				group.Instances = append(group.Instances, types.Instance{InstanceId: stringPointer(instanceID), LifecycleState: state})
+			}
+			return &autoscaling.DescribeAutoScalingGroupsOutput{AutoScalingGroups: []types.AutoScalingGroup{
+				group,
+				{
+					AutoScalingGroupName: stringPointer("other-namespace/runners"),
+					Tags:                 []types.TagDescription{{Key: stringPointer("resource-class"), Value: stringPointer("other-namespace/runners")}},
+				},
+			}}, nil
+		},
+		MockDescribeLifecycleHooksAPI: func(ctx context.Context, params *autoscaling.DescribeLifecycleHooksInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeLifecycleHooksOutput, error) {
+			a.described++
+			output := &autoscaling.DescribeLifecycleHooksOutput{}
+			for _, hook := range a.hooks {
+				output.LifecycleHooks = append(output.LifecycleHooks, types.LifecycleHook{LifecycleHookName: stringPointer(hook)})
+			}
+			return output, nil
+		},
+		MockPutLifecycleHookAPI: func(ctx context.Context, params *autoscaling.PutLifecycleHookInput, optFns ...func(*autoscaling.Options)) (*autoscaling.PutLifecycleHookOutput, error) {
+			a.hooks = append(a.hooks, *params.AutoScalingGroupName+"/"+*params.LifecycleHookName+"/"+*params.LifecycleTransition)
+			return &autoscaling.PutLifecycleHookOutput{}, nil
+		},
+		MockRecordLifecycleActionHeartbeatAPI: func(ctx context.Context, params *autoscaling.RecordLifecycleActionHeartbeatInput, optFns ...func(*autoscaling.Options)) (*autoscaling.RecordLifecycleActionHeartbeatOutput, error) {
+			a.heartbeats = append(a.heartbeats, *params.InstanceId)
+			return &autoscaling.RecordLifecycleActionHeartbeatOutput{}, nil
+		},
+		MockCompleteLifecycleActionAPI: func(ctx context.Context, params *autoscaling.CompleteLifecycleActionInput, optFns ...func(*autoscaling.Options)) (*autoscaling.CompleteLifecycleActionOutput, error) {
+			a.completed = append(a.completed, *params.InstanceId)
+			return &autoscaling.CompleteLifecycleActionOutput{}, nil
+		},
+	}
+}
+
+// drainCircleCiClient has the given running tasks, and a runner for every instance last used at the given time
+func drainCircleCiClient(running int, lastUsed map[string]time.Time) *mockCircleCiClient {
+	client := poolCircleCiClient(0, running)
+	client.MockGetRunnersWithResponse = func(ctx context.Context, params *circleci_client.GetRunnersParams, reqEditors ...circleci_client.RequestEditorFn) (*circleci_client.GetRunnersResponse, error) {
+		var runners []circleci_client.Agent
+		for instanceID, used := range lastUsed {
+			used := used
+			runners = append(runners, circleci_client.Agent{Name: stringPointer(instanceID), LastUsed: &used})
+		}
+		return &circleci_client.GetRunnersResponse{
+			HTTPResponse: &http.Response{StatusCode: 200},
+			JSON200:      &circleci_client.AgentList{Items: &runners},
+		}, nil
+	}
+	return client
+}
+
+// runnerStates returns an EC2 client whose instances have the given runner-state tag, none if it's empty
+func runnerStates(states map[string]string) mockEC2API {
+	return mockEC2API{
+		MockDescribeInstancesAPI: func(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+			reservation := ec2types.Reservation{}
+			for _, instanceID := range params.InstanceIds {
+				instance := ec2types.Instance{InstanceId: stringPointer(instanceID)}
+				if state := states[instanceID]; state != "" {
+					instance.Tags = []ec2types.Tag{{Key: stringPointer(workers.RunnerStateTag), Value: stringPointer(state)}}
+				}
+				reservation.Instances = append(reservation.Instances, instance)
+			}
+			return &ec2.DescribeInstancesOutput{Reservations: []ec2types.Reservation{reservation}}, nil
+		},
+	}
+}
+
+func TestAWSDrainWorker(t *testing.T) {
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+
+	t.Run("it should put the lifecycle hook on the runner ASGs once", func(t *testing.T) {
+		asg := &drainingASG{}
+		worker := &workers.AWSDrainWorker{
+			AsgAwsService:  asg.client(nil),
+			CircleCiClient: poolCircleCiClient(0, 0),
+			Namespace:      "vela-games",
+		}
+		worker.Handle(context.TODO())
+		worker.Handle(context.TODO())
+
+		assert.DeepEqual(t, []string{"vela-games/runners/circleci-runner-drain/autoscaling:EC2_INSTANCE_TERMINATING"}, asg.hooks)
+		assert.Equal(t, 1, asg.described)
+	})
+
+	t.Run("it should let go of instances with idle runners", func(t *testing.T) {
+		asg := &drainingASG{hooks: []string{"circleci-runner-drain"}}
+		worker := &workers.AWSDrainWorker{
+			AsgAwsService: asg.client(map[string]types.LifecycleState{
+				"i-laiCh3oo": types.LifecycleStateTerminatingWait,
+				"i-As0iugan": types.LifecycleStateInService,
+			}),
+			CircleCiClient: poolCircleCiClient(0, 0),
+			Namespace:      "vela-games",
+		}
+		worker.Handle(context.TODO())
+
+		assert.DeepEqual(t, []string{"i-laiCh3oo"}, asg.completed)
+		assert.Equal(t, 0, len(asg.heartbeats))
+		assert.Equal(t, "1 instances waiting for their runner, let go of 1", worker.Report().LastDecision)
+	})
+
+	t.Run("it should only let go of instances whose runner says it's idle while tasks are running", func(t *testing.T) {
+		asg := &drainingASG{hooks: []string{"circleci-runner-drain"}}
+		worker := &workers.AWSDrainWorker{
+			AsgAwsService: asg.client(map[string]types.LifecycleState{
+				"i-laiCh3oo": types.LifecycleStateTerminatingWait,
+				"i-As0iugan": types.LifecycleStateTerminatingWait,
+				"i-Eiph6ahm": types.LifecycleStateTerminatingWait,
+				"i-Oosh5eij": types.LifecycleStateTerminatingWait,
+				"i-Qui6josh": types.LifecycleStateInService,
+			}),
+			Ec2AwsService: runnerStates(map[string]string{
+				"i-As0iugan": "idle",
+				"i-Eiph6ahm": "busy",
+			}),
+			// One task running, CircleCI doesn't tell on which runner. i-Oosh5eij never got a runner.
+			CircleCiClient: drainCircleCiClient(1, map[string]time.Time{
+				"i-laiCh3oo": now,
+				"i-As0iugan": now,
+				"i-Eiph6ahm": now,
+				"i-Qui6josh": now,
+			}),
+			Namespace: "vela-games",
+		}
+		worker.Handle(context.TODO())
+
+		sort.Strings(asg.completed)
+		assert.DeepEqual(t, []string{"i-As0iugan", "i-Oosh5eij"}, asg.completed)
+		sort.Strings(asg.heartbeats)
+		assert.DeepEqual(t, []string{"i-Eiph6ahm", "i-laiCh3oo"}, asg.heartbeats)
+	})
+
+	t.Run("it should let go of busy instances after the max wait", func(t *testing.T) {
+		asg := &drainingASG{hooks: []string{"circleci-runner-drain"}}
+		clock := now
+		worker := &workers.AWSDrainWorker{
+			AsgAwsService: asg.client(map[string]types.LifecycleState{
+				"i-laiCh3oo": types.LifecycleStateTerminatingWait,
+			}),
+			CircleCiClient:     drainCircleCiClient(1, map[string]time.Time{"i-laiCh3oo": now}),
+			Namespace:          "vela-games",
+			MaxWait:            time.Hour,
+			TimestampGenerator: func() int64 { return clock.Unix() },
+		}
+		worker.Handle(context.TODO())
+		assert.Equal(t, 0, len(asg.completed))
+
+		clock = now.Add(61 * time.Minute)
+		worker.Handle(context.TODO())
+		assert.DeepEqual(t, []string{"i-laiCh3oo"}, asg.completed)
+	})
+
+	t.Run("it should let the ASG scale out while an instance waits for its runner", func(t *testing.T) {
+		asg := &drainingASG{hooks: []string{"circleci-runner-drain"}}
+		client := asg.client(map[string]types.LifecycleState{
+			"i-laiCh3oo": types.LifecycleStateTerminatingWait,
+			"i-As0iugan": types.LifecycleStateInService,
+		})
+		describe := client.MockDescribeAutoScalingGroupsAPI
+		client.MockDescribeAutoScalingGroupsAPI = func(ctx context.Context, params *autoscaling.DescribeAutoScalingGroupsInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+			output, err := describe(ctx, params, optFns...)
+			output.AutoScalingGroups[0].DesiredCapacity = int32Pointer(1)
+			output.AutoScalingGroups[0].MinSize = int32Pointer(0)
+			output.AutoScalingGroups[0].MaxSize = int32Pointer(10)
+			return output, err
+		}
+		// The termination of the drained instance stays in progress while it waits
+		client.MockDescribeScalingActivitiesAPI = func(ctx context.Context, params *autoscaling.DescribeScalingActivitiesInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeScalingActivitiesOutput, error) {
+			return &autoscaling.DescribeScalingActivitiesOutput{
+				Activities: []types.Activity{
+					{
+						Description: stringPointer("Terminating EC2 instance: i-laiCh3oo"),
+						StatusCode:  types.ScalingActivityStatusCodeMidLifecycleAction,
+						StartTime:   &now,
+					},
+					{
+						Description: stringPointer("Launching a new EC2 instance: i-As0iugan"),
+						StatusCode:  types.ScalingActivityStatusCodeSuccessful,
+						StartTime:   &now,
+					},
+				},
+			}, nil
+		}
+		var desired []int32
+		client.MockSetDesiredCapacityAPI = func(ctx context.Context, params *autoscaling.SetDesiredCapacityInput, optFns ...func(*autoscaling.Options)) (*autoscaling.SetDesiredCapacityOutput, error) {
+			desired = append(desired, *params.DesiredCapacity)
+			return &autoscaling.SetDesiredCapacityOutput{}, nil
+		}
+
+		circleCiClient := poolCircleCiClient(1, 1)
+		circleCiClient.MockGetRunnersWithResponse = drainCircleCiClient(1, map[string]time.Time{"i-laiCh3oo": now}).MockGetRunnersWithResponse
+		drain := &workers.AWSDrainWorker{
+			AsgAwsService:  client,
+			CircleCiClient: circleCiClient,
+			Namespace:      "vela-games",
+		}
+		scaling := &workers.AWSScalingWorker{
+			ResourceClass:  "vela-games/runners",
+			AsgAwsService:  client,
+			CircleCiClient: circleCiClient,
+		}
+		drain.Handle(context.TODO())
+		scaling.Handle(context.TODO())
+
+		assert.DeepEqual(t, []string{"i-laiCh3oo"}, asg.heartbeats)
+		assert.DeepEqual(t, []int32{2}, desired)
+	})
+
+	t.Run("it should not touch the ASGs in dry run", func(t *testing.T) {
+		asg := &drainingASG{}
+		worker := &workers.AWSDrainWorker{
+			AsgAwsService: asg.client(map[string]types.LifecycleState{
+				"i-laiCh3oo": types.LifecycleStateTerminatingWait,
+			}),
+			CircleCiClient: poolCircleCiClient(0, 0),
+			Namespace:      "vela-games",
+			DryRun:         true,
+		}
+		worker.Handle(context.TODO())
+
+		assert.Equal(t, 0, len(asg.hooks))
+		assert.Equal(t, 0, len(asg.completed))
+		assert.Equal(t, "dry run: 1 instances waiting for their runner, would let go of 1", worker.Report().LastDecision)
+	})
+}
@@ -0,0 +1,448 @@
+package workers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/vela-games/circleci-runner-autoscaler/budget"
+	"github.com/vela-games/circleci-runner-autoscaler/services"
+)
+
+type InterruptionKind string
+
+const (
+	// EC2 takes the spot instance back in two minutes
+	InterruptionSpot InterruptionKind = "EC2 Spot Instance Interruption Warning"
+	// The spot instance is at elevated risk of being interrupted
+	InterruptionRebalance InterruptionKind = "EC2 Instance Rebalance Recommendation"
+)
+
+// EC2 tags the instances of an ASG with its name
+const asgNameTag = "aws:autoscaling:groupName"
+
+// Interruption is an instance EC2 warned about
+type Interruption struct {
+	InstanceID string
+	Kind       InterruptionKind
+	At         time.Time
+	// It was detached from its ASG for the ASG to launch a replacement
+	Replaced bool
+}
+
+// Interruptions tracks the instances that are about to be taken back by EC2. It's filled by the
+// AWSInterruptionWorker and read by the runner matchers, so interrupted instances don't count as ready capacity.
+type Interruptions struct {
+	// How long an interruption is remembered, the instance is gone by then. 30 minutes if not set.
+	TTL time.Duration
+
+	mu        sync.Mutex
+	instances map[string]*Interruption
+}
+
+// Record adds an interruption of the instance, it keeps the first one if EC2 warned more than once
+func (i *Interruptions) Record(instanceID string, kind InterruptionKind, at time.Time) Interruption {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.expire()
+
+	if interruption, ok := i.instances[instanceID]; ok {
+		return *interruption
+	}
+	interruption := &Interruption{InstanceID: instanceID, Kind: kind, At: at}
+	i.instances[instanceID] = interruption
+	return *interruption
+}
+
+// Replaced records that a replacement of the instance was asked for
+func (i *Interruptions) Replaced(instanceID string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if interruption, ok := i.instances[instanceID]; ok {
+		interruption.Replaced = true
+	}
+}
+
+// Interrupted returns whether EC2 warned about the instance, it's safe to call on a nil Interruptions
+func (i *Interruptions) Interrupted(instanceID string) bool {
+	if i == nil {
+		return false
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.expire()
+
+	_, ok := i.instances[instanceID]
+	return ok
+}
+
+func (i *Interruptions) expire() {
+	if i.instances == nil {
+		i.instances = map[string]*Interruption{}
+	}
+
+	ttl := i.TTL
+	if ttl <= 0 {
+		ttl = 30 * time.Minute
+	}
+	for id, interruption := range i.instances {
+		if time.Since(interruption.At) > ttl {
+			delete(i.instances, id)
+		}
+	}
+}
+
+// ec2Event is the part of the EventBridge events of EC2 we need
+type ec2Event struct {
+	DetailType string    `json:"detail-type"`
+	Time       time.Time `json:"time"`
+	Detail     struct {
+		InstanceID string `json:"instance-id"`
+	} `json:"detail"`
+}
+
+// AWSInterruptionWorker reads the spot interruption warnings and rebalance recommendations EventBridge sends to an
+// SQS queue. Instances about to be interrupted are detached from their ASG without lowering its desired capacity,
+// so the ASG launches their replacement right away instead of once the instance is gone, and the desired capacity
+// is back to what it was when EC2 takes the instance. Instances only at risk of interruption are left to the
+// capacity rebalancing of their ASG, but like the interrupted ones their runners aren't counted as ready anymore.
+type AWSInterruptionWorker struct {
+	QueueURL  string
+	SQSClient services.SQSAPI
+	// How long to wait for messages on every tick, up to 20 seconds
+	WaitTime time.Duration
+
+	// Interrupted instances are looked for in every target, if there are none in the default clients
+	Targets       []services.AutoScalingTarget
+	AsgAwsService services.AutoScalingAPI
+	Ec2AwsService services.EC2API
+
+	Interruptions *Interruptions
+
+	// Optional, replacements only overlap with the instances they replace if the budget has room for them
+	Budget *budget.Budget
+
+	// Only record the interruptions, without changing any ASG
+	DryRun bool
+
+	// Target of the detached instances charged to the budget, until EC2 terminates them
+	detached map[string]string
+
+	reporter
+}
+
+func (w *AWSInterruptionWorker) Kind() WorkerKind {
+	return KindScaling
+}
+
+func (w *AWSInterruptionWorker) Report() WorkerReport {
+	report := w.snapshot()
+	report.Backend = "aws"
+	report.Target = w.QueueURL
+	return report
+}
+
+func (w *AWSInterruptionWorker) Handle(ctx context.Context) {
+	if len(w.detached) > 0 {
+		w.releaseDetached(ctx)
+	}
+
+	messages, err := w.SQSClient.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(w.QueueURL),
+		MaxNumberOfMessages: 10,
+		WaitTimeSeconds:     int32(w.WaitTime.Seconds()),
+	})
+	if err != nil {
+		log.Printf("error receiving interruption events from %v: %v", w.QueueURL, err)
+		w.failed("receiving interruption events: %v", err)
+		return
+	}
+
+	if len(messages.Messages) == 0 {
+		w.decided("no interruption events")
+		return
+	}
+
+	// Messages are deleted once their instance is taken care of, the rest are received again to retry them
+	receipts := map[string][]string{}
+	var done []string
+	for _, message := range messages.Messages {
+		var event ec2Event
+		if err := json.Unmarshal([]byte(aws.ToString(message.Body)), &event); err != nil || event.Detail.InstanceID == "" {
+			log.Printf("ignoring message %v that isn't an EC2 instance event: %v", aws.ToString(message.MessageId), err)
+			done = append(done, aws.ToString(message.ReceiptHandle))
+			continue
+		}
+
+		kind := InterruptionKind(event.DetailType)
+		if kind != InterruptionSpot && kind != InterruptionRebalance {
+			log.Printf("ignoring %v event of instance %v", event.DetailType, event.Detail.InstanceID)
+			done = append(done, aws.ToString(message.ReceiptHandle))
+			continue
+		}
+
+		if event.Time.IsZero() {
+			event.Time = time.Now()
+		}
+		interruption := w.Interruptions.Record(event.Detail.InstanceID, kind, event.Time)
+		log.Printf("instance %v: %v", event.Detail.InstanceID, kind)
+		if interruption.Replaced || kind == InterruptionRebalance {
+			done = append(done, aws.ToString(message.ReceiptHandle))
+			continue
+		}
+		receipts[event.Detail.InstanceID] = append(receipts[event.Detail.InstanceID], aws.ToString(message.ReceiptHandle))
+	}
+
+	replaced, failed := 0, 0
+	if len(receipts) > 0 {
+		var instanceIDs []string
+		for instanceID := range receipts {
+			instanceIDs = append(instanceIDs, instanceID)
+		}
+
+		handled := w.replace(ctx, instanceIDs)
+		for instanceID, wasReplaced := range handled {
+			if wasReplaced {
+				replaced++
+			}
+			done = append(done, receipts[instanceID]...)
+		}
+		failed = len(instanceIDs) - len(handled)
+	}
+
+	if w.DryRun {
+		w.decided("dry run: %v interruption events, would replace %v instances", len(messages.Messages), replaced)
+		return
+	}
+
+	for _, receipt := range done {
+		if _, err := w.SQSClient.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+			QueueUrl:      aws.String(w.QueueURL),
+			ReceiptHandle: aws.String(receipt),
+		}); err != nil {
+			log.Printf("error deleting interruption event from %v: %v", w.QueueURL, err)
+		}
+	}
+	w.decided("%v interruption events, replaced %v instances, %v to retry", len(messages.Messages), replaced, failed)
+}
+
+// replace detaches the interrupted instances still InService from their ASG. It returns the instances that were
+// handled, whether they needed a replacement or not, so failed ones are retried.
+func (w *AWSInterruptionWorker) replace(ctx context.Context, instanceIDs []string) map[string]bool {
+	handled := map[string]bool{}
+	found := map[string]bool{}
+	complete := true
+	for _, target := range w.targets() {
+		// Filtering instead of asking for the ids doesn't fail on instances of other targets
+		output, err := target.EC2Client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+			Filters: []ec2types.Filter{
+				{Name: aws.String("instance-id"), Values: instanceIDs},
+			},
+		})
+		if err != nil {
+			log.Printf("error describing interrupted instances in %v: %v", target.Name, err)
+			w.failed("describing interrupted instances in %v: %v", target.Name, err)
+			complete = false
+			continue
+		}
+
+		groups := map[string][]string{}
+		for _, reservation := range output.Reservations {
+			for _, instance := range reservation.Instances {
+				instanceID := aws.ToString(instance.InstanceId)
+				found[instanceID] = true
+				group := ""
+				for _, tag := range instance.Tags {
+					if aws.ToString(tag.Key) == asgNameTag {
+						group = aws.ToString(tag.Value)
+					}
+				}
+				if group == "" {
+					log.Printf("interrupted instance %v isn't in an ASG, nothing to replace", instanceID)
+					handled[instanceID] = false
+					continue
+				}
+				groups[group] = append(groups[group], instanceID)
+			}
+		}
+
+		for group, groupInstances := range groups {
+			w.replaceInGroup(ctx, target, group, groupInstances, handled)
+		}
+	}
+
+	// Instances no target knows about are already gone, unless we couldn't look in every target
+	if complete {
+		for _, instanceID := range instanceIDs {
+			if !found[instanceID] {
+				handled[instanceID] = false
+			}
+		}
+	}
+
+	return handled
+}
+
+func (w *AWSInterruptionWorker) replaceInGroup(ctx context.Context, target services.AutoScalingTarget, groupName string, instanceIDs []string, handled map[string]bool) {
+	asg, err := target.Client.DescribeAutoScalingGroups(ctx, &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: []string{groupName},
+	})
+	if err != nil || len(asg.AutoScalingGroups) == 0 {
+		log.Printf("error describing ASG %v of interrupted instances: %v", groupName, err)
+		w.failed("describing ASG %v of interrupted instances: %v", groupName, err)
+		return
+	}
+	group := asg.AutoScalingGroups[0]
+
+	// Only InService instances can be detached, the others are replaced by the ASG itself once they're gone
+	var replacing []string
+	instanceType := ""
+	for _, instanceID := range instanceIDs {
+		handled[instanceID] = false
+		for _, instance := range group.Instances {
+			if aws.ToString(instance.InstanceId) == instanceID && instance.LifecycleState == types.LifecycleStateInService {
+				replacing = append(replacing, instanceID)
+				instanceType = aws.ToString(instance.InstanceType)
+				delete(handled, instanceID)
+			}
+		}
+	}
+
+	if len(replacing) == 0 {
+		return
+	}
+
+	// The replacements run next to the interrupted instances until EC2 takes them, so they need room in the budget
+	if class := groupResourceClass(group); w.Budget != nil && class != "" {
+		current := *group.DesiredCapacity
+		granted := w.Budget.Claim(class, groupName, current, current+int32(len(replacing)), w.Budget.Weight(class, instanceType))
+		if extra := int(granted - current); extra < len(replacing) {
+			log.Printf("budget exhausted, leaving interrupted instances %v of %v to the ASG", replacing[extra:], groupName)
+			for _, instanceID := range replacing[extra:] {
+				handled[instanceID] = false
+			}
+			replacing = replacing[:extra]
+			if extra == 0 {
+				return
+			}
+		}
+	}
+
+	log.Printf("replacing interrupted instances %v, detaching them from %v", replacing, groupName)
+	if w.DryRun {
+		w.updateBudget(group, instanceType)
+	} else {
+		_, err = target.Client.DetachInstances(ctx, &autoscaling.DetachInstancesInput{
+			AutoScalingGroupName:           aws.String(groupName),
+			InstanceIds:                    replacing,
+			ShouldDecrementDesiredCapacity: aws.Bool(false),
+		})
+		if err != nil {
+			log.Printf("error detaching interrupted instances from %v: %v", groupName, err)
+			w.failed("detaching interrupted instances from %v: %v", groupName, err)
+			w.updateBudget(group, instanceType)
+			return
+		}
+	}
+
+	// The ASG is back to its desired capacity with the replacements, the detached instances are charged on their own
+	if class := groupResourceClass(group); w.Budget != nil && class != "" && !w.DryRun {
+		weight := w.Budget.Weight(class, instanceType)
+		w.Budget.Update(class, groupName, *group.DesiredCapacity, weight)
+		for _, instanceID := range replacing {
+			w.Budget.Detach(class, instanceID, weight)
+			if w.detached == nil {
+				w.detached = map[string]string{}
+			}
+			w.detached[instanceID] = target.Name
+		}
+	}
+
+	for _, instanceID := range replacing {
+		if !w.DryRun {
+			w.Interruptions.Replaced(instanceID)
+		}
+		handled[instanceID] = true
+	}
+}
+
+// releaseDetached gives back the budget of the detached instances EC2 terminated
+func (w *AWSInterruptionWorker) releaseDetached(ctx context.Context) {
+	for _, target := range w.targets() {
+		var instanceIDs []string
+		for instanceID, targetName := range w.detached {
+			if targetName == target.Name {
+				instanceIDs = append(instanceIDs, instanceID)
+			}
+		}
+		if len(instanceIDs) == 0 {
+			continue
+		}
+
+		output, err := target.EC2Client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+			Filters: []ec2types.Filter{
+				{Name: aws.String("instance-id"), Values: instanceIDs},
+			},
+		})
+		if err != nil {
+			log.Printf("error describing detached instances in %v: %v", target.Name, err)
+			continue
+		}
+
+		running := map[string]bool{}
+		for _, reservation := range output.Reservations {
+			for _, instance := range reservation.Instances {
+				if instance.State == nil || (instance.State.Name != ec2types.InstanceStateNameTerminated && instance.State.Name != ec2types.InstanceStateNameShuttingDown) {
+					running[aws.ToString(instance.InstanceId)] = true
+				}
+			}
+		}
+		for _, instanceID := range instanceIDs {
+			if !running[instanceID] {
+				log.Printf("detached instance %v is gone, releasing its budget", instanceID)
+				w.Budget.Release(instanceID)
+				delete(w.detached, instanceID)
+			}
+		}
+	}
+}
+
+func (w *AWSInterruptionWorker) targets() []services.AutoScalingTarget {
+	if len(w.Targets) > 0 {
+		return w.Targets
+	}
+	return []services.AutoScalingTarget{
+		{
+			Name:      "default",
+			Client:    w.AsgAwsService,
+			EC2Client: w.Ec2AwsService,
+		},
+	}
+}
+
+// updateBudget gives back what was claimed for the replacements of the instances of the group
+func (w *AWSInterruptionWorker) updateBudget(group types.AutoScalingGroup, instanceType string) {
+	if class := groupResourceClass(group); w.Budget != nil && class != "" {
+		w.Budget.Update(class, aws.ToString(group.AutoScalingGroupName), *group.DesiredCapacity, w.Budget.Weight(class, instanceType))
+	}
+}
+
+// groupResourceClass returns the resource class in the resource-class tag of the ASG, empty if it has none
+func groupResourceClass(group types.AutoScalingGroup) string {
+	for _, tag := range group.Tags {
+		if aws.ToString(tag.Key) == resourceClassTagKey {
+			return aws.ToString(tag.Value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,304 @@
+package workers_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/vela-games/circleci-runner-autoscaler/budget"
+	circleci_client "github.com/vela-games/circleci-runner-autoscaler/client"
+	"github.com/vela-games/circleci-runner-autoscaler/workers"
+	"gotest.tools/v3/assert"
+)
+
+// fakeSQS is a queue whose messages stay in it until they're deleted, like SQS once the visibility timeout is over
+type fakeSQS struct {
+	messages map[string]string
+	received int
+}
+
+func (q *fakeSQS) send(body string) {
+	if q.messages == nil {
+		q.messages = map[string]string{}
+	}
+	q.messages[fmt.Sprintf("receipt-%v", len(q.messages))] = body
+}
+
+func (q *fakeSQS) ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	q.received++
+	output := &sqs.ReceiveMessageOutput{}
+	for receipt, body := range q.messages {
+		output.Messages = append(output.Messages, sqstypes.Message{
+			MessageId:     stringPointer("message-" + receipt),
+			ReceiptHandle: stringPointer(receipt),
+			Body:          stringPointer(body),
+		})
+	}
+	return output, nil
+}
+
+func (q *fakeSQS) DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+	delete(q.messages, *params.ReceiptHandle)
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func interruptionEvent(detailType string, instanceID string) string {
+	return fmt.Sprintf(`{"version":"0","detail-type":%q,"source":"aws.ec2","region":"eu-west-1","time":"2026-10-19T10:00:00Z","detail":{"instance-id":%q,"instance-action":"terminate"}}`, detailType, instanceID)
+}
+
+// runnerInstances serves the instances of the runners ASG, and the ASG with the given lifecycle states. It returns
+// the instances detached from the ASG, which keep running until they're removed from it.
+func runnerInstances(t *testing.T, desired int32, states map[string]types.LifecycleState) (mockEC2API, *mockAutoScalingGroupsAPI, *[]string) {
+	var detached []string
+	ec2Client := mockEC2API{
+		MockDescribeInstancesAPI: func(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+			reservation := ec2types.Reservation{}
+			for _, filter := range params.Filters {
+				for _, instanceID := range filter.Values {
+					for _, detachedID := range detached {
+						if detachedID == instanceID {
+							reservation.Instances = append(reservation.Instances, ec2types.Instance{
+								InstanceId: stringPointer(instanceID),
+								State:      &ec2types.InstanceState{Name: ec2types.InstanceStateNameRunning},
+							})
+						}
+					}
+					if _, ok := states[instanceID]; !ok {
+						continue
+					}
+					reservation.Instances = append(reservation.Instances, ec2types.Instance{
+						InstanceId: stringPointer(instanceID),
+						Tags: []ec2types.Tag{
+							{Key: stringPointer("aws:autoscaling:groupName"), Value: stringPointer("vela-games/runners")},
+						},
+					})
+				}
+			}
+			return &ec2.DescribeInstancesOutput{Reservations: []ec2types.Reservation{reservation}}, nil
+		},
+	}
+
+	asgClient := &mockAutoScalingGroupsAPI{
+		MockDescribeAutoScalingGroupsAPI: func(ctx context.Context, params *autoscaling.DescribeAutoScalingGroupsInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+			group := types.AutoScalingGroup{
+				AutoScalingGroupName: stringPointer("vela-games/runners"),
+				DesiredCapacity:      int32Pointer(desired),
+				MaxSize:              int32Pointer(desired),
+				Tags: []types.TagDescription{
+					{Key: stringPointer("resource-class"), Value: stringPointer("vela-games/runners")},
+				},
+			}
+			for instanceID, state := range states {
+				group.Instances = append(group.Instances, types.Instance{InstanceId: stringPointer(instanceID), LifecycleState: state})
+			}
+			return &autoscaling.DescribeAutoScalingGroupsOutput{AutoScalingGroups: []types.AutoScalingGroup{group}}, nil
+		},
+		MockSetDesiredCapacityAPI: func(ctx context.Context, params *autoscaling.SetDesiredCapacityInput, optFns ...func(*autoscaling.Options)) (*autoscaling.SetDesiredCapacityOutput, error) {
+			t.Error("SetDesiredCapacity was called")
+			return &autoscaling.SetDesiredCapacityOutput{}, nil
+		},
+		MockDetachInstancesAPI: func(ctx context.Context, params *autoscaling.DetachInstancesInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DetachInstancesOutput, error) {
+			// The ASG keeps its desired capacity and launches the replacements
+			assert.Equal(t, false, *params.ShouldDecrementDesiredCapacity)
+			for _, instanceID := range params.InstanceIds {
+				delete(states, instanceID)
+				states[instanceID+"-replacement"] = types.LifecycleStatePending
+			}
+			detached = append(detached, params.InstanceIds...)
+			return &autoscaling.DetachInstancesOutput{}, nil
+		},
+	}
+	return ec2Client, asgClient, &detached
+}
+
+func TestAWSInterruptionWorker(t *testing.T) {
+	t.Run("it should replace interrupted instances and not count them as ready", func(t *testing.T) {
+		queue := &fakeSQS{}
+		queue.send(interruptionEvent("EC2 Spot Instance Interruption Warning", "i-laiCh3oo"))
+
+		ec2Client, asgClient, detached := runnerInstances(t, 2, map[string]types.LifecycleState{
+			"i-laiCh3oo": types.LifecycleStateInService,
+			"i-As0iugan": types.LifecycleStateInService,
+		})
+		interruptions := &workers.Interruptions{}
+		worker := &workers.AWSInterruptionWorker{
+			QueueURL:      "https://sqs.eu-west-1.amazonaws.com/123456789012/interruptions",
+			SQSClient:     queue,
+			AsgAwsService: asgClient,
+			Ec2AwsService: ec2Client,
+			Interruptions: interruptions,
+		}
+		worker.Handle(context.TODO())
+
+		assert.DeepEqual(t, []string{"i-laiCh3oo"}, *detached)
+		assert.Equal(t, 0, len(queue.messages))
+		assert.Equal(t, "1 interruption events, replaced 1 instances, 0 to retry", worker.Report().LastDecision)
+		assert.Assert(t, interruptions.Interrupted("i-laiCh3oo"))
+
+		// The replacement is what's missing, not the runner of the interrupted instance
+		matcher := &workers.RunnerMatcher{Interruptions: interruptions}
+		asg, err := asgClient.DescribeAutoScalingGroups(context.TODO(), &autoscaling.DescribeAutoScalingGroupsInput{})
+		assert.NilError(t, err)
+		ready, found, expected, err := matcher.Ready(context.TODO(), asg.AutoScalingGroups[0], []circleci_client.Agent{
+			{Name: stringPointer("i-laiCh3oo")},
+			{Name: stringPointer("i-As0iugan")},
+		})
+		assert.NilError(t, err)
+		assert.Equal(t, false, ready)
+		assert.Equal(t, 1, found)
+		assert.Equal(t, 2, expected)
+	})
+
+	t.Run("it should only replace an instance once", func(t *testing.T) {
+		queue := &fakeSQS{}
+		queue.send(interruptionEvent("EC2 Spot Instance Interruption Warning", "i-laiCh3oo"))
+
+		ec2Client, asgClient, detached := runnerInstances(t, 2, map[string]types.LifecycleState{
+			"i-laiCh3oo": types.LifecycleStateInService,
+		})
+		worker := &workers.AWSInterruptionWorker{
+			SQSClient:     queue,
+			AsgAwsService: asgClient,
+			Ec2AwsService: ec2Client,
+			Interruptions: &workers.Interruptions{},
+		}
+		worker.Handle(context.TODO())
+
+		queue.send(interruptionEvent("EC2 Spot Instance Interruption Warning", "i-laiCh3oo"))
+		worker.Handle(context.TODO())
+
+		assert.DeepEqual(t, []string{"i-laiCh3oo"}, *detached)
+		assert.Equal(t, 0, len(queue.messages))
+	})
+
+	t.Run("it should leave rebalance recommendations to the capacity rebalancing of the ASG", func(t *testing.T) {
+		queue := &fakeSQS{}
+		queue.send(interruptionEvent("EC2 Instance Rebalance Recommendation", "i-laiCh3oo"))
+
+		ec2Client, asgClient, detached := runnerInstances(t, 2, map[string]types.LifecycleState{
+			"i-laiCh3oo": types.LifecycleStateInService,
+		})
+		worker := &workers.AWSInterruptionWorker{
+			SQSClient:     queue,
+			AsgAwsService: asgClient,
+			Ec2AwsService: ec2Client,
+			Interruptions: &workers.Interruptions{},
+		}
+		worker.Handle(context.TODO())
+
+		assert.Equal(t, 0, len(*detached))
+		assert.Equal(t, 0, len(queue.messages))
+		assert.Assert(t, worker.Interruptions.Interrupted("i-laiCh3oo"))
+
+		// The instance is still replaced if EC2 goes on to interrupt it
+		queue.send(interruptionEvent("EC2 Spot Instance Interruption Warning", "i-laiCh3oo"))
+		worker.Handle(context.TODO())
+
+		assert.DeepEqual(t, []string{"i-laiCh3oo"}, *detached)
+	})
+
+	t.Run("it should leave instances already on their way out to the ASG", func(t *testing.T) {
+		queue := &fakeSQS{}
+		queue.send(interruptionEvent("EC2 Spot Instance Interruption Warning", "i-laiCh3oo"))
+		queue.send(interruptionEvent("EC2 Spot Instance Interruption Warning", "i-Eeng4qua"))
+		queue.send(interruptionEvent("EC2 Spot Instance Interruption Warning", "i-gone"))
+
+		ec2Client, asgClient, detached := runnerInstances(t, 2, map[string]types.LifecycleState{
+			"i-laiCh3oo": types.LifecycleStateTerminating,
+			"i-Eeng4qua": types.LifecycleStatePending,
+		})
+		worker := &workers.AWSInterruptionWorker{
+			SQSClient:     queue,
+			AsgAwsService: asgClient,
+			Ec2AwsService: ec2Client,
+			Interruptions: &workers.Interruptions{},
+		}
+		worker.Handle(context.TODO())
+
+		assert.Equal(t, 0, len(*detached))
+		assert.Equal(t, 0, len(queue.messages))
+	})
+
+	t.Run("it should only replace the instances the budget has room for", func(t *testing.T) {
+		queue := &fakeSQS{}
+		queue.send(interruptionEvent("EC2 Spot Instance Interruption Warning", "i-laiCh3oo"))
+		queue.send(interruptionEvent("EC2 Spot Instance Interruption Warning", "i-As0iugan"))
+
+		ec2Client, asgClient, detached := runnerInstances(t, 4, map[string]types.LifecycleState{
+			"i-laiCh3oo": types.LifecycleStateInService,
+			"i-As0iugan": types.LifecycleStateInService,
+		})
+		spendBudget := &budget.Budget{Limit: 5, OnExhausted: func(budget.Exhausted) {}}
+		worker := &workers.AWSInterruptionWorker{
+			SQSClient:     queue,
+			AsgAwsService: asgClient,
+			Ec2AwsService: ec2Client,
+			Interruptions: &workers.Interruptions{},
+			Budget:        spendBudget,
+		}
+		worker.Handle(context.TODO())
+
+		assert.Equal(t, 1, len(*detached))
+		assert.Equal(t, "2 interruption events, replaced 1 instances, 0 to retry", worker.Report().LastDecision)
+		// The replacement running next to the interrupted instance is charged, even once the scaling worker
+		// records the capacity of the ASG again
+		spendBudget.Update("vela-games/runners", "vela-games/runners", 4, 1)
+		assert.Equal(t, int32(0), spendBudget.Claim("vela-games/other", "other", 0, 1, 1))
+
+		// Until EC2 takes the interrupted instance back
+		*detached = nil
+		worker.Handle(context.TODO())
+		assert.Equal(t, int32(1), spendBudget.Claim("vela-games/other", "other", 0, 1, 1))
+	})
+
+	t.Run("it should keep the events it couldn't act on to retry them", func(t *testing.T) {
+		queue := &fakeSQS{}
+		queue.send(interruptionEvent("EC2 Spot Instance Interruption Warning", "i-laiCh3oo"))
+
+		ec2Client, asgClient, detached := runnerInstances(t, 2, map[string]types.LifecycleState{
+			"i-laiCh3oo": types.LifecycleStateInService,
+		})
+		detachInstances := asgClient.MockDetachInstancesAPI
+		asgClient.MockDetachInstancesAPI = func(ctx context.Context, params *autoscaling.DetachInstancesInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DetachInstancesOutput, error) {
+			return nil, errors.New("throttled")
+		}
+		worker := &workers.AWSInterruptionWorker{
+			SQSClient:     queue,
+			AsgAwsService: asgClient,
+			Ec2AwsService: ec2Client,
+			Interruptions: &workers.Interruptions{},
+		}
+		worker.Handle(context.TODO())
+
+		assert.Equal(t, 1, len(queue.messages))
+		assert.Equal(t, "1 interruption events, replaced 0 instances, 1 to retry", worker.Report().LastDecision)
+
+		asgClient.MockDetachInstancesAPI = detachInstances
+		worker.Handle(context.TODO())
+
+		assert.DeepEqual(t, []string{"i-laiCh3oo"}, *detached)
+		assert.Equal(t, 0, len(queue.messages))
+	})
+
+	t.Run("it should drop messages that aren't interruption events", func(t *testing.T) {
+		queue := &fakeSQS{}
+		queue.send("not json")
+		queue.send(interruptionEvent("EC2 Instance State-change Notification", "i-laiCh3oo"))
+
+		worker := &workers.AWSInterruptionWorker{
+			SQSClient:     queue,
+			Interruptions: &workers.Interruptions{},
+		}
+		worker.Handle(context.TODO())
+
+		assert.Equal(t, 0, len(queue.messages))
+		assert.Assert(t, !worker.Interruptions.Interrupted("i-laiCh3oo"))
+	})
+}
@@ -0,0 +1,146 @@
+package workers
+
+import (
+	"context"
+	"math"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	circleci_client "github.com/vela-games/circleci-runner-autoscaler/client"
+	"github.com/vela-games/circleci-runner-autoscaler/services"
+)
+
+type RunnerMatchMode string
+
+const (
+	// Runners are named after the instance id, this is what our terraform module does
+	MatchInstanceID RunnerMatchMode = "instance-id"
+	// Runners are named after the instance hostname, e.g. ip-10-0-0-1.ec2.internal or ip-10-0-0-1
+	MatchPrivateDNS RunnerMatchMode = "private-dns"
+	// Runners are named after the value of an instance tag, by default the Name tag
+	MatchTag RunnerMatchMode = "tag"
+)
+
+// RunnerMatcher decides which instances of an ASG have a runner registered in CircleCI
+// and whether enough of them are up for the ASG to be considered ready
+type RunnerMatcher struct {
+	Mode RunnerMatchMode
+	// Instance tag used when Mode is MatchTag, defaults to Name
+	TagKey string
+	// Fraction of the expected instances that need a runner before the ASG is ready, defaults to all of them
+	Threshold float64
+
+	// Only needed for MatchPrivateDNS and MatchTag
+	Ec2AwsService services.EC2API
+
+	// Optional, interrupted instances are replaced so they aren't expected to have a runner
+	Interruptions *Interruptions
+}
+
+// Ready returns whether enough InService instances of the group have a runner, along with how many have one
+// and how many we expect. Instances on their way out, in Standby or interrupted by EC2 aren't expected to ever
+// get a runner, or to keep it.
+func (m *RunnerMatcher) Ready(ctx context.Context, group types.AutoScalingGroup, runners []circleci_client.Agent) (bool, int, int, error) {
+	expected := int(aws.ToInt32(group.DesiredCapacity))
+	var inService []string
+	for _, instance := range group.Instances {
+		switch instance.LifecycleState {
+		case types.LifecycleStateInService:
+			if m.Interruptions.Interrupted(aws.ToString(instance.InstanceId)) {
+				expected--
+				continue
+			}
+			inService = append(inService, aws.ToString(instance.InstanceId))
+		case types.LifecycleStateStandby, types.LifecycleStateEnteringStandby,
+			types.LifecycleStateTerminating, types.LifecycleStateTerminatingWait, types.LifecycleStateTerminatingProceed, types.LifecycleStateTerminated,
+			types.LifecycleStateDetaching, types.LifecycleStateDetached:
+			expected--
+		}
+	}
+
+	if expected < 0 {
+		expected = 0
+	}
+
+	names, err := m.instanceNames(ctx, inService)
+	if err != nil {
+		return false, 0, expected, err
+	}
+
+	found := 0
+	for _, instanceId := range inService {
+		for _, runner := range runners {
+			if matchesAny(runner, names[instanceId]) {
+				found++
+				break
+			}
+		}
+	}
+
+	threshold := m.Threshold
+	if threshold <= 0 || threshold > 1 {
+		threshold = 1
+	}
+
+	return found >= int(math.Ceil(threshold*float64(expected))), found, expected, nil
+}
+
+// instanceNames returns the names a runner can register with for each instance id
+func (m *RunnerMatcher) instanceNames(ctx context.Context, instanceIds []string) (map[string][]string, error) {
+	names := map[string][]string{}
+	if m.Mode == "" || m.Mode == MatchInstanceID || len(instanceIds) == 0 {
+		for _, instanceId := range instanceIds {
+			names[instanceId] = []string{instanceId}
+		}
+		return names, nil
+	}
+
+	paginator := ec2.NewDescribeInstancesPaginator(m.Ec2AwsService, &ec2.DescribeInstancesInput{
+		InstanceIds: instanceIds,
+	})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, reservation := range output.Reservations {
+			for _, instance := range reservation.Instances {
+				instanceId := aws.ToString(instance.InstanceId)
+				switch m.Mode {
+				case MatchPrivateDNS:
+					dnsName := aws.ToString(instance.PrivateDnsName)
+					names[instanceId] = []string{dnsName, strings.Split(dnsName, ".")[0]}
+				case MatchTag:
+					tagKey := m.TagKey
+					if tagKey == "" {
+						tagKey = "Name"
+					}
+					for _, tag := range instance.Tags {
+						if aws.ToString(tag.Key) == tagKey {
+							names[instanceId] = []string{aws.ToString(tag.Value)}
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return names, nil
+}
+
+func matchesAny(runner circleci_client.Agent, names []string) bool {
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+
+		if aws.ToString(runner.Name) == name || aws.ToString(runner.Hostname) == name {
+			return true
+		}
+	}
+
+	return false
+}
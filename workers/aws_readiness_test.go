@@ -0,0 +1,216 @@
+package workers_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	circleci_client "github.com/vela-games/circleci-runner-autoscaler/client"
+	"github.com/vela-games/circleci-runner-autoscaler/workers"
+	"gotest.tools/v3/assert"
+)
+
+type mockDescribeInstancesAPI func(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error)
+
+// mockEC2API only describes instances, launching them is done by fakeEC2
+type mockEC2API struct {
+	MockDescribeInstancesAPI mockDescribeInstancesAPI
+}
+
+func (m mockEC2API) DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	return m.MockDescribeInstancesAPI(ctx, params, optFns...)
+}
+
+func (m mockEC2API) DescribeLaunchTemplates(ctx context.Context, params *ec2.DescribeLaunchTemplatesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeLaunchTemplatesOutput, error) {
+	return &ec2.DescribeLaunchTemplatesOutput{}, nil
+}
+
+func (m mockEC2API) RunInstances(ctx context.Context, params *ec2.RunInstancesInput, optFns ...func(*ec2.Options)) (*ec2.RunInstancesOutput, error) {
+	return nil, errors.New("RunInstances isn't mocked")
+}
+
+func (m mockEC2API) TerminateInstances(ctx context.Context, params *ec2.TerminateInstancesInput, optFns ...func(*ec2.Options)) (*ec2.TerminateInstancesOutput, error) {
+	return nil, errors.New("TerminateInstances isn't mocked")
+}
+
+func TestRunnerMatcher(t *testing.T) {
+	ec2Client := mockEC2API{
+		MockDescribeInstancesAPI: func(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+			output := &ec2.DescribeInstancesOutput{
+				Reservations: []ec2types.Reservation{{}},
+			}
+			hosts := map[string]string{
+				"i-laiCh3oo": "10-0-0-1",
+				"i-As0iugan": "10-0-0-2",
+				"i-Qui6josh": "10-0-0-3",
+			}
+			for _, instanceId := range params.InstanceIds {
+				output.Reservations[0].Instances = append(output.Reservations[0].Instances, ec2types.Instance{
+					InstanceId:     stringPointer(instanceId),
+					PrivateDnsName: stringPointer("ip-" + hosts[instanceId] + ".ec2.internal"),
+					Tags: []ec2types.Tag{
+						{
+							Key:   stringPointer("Name"),
+							Value: stringPointer("runner-" + hosts[instanceId]),
+						},
+					},
+				})
+			}
+			return output, nil
+		},
+	}
+
+	instances := func(states ...types.LifecycleState) []types.Instance {
+		ids := []string{"i-laiCh3oo", "i-As0iugan", "i-Qui6josh"}
+		var result []types.Instance
+		for i, state := range states {
+			result = append(result, types.Instance{
+				InstanceId:     stringPointer(ids[i]),
+				LifecycleState: state,
+			})
+		}
+		return result
+	}
+
+	runners := func(names ...string) []circleci_client.Agent {
+		var result []circleci_client.Agent
+		for _, name := range names {
+			result = append(result, circleci_client.Agent{
+				Name:     stringPointer(name),
+				Hostname: stringPointer(name),
+			})
+		}
+		return result
+	}
+
+	tests := []struct {
+		name      string
+		matcher   *workers.RunnerMatcher
+		desired   int32
+		instances []types.Instance
+		runners   []circleci_client.Agent
+		ready     bool
+		found     int
+		expected  int
+	}{
+		{
+			name:      "all runners named after instance ids",
+			matcher:   &workers.RunnerMatcher{Mode: workers.MatchInstanceID},
+			desired:   2,
+			instances: instances(types.LifecycleStateInService, types.LifecycleStateInService),
+			runners:   runners("i-laiCh3oo", "i-As0iugan"),
+			ready:     true,
+			found:     2,
+			expected:  2,
+		},
+		{
+			name:      "instance still pending",
+			matcher:   &workers.RunnerMatcher{Mode: workers.MatchInstanceID},
+			desired:   2,
+			instances: instances(types.LifecycleStateInService, types.LifecycleStatePending),
+			runners:   runners("i-laiCh3oo"),
+			ready:     false,
+			found:     1,
+			expected:  2,
+		},
+		{
+			name:      "instance in standby isn't expected to have a runner",
+			matcher:   &workers.RunnerMatcher{Mode: workers.MatchInstanceID},
+			desired:   2,
+			instances: instances(types.LifecycleStateInService, types.LifecycleStateStandby),
+			runners:   runners("i-laiCh3oo"),
+			ready:     true,
+			found:     1,
+			expected:  1,
+		},
+		{
+			name:      "instance terminating isn't expected to have a runner",
+			matcher:   &workers.RunnerMatcher{Mode: workers.MatchInstanceID},
+			desired:   3,
+			instances: instances(types.LifecycleStateInService, types.LifecycleStateTerminatingWait, types.LifecycleStateInService),
+			runners:   runners("i-laiCh3oo", "i-As0iugan", "i-Qui6josh"),
+			ready:     true,
+			found:     2,
+			expected:  2,
+		},
+		{
+			name:      "more instances in service than desired",
+			matcher:   &workers.RunnerMatcher{Mode: workers.MatchInstanceID},
+			desired:   2,
+			instances: instances(types.LifecycleStateInService, types.LifecycleStateInService, types.LifecycleStateInService),
+			runners:   runners("i-laiCh3oo", "i-As0iugan", "i-Qui6josh"),
+			ready:     true,
+			found:     3,
+			expected:  2,
+		},
+		{
+			name:      "runners named after the private dns",
+			matcher:   &workers.RunnerMatcher{Mode: workers.MatchPrivateDNS, Ec2AwsService: ec2Client},
+			desired:   2,
+			instances: instances(types.LifecycleStateInService, types.LifecycleStateInService),
+			runners:   runners("ip-10-0-0-1.ec2.internal", "ip-10-0-0-2"),
+			ready:     true,
+			found:     2,
+			expected:  2,
+		},
+		{
+			name:      "runners named after the instance id don't match the private dns",
+			matcher:   &workers.RunnerMatcher{Mode: workers.MatchPrivateDNS, Ec2AwsService: ec2Client},
+			desired:   2,
+			instances: instances(types.LifecycleStateInService, types.LifecycleStateInService),
+			runners:   runners("i-laiCh3oo", "i-As0iugan"),
+			ready:     false,
+			found:     0,
+			expected:  2,
+		},
+		{
+			name:      "runners named after the name tag",
+			matcher:   &workers.RunnerMatcher{Mode: workers.MatchTag, Ec2AwsService: ec2Client},
+			desired:   1,
+			instances: instances(types.LifecycleStateInService),
+			runners:   runners("runner-10-0-0-1"),
+			ready:     true,
+			found:     1,
+			expected:  1,
+		},
+		{
+			name:      "threshold reached",
+			matcher:   &workers.RunnerMatcher{Mode: workers.MatchInstanceID, Threshold: 0.5},
+			desired:   3,
+			instances: instances(types.LifecycleStateInService, types.LifecycleStateInService, types.LifecycleStatePending),
+			runners:   runners("i-laiCh3oo", "i-As0iugan"),
+			ready:     true,
+			found:     2,
+			expected:  3,
+		},
+		{
+			name:      "threshold not reached",
+			matcher:   &workers.RunnerMatcher{Mode: workers.MatchInstanceID, Threshold: 0.8},
+			desired:   3,
+			instances: instances(types.LifecycleStateInService, types.LifecycleStateInService, types.LifecycleStatePending),
+			runners:   runners("i-laiCh3oo", "i-As0iugan"),
+			ready:     false,
+			found:     2,
+			expected:  3,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			group := types.AutoScalingGroup{
+				AutoScalingGroupName: stringPointer("vela-games/my-resource-class"),
+				DesiredCapacity:      int32Pointer(test.desired),
+				Instances:            test.instances,
+			}
+
+			ready, found, expected, err := test.matcher.Ready(context.TODO(), group, test.runners)
+			assert.NilError(t, err)
+			assert.Equal(t, test.ready, ready)
+			assert.Equal(t, test.found, found)
+			assert.Equal(t, test.expected, expected)
+		})
+	}
+}
@@ -5,60 +5,167 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
 	backoff "github.com/cenkalti/backoff/v4"
+	"github.com/vela-games/circleci-runner-autoscaler/budget"
 	circleci_client "github.com/vela-games/circleci-runner-autoscaler/client"
+	"github.com/vela-games/circleci-runner-autoscaler/config"
+	"github.com/vela-games/circleci-runner-autoscaler/forecast"
 	"github.com/vela-games/circleci-runner-autoscaler/services"
 )
 
 type AWSScalingWorker struct {
 	ResourceClass string
+	// Name of the account and region the ASG lives in
+	Target string
+
+	// Optional, when set the ASG is scaled out ahead of the demand predicted from history
+	Forecaster         *forecast.Forecaster
+	TimestampGenerator func() int64
+
+	// Optional ASG that takes over the scale-out when the ASG of the resource class fails to launch instances,
+	// e.g. an on-demand ASG for a spot one. The primary ASG is tried again after FallbackRecoveryInterval.
+	FallbackAutoScalingGroup string
+	FallbackRecoveryInterval time.Duration
+	// Decides which runners belong to the ASG instances, by default runners are named after the instance id
+	Matcher *RunnerMatcher
+	// How long instances have to reach InService after a scale-out before we consider the launch failed
+	LaunchTimeout time.Duration
+
+	// Minimum time between two scale-outs of the ASG
+	Cooldown time.Duration
+	// Scale-out is paused when this many consecutive scaling activities failed within FailedActivitiesWindow
+	MaxFailedActivities    int
+	FailedActivitiesWindow time.Duration
 
 	AsgAwsService  services.AutoScalingAPI
 	CircleCiClient circleci_client.ClientWithResponsesInterface
+
+	// Optional, scale-outs are limited to the capacity the budget grants
+	Budget *budget.Budget
+
+	// Only decide how to scale, without changing any ASG
+	DryRun bool
+
+	lastScaleOut  time.Time
+	usingFallback bool
+	fallbackSince time.Time
+
+	pendingConfiguration
+	reporter
+	capacityLimit
+}
+
+// scalingActivitiesFailedError is returned when the most recent scaling activities of an ASG failed
+type scalingActivitiesFailedError struct {
+	count  int
+	reason string
+}
+
+func (e *scalingActivitiesFailedError) Error() string {
+	return fmt.Sprintf("last %v scaling activities failed: %v", e.count, e.reason)
+}
+
+var errLaunchTimeout = errors.New("instances didn't reach InService in time")
+
+func (w *AWSScalingWorker) Kind() WorkerKind {
+	return KindScaling
+}
+
+func (w *AWSScalingWorker) ResourceClassName() string {
+	return w.ResourceClass
+}
+
+func (w *AWSScalingWorker) Report() WorkerReport {
+	report := w.snapshot()
+	report.Backend = "aws"
+	report.Target = w.Target
+	report.ResourceClass = w.ResourceClass
+	w.reportLimit(&report, w.now())
+	return report
 }
 
 // Handle autoscaling for the ResourceClass defined in the struct
 func (w *AWSScalingWorker) Handle(ctx context.Context) {
 	log.Printf("handle scaling of %v", w.ResourceClass)
 
+	if c := w.take(); c != nil {
+		w.applyConfiguration(c)
+	}
+
 	// Get count of unclaimed tasks
 	response, err := w.CircleCiClient.GetUnclaimedTasksWithResponse(ctx, &circleci_client.GetUnclaimedTasksParams{
 		ResourceClass: w.ResourceClass,
 	})
 	if err != nil {
 		log.Printf("error getting unclaimed tasks by resource class %v: %v", w.ResourceClass, err)
+		w.failed("getting unclaimed tasks: %v", err)
 		return
 	}
 
 	if response.StatusCode() != 200 {
 		log.Printf("got %v code instead of 200", response.StatusCode())
+		w.failed("getting unclaimed tasks: got %v code instead of 200", response.StatusCode())
+		return
+	}
+
+	if response.JSON200 == nil || response.JSON200.UnclaimedTaskCount == nil {
+		log.Printf("%v: unclaimed tasks response is missing the task count", w.ResourceClass)
+		w.failed("unclaimed tasks response is missing the task count")
 		return
 	}
 
 	unclaimedTaskCount := *response.JSON200.UnclaimedTaskCount
 	if unclaimedTaskCount > 0 {
-		// Get AutoScalingGroup associated with ResourceClass
+		// Get AutoScalingGroup associated with ResourceClass, or its fallback if the primary one is failing
+		groupName := w.activeGroupName()
 		asg, err := w.AsgAwsService.DescribeAutoScalingGroups(ctx, &autoscaling.DescribeAutoScalingGroupsInput{
 			AutoScalingGroupNames: []string{
-				w.ResourceClass,
+				groupName,
 			},
 		})
 
 		if err != nil {
-			log.Printf("error trying to describe ASG %v: %v", w.ResourceClass, err)
+			log.Printf("error trying to describe ASG %v: %v", groupName, err)
+			w.failed("describing ASG %v: %v", groupName, err)
 			return
 		}
 
 		if len(asg.AutoScalingGroups) == 0 {
-			log.Printf("AWS api didn't return the ASG %v: %v", w.ResourceClass, err)
+			log.Printf("AWS api didn't return the ASG %v: %v", groupName, err)
+			w.failed("AWS api didn't return the ASG %v", groupName)
 			return
 		}
+		w.applyCapacityLimit(&asg.AutoScalingGroups[0])
 
-		if *asg.AutoScalingGroups[0].DesiredCapacity == *asg.AutoScalingGroups[0].MaxSize {
-			log.Printf("resource class ASG %v is at full capacity", w.ResourceClass)
+		var predictedCapacity int32
+		if w.Forecaster != nil {
+			predictedCapacity = w.forecastDesiredCapacity(ctx, asg.AutoScalingGroups[0], unclaimedTaskCount)
+		}
+
+		if *asg.AutoScalingGroups[0].DesiredCapacity >= *asg.AutoScalingGroups[0].MaxSize {
+			log.Printf("resource class ASG %v is at full capacity", groupName)
+			w.decided("%v unclaimed tasks but %v is at full capacity of %v", unclaimedTaskCount, groupName, *asg.AutoScalingGroups[0].MaxSize)
+			w.updateBudget(asg.AutoScalingGroups[0])
+			return
+		}
+
+		if err := w.checkScaleOutAllowed(ctx, groupName); err != nil {
+			var failedErr *scalingActivitiesFailedError
+			if errors.As(err, &failedErr) && w.canFailOver(groupName) {
+				log.Printf("%v: %v", w.ResourceClass, err)
+				w.failed("%v", err)
+				w.failOver(ctx, asg.AutoScalingGroups[0])
+				return
+			}
+
+			log.Printf("%v: scale-out paused, %v", groupName, err)
+			w.decided("scale-out of %v paused, %v", groupName, err)
 			return
 		}
 
@@ -73,17 +180,44 @@ func (w *AWSScalingWorker) Handle(ctx context.Context) {
 			increaseDesiredCapacityBy = int32(*asg.AutoScalingGroups[0].MaxSize)
 		}
 
-		log.Printf("%v has %v unclaimed tasks, current desired capacity %v, new desired capacity %v", w.ResourceClass, unclaimedTaskCount, *asg.AutoScalingGroups[0].DesiredCapacity, increaseDesiredCapacityBy)
+		if predictedCapacity > increaseDesiredCapacityBy {
+			log.Printf("%v: forecast expects a demand of %v, scaling out ahead of it", w.ResourceClass, predictedCapacity)
+			increaseDesiredCapacityBy = predictedCapacity
+		}
+
+		if w.Budget != nil {
+			current := *asg.AutoScalingGroups[0].DesiredCapacity
+			increaseDesiredCapacityBy = w.Budget.Claim(w.ResourceClass, groupName, current, increaseDesiredCapacityBy, w.budgetWeight(asg.AutoScalingGroups[0]))
+			if increaseDesiredCapacityBy <= current {
+				log.Printf("%v: budget exhausted, not scaling out %v", w.ResourceClass, groupName)
+				w.decided("budget exhausted, %v unclaimed tasks but %v stays at %v", unclaimedTaskCount, groupName, current)
+				return
+			}
+		}
+
+		log.Printf("%v has %v unclaimed tasks, current desired capacity of %v %v, new desired capacity %v", w.ResourceClass, unclaimedTaskCount, groupName, *asg.AutoScalingGroups[0].DesiredCapacity, increaseDesiredCapacityBy)
+
+		if w.DryRun {
+			w.decided("dry run: %v unclaimed tasks, would scale out %v from %v to %v", unclaimedTaskCount, groupName, *asg.AutoScalingGroups[0].DesiredCapacity, increaseDesiredCapacityBy)
+			w.updateBudget(asg.AutoScalingGroups[0])
+			return
+		}
 
 		// Set the desired capacity
 		_, err = w.AsgAwsService.SetDesiredCapacity(ctx, &autoscaling.SetDesiredCapacityInput{
-			AutoScalingGroupName: &w.ResourceClass,
+			AutoScalingGroupName: &groupName,
 			DesiredCapacity:      &increaseDesiredCapacityBy,
 		})
 		if err != nil {
-			log.Printf("error setting desired capacity for %v", w.ResourceClass)
+			log.Printf("error setting desired capacity for %v", groupName)
+			w.failed("setting desired capacity of %v: %v", groupName, err)
+			w.updateBudget(asg.AutoScalingGroups[0])
 			return
 		}
+		scaledOutAt := w.now()
+		w.lastScaleOut = scaledOutAt
+		w.decided("%v unclaimed tasks, scaled out %v from %v to %v", unclaimedTaskCount, groupName, *asg.AutoScalingGroups[0].DesiredCapacity, increaseDesiredCapacityBy)
+		w.pending(increaseDesiredCapacityBy - *asg.AutoScalingGroups[0].DesiredCapacity)
 
 		// We check that the instances are running and ready to recieve tasks before exiting the func, as if Handle() get executed immediately after
 		// the unclaimed task amount will still be greater than 0 and we add more instances than we need
@@ -104,7 +238,7 @@ func (w *AWSScalingWorker) Handle(ctx context.Context) {
 
 			asg, err := w.AsgAwsService.DescribeAutoScalingGroups(ctx, &autoscaling.DescribeAutoScalingGroupsInput{
 				AutoScalingGroupNames: []string{
-					w.ResourceClass,
+					groupName,
 				},
 			})
 			if err != nil {
@@ -112,21 +246,35 @@ func (w *AWSScalingWorker) Handle(ctx context.Context) {
 				return err
 			}
 
-			foundCount := 0
-			for _, instance := range asg.AutoScalingGroups[0].Instances {
-				// We only check instances 'InService' as to try to avoid as scenario where a runner is being terminated while we are creating a new one
-				if instance.LifecycleState != "InService" {
-					continue
-				}
-				for _, runner := range *runners.JSON200.Items {
-					if *runner.Name == *instance.InstanceId {
-						foundCount++
-					}
-				}
+			if len(asg.AutoScalingGroups) == 0 {
+				return fmt.Errorf("AWS api didn't return the ASG %v", groupName)
+			}
+
+			if runners.JSON200 == nil || runners.JSON200.Items == nil {
+				return fmt.Errorf("runners response for %v is missing the runners", w.ResourceClass)
+			}
+
+			matcher := w.Matcher
+			if matcher == nil {
+				matcher = &RunnerMatcher{Mode: MatchInstanceID}
+			}
+
+			// We only count instances 'InService' as to try to avoid as scenario where a runner is being terminated while we are creating a new one
+			ready, foundCount, expectedCount, err := matcher.Ready(ctx, asg.AutoScalingGroups[0], *runners.JSON200.Items)
+			if err != nil {
+				log.Printf("error matching runners to instances of %v: %v", groupName, err)
+				return err
 			}
 
-			if int32(foundCount) != *asg.AutoScalingGroups[0].DesiredCapacity {
-				return errors.New("waiting for all runners to come up")
+			w.pending(int32(expectedCount - foundCount))
+			if !ready {
+				// Instances that never reach InService (e.g. no spot capacity in the AZ) would keep us waiting forever
+				if w.LaunchTimeout > 0 && w.now().Sub(scaledOutAt) > w.LaunchTimeout && w.canFailOver(groupName) {
+					w.failOver(ctx, asg.AutoScalingGroups[0])
+					return backoff.Permanent(errLaunchTimeout)
+				}
+
+				return fmt.Errorf("waiting for all runners to come up, %v of %v up", foundCount, expectedCount)
 			}
 
 			return nil
@@ -141,10 +289,329 @@ func (w *AWSScalingWorker) Handle(ctx context.Context) {
 		})
 		if err != nil {
 			log.Printf("%v: unrecoverable error %v", w.ResourceClass, err)
+			w.failed("waiting for runners of %v: %v", groupName, err)
 			return
 		}
+		w.pending(0)
 
+	} else if w.Forecaster != nil {
+		w.preProvision(ctx)
 	} else {
 		log.Printf("%v: no unclaimed tasks", w.ResourceClass)
+		w.decided("no unclaimed tasks")
+		if w.Budget != nil {
+			w.refreshBudget(ctx)
+		}
 	}
 }
+
+// refreshBudget records the capacity the ASG is using in the budget, so what it frees when it scales in goes
+// back to the other resource classes
+func (w *AWSScalingWorker) refreshBudget(ctx context.Context) {
+	groupName := w.activeGroupName()
+	asg, err := w.AsgAwsService.DescribeAutoScalingGroups(ctx, &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: []string{
+			groupName,
+		},
+	})
+	if err != nil || len(asg.AutoScalingGroups) == 0 {
+		log.Printf("error trying to describe ASG %v for the budget: %v", groupName, err)
+		return
+	}
+
+	w.updateBudget(asg.AutoScalingGroups[0])
+}
+
+func (w *AWSScalingWorker) updateBudget(group types.AutoScalingGroup) {
+	if w.Budget != nil {
+		w.Budget.Update(w.ResourceClass, aws.ToString(group.AutoScalingGroupName), *group.DesiredCapacity, w.budgetWeight(group))
+	}
+}
+
+// budgetWeight returns the cost units of an instance of the ASG, going by the type of its instances
+func (w *AWSScalingWorker) budgetWeight(group types.AutoScalingGroup) float64 {
+	instanceType := ""
+	if len(group.Instances) > 0 {
+		instanceType = aws.ToString(group.Instances[0].InstanceType)
+	} else if group.MixedInstancesPolicy != nil && group.MixedInstancesPolicy.LaunchTemplate != nil && len(group.MixedInstancesPolicy.LaunchTemplate.Overrides) > 0 {
+		instanceType = aws.ToString(group.MixedInstancesPolicy.LaunchTemplate.Overrides[0].InstanceType)
+	}
+
+	return w.Budget.Weight(w.ResourceClass, instanceType)
+}
+
+// applyCapacityLimit lowers the MaxSize of the described ASG to the capacity limit in place, if any.
+// The limit can't raise the MaxSize as AWS rejects a desired capacity above it.
+func (w *AWSScalingWorker) applyCapacityLimit(group *types.AutoScalingGroup) {
+	if max, _, ok := w.limit(w.now()); ok && max < *group.MaxSize {
+		group.MaxSize = aws.Int32(max)
+	}
+}
+
+// applyConfiguration updates the scaling settings of the worker from the configuration
+func (w *AWSScalingWorker) applyConfiguration(c *config.Configuration) {
+	settings := c.AwsScalingSettings(w.ResourceClass)
+	w.Cooldown = settings.Cooldown
+	w.MaxFailedActivities = settings.MaxFailedActivities
+	w.FailedActivitiesWindow = settings.FailedActivitiesWindow
+	w.FallbackAutoScalingGroup = settings.FallbackGroup
+	w.FallbackRecoveryInterval = settings.FallbackRecoveryInterval
+	w.LaunchTimeout = settings.LaunchTimeout
+
+	// The configuration was validated so the runner match is always valid
+	mode, tagKey, _ := c.RunnerMatch()
+	if w.Matcher == nil {
+		w.Matcher = &RunnerMatcher{}
+	}
+	w.Matcher.Mode = RunnerMatchMode(mode)
+	w.Matcher.TagKey = tagKey
+	w.Matcher.Threshold = settings.ReadinessThreshold
+
+	if !w.canFailOver(w.ResourceClass) {
+		w.usingFallback = false
+	}
+}
+
+// preProvision scales out the ASG when there are no unclaimed tasks but the forecaster expects more demand
+// than the current desired capacity. We don't wait for the runners as there's no queue that could make us overshoot.
+func (w *AWSScalingWorker) preProvision(ctx context.Context) {
+	groupName := w.activeGroupName()
+	asg, err := w.AsgAwsService.DescribeAutoScalingGroups(ctx, &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: []string{
+			groupName,
+		},
+	})
+	if err != nil {
+		log.Printf("error trying to describe ASG %v: %v", groupName, err)
+		w.failed("describing ASG %v: %v", groupName, err)
+		return
+	}
+
+	if len(asg.AutoScalingGroups) == 0 {
+		log.Printf("AWS api didn't return the ASG %v", groupName)
+		w.failed("AWS api didn't return the ASG %v", groupName)
+		return
+	}
+	w.applyCapacityLimit(&asg.AutoScalingGroups[0])
+
+	predictedCapacity := w.forecastDesiredCapacity(ctx, asg.AutoScalingGroups[0], 0)
+	if predictedCapacity <= *asg.AutoScalingGroups[0].DesiredCapacity {
+		log.Printf("%v: no unclaimed tasks", w.ResourceClass)
+		w.decided("no unclaimed tasks")
+		w.updateBudget(asg.AutoScalingGroups[0])
+		return
+	}
+
+	if err := w.checkScaleOutAllowed(ctx, groupName); err != nil {
+		log.Printf("%v: pre-provisioning paused, %v", groupName, err)
+		w.decided("pre-provisioning of %v paused, %v", groupName, err)
+		return
+	}
+
+	if w.Budget != nil {
+		current := *asg.AutoScalingGroups[0].DesiredCapacity
+		predictedCapacity = w.Budget.Claim(w.ResourceClass, groupName, current, predictedCapacity, w.budgetWeight(asg.AutoScalingGroups[0]))
+		if predictedCapacity <= current {
+			w.decided("budget exhausted, not pre-provisioning %v", groupName)
+			return
+		}
+	}
+
+	log.Printf("%v: no unclaimed tasks but forecast expects a demand of %v, pre-provisioning %v from desired capacity %v", w.ResourceClass, predictedCapacity, groupName, *asg.AutoScalingGroups[0].DesiredCapacity)
+
+	if w.DryRun {
+		w.decided("dry run: forecast expects a demand of %v, would pre-provision %v from %v", predictedCapacity, groupName, *asg.AutoScalingGroups[0].DesiredCapacity)
+		w.updateBudget(asg.AutoScalingGroups[0])
+		return
+	}
+
+	_, err = w.AsgAwsService.SetDesiredCapacity(ctx, &autoscaling.SetDesiredCapacityInput{
+		AutoScalingGroupName: &groupName,
+		DesiredCapacity:      &predictedCapacity,
+	})
+	if err != nil {
+		log.Printf("error setting desired capacity for %v", groupName)
+		w.failed("setting desired capacity of %v: %v", groupName, err)
+		w.updateBudget(asg.AutoScalingGroups[0])
+		return
+	}
+	w.lastScaleOut = w.now()
+	w.decided("forecast expects a demand of %v, pre-provisioned %v from %v", predictedCapacity, groupName, *asg.AutoScalingGroups[0].DesiredCapacity)
+}
+
+// checkScaleOutAllowed returns the reason why the ASG shouldn't be scaled out right now, either because we are in cooldown,
+// the ASG still has launches in progress, or its most recent launches keep failing
+func (w *AWSScalingWorker) checkScaleOutAllowed(ctx context.Context, groupName string) error {
+	now := w.now()
+	if w.Cooldown > 0 && now.Sub(w.lastScaleOut) < w.Cooldown {
+		return fmt.Errorf("in cooldown until %v", w.lastScaleOut.Add(w.Cooldown).Format(time.RFC3339))
+	}
+
+	activities, err := w.AsgAwsService.DescribeScalingActivities(ctx, &autoscaling.DescribeScalingActivitiesInput{
+		AutoScalingGroupName: &groupName,
+		MaxRecords:           aws.Int32(20),
+	})
+	if err != nil {
+		return fmt.Errorf("error describing scaling activities: %w", err)
+	}
+
+	for _, activity := range activities.Activities {
+		if terminationActivity(activity) {
+			continue
+		}
+
+		switch activity.StatusCode {
+		case types.ScalingActivityStatusCodeSuccessful, types.ScalingActivityStatusCodeFailed, types.ScalingActivityStatusCodeCancelled:
+			continue
+		}
+
+		return fmt.Errorf("scaling activity %v is still %v", aws.ToString(activity.Description), activity.StatusCode)
+	}
+
+	if w.MaxFailedActivities <= 0 {
+		return nil
+	}
+
+	// Activities are returned newest first, we only care about failures that happened in a row and recently
+	failedCount := 0
+	for _, activity := range activities.Activities {
+		if terminationActivity(activity) {
+			continue
+		}
+		if activity.StatusCode != types.ScalingActivityStatusCodeFailed {
+			break
+		}
+
+		if activity.StartTime != nil && w.FailedActivitiesWindow > 0 && now.Sub(*activity.StartTime) > w.FailedActivitiesWindow {
+			break
+		}
+
+		failedCount++
+	}
+
+	if failedCount >= w.MaxFailedActivities {
+		return &scalingActivitiesFailedError{
+			count:  failedCount,
+			reason: aws.ToString(activities.Activities[0].StatusMessage),
+		}
+	}
+
+	return nil
+}
+
+// terminationActivity tells if the activity terminates an instance, which doesn't hold up launching more. Drained
+// instances keep theirs in progress for as long as they wait for their runner.
+func terminationActivity(activity types.Activity) bool {
+	return strings.HasPrefix(aws.ToString(activity.Description), "Terminating EC2 instance")
+}
+
+// activeGroupName returns the ASG scale-outs should go to. After FallbackRecoveryInterval on the fallback ASG
+// we go back to the primary one, if it's still failing we'll fail over again.
+func (w *AWSScalingWorker) activeGroupName() string {
+	if !w.usingFallback {
+		return w.ResourceClass
+	}
+
+	if w.now().Sub(w.fallbackSince) >= w.FallbackRecoveryInterval {
+		log.Printf("%v: trying primary ASG again after %v on fallback %v", w.ResourceClass, w.FallbackRecoveryInterval, w.FallbackAutoScalingGroup)
+		w.usingFallback = false
+		return w.ResourceClass
+	}
+
+	return w.FallbackAutoScalingGroup
+}
+
+func (w *AWSScalingWorker) canFailOver(groupName string) bool {
+	return w.FallbackAutoScalingGroup != "" && groupName == w.ResourceClass
+}
+
+// failOver moves the capacity the primary ASG couldn't launch to the fallback ASG. The primary desired capacity is lowered
+// to the instances it managed to launch so it stops retrying, and later scale-outs go to the fallback until it recovers.
+func (w *AWSScalingWorker) failOver(ctx context.Context, primary types.AutoScalingGroup) {
+	if w.DryRun {
+		w.decided("dry run: would fail over from %v to %v", aws.ToString(primary.AutoScalingGroupName), w.FallbackAutoScalingGroup)
+		return
+	}
+
+	w.usingFallback = true
+	w.fallbackSince = w.now()
+
+	launched := int32(0)
+	for _, instance := range primary.Instances {
+		switch instance.LifecycleState {
+		case types.LifecycleStatePending, types.LifecycleStatePendingWait, types.LifecycleStatePendingProceed, types.LifecycleStateInService:
+			launched++
+		}
+	}
+
+	shortfall := *primary.DesiredCapacity - launched
+	log.Printf("%v: failing over to %v, moving a shortfall of %v instances", w.ResourceClass, w.FallbackAutoScalingGroup, shortfall)
+	if shortfall <= 0 {
+		return
+	}
+
+	fallback, err := w.AsgAwsService.DescribeAutoScalingGroups(ctx, &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: []string{
+			w.FallbackAutoScalingGroup,
+		},
+	})
+	if err != nil {
+		log.Printf("error trying to describe fallback ASG %v: %v", w.FallbackAutoScalingGroup, err)
+		return
+	}
+
+	if len(fallback.AutoScalingGroups) == 0 {
+		log.Printf("AWS api didn't return the fallback ASG %v", w.FallbackAutoScalingGroup)
+		return
+	}
+
+	fallbackCapacity := *fallback.AutoScalingGroups[0].DesiredCapacity + shortfall
+	if fallbackCapacity > *fallback.AutoScalingGroups[0].MaxSize {
+		fallbackCapacity = *fallback.AutoScalingGroups[0].MaxSize
+	}
+
+	_, err = w.AsgAwsService.SetDesiredCapacity(ctx, &autoscaling.SetDesiredCapacityInput{
+		AutoScalingGroupName: &w.FallbackAutoScalingGroup,
+		DesiredCapacity:      &fallbackCapacity,
+	})
+	if err != nil {
+		log.Printf("error setting desired capacity for fallback %v: %v", w.FallbackAutoScalingGroup, err)
+		return
+	}
+
+	_, err = w.AsgAwsService.SetDesiredCapacity(ctx, &autoscaling.SetDesiredCapacityInput{
+		AutoScalingGroupName: &w.ResourceClass,
+		DesiredCapacity:      &launched,
+	})
+	if err != nil {
+		log.Printf("error setting desired capacity for %v: %v", w.ResourceClass, err)
+	}
+}
+
+func (w *AWSScalingWorker) now() time.Time {
+	if w.TimestampGenerator != nil {
+		return time.Unix(w.TimestampGenerator(), 0)
+	}
+
+	return time.Now()
+}
+
+// forecastDesiredCapacity records the current demand of the resource class, the running plus the unclaimed tasks,
+// and returns the capacity the forecaster expects we'll need soon, clamped by the ASG MaxSize. The capacity of the
+// ASG isn't part of the demand, or our own scale-outs would feed back into the forecast.
+func (w *AWSScalingWorker) forecastDesiredCapacity(ctx context.Context, group types.AutoScalingGroup, unclaimedTaskCount int) int32 {
+	now := w.now()
+	running, err := runningTasks(ctx, w.CircleCiClient, w.ResourceClass)
+	if err != nil {
+		log.Printf("%v: not recording demand history, %v", w.ResourceClass, err)
+	} else if err := w.Forecaster.Observe(w.ResourceClass, now, running+unclaimedTaskCount); err != nil {
+		log.Printf("%v: error recording demand history: %v", w.ResourceClass, err)
+	}
+
+	predictedCapacity := int32(w.Forecaster.Predict(w.ResourceClass, now))
+	if predictedCapacity > *group.MaxSize {
+		predictedCapacity = *group.MaxSize
+	}
+
+	return predictedCapacity
+}
@@ -4,10 +4,13 @@ import (
 	"context"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
 	"github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/vela-games/circleci-runner-autoscaler/budget"
 	circleci_client "github.com/vela-games/circleci-runner-autoscaler/client"
+	"github.com/vela-games/circleci-runner-autoscaler/forecast"
 	"github.com/vela-games/circleci-runner-autoscaler/workers"
 	"gotest.tools/v3/assert"
 )
@@ -84,6 +87,169 @@ func TestAWSScalingWorker(t *testing.T) {
 		scaling.Handle(context.TODO())
 	})
 
+	t.Run("it should do nothing when the unclaimed task count is missing", func(t *testing.T) {
+		scaling := &workers.AWSScalingWorker{
+			ResourceClass: "vela-games/my-resource-class",
+			AsgAwsService: &mockAutoScalingGroupsAPI{
+				MockDescribeAutoScalingGroupsAPI: func(ctx context.Context, params *autoscaling.DescribeAutoScalingGroupsInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+					t.Error("DescribeAutoScalingGroups was called")
+					return nil, nil
+				},
+			},
+			CircleCiClient: &mockCircleCiClient{
+				MockGetUnclaimedTasksWithResponse: func(ctx context.Context, params *circleci_client.GetUnclaimedTasksParams, reqEditors ...circleci_client.RequestEditorFn) (*circleci_client.GetUnclaimedTasksResponse, error) {
+					return &circleci_client.GetUnclaimedTasksResponse{
+						HTTPResponse: &http.Response{
+							StatusCode: 200,
+						},
+						JSON200: &circleci_client.UnclaimedTaskCount{},
+					}, nil
+				},
+			},
+		}
+
+		scaling.Handle(context.TODO())
+	})
+
+	t.Run("it should not scale out past a temporary capacity limit", func(t *testing.T) {
+		var desiredCapacity int32
+		scaling := &workers.AWSScalingWorker{
+			ResourceClass: "vela-games/my-resource-class",
+			AsgAwsService: &mockAutoScalingGroupsAPI{
+				MockDescribeAutoScalingGroupsAPI: func(ctx context.Context, params *autoscaling.DescribeAutoScalingGroupsInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+					return &autoscaling.DescribeAutoScalingGroupsOutput{
+						AutoScalingGroups: []types.AutoScalingGroup{
+							{
+								AutoScalingGroupName: stringPointer("vela-games/my-resource-class"),
+								DesiredCapacity:      int32Pointer(0),
+								MaxSize:              int32Pointer(10),
+								MinSize:              int32Pointer(0),
+							},
+						},
+					}, nil
+				},
+				MockSetDesiredCapacityAPI: func(ctx context.Context, params *autoscaling.SetDesiredCapacityInput, optFns ...func(*autoscaling.Options)) (*autoscaling.SetDesiredCapacityOutput, error) {
+					desiredCapacity = *params.DesiredCapacity
+					return nil, nil
+				},
+			},
+			CircleCiClient: &mockCircleCiClient{
+				MockGetUnclaimedTasksWithResponse: func(ctx context.Context, params *circleci_client.GetUnclaimedTasksParams, reqEditors ...circleci_client.RequestEditorFn) (*circleci_client.GetUnclaimedTasksResponse, error) {
+					return &circleci_client.GetUnclaimedTasksResponse{
+						HTTPResponse: &http.Response{
+							StatusCode: 200,
+						},
+						JSON200: &circleci_client.UnclaimedTaskCount{
+							UnclaimedTaskCount: intPointer(5),
+						},
+					}, nil
+				},
+				MockGetRunnersWithResponse: func(ctx context.Context, params *circleci_client.GetRunnersParams, reqEditors ...circleci_client.RequestEditorFn) (*circleci_client.GetRunnersResponse, error) {
+					return &circleci_client.GetRunnersResponse{
+						HTTPResponse: &http.Response{
+							StatusCode: 200,
+						},
+						JSON200: &circleci_client.AgentList{
+							Items: &[]circleci_client.Agent{},
+						},
+					}, nil
+				},
+			},
+		}
+
+		scaling.LimitCapacity(2, time.Now().Add(time.Hour))
+		scaling.Handle(context.TODO())
+
+		assert.Equal(t, int32(2), desiredCapacity)
+		report := scaling.Report()
+		assert.Equal(t, "aws", report.Backend)
+		assert.Equal(t, "5 unclaimed tasks, scaled out vela-games/my-resource-class from 0 to 2", report.LastDecision)
+		assert.Equal(t, int32(2), *report.CapacityLimit)
+
+		// Once the limit expires the ASG MaxSize applies again
+		scaling.LimitCapacity(2, time.Now().Add(-time.Minute))
+		scaling.Handle(context.TODO())
+
+		assert.Equal(t, int32(5), desiredCapacity)
+		assert.Assert(t, scaling.Report().CapacityLimit == nil)
+	})
+
+	t.Run("it should only scale out to what the budget grants", func(t *testing.T) {
+		var setCapacities []int32
+		spendBudget := &budget.Budget{
+			Limit: 5,
+			Weights: map[string]float64{
+				"c5.xlarge": 2,
+			},
+			OnExhausted: func(budget.Exhausted) {},
+		}
+
+		newWorker := func(class string, instanceType string) *workers.AWSScalingWorker {
+			return &workers.AWSScalingWorker{
+				ResourceClass: class,
+				Budget:        spendBudget,
+				AsgAwsService: &mockAutoScalingGroupsAPI{
+					MockDescribeAutoScalingGroupsAPI: func(ctx context.Context, params *autoscaling.DescribeAutoScalingGroupsInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+						return &autoscaling.DescribeAutoScalingGroupsOutput{
+							AutoScalingGroups: []types.AutoScalingGroup{
+								{
+									AutoScalingGroupName: stringPointer(class),
+									DesiredCapacity:      int32Pointer(0),
+									MaxSize:              int32Pointer(10),
+									MinSize:              int32Pointer(0),
+									MixedInstancesPolicy: &types.MixedInstancesPolicy{
+										LaunchTemplate: &types.LaunchTemplate{
+											Overrides: []types.LaunchTemplateOverrides{
+												{InstanceType: stringPointer(instanceType)},
+											},
+										},
+									},
+								},
+							},
+						}, nil
+					},
+					MockSetDesiredCapacityAPI: func(ctx context.Context, params *autoscaling.SetDesiredCapacityInput, optFns ...func(*autoscaling.Options)) (*autoscaling.SetDesiredCapacityOutput, error) {
+						setCapacities = append(setCapacities, *params.DesiredCapacity)
+						return nil, nil
+					},
+				},
+				CircleCiClient: &mockCircleCiClient{
+					MockGetUnclaimedTasksWithResponse: func(ctx context.Context, params *circleci_client.GetUnclaimedTasksParams, reqEditors ...circleci_client.RequestEditorFn) (*circleci_client.GetUnclaimedTasksResponse, error) {
+						return &circleci_client.GetUnclaimedTasksResponse{
+							HTTPResponse: &http.Response{
+								StatusCode: 200,
+							},
+							JSON200: &circleci_client.UnclaimedTaskCount{
+								UnclaimedTaskCount: intPointer(4),
+							},
+						}, nil
+					},
+					MockGetRunnersWithResponse: func(ctx context.Context, params *circleci_client.GetRunnersParams, reqEditors ...circleci_client.RequestEditorFn) (*circleci_client.GetRunnersResponse, error) {
+						return &circleci_client.GetRunnersResponse{
+							HTTPResponse: &http.Response{
+								StatusCode: 200,
+							},
+							JSON200: &circleci_client.AgentList{
+								Items: &[]circleci_client.Agent{},
+							},
+						}, nil
+					},
+				},
+			}
+		}
+
+		large := newWorker("vela-games/large", "c5.xlarge")
+		small := newWorker("vela-games/small", "t3.small")
+		other := newWorker("vela-games/other", "t3.small")
+
+		large.Handle(context.TODO())
+		small.Handle(context.TODO())
+		other.Handle(context.TODO())
+
+		assert.DeepEqual(t, []int32{2, 1}, setCapacities)
+		assert.Equal(t, "budget exhausted, 4 unclaimed tasks but vela-games/other stays at 0", other.Report().LastDecision)
+	})
+
 	t.Run("it should do nothing becuase ASG DesiredCapacity==MaxSize", func(t *testing.T) {
 		asgClient := &mockAutoScalingGroupsAPI{
 			MockDescribeAutoScalingGroupsAPI: func(ctx context.Context, params *autoscaling.DescribeAutoScalingGroupsInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
@@ -526,4 +692,468 @@ func TestAWSScalingWorker(t *testing.T) {
 		scaling.Handle(context.TODO())
 	})
 
+	t.Run("it should pre-provision the forecasted demand", func(t *testing.T) {
+		now := time.Date(2022, 5, 23, 8, 50, 0, 0, time.UTC)
+
+		store, err := forecast.NewFileStore("", 0)
+		assert.NilError(t, err)
+		store.Observe("vela-games/my-resource-class", now.Add(-7*24*time.Hour).Add(20*time.Minute), 6)
+		store.Observe("vela-games/my-resource-class", now.Add(-14*24*time.Hour).Add(20*time.Minute), 8)
+
+		setDesiredCapacityCount := 0
+
+		asgClient := &mockAutoScalingGroupsAPI{
+			MockDescribeAutoScalingGroupsAPI: func(ctx context.Context, params *autoscaling.DescribeAutoScalingGroupsInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+				return &autoscaling.DescribeAutoScalingGroupsOutput{
+					AutoScalingGroups: []types.AutoScalingGroup{
+						{
+							AutoScalingGroupName: stringPointer("vela-games/my-resource-class"),
+							DesiredCapacity:      int32Pointer(1),
+							MaxSize:              int32Pointer(10),
+							MinSize:              int32Pointer(0),
+						},
+					},
+				}, nil
+			},
+			MockSetDesiredCapacityAPI: func(ctx context.Context, params *autoscaling.SetDesiredCapacityInput, optFns ...func(*autoscaling.Options)) (*autoscaling.SetDesiredCapacityOutput, error) {
+				setDesiredCapacityCount++
+				assert.Equal(t, *params.AutoScalingGroupName, "vela-games/my-resource-class")
+				assert.Equal(t, *params.DesiredCapacity, int32(7))
+				return nil, nil
+			},
+		}
+
+		ciClient := &mockCircleCiClient{
+			MockGetUnclaimedTasksWithResponse: func(ctx context.Context, params *circleci_client.GetUnclaimedTasksParams, reqEditors ...circleci_client.RequestEditorFn) (*circleci_client.GetUnclaimedTasksResponse, error) {
+				return &circleci_client.GetUnclaimedTasksResponse{
+					HTTPResponse: &http.Response{
+						StatusCode: 200,
+					},
+					JSON200: &circleci_client.UnclaimedTaskCount{
+						UnclaimedTaskCount: intPointer(0),
+					},
+				}, nil
+			},
+			MockGetRunnersWithResponse: func(ctx context.Context, params *circleci_client.GetRunnersParams, reqEditors ...circleci_client.RequestEditorFn) (*circleci_client.GetRunnersResponse, error) {
+				t.Error("GetRunnersWithResponse was called")
+				return nil, nil
+			},
+			MockGetRunningTasksWithResponse: func(ctx context.Context, params *circleci_client.GetRunningTasksParams, reqEditors ...circleci_client.RequestEditorFn) (*circleci_client.GetRunningTasksResponse, error) {
+				return &circleci_client.GetRunningTasksResponse{
+					Body:         []byte(`{"running_runner_tasks": 3}`),
+					HTTPResponse: &http.Response{StatusCode: 200},
+				}, nil
+			},
+		}
+
+		scaling := &workers.AWSScalingWorker{
+			ResourceClass: "vela-games/my-resource-class",
+			Forecaster: &forecast.Forecaster{
+				Store:      store,
+				Lookahead:  15 * time.Minute,
+				MinSeasons: 2,
+			},
+			TimestampGenerator: func() int64 {
+				return now.Unix()
+			},
+			CircleCiClient: ciClient,
+			AsgAwsService:  asgClient,
+		}
+
+		scaling.Handle(context.TODO())
+
+		assert.Equal(t, 1, setDesiredCapacityCount)
+		// The demand is the running tasks, not the capacity of the ASG
+		observed := -1
+		for hour, demand := range store.Peaks("vela-games/my-resource-class") {
+			if hour.Equal(now.Truncate(time.Hour)) {
+				observed = demand
+			}
+		}
+		assert.Equal(t, 3, observed)
+	})
+
+	t.Run("it should pause scale-out while scaling activities are in progress or failing", func(t *testing.T) {
+		now := time.Now()
+
+		tests := []struct {
+			name       string
+			activities []types.Activity
+			scaleOut   bool
+		}{
+			{
+				name: "activity in progress",
+				activities: []types.Activity{
+					{
+						Description: stringPointer("Launching a new EC2 instance: i-laiCh3oo"),
+						StatusCode:  types.ScalingActivityStatusCodePreInService,
+						StartTime:   &now,
+					},
+				},
+				scaleOut: false,
+			},
+			{
+				name: "repeated capacity errors",
+				activities: []types.Activity{
+					{
+						StatusCode:    types.ScalingActivityStatusCodeFailed,
+						StatusMessage: stringPointer("We currently do not have sufficient capacity in the Availability Zone you requested"),
+						StartTime:     &now,
+					},
+					{
+						StatusCode: types.ScalingActivityStatusCodeFailed,
+						StartTime:  &now,
+					},
+					{
+						StatusCode: types.ScalingActivityStatusCodeFailed,
+						StartTime:  &now,
+					},
+				},
+				scaleOut: false,
+			},
+			{
+				name: "single failure followed by success",
+				activities: []types.Activity{
+					{
+						StatusCode: types.ScalingActivityStatusCodeSuccessful,
+						StartTime:  &now,
+					},
+					{
+						StatusCode: types.ScalingActivityStatusCodeFailed,
+						StartTime:  &now,
+					},
+				},
+				scaleOut: true,
+			},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				setDesiredCapacityCount := 0
+
+				asgClient := &mockAutoScalingGroupsAPI{
+					MockDescribeAutoScalingGroupsAPI: func(ctx context.Context, params *autoscaling.DescribeAutoScalingGroupsInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+						return &autoscaling.DescribeAutoScalingGroupsOutput{
+							AutoScalingGroups: []types.AutoScalingGroup{
+								{
+									AutoScalingGroupName: stringPointer("vela-games/my-resource-class"),
+									DesiredCapacity:      int32Pointer(0),
+									MaxSize:              int32Pointer(10),
+									MinSize:              int32Pointer(0),
+								},
+							},
+						}, nil
+					},
+					MockDescribeScalingActivitiesAPI: func(ctx context.Context, params *autoscaling.DescribeScalingActivitiesInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeScalingActivitiesOutput, error) {
+						assert.Equal(t, *params.AutoScalingGroupName, "vela-games/my-resource-class")
+						return &autoscaling.DescribeScalingActivitiesOutput{
+							Activities: test.activities,
+						}, nil
+					},
+					MockSetDesiredCapacityAPI: func(ctx context.Context, params *autoscaling.SetDesiredCapacityInput, optFns ...func(*autoscaling.Options)) (*autoscaling.SetDesiredCapacityOutput, error) {
+						setDesiredCapacityCount++
+						return nil, nil
+					},
+				}
+
+				ciClient := &mockCircleCiClient{
+					MockGetUnclaimedTasksWithResponse: func(ctx context.Context, params *circleci_client.GetUnclaimedTasksParams, reqEditors ...circleci_client.RequestEditorFn) (*circleci_client.GetUnclaimedTasksResponse, error) {
+						return &circleci_client.GetUnclaimedTasksResponse{
+							HTTPResponse: &http.Response{
+								StatusCode: 200,
+							},
+							JSON200: &circleci_client.UnclaimedTaskCount{
+								UnclaimedTaskCount: intPointer(1),
+							},
+						}, nil
+					},
+					MockGetRunnersWithResponse: func(ctx context.Context, params *circleci_client.GetRunnersParams, reqEditors ...circleci_client.RequestEditorFn) (*circleci_client.GetRunnersResponse, error) {
+						return &circleci_client.GetRunnersResponse{
+							HTTPResponse: &http.Response{
+								StatusCode: 200,
+							},
+							JSON200: &circleci_client.AgentList{
+								Items: &[]circleci_client.Agent{},
+							},
+						}, nil
+					},
+					MockGetRunningTasksWithResponse: func(ctx context.Context, params *circleci_client.GetRunningTasksParams, reqEditors ...circleci_client.RequestEditorFn) (*circleci_client.GetRunningTasksResponse, error) {
+						return nil, nil
+					},
+				}
+
+				scaling := &workers.AWSScalingWorker{
+					ResourceClass:          "vela-games/my-resource-class",
+					MaxFailedActivities:    3,
+					FailedActivitiesWindow: 15 * time.Minute,
+					CircleCiClient:         ciClient,
+					AsgAwsService:          asgClient,
+				}
+
+				scaling.Handle(context.TODO())
+
+				if test.scaleOut {
+					assert.Equal(t, 1, setDesiredCapacityCount)
+				} else {
+					assert.Equal(t, 0, setDesiredCapacityCount)
+				}
+			})
+		}
+	})
+
+	t.Run("it should not scale out again during the cooldown", func(t *testing.T) {
+		now := time.Now()
+		setDesiredCapacityCount := 0
+
+		asgClient := &mockAutoScalingGroupsAPI{
+			MockDescribeAutoScalingGroupsAPI: func(ctx context.Context, params *autoscaling.DescribeAutoScalingGroupsInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+				return &autoscaling.DescribeAutoScalingGroupsOutput{
+					AutoScalingGroups: []types.AutoScalingGroup{
+						{
+							AutoScalingGroupName: stringPointer("vela-games/my-resource-class"),
+							DesiredCapacity:      int32Pointer(0),
+							MaxSize:              int32Pointer(10),
+							MinSize:              int32Pointer(0),
+						},
+					},
+				}, nil
+			},
+			MockSetDesiredCapacityAPI: func(ctx context.Context, params *autoscaling.SetDesiredCapacityInput, optFns ...func(*autoscaling.Options)) (*autoscaling.SetDesiredCapacityOutput, error) {
+				setDesiredCapacityCount++
+				return nil, nil
+			},
+		}
+
+		ciClient := &mockCircleCiClient{
+			MockGetUnclaimedTasksWithResponse: func(ctx context.Context, params *circleci_client.GetUnclaimedTasksParams, reqEditors ...circleci_client.RequestEditorFn) (*circleci_client.GetUnclaimedTasksResponse, error) {
+				return &circleci_client.GetUnclaimedTasksResponse{
+					HTTPResponse: &http.Response{
+						StatusCode: 200,
+					},
+					JSON200: &circleci_client.UnclaimedTaskCount{
+						UnclaimedTaskCount: intPointer(1),
+					},
+				}, nil
+			},
+			MockGetRunnersWithResponse: func(ctx context.Context, params *circleci_client.GetRunnersParams, reqEditors ...circleci_client.RequestEditorFn) (*circleci_client.GetRunnersResponse, error) {
+				return &circleci_client.GetRunnersResponse{
+					HTTPResponse: &http.Response{
+						StatusCode: 200,
+					},
+					JSON200: &circleci_client.AgentList{
+						Items: &[]circleci_client.Agent{},
+					},
+				}, nil
+			},
+			MockGetRunningTasksWithResponse: func(ctx context.Context, params *circleci_client.GetRunningTasksParams, reqEditors ...circleci_client.RequestEditorFn) (*circleci_client.GetRunningTasksResponse, error) {
+				return nil, nil
+			},
+		}
+
+		scaling := &workers.AWSScalingWorker{
+			ResourceClass: "vela-games/my-resource-class",
+			Cooldown:      time.Minute,
+			TimestampGenerator: func() int64 {
+				return now.Unix()
+			},
+			CircleCiClient: ciClient,
+			AsgAwsService:  asgClient,
+		}
+
+		scaling.Handle(context.TODO())
+		scaling.Handle(context.TODO())
+		assert.Equal(t, 1, setDesiredCapacityCount)
+
+		now = now.Add(2 * time.Minute)
+		scaling.Handle(context.TODO())
+		assert.Equal(t, 2, setDesiredCapacityCount)
+	})
+
+	t.Run("it should move the shortfall to the fallback ASG when scaling activities fail", func(t *testing.T) {
+		now := time.Now()
+		desiredCapacities := map[string]int32{}
+
+		asgClient := &mockAutoScalingGroupsAPI{
+			MockDescribeAutoScalingGroupsAPI: func(ctx context.Context, params *autoscaling.DescribeAutoScalingGroupsInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+				if params.AutoScalingGroupNames[0] == "vela-games/my-resource-class-on-demand" {
+					return &autoscaling.DescribeAutoScalingGroupsOutput{
+						AutoScalingGroups: []types.AutoScalingGroup{
+							{
+								AutoScalingGroupName: stringPointer("vela-games/my-resource-class-on-demand"),
+								DesiredCapacity:      int32Pointer(0),
+								MaxSize:              int32Pointer(10),
+								MinSize:              int32Pointer(0),
+							},
+						},
+					}, nil
+				}
+
+				return &autoscaling.DescribeAutoScalingGroupsOutput{
+					AutoScalingGroups: []types.AutoScalingGroup{
+						{
+							AutoScalingGroupName: stringPointer("vela-games/my-resource-class"),
+							DesiredCapacity:      int32Pointer(4),
+							MaxSize:              int32Pointer(10),
+							MinSize:              int32Pointer(0),
+							Instances: []types.Instance{
+								{
+									InstanceId:     stringPointer("i-laiCh3oo"),
+									LifecycleState: "InService",
+								},
+							},
+						},
+					},
+				}, nil
+			},
+			MockDescribeScalingActivitiesAPI: func(ctx context.Context, params *autoscaling.DescribeScalingActivitiesInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeScalingActivitiesOutput, error) {
+				if *params.AutoScalingGroupName != "vela-games/my-resource-class" {
+					return &autoscaling.DescribeScalingActivitiesOutput{}, nil
+				}
+
+				return &autoscaling.DescribeScalingActivitiesOutput{
+					Activities: []types.Activity{
+						{
+							StatusCode:    types.ScalingActivityStatusCodeFailed,
+							StatusMessage: stringPointer("There is no Spot capacity available that matches your request"),
+							StartTime:     &now,
+						},
+					},
+				}, nil
+			},
+			MockSetDesiredCapacityAPI: func(ctx context.Context, params *autoscaling.SetDesiredCapacityInput, optFns ...func(*autoscaling.Options)) (*autoscaling.SetDesiredCapacityOutput, error) {
+				desiredCapacities[*params.AutoScalingGroupName] = *params.DesiredCapacity
+				return nil, nil
+			},
+		}
+
+		ciClient := &mockCircleCiClient{
+			MockGetUnclaimedTasksWithResponse: func(ctx context.Context, params *circleci_client.GetUnclaimedTasksParams, reqEditors ...circleci_client.RequestEditorFn) (*circleci_client.GetUnclaimedTasksResponse, error) {
+				return &circleci_client.GetUnclaimedTasksResponse{
+					HTTPResponse: &http.Response{
+						StatusCode: 200,
+					},
+					JSON200: &circleci_client.UnclaimedTaskCount{
+						UnclaimedTaskCount: intPointer(3),
+					},
+				}, nil
+			},
+			MockGetRunnersWithResponse: func(ctx context.Context, params *circleci_client.GetRunnersParams, reqEditors ...circleci_client.RequestEditorFn) (*circleci_client.GetRunnersResponse, error) {
+				return &circleci_client.GetRunnersResponse{
+					HTTPResponse: &http.Response{
+						StatusCode: 200,
+					},
+					JSON200: &circleci_client.AgentList{
+						Items: &[]circleci_client.Agent{},
+					},
+				}, nil
+			},
+			MockGetRunningTasksWithResponse: func(ctx context.Context, params *circleci_client.GetRunningTasksParams, reqEditors ...circleci_client.RequestEditorFn) (*circleci_client.GetRunningTasksResponse, error) {
+				return nil, nil
+			},
+		}
+
+		scaling := &workers.AWSScalingWorker{
+			ResourceClass:            "vela-games/my-resource-class",
+			FallbackAutoScalingGroup: "vela-games/my-resource-class-on-demand",
+			FallbackRecoveryInterval: 30 * time.Minute,
+			MaxFailedActivities:      1,
+			TimestampGenerator: func() int64 {
+				return now.Unix()
+			},
+			CircleCiClient: ciClient,
+			AsgAwsService:  asgClient,
+		}
+
+		scaling.Handle(context.TODO())
+
+		assert.DeepEqual(t, map[string]int32{
+			"vela-games/my-resource-class":           1,
+			"vela-games/my-resource-class-on-demand": 3,
+		}, desiredCapacities)
+	})
+
+	t.Run("it should fail over when instances don't reach InService in time", func(t *testing.T) {
+		now := time.Now()
+		desiredCapacities := map[string]int32{}
+
+		asgClient := &mockAutoScalingGroupsAPI{
+			MockDescribeAutoScalingGroupsAPI: func(ctx context.Context, params *autoscaling.DescribeAutoScalingGroupsInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+				if params.AutoScalingGroupNames[0] == "vela-games/my-resource-class-on-demand" {
+					return &autoscaling.DescribeAutoScalingGroupsOutput{
+						AutoScalingGroups: []types.AutoScalingGroup{
+							{
+								AutoScalingGroupName: stringPointer("vela-games/my-resource-class-on-demand"),
+								DesiredCapacity:      int32Pointer(0),
+								MaxSize:              int32Pointer(10),
+								MinSize:              int32Pointer(0),
+							},
+						},
+					}, nil
+				}
+
+				return &autoscaling.DescribeAutoScalingGroupsOutput{
+					AutoScalingGroups: []types.AutoScalingGroup{
+						{
+							AutoScalingGroupName: stringPointer("vela-games/my-resource-class"),
+							DesiredCapacity:      int32Pointer(2),
+							MaxSize:              int32Pointer(10),
+							MinSize:              int32Pointer(0),
+						},
+					},
+				}, nil
+			},
+			MockSetDesiredCapacityAPI: func(ctx context.Context, params *autoscaling.SetDesiredCapacityInput, optFns ...func(*autoscaling.Options)) (*autoscaling.SetDesiredCapacityOutput, error) {
+				desiredCapacities[*params.AutoScalingGroupName] = *params.DesiredCapacity
+				return nil, nil
+			},
+		}
+
+		ciClient := &mockCircleCiClient{
+			MockGetUnclaimedTasksWithResponse: func(ctx context.Context, params *circleci_client.GetUnclaimedTasksParams, reqEditors ...circleci_client.RequestEditorFn) (*circleci_client.GetUnclaimedTasksResponse, error) {
+				return &circleci_client.GetUnclaimedTasksResponse{
+					HTTPResponse: &http.Response{
+						StatusCode: 200,
+					},
+					JSON200: &circleci_client.UnclaimedTaskCount{
+						UnclaimedTaskCount: intPointer(2),
+					},
+				}, nil
+			},
+			MockGetRunnersWithResponse: func(ctx context.Context, params *circleci_client.GetRunnersParams, reqEditors ...circleci_client.RequestEditorFn) (*circleci_client.GetRunnersResponse, error) {
+				return &circleci_client.GetRunnersResponse{
+					HTTPResponse: &http.Response{
+						StatusCode: 200,
+					},
+					JSON200: &circleci_client.AgentList{
+						Items: &[]circleci_client.Agent{},
+					},
+				}, nil
+			},
+			MockGetRunningTasksWithResponse: func(ctx context.Context, params *circleci_client.GetRunningTasksParams, reqEditors ...circleci_client.RequestEditorFn) (*circleci_client.GetRunningTasksResponse, error) {
+				return nil, nil
+			},
+		}
+
+		scaling := &workers.AWSScalingWorker{
+			ResourceClass:            "vela-games/my-resource-class",
+			FallbackAutoScalingGroup: "vela-games/my-resource-class-on-demand",
+			FallbackRecoveryInterval: 30 * time.Minute,
+			LaunchTimeout:            10 * time.Minute,
+			// Every time the worker checks the clock 6 minutes have passed
+			TimestampGenerator: func() int64 {
+				now = now.Add(6 * time.Minute)
+				return now.Unix()
+			},
+			CircleCiClient: ciClient,
+			AsgAwsService:  asgClient,
+		}
+
+		scaling.Handle(context.TODO())
+
+		assert.DeepEqual(t, map[string]int32{
+			"vela-games/my-resource-class":           0,
+			"vela-games/my-resource-class-on-demand": 2,
+		}, desiredCapacities)
+	})
+
 }
@@ -0,0 +1,103 @@
+package workers
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/vela-games/circleci-runner-autoscaler/budget"
+	"github.com/vela-games/circleci-runner-autoscaler/client"
+	"github.com/vela-games/circleci-runner-autoscaler/services"
+)
+
+// AzureDiscoveryWorker finds the VM scale sets tagged with a resource class and starts an AzureScalingWorker for each
+type AzureDiscoveryWorker struct {
+	Dispatcher Dispatcher
+
+	// Scale sets are discovered in every subscription
+	Targets        []services.ScaleSetsTarget
+	CircleCiClient client.ClientWithResponsesInterface
+	Budget         *budget.Budget
+
+	// Most VMs of the scale sets without a max-instances tag
+	MaxInstances int32
+
+	Namespace                 string
+	childWorkersResourceClass []string
+
+	reporter
+}
+
+func (w *AzureDiscoveryWorker) Kind() WorkerKind {
+	return KindDiscovery
+}
+
+func (w *AzureDiscoveryWorker) Report() WorkerReport {
+	report := w.snapshot()
+	report.Backend = "azure"
+	var names []string
+	for _, target := range w.Targets {
+		names = append(names, target.Name)
+	}
+	report.Target = strings.Join(names, ",")
+	return report
+}
+
+func (w *AzureDiscoveryWorker) Handle(ctx context.Context) {
+	for _, target := range w.Targets {
+		w.discover(ctx, target)
+	}
+	w.decided("scaling %v resource classes", len(w.childWorkersResourceClass))
+}
+
+// discover starts scaling workers for the scale sets found in the subscription.
+// If a resource class has scale sets in several subscriptions only the first one found is scaled.
+func (w *AzureDiscoveryWorker) discover(ctx context.Context, target services.ScaleSetsTarget) {
+	sets, err := target.Client.ListScaleSets(ctx)
+	if err != nil {
+		log.Printf("error getting scale sets from %v: %v", target.Name, err)
+		w.failed("getting scale sets from %v: %v", target.Name, err)
+		return
+	}
+
+	for _, set := range sets {
+		className, ok := set.Tags[resourceClassTagKey]
+		if !ok || strings.Split(className, "/")[0] != w.Namespace {
+			continue
+		}
+
+		found := false
+		for _, c := range w.childWorkersResourceClass {
+			if className == c {
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+
+		maxInstances := w.MaxInstances
+		if value, ok := set.Tags[maxInstancesTagKey]; ok {
+			max, err := strconv.Atoi(value)
+			if err == nil && max >= 0 {
+				maxInstances = int32(max)
+			} else {
+				log.Printf("ignoring invalid %v tag %q of scale set %v", maxInstancesTagKey, value, set.Name)
+			}
+		}
+
+		w.childWorkersResourceClass = append(w.childWorkersResourceClass, className)
+		log.Printf("Found new resource class %v with scale set %v/%v in %v, starting scaling worker for it", className, set.ResourceGroup, set.Name, target.Name)
+		w.Dispatcher.Start(ctx, &AzureScalingWorker{
+			ResourceClass:    className,
+			Target:           target.Name,
+			ScaleSet:         set,
+			ScaleSetsService: target.Client,
+			CircleCiClient:   w.CircleCiClient,
+			MaxInstances:     maxInstances,
+			Budget:           w.Budget,
+		})
+	}
+}
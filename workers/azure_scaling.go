@@ -0,0 +1,110 @@
+package workers
+
+import (
+	"context"
+	"time"
+
+	"github.com/vela-games/circleci-runner-autoscaler/budget"
+	circleci_client "github.com/vela-games/circleci-runner-autoscaler/client"
+	"github.com/vela-games/circleci-runner-autoscaler/services"
+)
+
+// AzureScalingWorker raises the capacity of the VM scale set of a resource class from its unclaimed tasks. Runners
+// are matched to VMs by name or computer name, and are expected to delete their own VM from the scale set when idle.
+type AzureScalingWorker struct {
+	ResourceClass string
+	// Subscription the scale set lives in
+	Target string
+	// Scale set as discovered, its capacity is described again on every run
+	ScaleSet         services.ScaleSet
+	ScaleSetsService services.ScaleSetsAPI
+
+	CircleCiClient circleci_client.ClientWithResponsesInterface
+
+	// Most VMs the scale set can be scaled to, scale sets have no max size unless autoscale settings are attached
+	MaxInstances int32
+
+	// Optional, scale-outs are limited to the capacity the budget grants
+	Budget *budget.Budget
+
+	// Only decide how to scale, without changing the scale set
+	DryRun bool
+
+	reporter
+	capacityLimit
+}
+
+func (w *AzureScalingWorker) Kind() WorkerKind {
+	return KindScaling
+}
+
+func (w *AzureScalingWorker) ResourceClassName() string {
+	return w.ResourceClass
+}
+
+func (w *AzureScalingWorker) Report() WorkerReport {
+	report := w.snapshot()
+	report.Backend = "azure"
+	report.Target = w.Target
+	report.ResourceClass = w.ResourceClass
+	w.reportLimit(&report, time.Now())
+	return report
+}
+
+func (w *AzureScalingWorker) Handle(ctx context.Context) {
+	scaleGroup[services.ScaleSet](ctx, w.scaling(), w)
+}
+
+func (w *AzureScalingWorker) Inspect(ctx context.Context) (ClassState, error) {
+	state := ClassState{
+		ResourceClass: w.ResourceClass,
+		Backend:       "azure",
+		Target:        w.Target,
+		Group:         w.ScaleSet.Name,
+		MaxSize:       w.MaxInstances,
+	}
+	err := inspectGroup[services.ScaleSet](ctx, w.scaling(), w, &state)
+	return state, err
+}
+
+func (w *AzureScalingWorker) scaling() groupScaling {
+	return groupScaling{
+		resourceClass:  w.ResourceClass,
+		circleCiClient: w.CircleCiClient,
+		maxInstances:   w.MaxInstances,
+		budget:         w.Budget,
+		dryRun:         w.DryRun,
+		kind:           "scale set",
+		group:          w.ScaleSet.Name,
+		reporter:       &w.reporter,
+		limit:          &w.capacityLimit,
+	}
+}
+
+func (w *AzureScalingWorker) getGroup(ctx context.Context) (services.ScaleSet, groupSize, error) {
+	set, err := w.ScaleSetsService.GetScaleSet(ctx, w.ScaleSet.ResourceGroup, w.ScaleSet.Name)
+	return set, groupSize{name: set.Name, size: set.Capacity, machineType: set.SKU}, err
+}
+
+// listMachines returns the VMs of the scale set, runners are named after either their name or computer name
+func (w *AzureScalingWorker) listMachines(ctx context.Context, set services.ScaleSet) ([]groupMachine, error) {
+	vms, err := w.ScaleSetsService.ListVMs(ctx, set)
+	if err != nil {
+		return nil, err
+	}
+
+	var machines []groupMachine
+	for _, vm := range vms {
+		machines = append(machines, groupMachine{
+			names:   []string{vm.Name, vm.ComputerName},
+			leaving: vm.ProvisioningState == "Deleting",
+			ready:   vm.ProvisioningState == "Succeeded",
+		})
+	}
+	return machines, nil
+}
+
+// resize starts the update of the capacity, with the SKU the scale set has now
+func (w *AzureScalingWorker) resize(ctx context.Context, set services.ScaleSet, capacity int32) error {
+	return w.ScaleSetsService.SetCapacity(ctx, set, capacity)
+}
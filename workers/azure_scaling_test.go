@@ -0,0 +1,52 @@
+package workers_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/vela-games/circleci-runner-autoscaler/services"
+	"github.com/vela-games/circleci-runner-autoscaler/workers"
+	"gotest.tools/v3/assert"
+)
+
+func TestAzureDiscoveryWorker(t *testing.T) {
+	sets := &fakeCloudGroups{groups: []cloudGroup{
+		{name: "vmss-large", class: "vela-games/vmss-large", maxInstances: "8"},
+		{name: "vmss-small", class: "vela-games/vmss-small"},
+		{name: "other", class: "other-namespace/vmss-large"},
+		{name: "untagged"},
+	}}
+	dispatcher := &WorkerDispatcherTest{}
+
+	discovery := &workers.AzureDiscoveryWorker{
+		Dispatcher:   dispatcher,
+		Namespace:    "vela-games",
+		Targets:      []services.ScaleSetsTarget{{Name: "00000000-0000-0000-0000-000000000000", Client: sets}},
+		MaxInstances: 5,
+	}
+	discovery.Handle(context.TODO())
+	discovery.Handle(context.TODO())
+
+	assert.Equal(t, 2, dispatcher.Count)
+	assert.Equal(t, "scaling 2 resource classes", discovery.Report().LastDecision)
+
+	worker := dispatcher.Workers[0].(*workers.AzureScalingWorker)
+	assert.Equal(t, "vela-games/vmss-large", worker.ResourceClass)
+	assert.Equal(t, int32(8), worker.MaxInstances)
+	assert.Equal(t, int32(5), dispatcher.Workers[1].(*workers.AzureScalingWorker).MaxInstances)
+}
+
+func TestAzureScalingWorker(t *testing.T) {
+	t.Run("it should match runners named after the computer name of the VM", func(t *testing.T) {
+		sets := &fakeCloudGroups{groups: []cloudGroup{{
+			name:     "vmss-large",
+			class:    "vela-games/vmss-large",
+			size:     1,
+			machines: []cloudMachine{{name: "vmss-large_0", hostname: "vmss-large000000", state: "running"}},
+		}}}
+		worker := groupWorkers["azure"](sets, namedRunnersCircleCiClient(1, "vmss-large000000"), false)
+		worker.Handle(context.TODO())
+
+		assert.DeepEqual(t, []int32{2}, sets.resized)
+	})
+}
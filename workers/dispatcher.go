@@ -2,28 +2,324 @@ package workers
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"math/rand"
+	"runtime/debug"
+	"sync"
 	"time"
 
 	"golang.org/x/sync/errgroup"
 )
 
+// WorkerKind groups workers that run at the same interval
+type WorkerKind string
+
+const (
+	KindDiscovery WorkerKind = "discovery"
+	KindScaling   WorkerKind = "scaling"
+	KindJanitor   WorkerKind = "janitor"
+)
+
+// Workers that tell the dispatcher which interval to run them at
+type KindedWorker interface {
+	Kind() WorkerKind
+}
+
+// Workers that handle a single resource class, so they can be woken up by it
+type ResourceClassWorker interface {
+	ResourceClassName() string
+}
+
 type WorkerDispatcher struct {
-	RunEvery time.Duration
-	Group    *errgroup.Group
+	// Interval for workers without a kind or whose kind isn't in Intervals
+	RunEvery  time.Duration
+	Intervals map[WorkerKind]time.Duration
+	// Fraction of the interval randomly added to every wait, so workers started together drift apart. With jitter,
+	// workers also wait a random part of their interval before their first run.
+	Jitter float64
+	Group  *errgroup.Group
+
+	// A panicking worker is restarted after RestartBackoff, doubled on every consecutive panic up to
+	// MaxRestartBackoff. After QuarantineAfter consecutive panics it's quarantined and not run anymore (0 never quarantines).
+	RestartBackoff    time.Duration
+	MaxRestartBackoff time.Duration
+	QuarantineAfter   int
+
+	// After and Random default to time.After and rand.Float64, tests replace them with a fake clock
+	After  func(time.Duration) <-chan time.Time
+	Random func() float64
+
+	mu     sync.Mutex
+	status []*WorkerStatus
+}
+
+// WorkerStatus tracks the panics of a dispatched worker and whether it's paused
+type WorkerStatus struct {
+	Worker            Worker
+	Panics            int
+	ConsecutivePanics int
+	LastPanic         string
+	Quarantined       bool
+	Paused            bool
+
+	wake chan struct{}
 }
 
+// Start runs the worker until ctx is done. Canceling ctx, e.g. when discovery finds the worker's resources gone,
+// stops the worker and removes it from the status.
 func (w *WorkerDispatcher) Start(ctx context.Context, worker Worker) {
+	status := &WorkerStatus{Worker: worker, wake: make(chan struct{}, 1)}
+	w.mu.Lock()
+	w.status = append(w.status, status)
+	w.mu.Unlock()
+
 	w.Group.Go(func() error {
+		// Workers started together, e.g. by discovery, would otherwise keep running at the same moment
+		if delay := w.initialDelay(worker); delay > 0 {
+			select {
+			case <-w.after(delay):
+			case <-status.wake:
+			case <-ctx.Done():
+				log.Printf("exiting %T", worker)
+				w.remove(status)
+				return nil
+			}
+		}
+
 		for {
-			worker.Handle(ctx)
+			wait := w.wait(worker)
+			wake := status.wake
+			if w.paused(status) {
+				log.Printf("%T is paused", worker)
+			} else if panicked := w.handle(ctx, worker, status); panicked {
+				if w.quarantine(status) {
+					log.Printf("%T panicked %v times in a row, quarantined", worker, w.QuarantineAfter)
+					return nil
+				}
+				if w.RestartBackoff > 0 {
+					wait = w.restartBackoff(status)
+					// Wake-ups don't cut the backoff short, the run after it covers them
+					wake = nil
+				}
+				log.Printf("restarting %T in %v", worker, wait)
+			}
+
 			select {
-			case <-time.After(w.RunEvery):
+			case <-w.after(wait):
+				if wake == nil {
+					select {
+					case <-status.wake:
+					default:
+					}
+				}
+				continue
+			case <-wake:
 				continue
 			case <-ctx.Done():
 				log.Printf("exiting %T", worker)
+				w.remove(status)
 				return nil
 			}
 		}
 	})
 }
+
+// remove drops the status of a worker that exited
+func (w *WorkerDispatcher) remove(status *WorkerStatus) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for i, s := range w.status {
+		if s == status {
+			w.status = append(w.status[:i], w.status[i+1:]...)
+			return
+		}
+	}
+}
+
+// Status returns a snapshot of the status of every dispatched worker
+func (w *WorkerDispatcher) Status() []WorkerStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	status := make([]WorkerStatus, 0, len(w.status))
+	for _, s := range w.status {
+		status = append(status, *s)
+	}
+	return status
+}
+
+// WakeResourceClass runs the scaling workers of the resource class right away instead of waiting for their next tick,
+// or every scaling worker if the class is empty. It returns how many workers were woken up.
+func (w *WorkerDispatcher) WakeResourceClass(class string) int {
+	return w.forResourceClass(class, func(s *WorkerStatus) bool {
+		if s.Quarantined {
+			return false
+		}
+
+		// A wake-up already pending covers this one too
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+		return true
+	})
+}
+
+// PauseResourceClass stops running the scaling workers of the resource class until it's resumed
+func (w *WorkerDispatcher) PauseResourceClass(class string) int {
+	return w.forResourceClass(class, func(s *WorkerStatus) bool {
+		s.Paused = true
+		return true
+	})
+}
+
+func (w *WorkerDispatcher) ResumeResourceClass(class string) int {
+	return w.forResourceClass(class, func(s *WorkerStatus) bool {
+		s.Paused = false
+		return true
+	})
+}
+
+// LimitResourceClassCapacity limits the capacity the scaling workers of the resource class scale to until the given time
+func (w *WorkerDispatcher) LimitResourceClassCapacity(class string, max int32, until time.Time) int {
+	return w.forResourceClass(class, func(s *WorkerStatus) bool {
+		limiter, ok := s.Worker.(CapacityLimiter)
+		if ok {
+			limiter.LimitCapacity(max, until)
+		}
+		return ok
+	})
+}
+
+func (w *WorkerDispatcher) ClearResourceClassCapacityLimit(class string) int {
+	return w.forResourceClass(class, func(s *WorkerStatus) bool {
+		limiter, ok := s.Worker.(CapacityLimiter)
+		if ok {
+			limiter.ClearCapacityLimit()
+		}
+		return ok
+	})
+}
+
+// forResourceClass calls fn with the status of the scaling workers of the resource class, or of every scaling worker
+// if the class is empty, and returns how many of them fn applied to
+func (w *WorkerDispatcher) forResourceClass(class string, fn func(*WorkerStatus) bool) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	count := 0
+	for _, s := range w.status {
+		if kinded, ok := s.Worker.(KindedWorker); !ok || kinded.Kind() != KindScaling {
+			continue
+		}
+
+		if class != "" {
+			if classWorker, ok := s.Worker.(ResourceClassWorker); !ok || classWorker.ResourceClassName() != class {
+				continue
+			}
+		}
+
+		if fn(s) {
+			count++
+		}
+	}
+	return count
+}
+
+func (w *WorkerDispatcher) paused(status *WorkerStatus) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return status.Paused
+}
+
+// handle runs the worker once, recovering from a panic so it doesn't take down every other worker
+func (w *WorkerDispatcher) handle(ctx context.Context, worker Worker, status *WorkerStatus) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("%T panicked: %v\n%s", worker, r, debug.Stack())
+
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			status.Panics++
+			status.ConsecutivePanics++
+			status.LastPanic = fmt.Sprint(r)
+			panicked = true
+		}
+	}()
+
+	worker.Handle(ctx)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	status.ConsecutivePanics = 0
+	return false
+}
+
+func (w *WorkerDispatcher) quarantine(status *WorkerStatus) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.QuarantineAfter > 0 && status.ConsecutivePanics >= w.QuarantineAfter {
+		status.Quarantined = true
+	}
+	return status.Quarantined
+}
+
+func (w *WorkerDispatcher) restartBackoff(status *WorkerStatus) time.Duration {
+	w.mu.Lock()
+	consecutive := status.ConsecutivePanics
+	w.mu.Unlock()
+
+	backoff := w.RestartBackoff
+	for i := 1; i < consecutive && (w.MaxRestartBackoff <= 0 || backoff < w.MaxRestartBackoff); i++ {
+		backoff *= 2
+	}
+	if w.MaxRestartBackoff > 0 && backoff > w.MaxRestartBackoff {
+		backoff = w.MaxRestartBackoff
+	}
+	return backoff
+}
+
+// wait returns how long to wait before handling the worker again
+func (w *WorkerDispatcher) wait(worker Worker) time.Duration {
+	interval := w.interval(worker)
+	if w.Jitter <= 0 {
+		return interval
+	}
+
+	return interval + time.Duration(w.random()*w.Jitter*float64(interval))
+}
+
+// initialDelay returns how long to wait before handling the worker for the first time, a random part of its
+// interval when there's jitter
+func (w *WorkerDispatcher) initialDelay(worker Worker) time.Duration {
+	if w.Jitter <= 0 {
+		return 0
+	}
+
+	return time.Duration(w.random() * float64(w.interval(worker)))
+}
+
+func (w *WorkerDispatcher) interval(worker Worker) time.Duration {
+	if kinded, ok := worker.(KindedWorker); ok {
+		if kindInterval, ok := w.Intervals[kinded.Kind()]; ok {
+			return kindInterval
+		}
+	}
+	return w.RunEvery
+}
+
+func (w *WorkerDispatcher) random() float64 {
+	if w.Random != nil {
+		return w.Random()
+	}
+	return rand.Float64()
+}
+
+func (w *WorkerDispatcher) after(d time.Duration) <-chan time.Time {
+	if w.After != nil {
+		return w.After(d)
+	}
+	return time.After(d)
+}
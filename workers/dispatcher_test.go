@@ -0,0 +1,430 @@
+package workers_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/vela-games/circleci-runner-autoscaler/workers"
+	"golang.org/x/sync/errgroup"
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/poll"
+)
+
+// fakeClock hands every wait requested by the dispatcher to the test, which decides when it's over
+type fakeClock struct {
+	waits chan fakeWait
+}
+
+type fakeWait struct {
+	duration time.Duration
+	done     chan time.Time
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	done := make(chan time.Time, 1)
+	c.waits <- fakeWait{duration: d, done: done}
+	return done
+}
+
+type kindedWorkerTest struct {
+	kind    workers.WorkerKind
+	handled chan struct{}
+}
+
+func (w *kindedWorkerTest) Kind() workers.WorkerKind {
+	return w.kind
+}
+
+func (w *kindedWorkerTest) Handle(ctx context.Context) {
+	w.handled <- struct{}{}
+}
+
+type plainWorkerTest struct {
+	handled chan struct{}
+}
+
+func (w *plainWorkerTest) Handle(ctx context.Context) {
+	w.handled <- struct{}{}
+}
+
+func TestWorkerDispatcher(t *testing.T) {
+	intervals := map[workers.WorkerKind]time.Duration{
+		workers.KindDiscovery: 30 * time.Second,
+		workers.KindScaling:   2 * time.Second,
+	}
+
+	tests := []struct {
+		name   string
+		worker func(handled chan struct{}) workers.Worker
+		jitter float64
+		random float64
+		// Wait before the first run
+		initial time.Duration
+		want    time.Duration
+	}{
+		{
+			name: "discovery workers run at the discovery interval",
+			worker: func(handled chan struct{}) workers.Worker {
+				return &kindedWorkerTest{kind: workers.KindDiscovery, handled: handled}
+			},
+			want: 30 * time.Second,
+		},
+		{
+			name: "scaling workers run at the scaling interval",
+			worker: func(handled chan struct{}) workers.Worker {
+				return &kindedWorkerTest{kind: workers.KindScaling, handled: handled}
+			},
+			want: 2 * time.Second,
+		},
+		{
+			name: "workers of a kind without an interval run at the default one",
+			worker: func(handled chan struct{}) workers.Worker {
+				return &kindedWorkerTest{kind: workers.KindJanitor, handled: handled}
+			},
+			want: 5 * time.Second,
+		},
+		{
+			name: "workers without a kind run at the default interval",
+			worker: func(handled chan struct{}) workers.Worker {
+				return &plainWorkerTest{handled: handled}
+			},
+			want: 5 * time.Second,
+		},
+		{
+			name: "jitter delays the first run and adds a random fraction of the interval",
+			worker: func(handled chan struct{}) workers.Worker {
+				return &kindedWorkerTest{kind: workers.KindScaling, handled: handled}
+			},
+			jitter:  0.5,
+			random:  0.5,
+			initial: time.Second,
+			want:    2500 * time.Millisecond,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			group, ctx := errgroup.WithContext(ctx)
+			clock := &fakeClock{waits: make(chan fakeWait)}
+			handled := make(chan struct{})
+
+			dispatcher := &workers.WorkerDispatcher{
+				RunEvery:  5 * time.Second,
+				Intervals: intervals,
+				Jitter:    tt.jitter,
+				Group:     group,
+				After:     clock.After,
+				Random: func() float64 {
+					return tt.random
+				},
+			}
+			dispatcher.Start(ctx, tt.worker(handled))
+
+			if tt.initial > 0 {
+				wait := <-clock.waits
+				assert.Equal(t, tt.initial, wait.duration)
+				wait.done <- time.Now()
+			}
+
+			// The worker is handled and then waits for the interval before the next run
+			for i := 0; i < 3; i++ {
+				<-handled
+				wait := <-clock.waits
+				assert.Equal(t, tt.want, wait.duration)
+				wait.done <- time.Now()
+			}
+
+			<-handled
+			cancel()
+			<-clock.waits
+			assert.NilError(t, group.Wait())
+		})
+	}
+}
+
+type panickingWorkerTest struct {
+	// Handle panics while panics is positive, counting down on every run
+	panics  int
+	handled chan struct{}
+}
+
+func (w *panickingWorkerTest) Handle(ctx context.Context) {
+	w.handled <- struct{}{}
+	if w.panics > 0 {
+		w.panics--
+		var response *struct{ Count *int }
+		_ = *response.Count
+	}
+}
+
+func TestWorkerDispatcherPanics(t *testing.T) {
+	t.Run("it should restart panicking workers with backoff and keep other workers running", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		group, ctx := errgroup.WithContext(ctx)
+		clock := &fakeClock{waits: make(chan fakeWait)}
+		handled := make(chan struct{})
+
+		dispatcher := &workers.WorkerDispatcher{
+			RunEvery:          5 * time.Second,
+			Group:             group,
+			RestartBackoff:    10 * time.Second,
+			MaxRestartBackoff: 30 * time.Second,
+			QuarantineAfter:   5,
+			After:             clock.After,
+		}
+		dispatcher.Start(ctx, &panickingWorkerTest{panics: 3, handled: handled})
+
+		for _, want := range []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second, 5 * time.Second} {
+			<-handled
+			wait := <-clock.waits
+			assert.Equal(t, want, wait.duration)
+			wait.done <- time.Now()
+		}
+
+		<-handled
+		status := dispatcher.Status()
+		assert.Equal(t, 1, len(status))
+		assert.Equal(t, 3, status[0].Panics)
+		assert.Equal(t, false, status[0].Quarantined)
+		assert.Assert(t, status[0].LastPanic != "")
+
+		cancel()
+		<-clock.waits
+		assert.NilError(t, group.Wait())
+	})
+
+	t.Run("it should quarantine workers that keep panicking without stopping other workers", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		group, ctx := errgroup.WithContext(ctx)
+		clock := &fakeClock{waits: make(chan fakeWait)}
+		handled := make(chan struct{})
+
+		dispatcher := &workers.WorkerDispatcher{
+			RunEvery:        5 * time.Second,
+			Group:           group,
+			RestartBackoff:  time.Second,
+			QuarantineAfter: 3,
+			After:           clock.After,
+		}
+		dispatcher.Start(ctx, &panickingWorkerTest{panics: 10, handled: handled})
+
+		for i := 0; i < 2; i++ {
+			<-handled
+			wait := <-clock.waits
+			wait.done <- time.Now()
+		}
+		<-handled
+		poll.WaitOn(t, func(poll.LogT) poll.Result {
+			if dispatcher.Status()[0].Quarantined {
+				return poll.Success()
+			}
+			return poll.Continue("worker not quarantined yet")
+		})
+
+		// A healthy worker on the same group keeps running after the other one is quarantined
+		healthyClock := &fakeClock{waits: make(chan fakeWait)}
+		healthyHandled := make(chan struct{})
+		healthyDispatcher := &workers.WorkerDispatcher{
+			RunEvery: 5 * time.Second,
+			Group:    group,
+			After:    healthyClock.After,
+		}
+		healthyDispatcher.Start(ctx, &plainWorkerTest{handled: healthyHandled})
+		for i := 0; i < 2; i++ {
+			<-healthyHandled
+			wait := <-healthyClock.waits
+			wait.done <- time.Now()
+		}
+		<-healthyHandled
+
+		assert.Equal(t, 3, dispatcher.Status()[0].Panics)
+
+		cancel()
+		<-healthyClock.waits
+		assert.NilError(t, group.Wait())
+	})
+}
+
+type panickingClassWorkerTest struct {
+	panickingWorkerTest
+}
+
+func (w *panickingClassWorkerTest) Kind() workers.WorkerKind {
+	return workers.KindScaling
+}
+
+func (w *panickingClassWorkerTest) ResourceClassName() string {
+	return "vela-games/small"
+}
+
+func TestWorkerDispatcherWakeDuringBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	group, ctx := errgroup.WithContext(ctx)
+	clock := &fakeClock{waits: make(chan fakeWait)}
+	handled := make(chan struct{})
+
+	dispatcher := &workers.WorkerDispatcher{
+		RunEvery:       5 * time.Second,
+		Group:          group,
+		RestartBackoff: 10 * time.Second,
+		After:          clock.After,
+	}
+	dispatcher.Start(ctx, &panickingClassWorkerTest{panickingWorkerTest{panics: 1, handled: handled}})
+
+	<-handled
+	backoff := <-clock.waits
+	assert.Equal(t, 10*time.Second, backoff.duration)
+
+	// The worker is woken up but stays in backoff
+	assert.Equal(t, 1, dispatcher.WakeResourceClass("vela-games/small"))
+	select {
+	case <-handled:
+		t.Error("worker was handled during its restart backoff")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The run after the backoff covers the wake-up, which isn't run again
+	backoff.done <- time.Now()
+	<-handled
+	wait := <-clock.waits
+	assert.Equal(t, 5*time.Second, wait.duration)
+	select {
+	case <-handled:
+		t.Error("wake-up was run after the backoff")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+	assert.NilError(t, group.Wait())
+}
+
+type classWorkerTest struct {
+	kindedWorkerTest
+	class string
+}
+
+func (w *classWorkerTest) ResourceClassName() string {
+	return w.class
+}
+
+func TestWorkerDispatcherWake(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	group, ctx := errgroup.WithContext(ctx)
+	clock := &fakeClock{waits: make(chan fakeWait)}
+
+	dispatcher := &workers.WorkerDispatcher{
+		RunEvery: 5 * time.Second,
+		Group:    group,
+		After:    clock.After,
+	}
+
+	small := &classWorkerTest{kindedWorkerTest{kind: workers.KindScaling, handled: make(chan struct{})}, "vela-games/small"}
+	large := &classWorkerTest{kindedWorkerTest{kind: workers.KindScaling, handled: make(chan struct{})}, "vela-games/large"}
+	discovery := &kindedWorkerTest{kind: workers.KindDiscovery, handled: make(chan struct{})}
+
+	dispatcher.Start(ctx, small)
+	<-small.handled
+	<-clock.waits
+	dispatcher.Start(ctx, large)
+	<-large.handled
+	<-clock.waits
+	dispatcher.Start(ctx, discovery)
+	<-discovery.handled
+	<-clock.waits
+
+	// Only the worker of the resource class runs, without its wait being over
+	assert.Equal(t, 1, dispatcher.WakeResourceClass("vela-games/small"))
+	<-small.handled
+	<-clock.waits
+
+	assert.Equal(t, 0, dispatcher.WakeResourceClass("vela-games/unknown"))
+
+	// An empty class wakes every scaling worker but not discovery
+	assert.Equal(t, 2, dispatcher.WakeResourceClass(""))
+	<-small.handled
+	<-clock.waits
+	<-large.handled
+	<-clock.waits
+
+	select {
+	case <-discovery.handled:
+		t.Error("discovery worker was woken up")
+	default:
+	}
+
+	cancel()
+	assert.NilError(t, group.Wait())
+}
+
+func TestWorkerDispatcherPause(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	group, ctx := errgroup.WithContext(ctx)
+	clock := &fakeClock{waits: make(chan fakeWait)}
+
+	dispatcher := &workers.WorkerDispatcher{
+		RunEvery: 5 * time.Second,
+		Group:    group,
+		After:    clock.After,
+	}
+
+	worker := &classWorkerTest{kindedWorkerTest{kind: workers.KindScaling, handled: make(chan struct{}, 1)}, "vela-games/small"}
+	dispatcher.Start(ctx, worker)
+	<-worker.handled
+	<-clock.waits
+
+	assert.Equal(t, 1, dispatcher.PauseResourceClass("vela-games/small"))
+	assert.Equal(t, 0, dispatcher.PauseResourceClass("vela-games/unknown"))
+	assert.Equal(t, true, dispatcher.Status()[0].Paused)
+
+	// A paused worker keeps ticking without being handled
+	dispatcher.WakeResourceClass("vela-games/small")
+	wait := <-clock.waits
+	assert.Equal(t, 0, len(worker.handled))
+
+	assert.Equal(t, 1, dispatcher.ResumeResourceClass("vela-games/small"))
+	wait.done <- time.Now()
+	<-worker.handled
+	<-clock.waits
+
+	cancel()
+	assert.NilError(t, group.Wait())
+}
+
+func TestWorkerDispatcherStop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	group, ctx := errgroup.WithContext(ctx)
+	clock := &fakeClock{waits: make(chan fakeWait)}
+
+	dispatcher := &workers.WorkerDispatcher{
+		RunEvery: 5 * time.Second,
+		Group:    group,
+		After:    clock.After,
+	}
+
+	small := &classWorkerTest{kindedWorkerTest{kind: workers.KindScaling, handled: make(chan struct{})}, "vela-games/small"}
+	large := &classWorkerTest{kindedWorkerTest{kind: workers.KindScaling, handled: make(chan struct{})}, "vela-games/large"}
+
+	smallCtx, stopSmall := context.WithCancel(ctx)
+	dispatcher.Start(smallCtx, small)
+	<-small.handled
+	<-clock.waits
+	dispatcher.Start(ctx, large)
+	<-large.handled
+	<-clock.waits
+
+	// Stopping a single worker removes it and leaves the others running
+	stopSmall()
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		if len(dispatcher.Status()) != 1 {
+			return poll.Continue("the stopped worker is still dispatched")
+		}
+		return poll.Success()
+	}, poll.WithDelay(time.Millisecond))
+	assert.Equal(t, workers.Worker(large), dispatcher.Status()[0].Worker)
+	assert.Equal(t, 0, dispatcher.WakeResourceClass("vela-games/small"))
+
+	cancel()
+	assert.NilError(t, group.Wait())
+}
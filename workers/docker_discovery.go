@@ -0,0 +1,90 @@
+package workers
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vela-games/circleci-runner-autoscaler/budget"
+	"github.com/vela-games/circleci-runner-autoscaler/client"
+	"github.com/vela-games/circleci-runner-autoscaler/services"
+)
+
+// DockerDiscoveryWorker starts a DockerScalingWorker for every resource class with an image configured
+type DockerDiscoveryWorker struct {
+	Dispatcher Dispatcher
+
+	// Docker host the containers run on
+	Target            string
+	ContainersService services.ContainersAPI
+	CircleCiClient    client.ClientWithResponsesInterface
+	Budget            *budget.Budget
+
+	// Image and runner token of every resource class
+	Images       map[string]string
+	RunnerTokens map[string]string
+
+	// Settings of every resource class
+	MaxContainers int32
+	IdleTimeout   time.Duration
+	LaunchTimeout time.Duration
+
+	Namespace                 string
+	childWorkersResourceClass []string
+
+	reporter
+}
+
+func (w *DockerDiscoveryWorker) Kind() WorkerKind {
+	return KindDiscovery
+}
+
+func (w *DockerDiscoveryWorker) Report() WorkerReport {
+	report := w.snapshot()
+	report.Backend = "docker"
+	report.Target = w.Target
+	return report
+}
+
+func (w *DockerDiscoveryWorker) Handle(ctx context.Context) {
+	var classNames []string
+	for className := range w.Images {
+		classNames = append(classNames, className)
+	}
+	sort.Strings(classNames)
+
+	for _, className := range classNames {
+		if strings.Split(className, "/")[0] != w.Namespace {
+			continue
+		}
+
+		found := false
+		for _, c := range w.childWorkersResourceClass {
+			if className == c {
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+
+		w.childWorkersResourceClass = append(w.childWorkersResourceClass, className)
+		log.Printf("Found new resource class %v with image %v on %v, starting scaling worker for it", className, w.Images[className], w.Target)
+		w.Dispatcher.Start(ctx, &DockerScalingWorker{
+			ResourceClass:     className,
+			Target:            w.Target,
+			Image:             w.Images[className],
+			RunnerToken:       w.RunnerTokens[className],
+			ContainersService: w.ContainersService,
+			CircleCiClient:    w.CircleCiClient,
+			MaxContainers:     w.MaxContainers,
+			IdleTimeout:       w.IdleTimeout,
+			LaunchTimeout:     w.LaunchTimeout,
+			Budget:            w.Budget,
+		})
+	}
+	w.decided("scaling %v resource classes", len(w.childWorkersResourceClass))
+}
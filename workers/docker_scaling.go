@@ -0,0 +1,210 @@
+package workers
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/vela-games/circleci-runner-autoscaler/budget"
+	circleci_client "github.com/vela-games/circleci-runner-autoscaler/client"
+	"github.com/vela-games/circleci-runner-autoscaler/services"
+)
+
+// Containers get this long to exit once their runner is idle before they're killed
+const dockerStopTimeout = 30 * time.Second
+
+// DockerScalingWorker starts the runner containers of a resource class on a Docker-compatible engine. Its containers
+// are found by their labels, and stopped once their runner is idle for IdleTimeout.
+type DockerScalingWorker struct {
+	ResourceClass string
+	// Docker host the containers run on
+	Target string
+	Image  string
+	// Optional, passed to the containers as CIRCLECI_RUNNER_API_AUTH_TOKEN
+	RunnerToken string
+
+	ContainersService services.ContainersAPI
+	CircleCiClient    circleci_client.ClientWithResponsesInterface
+
+	// Most containers the resource class can have at once
+	MaxContainers int32
+	// Runners that didn't run a task for this long are stopped, never if not set
+	IdleTimeout time.Duration
+	// Containers whose runner doesn't show up in CircleCI for this long are removed, never if not set
+	LaunchTimeout time.Duration
+
+	// Optional, launches are limited to the capacity the budget grants
+	Budget *budget.Budget
+
+	TimestampGenerator func() int64
+
+	// Only decide what to start and stop, without touching any container
+	DryRun bool
+
+	reporter
+	capacityLimit
+}
+
+func (w *DockerScalingWorker) Kind() WorkerKind {
+	return KindScaling
+}
+
+func (w *DockerScalingWorker) ResourceClassName() string {
+	return w.ResourceClass
+}
+
+func (w *DockerScalingWorker) Report() WorkerReport {
+	report := w.snapshot()
+	report.Backend = "docker"
+	report.Target = w.Target
+	report.ResourceClass = w.ResourceClass
+	w.reportLimit(&report, w.now())
+	return report
+}
+
+func (w *DockerScalingWorker) Handle(ctx context.Context) {
+	w.scaling().handle(ctx)
+}
+
+func (w *DockerScalingWorker) Inspect(ctx context.Context) (ClassState, error) {
+	state := ClassState{
+		ResourceClass: w.ResourceClass,
+		Backend:       "docker",
+		Target:        w.Target,
+		Group:         w.Image,
+		MaxSize:       w.MaxContainers,
+	}
+	return state, w.scaling().inspect(ctx, &state)
+}
+
+func (w *DockerScalingWorker) scaling() launchScaling {
+	return launchScaling{
+		resourceClass:  w.ResourceClass,
+		circleCiClient: w.CircleCiClient,
+		backend:        w,
+		maxMachines:    w.MaxContainers,
+		idleTimeout:    w.IdleTimeout,
+		launchTimeout:  w.LaunchTimeout,
+		budget:         w.Budget,
+		dryRun:         w.DryRun,
+		now:            w.now(),
+		source:         w.Image,
+		unit:           "containers",
+		machineType:    w.Image,
+		reporter:       &w.reporter,
+		limit:          &w.capacityLimit,
+	}
+}
+
+// listMachines returns the containers we started for the resource class, with their runner. Containers that exited
+// and weren't removed, e.g. because the engine was restarted, are gone.
+func (w *DockerScalingWorker) listMachines(ctx context.Context) ([]launchedMachine, error) {
+	containers, err := w.ContainersService.ListContainers(ctx, map[string]string{
+		resourceClassTagKey: w.ResourceClass,
+		managedByTag:        managedByValue,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(containers) == 0 {
+		return nil, nil
+	}
+
+	runners, err := classRunners(ctx, w.CircleCiClient, w.ResourceClass)
+	if err != nil {
+		return nil, err
+	}
+
+	var machines []launchedMachine
+	for _, container := range containers {
+		machine := launchedMachine{
+			id:       container.ID,
+			name:     "container " + container.Name,
+			launched: container.Created,
+			gone:     container.State == "exited" || container.State == "dead",
+			ready:    container.State == "running",
+		}
+		// Runners are named after their container, and have the short container id as hostname
+		names := []string{container.Name, container.ID}
+		if len(container.ID) > 12 {
+			names = append(names, container.ID[:12])
+		}
+		for i := range runners {
+			if matchesAny(runners[i], names) {
+				machine.runner = &runners[i]
+			}
+		}
+		machines = append(machines, machine)
+	}
+
+	return machines, nil
+}
+
+// launch starts the containers one by one, and stops at the first one that fails
+func (w *DockerScalingWorker) launch(ctx context.Context, count int32) (int32, error) {
+	var started int32
+	for ; started < count; started++ {
+		spec, err := w.containerSpec()
+		if err != nil {
+			return started, err
+		}
+		if _, err := w.ContainersService.RunContainer(ctx, spec); err != nil {
+			return started, err
+		}
+	}
+	return started, nil
+}
+
+// remove stops the containers, which the engine removes once they exit, or removes them right away if not graceful
+func (w *DockerScalingWorker) remove(ctx context.Context, machines []launchedMachine, graceful bool) error {
+	for _, machine := range machines {
+		if graceful {
+			if err := w.ContainersService.StopContainer(ctx, machine.id, dockerStopTimeout); err != nil {
+				return fmt.Errorf("stopping %v: %w", machine.name, err)
+			}
+			continue
+		}
+		if err := w.ContainersService.RemoveContainer(ctx, machine.id); err != nil {
+			return fmt.Errorf("removing %v: %w", machine.name, err)
+		}
+	}
+	return nil
+}
+
+// containerSpec describes a new container of the resource class. The random suffix only keeps the names of
+// containers started together apart, a launch that's retried starts new containers.
+func (w *DockerScalingWorker) containerSpec() (services.ContainerSpec, error) {
+	suffix := make([]byte, 5)
+	if _, err := rand.Read(suffix); err != nil {
+		return services.ContainerSpec{}, err
+	}
+	classParts := strings.Split(w.ResourceClass, "/")
+	name := fmt.Sprintf("%v-%x", classParts[len(classParts)-1], suffix)
+
+	env := []string{
+		"CIRCLECI_RUNNER_NAME=" + name,
+		"CIRCLECI_RUNNER_RESOURCE_CLASS=" + w.ResourceClass,
+	}
+	if w.RunnerToken != "" {
+		env = append(env, "CIRCLECI_RUNNER_API_AUTH_TOKEN="+w.RunnerToken)
+	}
+
+	return services.ContainerSpec{
+		Name:  name,
+		Image: w.Image,
+		Env:   env,
+		Labels: map[string]string{
+			resourceClassTagKey: w.ResourceClass,
+			managedByTag:        managedByValue,
+		},
+	}, nil
+}
+
+func (w *DockerScalingWorker) now() time.Time {
+	if w.TimestampGenerator != nil {
+		return time.Unix(w.TimestampGenerator(), 0)
+	}
+	return time.Now()
+}
@@ -0,0 +1,349 @@
+package workers_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vela-games/circleci-runner-autoscaler/services"
+	"github.com/vela-games/circleci-runner-autoscaler/workers"
+	"gotest.tools/v3/assert"
+)
+
+// fakeEngine answers the Engine API calls of the Docker backend like an engine with AutoRemove containers does
+type fakeEngine struct {
+	mu sync.Mutex
+	// Creation time of the containers it creates
+	now time.Time
+
+	images     map[string]bool
+	containers []fakeContainer
+	// Error the pull of an image fails with after it started
+	pullError string
+
+	pulled  []string
+	stopped []string
+	removed []string
+}
+
+type fakeContainer struct {
+	Id      string
+	Names   []string
+	Image   string
+	State   string
+	Labels  map[string]string
+	Created int64
+	Env     []string `json:"-"`
+}
+
+func (f *fakeEngine) container(name string, state string, created time.Time, labels map[string]string) {
+	f.containers = append(f.containers, fakeContainer{
+		Id:      fmt.Sprintf("%064x", len(f.containers)+1),
+		Names:   []string{"/" + name},
+		State:   state,
+		Labels:  labels,
+		Created: created.Unix(),
+	})
+}
+
+// listen serves the engine on a unix socket, and returns a client for it
+func (f *fakeEngine) listen(t *testing.T) *services.DockerEngine {
+	// Socket paths can't be much longer than 100 characters, too short for the temporary directories of subtests
+	dir, err := os.MkdirTemp("", "engine")
+	assert.NilError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	socket := filepath.Join(dir, "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	assert.NilError(t, err)
+
+	server := httptest.NewUnstartedServer(f)
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+
+	engine, err := services.NewDockerEngine("unix://" + socket)
+	assert.NilError(t, err)
+	return engine
+}
+
+func (f *fakeEngine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1.41")
+	switch {
+	case r.Method == http.MethodGet && path == "/containers/json":
+		var filters map[string][]string
+		_ = json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters)
+		containers := []fakeContainer{}
+		for _, container := range f.containers {
+			if hasLabels(container.Labels, filters["label"]) {
+				containers = append(containers, container)
+			}
+		}
+		_ = json.NewEncoder(w).Encode(containers)
+
+	case r.Method == http.MethodPost && path == "/images/create":
+		image := r.URL.Query().Get("fromImage")
+		f.pulled = append(f.pulled, image)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "Pulling from " + image})
+		if f.pullError != "" {
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": f.pullError})
+			return
+		}
+		f.images[image] = true
+
+	case r.Method == http.MethodPost && path == "/containers/create":
+		var body struct {
+			Image  string
+			Env    []string
+			Labels map[string]string
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		if !f.images[body.Image] {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]string{"message": "No such image: " + body.Image})
+			return
+		}
+		f.container(r.URL.Query().Get("name"), "created", f.now, body.Labels)
+		created := &f.containers[len(f.containers)-1]
+		created.Image, created.Env = body.Image, body.Env
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]string{"Id": created.Id})
+
+	case r.Method == http.MethodPost && strings.HasSuffix(path, "/start"):
+		for i := range f.containers {
+			if f.containers[i].Id == strings.Split(path, "/")[2] {
+				f.containers[i].State = "running"
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPost && strings.HasSuffix(path, "/stop"):
+		id := strings.Split(path, "/")[2]
+		f.stopped = append(f.stopped, id)
+		f.delete(id)
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodDelete && strings.HasPrefix(path, "/containers/"):
+		id := strings.TrimPrefix(path, "/containers/")
+		f.removed = append(f.removed, id)
+		f.delete(id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeEngine) delete(id string) {
+	for i := range f.containers {
+		if f.containers[i].Id == id {
+			f.containers = append(f.containers[:i], f.containers[i+1:]...)
+			return
+		}
+	}
+}
+
+func hasLabels(labels map[string]string, filters []string) bool {
+	for _, filter := range filters {
+		key, value, _ := strings.Cut(filter, "=")
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+var managedContainer = map[string]string{"resource-class": "vela-games/linux-large", "managed-by": "circleci-runner-autoscaler"}
+
+func dockerWorker(t *testing.T, engine *fakeEngine, unclaimed int, running int, lastUsed map[string]time.Time, now time.Time) *workers.DockerScalingWorker {
+	circleCiClient := drainCircleCiClient(running, lastUsed)
+	circleCiClient.MockGetUnclaimedTasksWithResponse = inspectCircleCiClient(unclaimed).MockGetUnclaimedTasksWithResponse
+	return &workers.DockerScalingWorker{
+		ResourceClass:      "vela-games/linux-large",
+		Target:             "unix:///var/run/docker.sock",
+		Image:              "circleci/runner-agent:machine-3",
+		RunnerToken:        "runner-token",
+		ContainersService:  engine.listen(t),
+		CircleCiClient:     circleCiClient,
+		MaxContainers:      3,
+		IdleTimeout:        10 * time.Minute,
+		LaunchTimeout:      5 * time.Minute,
+		TimestampGenerator: func() int64 { return now.Unix() },
+	}
+}
+
+func TestDockerDiscoveryWorker(t *testing.T) {
+	dispatcher := &WorkerDispatcherTest{}
+
+	discovery := &workers.DockerDiscoveryWorker{
+		Dispatcher: dispatcher,
+		Namespace:  "vela-games",
+		Target:     "unix:///var/run/docker.sock",
+		Images: map[string]string{
+			"vela-games/linux-large":     "circleci/runner-agent:machine-3",
+			"vela-games/linux-gpu":       "vela-games/gpu-runner:latest",
+			"other-namespace/linux-fast": "circleci/runner-agent:machine-3",
+		},
+		RunnerTokens:  map[string]string{"vela-games/linux-large": "runner-token"},
+		MaxContainers: 5,
+	}
+	discovery.Handle(context.TODO())
+	discovery.Handle(context.TODO())
+
+	assert.Equal(t, 2, dispatcher.Count)
+	assert.Equal(t, "scaling 2 resource classes", discovery.Report().LastDecision)
+
+	gpu := dispatcher.Workers[0].(*workers.DockerScalingWorker)
+	assert.Equal(t, "vela-games/linux-gpu", gpu.ResourceClass)
+	assert.Equal(t, "vela-games/gpu-runner:latest", gpu.Image)
+	assert.Equal(t, "", gpu.RunnerToken)
+	assert.Equal(t, "runner-token", dispatcher.Workers[1].(*workers.DockerScalingWorker).RunnerToken)
+	assert.Equal(t, int32(5), dispatcher.Workers[1].(*workers.DockerScalingWorker).MaxContainers)
+}
+
+func TestDockerScalingWorker(t *testing.T) {
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+
+	t.Run("it should start containers for the unclaimed tasks the starting ones won't take", func(t *testing.T) {
+		engine := &fakeEngine{images: map[string]bool{}}
+		engine.container("linux-large-starting", "running", now.Add(-time.Minute), managedContainer)
+		// Not started by the autoscaler
+		engine.container("linux-large-manual", "running", now.Add(-time.Minute), map[string]string{"resource-class": "vela-games/linux-large"})
+
+		worker := dockerWorker(t, engine, 2, 0, nil, now)
+		worker.Handle(context.TODO())
+
+		// The image is pulled as it's missing
+		assert.DeepEqual(t, []string{"circleci/runner-agent:machine-3"}, engine.pulled)
+		assert.Equal(t, 3, len(engine.containers))
+		started := engine.containers[2]
+		assert.Equal(t, "running", started.State)
+		assert.DeepEqual(t, managedContainer, started.Labels)
+		assert.DeepEqual(t, []string{
+			"CIRCLECI_RUNNER_NAME=" + strings.TrimPrefix(started.Names[0], "/"),
+			"CIRCLECI_RUNNER_RESOURCE_CLASS=vela-games/linux-large",
+			"CIRCLECI_RUNNER_API_AUTH_TOKEN=runner-token",
+		}, started.Env)
+		assert.Equal(t, "2 unclaimed tasks, launched 1 containers from circleci/runner-agent:machine-3", worker.Report().LastDecision)
+		assert.Equal(t, int32(2), worker.Report().PendingCapacity)
+	})
+
+	t.Run("it should not go over the max containers", func(t *testing.T) {
+		engine := &fakeEngine{now: now, images: map[string]bool{"circleci/runner-agent:machine-3": true}}
+		worker := dockerWorker(t, engine, 5, 0, nil, now)
+		worker.Handle(context.TODO())
+		worker.Handle(context.TODO())
+
+		assert.Equal(t, 3, len(engine.containers))
+		assert.Equal(t, 0, len(engine.pulled))
+		// Containers started together get different names
+		names := map[string]bool{}
+		for _, container := range engine.containers {
+			names[container.Names[0]] = true
+		}
+		assert.Equal(t, 3, len(names))
+		assert.Equal(t, "5 unclaimed tasks but 3 containers is the max of 3", worker.Report().LastDecision)
+	})
+
+	t.Run("it should stop runners that haven't run a task for the idle timeout", func(t *testing.T) {
+		engine := &fakeEngine{}
+		engine.container("linux-large-aaaa", "running", now.Add(-time.Hour), managedContainer)
+		engine.container("linux-large-bbbb", "running", now.Add(-time.Hour), managedContainer)
+		engine.container("linux-large-cccc", "running", now.Add(-time.Hour), managedContainer)
+		idle := []string{engine.containers[0].Id, engine.containers[1].Id}
+
+		worker := dockerWorker(t, engine, 0, 0, map[string]time.Time{
+			"linux-large-aaaa": now.Add(-30 * time.Minute),
+			"linux-large-bbbb": now.Add(-time.Hour),
+			"linux-large-cccc": now.Add(-5 * time.Minute),
+		}, now)
+		worker.Handle(context.TODO())
+
+		assert.DeepEqual(t, idle, engine.stopped)
+		assert.Equal(t, "no unclaimed tasks, removed 2 containers", worker.Report().LastDecision)
+	})
+
+	t.Run("it should not stop any runner while tasks are running", func(t *testing.T) {
+		engine := &fakeEngine{}
+		engine.container("linux-large-aaaa", "running", now.Add(-time.Hour), managedContainer)
+		engine.container("linux-large-bbbb", "running", now.Add(-time.Hour), managedContainer)
+
+		// CircleCI doesn't tell which runner runs the task, and containers can't say they're idle
+		worker := dockerWorker(t, engine, 0, 1, map[string]time.Time{
+			"linux-large-aaaa": now.Add(-30 * time.Minute),
+			"linux-large-bbbb": now.Add(-time.Hour),
+		}, now)
+		worker.Handle(context.TODO())
+
+		assert.Equal(t, 0, len(engine.stopped))
+		assert.Equal(t, "no unclaimed tasks, removed 0 containers", worker.Report().LastDecision)
+	})
+
+	t.Run("it should remove containers whose runner never showed up or that exited", func(t *testing.T) {
+		engine := &fakeEngine{}
+		engine.container("linux-large-aaaa", "running", now.Add(-time.Hour), managedContainer)
+		engine.container("linux-large-bbbb", "running", now.Add(-time.Minute), managedContainer)
+		engine.container("linux-large-cccc", "exited", now.Add(-time.Minute), managedContainer)
+		removed := []string{engine.containers[0].Id, engine.containers[2].Id}
+
+		worker := dockerWorker(t, engine, 0, 0, nil, now)
+		worker.Handle(context.TODO())
+
+		assert.DeepEqual(t, removed, engine.removed)
+		assert.Equal(t, 0, len(engine.stopped))
+	})
+
+	t.Run("it should fail when the image can't be pulled", func(t *testing.T) {
+		engine := &fakeEngine{images: map[string]bool{}, pullError: "manifest unknown"}
+		worker := dockerWorker(t, engine, 1, 0, nil, now)
+		worker.Handle(context.TODO())
+
+		assert.Equal(t, 0, len(engine.containers))
+		assert.Assert(t, strings.Contains(worker.Report().LastError, "manifest unknown"), worker.Report().LastError)
+	})
+
+	t.Run("it should not touch any container in dry run", func(t *testing.T) {
+		engine := &fakeEngine{images: map[string]bool{"circleci/runner-agent:machine-3": true}}
+		engine.container("linux-large-aaaa", "running", now.Add(-time.Hour), managedContainer)
+
+		worker := dockerWorker(t, engine, 0, 0, map[string]time.Time{"linux-large-aaaa": now.Add(-time.Hour)}, now)
+		worker.DryRun = true
+		worker.Handle(context.TODO())
+		assert.Equal(t, "dry run: no unclaimed tasks, would remove 1 containers", worker.Report().LastDecision)
+
+		worker = dockerWorker(t, engine, 2, 0, map[string]time.Time{"linux-large-aaaa": now.Add(-time.Hour)}, now)
+		worker.DryRun = true
+		worker.Handle(context.TODO())
+		assert.Equal(t, "dry run: 2 unclaimed tasks, would launch 2 containers from circleci/runner-agent:machine-3", worker.Report().LastDecision)
+
+		assert.Equal(t, 0, len(engine.stopped))
+		assert.Equal(t, 1, len(engine.containers))
+	})
+
+	t.Run("it should describe the state of the containers", func(t *testing.T) {
+		engine := &fakeEngine{}
+		engine.container("linux-large-aaaa", "running", now.Add(-time.Hour), managedContainer)
+		engine.container("linux-large-bbbb", "created", now.Add(-time.Minute), managedContainer)
+		engine.container("linux-large-cccc", "exited", now.Add(-time.Minute), managedContainer)
+
+		state, err := dockerWorker(t, engine, 0, 0, map[string]time.Time{"linux-large-aaaa": now}, now).Inspect(context.TODO())
+		assert.NilError(t, err)
+
+		assert.Equal(t, "docker", state.Backend)
+		assert.Equal(t, int32(2), state.DesiredCapacity)
+		assert.Equal(t, int32(1), state.Ready)
+		assert.Equal(t, int32(3), state.MaxSize)
+	})
+}
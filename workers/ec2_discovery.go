@@ -0,0 +1,149 @@
+package workers
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/vela-games/circleci-runner-autoscaler/budget"
+	"github.com/vela-games/circleci-runner-autoscaler/client"
+	"github.com/vela-games/circleci-runner-autoscaler/services"
+)
+
+// Launch templates can set the most instances of their resource class with this tag
+const maxInstancesTagKey = "max-instances"
+
+// EC2DiscoveryWorker finds the launch templates tagged with a resource class and starts an EC2ScalingWorker for each
+type EC2DiscoveryWorker struct {
+	Dispatcher Dispatcher
+
+	// Launch templates are discovered in every target, if there are none Ec2AwsService is used
+	Targets        []services.AutoScalingTarget
+	Ec2AwsService  services.EC2API
+	CircleCiClient client.ClientWithResponsesInterface
+	Budget         *budget.Budget
+	// Optional, instances EC2 is taking back aren't counted as ready runners
+	Interruptions *Interruptions
+
+	// Settings of the resource classes whose launch template doesn't have a max-instances tag
+	MaxInstances  int32
+	IdleTimeout   time.Duration
+	LaunchTimeout time.Duration
+	Matcher       *RunnerMatcher
+
+	Namespace                 string
+	childWorkersResourceClass []string
+
+	reporter
+}
+
+func (w *EC2DiscoveryWorker) Kind() WorkerKind {
+	return KindDiscovery
+}
+
+func (w *EC2DiscoveryWorker) Report() WorkerReport {
+	report := w.snapshot()
+	report.Backend = "ec2"
+	report.Target = "default"
+	if len(w.Targets) > 0 {
+		var names []string
+		for _, target := range w.Targets {
+			names = append(names, target.Name)
+		}
+		report.Target = strings.Join(names, ",")
+	}
+	return report
+}
+
+func (w *EC2DiscoveryWorker) Handle(ctx context.Context) {
+	targets := w.Targets
+	if len(targets) == 0 {
+		targets = []services.AutoScalingTarget{
+			{
+				Name:      "default",
+				EC2Client: w.Ec2AwsService,
+			},
+		}
+	}
+
+	for _, target := range targets {
+		w.discover(ctx, target)
+	}
+	w.decided("scaling %v resource classes", len(w.childWorkersResourceClass))
+}
+
+// discover starts scaling workers for the launch templates found in the target account and region.
+// If a resource class has launch templates in several targets only the first one found is scaled.
+func (w *EC2DiscoveryWorker) discover(ctx context.Context, target services.AutoScalingTarget) {
+	paginator := ec2.NewDescribeLaunchTemplatesPaginator(target.EC2Client, &ec2.DescribeLaunchTemplatesInput{
+		Filters: []ec2types.Filter{
+			{Name: aws.String("tag-key"), Values: []string{resourceClassTagKey}},
+		},
+	})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			log.Printf("error getting launch templates from %v: %v", target.Name, err)
+			w.failed("getting launch templates from %v: %v", target.Name, err)
+			return
+		}
+
+		for _, template := range output.LaunchTemplates {
+			w.startWorker(ctx, target, template)
+		}
+	}
+}
+
+func (w *EC2DiscoveryWorker) startWorker(ctx context.Context, target services.AutoScalingTarget, template ec2types.LaunchTemplate) {
+	className := ""
+	maxInstances := w.MaxInstances
+	for _, tag := range template.Tags {
+		switch aws.ToString(tag.Key) {
+		case resourceClassTagKey:
+			className = aws.ToString(tag.Value)
+		case maxInstancesTagKey:
+			max, err := strconv.Atoi(aws.ToString(tag.Value))
+			if err != nil || max < 0 {
+				log.Printf("ignoring invalid %v tag %q of launch template %v", maxInstancesTagKey, aws.ToString(tag.Value), aws.ToString(template.LaunchTemplateName))
+				continue
+			}
+			maxInstances = int32(max)
+		}
+	}
+
+	if className == "" || strings.Split(className, "/")[0] != w.Namespace {
+		return
+	}
+
+	for _, c := range w.childWorkersResourceClass {
+		if className == c {
+			return
+		}
+	}
+
+	w.childWorkersResourceClass = append(w.childWorkersResourceClass, className)
+	log.Printf("Found new resource class %v with launch template %v in %v, starting scaling worker for it", className, aws.ToString(template.LaunchTemplateName), target.Name)
+
+	matcher := &RunnerMatcher{Interruptions: w.Interruptions}
+	if w.Matcher != nil {
+		matcher.Mode = w.Matcher.Mode
+		matcher.TagKey = w.Matcher.TagKey
+	}
+	w.Dispatcher.Start(ctx, &EC2ScalingWorker{
+		ResourceClass:    className,
+		Target:           target.Name,
+		LaunchTemplateID: aws.ToString(template.LaunchTemplateId),
+		Ec2AwsService:    target.EC2Client,
+		CircleCiClient:   w.CircleCiClient,
+		MaxInstances:     maxInstances,
+		IdleTimeout:      w.IdleTimeout,
+		LaunchTimeout:    w.LaunchTimeout,
+		Matcher:          matcher,
+		Budget:           w.Budget,
+	})
+}
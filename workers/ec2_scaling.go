@@ -0,0 +1,221 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/vela-games/circleci-runner-autoscaler/budget"
+	circleci_client "github.com/vela-games/circleci-runner-autoscaler/client"
+	"github.com/vela-games/circleci-runner-autoscaler/services"
+)
+
+const (
+	// Launch templates of the EC2 backend are tagged with their resource class, and so are the instances we launch
+	resourceClassTagKey = "resource-class"
+	// Instances launched by the EC2 backend are tagged with it, so we never terminate instances we didn't launch
+	managedByTag   = "managed-by"
+	managedByValue = "circleci-runner-autoscaler"
+)
+
+// EC2ScalingWorker launches the runners of a resource class straight from its launch template, for classes where an
+// ASG is overkill. Its instances are found by their tags, and terminated once their runner is idle for IdleTimeout.
+type EC2ScalingWorker struct {
+	ResourceClass string
+	// Name of the account and region the instances live in
+	Target           string
+	LaunchTemplateID string
+
+	Ec2AwsService  services.EC2API
+	CircleCiClient circleci_client.ClientWithResponsesInterface
+
+	// Most instances the resource class can have at once
+	MaxInstances int32
+	// Runners that didn't run a task for this long are terminated, never if not set
+	IdleTimeout time.Duration
+	// Instances whose runner doesn't show up in CircleCI for this long are terminated, never if not set
+	LaunchTimeout time.Duration
+
+	// Decides which runners belong to the instances, by default runners are named after the instance id
+	Matcher *RunnerMatcher
+
+	// Optional, launches are limited to the capacity the budget grants
+	Budget *budget.Budget
+
+	TimestampGenerator func() int64
+
+	// Only decide what to launch and terminate, without touching any instance
+	DryRun bool
+
+	reporter
+	capacityLimit
+}
+
+func (w *EC2ScalingWorker) Kind() WorkerKind {
+	return KindScaling
+}
+
+func (w *EC2ScalingWorker) ResourceClassName() string {
+	return w.ResourceClass
+}
+
+func (w *EC2ScalingWorker) Report() WorkerReport {
+	report := w.snapshot()
+	report.Backend = "ec2"
+	report.Target = w.Target
+	report.ResourceClass = w.ResourceClass
+	w.reportLimit(&report, w.now())
+	return report
+}
+
+func (w *EC2ScalingWorker) Handle(ctx context.Context) {
+	w.scaling().handle(ctx)
+}
+
+func (w *EC2ScalingWorker) Inspect(ctx context.Context) (ClassState, error) {
+	state := ClassState{
+		ResourceClass: w.ResourceClass,
+		Backend:       "ec2",
+		Target:        w.Target,
+		Group:         w.LaunchTemplateID,
+		MaxSize:       w.MaxInstances,
+	}
+	return state, w.scaling().inspect(ctx, &state)
+}
+
+func (w *EC2ScalingWorker) scaling() launchScaling {
+	return launchScaling{
+		resourceClass:  w.ResourceClass,
+		circleCiClient: w.CircleCiClient,
+		backend:        w,
+		maxMachines:    w.MaxInstances,
+		idleTimeout:    w.IdleTimeout,
+		launchTimeout:  w.LaunchTimeout,
+		budget:         w.Budget,
+		dryRun:         w.DryRun,
+		now:            w.now(),
+		source:         w.LaunchTemplateID,
+		unit:           "instances",
+		reporter:       &w.reporter,
+		limit:          &w.capacityLimit,
+	}
+}
+
+// listMachines returns the live instances we launched for the resource class, with their runner
+func (w *EC2ScalingWorker) listMachines(ctx context.Context) ([]launchedMachine, error) {
+	var instances []ec2types.Instance
+	var instanceIDs []string
+	paginator := ec2.NewDescribeInstancesPaginator(w.Ec2AwsService, &ec2.DescribeInstancesInput{
+		Filters: []ec2types.Filter{
+			{Name: aws.String("tag:" + resourceClassTagKey), Values: []string{w.ResourceClass}},
+			{Name: aws.String("tag:" + managedByTag), Values: []string{managedByValue}},
+			{Name: aws.String("instance-state-name"), Values: []string{"pending", "running"}},
+		},
+	})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, reservation := range output.Reservations {
+			for _, instance := range reservation.Instances {
+				instances = append(instances, instance)
+				instanceIDs = append(instanceIDs, aws.ToString(instance.InstanceId))
+			}
+		}
+	}
+	if len(instances) == 0 {
+		return nil, nil
+	}
+
+	runners, err := classRunners(ctx, w.CircleCiClient, w.ResourceClass)
+	if err != nil {
+		return nil, err
+	}
+
+	matcher := w.matcher()
+	names, err := matcher.instanceNames(ctx, instanceIDs)
+	if err != nil {
+		return nil, fmt.Errorf("matching runners to instances: %w", err)
+	}
+
+	var machines []launchedMachine
+	for _, instance := range instances {
+		id := aws.ToString(instance.InstanceId)
+		machine := launchedMachine{
+			id:          id,
+			name:        "instance " + id,
+			launched:    aws.ToTime(instance.LaunchTime),
+			machineType: string(instance.InstanceType),
+			ready:       instance.State != nil && instance.State.Name == ec2types.InstanceStateNameRunning && !matcher.Interruptions.Interrupted(id),
+			saysIdle:    runnerIdle(instance.Tags),
+		}
+		for i := range runners {
+			if matchesAny(runners[i], names[id]) {
+				machine.runner = &runners[i]
+			}
+		}
+		machines = append(machines, machine)
+	}
+
+	return machines, nil
+}
+
+// launch launches the instances from the launch template, tagged so we can find them
+func (w *EC2ScalingWorker) launch(ctx context.Context, count int32) (int32, error) {
+	tags := []ec2types.Tag{
+		{Key: aws.String(resourceClassTagKey), Value: aws.String(w.ResourceClass)},
+		{Key: aws.String(managedByTag), Value: aws.String(managedByValue)},
+	}
+	output, err := w.Ec2AwsService.RunInstances(ctx, &ec2.RunInstancesInput{
+		LaunchTemplate: &ec2types.LaunchTemplateSpecification{
+			LaunchTemplateId: aws.String(w.LaunchTemplateID),
+			Version:          aws.String("$Default"),
+		},
+		// EC2 launches as many as it has capacity for, as long as it's at least one
+		MinCount: aws.Int32(1),
+		MaxCount: aws.Int32(count),
+		TagSpecifications: []ec2types.TagSpecification{
+			{ResourceType: ec2types.ResourceTypeInstance, Tags: tags},
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int32(len(output.Instances)), nil
+}
+
+// remove terminates the instances, EC2 has no graceful way to do it
+func (w *EC2ScalingWorker) remove(ctx context.Context, machines []launchedMachine, graceful bool) error {
+	var instanceIDs []string
+	for _, machine := range machines {
+		instanceIDs = append(instanceIDs, machine.id)
+	}
+
+	if _, err := w.Ec2AwsService.TerminateInstances(ctx, &ec2.TerminateInstancesInput{
+		InstanceIds: instanceIDs,
+	}); err != nil {
+		return fmt.Errorf("terminating %v: %w", instanceIDs, err)
+	}
+	return nil
+}
+
+func (w *EC2ScalingWorker) matcher() *RunnerMatcher {
+	matcher := &RunnerMatcher{Ec2AwsService: w.Ec2AwsService}
+	if w.Matcher != nil {
+		matcher.Mode = w.Matcher.Mode
+		matcher.TagKey = w.Matcher.TagKey
+		matcher.Interruptions = w.Matcher.Interruptions
+	}
+	return matcher
+}
+
+func (w *EC2ScalingWorker) now() time.Time {
+	if w.TimestampGenerator != nil {
+		return time.Unix(w.TimestampGenerator(), 0)
+	}
+	return time.Now()
+}
@@ -0,0 +1,290 @@
+package workers_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/vela-games/circleci-runner-autoscaler/budget"
+	"github.com/vela-games/circleci-runner-autoscaler/workers"
+	"gotest.tools/v3/assert"
+)
+
+// fakeEC2 keeps the launch templates and the instances launched from them, and answers the filters the EC2
+// backend uses like EC2 does
+type fakeEC2 struct {
+	// Launch time of the instances it launches
+	now time.Time
+
+	templates  []ec2types.LaunchTemplate
+	instances  []ec2types.Instance
+	launched   []*ec2.RunInstancesInput
+	terminated []string
+	// Returned by RunInstances when set
+	launchErr error
+}
+
+func (f *fakeEC2) template(id string, tags map[string]string) {
+	template := ec2types.LaunchTemplate{LaunchTemplateId: stringPointer(id), LaunchTemplateName: stringPointer(id)}
+	for key, value := range tags {
+		template.Tags = append(template.Tags, ec2types.Tag{Key: stringPointer(key), Value: stringPointer(value)})
+	}
+	f.templates = append(f.templates, template)
+}
+
+func (f *fakeEC2) instance(id string, launched time.Time, tags map[string]string) {
+	instance := ec2types.Instance{
+		InstanceId:   stringPointer(id),
+		InstanceType: ec2types.InstanceTypeC52xlarge,
+		LaunchTime:   &launched,
+		State:        &ec2types.InstanceState{Name: ec2types.InstanceStateNameRunning},
+	}
+	for key, value := range tags {
+		instance.Tags = append(instance.Tags, ec2types.Tag{Key: stringPointer(key), Value: stringPointer(value)})
+	}
+	f.instances = append(f.instances, instance)
+}
+
+func (f *fakeEC2) DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	reservation := ec2types.Reservation{}
+	for _, instance := range f.instances {
+		if matchesFilters(params.Filters, instance.Tags, string(instance.State.Name)) {
+			reservation.Instances = append(reservation.Instances, instance)
+		}
+	}
+	return &ec2.DescribeInstancesOutput{Reservations: []ec2types.Reservation{reservation}}, nil
+}
+
+func (f *fakeEC2) DescribeLaunchTemplates(ctx context.Context, params *ec2.DescribeLaunchTemplatesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeLaunchTemplatesOutput, error) {
+	output := &ec2.DescribeLaunchTemplatesOutput{}
+	for _, template := range f.templates {
+		if matchesFilters(params.Filters, template.Tags, "") {
+			output.LaunchTemplates = append(output.LaunchTemplates, template)
+		}
+	}
+	return output, nil
+}
+
+func (f *fakeEC2) RunInstances(ctx context.Context, params *ec2.RunInstancesInput, optFns ...func(*ec2.Options)) (*ec2.RunInstancesOutput, error) {
+	f.launched = append(f.launched, params)
+	if f.launchErr != nil {
+		return nil, f.launchErr
+	}
+	output := &ec2.RunInstancesOutput{}
+	for i := int32(0); i < *params.MaxCount; i++ {
+		instance := ec2types.Instance{
+			InstanceId: stringPointer(fmt.Sprintf("i-launched%v", len(f.instances))),
+			LaunchTime: &f.now,
+			State:      &ec2types.InstanceState{Name: ec2types.InstanceStateNamePending},
+			Tags:       params.TagSpecifications[0].Tags,
+		}
+		f.instances = append(f.instances, instance)
+		output.Instances = append(output.Instances, instance)
+	}
+	return output, nil
+}
+
+func (f *fakeEC2) TerminateInstances(ctx context.Context, params *ec2.TerminateInstancesInput, optFns ...func(*ec2.Options)) (*ec2.TerminateInstancesOutput, error) {
+	f.terminated = append(f.terminated, params.InstanceIds...)
+	return &ec2.TerminateInstancesOutput{}, nil
+}
+
+func matchesFilters(filters []ec2types.Filter, tags []ec2types.Tag, state string) bool {
+	for _, filter := range filters {
+		matched := false
+		for _, value := range filter.Values {
+			switch name := *filter.Name; name {
+			case "instance-state-name":
+				matched = matched || value == state
+			case "tag-key":
+				for _, tag := range tags {
+					matched = matched || *tag.Key == value
+				}
+			default:
+				for _, tag := range tags {
+					matched = matched || ("tag:"+*tag.Key == name && *tag.Value == value)
+				}
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+var managedRunner = map[string]string{"resource-class": "vela-games/large", "managed-by": "circleci-runner-autoscaler"}
+
+// runnerState returns the tags with the runner-state a runner sets on its own instance
+func runnerState(tags map[string]string, state string) map[string]string {
+	withState := map[string]string{workers.RunnerStateTag: state}
+	for key, value := range tags {
+		withState[key] = value
+	}
+	return withState
+}
+
+func ec2Worker(ec2Client *fakeEC2, unclaimed int, running int, lastUsed map[string]time.Time, now time.Time) *workers.EC2ScalingWorker {
+	circleCiClient := drainCircleCiClient(running, lastUsed)
+	circleCiClient.MockGetUnclaimedTasksWithResponse = inspectCircleCiClient(unclaimed).MockGetUnclaimedTasksWithResponse
+	return &workers.EC2ScalingWorker{
+		ResourceClass:      "vela-games/large",
+		LaunchTemplateID:   "lt-0abc",
+		Ec2AwsService:      ec2Client,
+		CircleCiClient:     circleCiClient,
+		MaxInstances:       3,
+		IdleTimeout:        10 * time.Minute,
+		LaunchTimeout:      15 * time.Minute,
+		TimestampGenerator: func() int64 { return now.Unix() },
+	}
+}
+
+func TestEC2DiscoveryWorker(t *testing.T) {
+	ec2Client := &fakeEC2{}
+	ec2Client.template("lt-0abc", map[string]string{"resource-class": "vela-games/large", "max-instances": "2"})
+	ec2Client.template("lt-0def", map[string]string{"resource-class": "vela-games/gpu"})
+	ec2Client.template("lt-0123", map[string]string{"resource-class": "other-namespace/large"})
+	ec2Client.template("lt-0456", map[string]string{"Name": "untagged"})
+	dispatcher := &WorkerDispatcherTest{}
+
+	discovery := &workers.EC2DiscoveryWorker{
+		Dispatcher:    dispatcher,
+		Namespace:     "vela-games",
+		Ec2AwsService: ec2Client,
+		MaxInstances:  5,
+	}
+	discovery.Handle(context.TODO())
+	discovery.Handle(context.TODO())
+
+	assert.Equal(t, 2, dispatcher.Count)
+	assert.Equal(t, "scaling 2 resource classes", discovery.Report().LastDecision)
+
+	large := dispatcher.Workers[0].(*workers.EC2ScalingWorker)
+	assert.Equal(t, "vela-games/large", large.ResourceClass)
+	assert.Equal(t, "lt-0abc", large.LaunchTemplateID)
+	assert.Equal(t, int32(2), large.MaxInstances)
+	assert.Equal(t, int32(5), dispatcher.Workers[1].(*workers.EC2ScalingWorker).MaxInstances)
+}
+
+func TestEC2ScalingWorker(t *testing.T) {
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+
+	t.Run("it should launch instances for the unclaimed tasks the booting ones won't take", func(t *testing.T) {
+		ec2Client := &fakeEC2{}
+		ec2Client.instance("i-laiCh3oo", now.Add(-time.Minute), managedRunner)
+		// Not launched by the autoscaler
+		ec2Client.instance("i-As0iugan", now.Add(-time.Minute), map[string]string{"resource-class": "vela-games/large"})
+
+		worker := ec2Worker(ec2Client, 2, 0, nil, now)
+		worker.Handle(context.TODO())
+
+		assert.Equal(t, 1, len(ec2Client.launched))
+		assert.Equal(t, int32(1), *ec2Client.launched[0].MaxCount)
+		assert.Equal(t, "lt-0abc", *ec2Client.launched[0].LaunchTemplate.LaunchTemplateId)
+		assert.Equal(t, "2 unclaimed tasks, launched 1 instances from lt-0abc", worker.Report().LastDecision)
+		assert.Equal(t, int32(2), worker.Report().PendingCapacity)
+	})
+
+	t.Run("it should not go over the max instances", func(t *testing.T) {
+		ec2Client := &fakeEC2{now: now}
+		worker := ec2Worker(ec2Client, 5, 0, nil, now)
+		worker.Handle(context.TODO())
+		worker.Handle(context.TODO())
+
+		assert.Equal(t, 1, len(ec2Client.launched))
+		assert.Equal(t, int32(3), *ec2Client.launched[0].MaxCount)
+		assert.Equal(t, "5 unclaimed tasks but 3 instances is the max of 3", worker.Report().LastDecision)
+	})
+
+	t.Run("it should not scale out past a temporary capacity limit", func(t *testing.T) {
+		ec2Client := &fakeEC2{now: now}
+		worker := ec2Worker(ec2Client, 5, 0, nil, now)
+		worker.LimitCapacity(1, now.Add(time.Hour))
+		worker.Handle(context.TODO())
+		worker.Handle(context.TODO())
+
+		assert.Equal(t, 1, len(ec2Client.launched))
+		assert.Equal(t, int32(1), *ec2Client.launched[0].MaxCount)
+		assert.Equal(t, "5 unclaimed tasks but 1 instances is the max of 1", worker.Report().LastDecision)
+		assert.Equal(t, int32(1), *worker.Report().CapacityLimit)
+	})
+
+	t.Run("it should give the budget back when the launch fails", func(t *testing.T) {
+		ec2Client := &fakeEC2{now: now, launchErr: errors.New("InsufficientInstanceCapacity")}
+		spendBudget := &budget.Budget{Limit: 3, OnExhausted: func(budget.Exhausted) {}}
+		worker := ec2Worker(ec2Client, 5, 0, nil, now)
+		worker.Budget = spendBudget
+		worker.Handle(context.TODO())
+
+		assert.Equal(t, 1, len(ec2Client.launched))
+		assert.Equal(t, int32(3), *ec2Client.launched[0].MaxCount)
+		assert.Equal(t, int32(3), spendBudget.Claim("vela-games/small", "lt-0def", 0, 3, 1))
+	})
+
+	t.Run("it should terminate runners that haven't run a task for the idle timeout", func(t *testing.T) {
+		ec2Client := &fakeEC2{}
+		ec2Client.instance("i-laiCh3oo", now.Add(-time.Hour), managedRunner)
+		ec2Client.instance("i-As0iugan", now.Add(-time.Hour), managedRunner)
+		ec2Client.instance("i-Qui6josh", now.Add(-time.Hour), managedRunner)
+
+		worker := ec2Worker(ec2Client, 0, 0, map[string]time.Time{
+			"i-laiCh3oo": now.Add(-30 * time.Minute),
+			"i-As0iugan": now.Add(-time.Hour),
+			"i-Qui6josh": now.Add(-5 * time.Minute),
+		}, now)
+		worker.Handle(context.TODO())
+
+		assert.DeepEqual(t, []string{"i-laiCh3oo", "i-As0iugan"}, ec2Client.terminated)
+		assert.Equal(t, "no unclaimed tasks, removed 2 instances", worker.Report().LastDecision)
+	})
+
+	t.Run("it should only terminate runners that say they're idle while tasks are running", func(t *testing.T) {
+		ec2Client := &fakeEC2{}
+		ec2Client.instance("i-laiCh3oo", now.Add(-time.Hour), runnerState(managedRunner, "idle"))
+		ec2Client.instance("i-As0iugan", now.Add(-time.Hour), managedRunner)
+		ec2Client.instance("i-Qui6josh", now.Add(-time.Hour), runnerState(managedRunner, "busy"))
+
+		// One task running, CircleCI doesn't tell on which runner
+		worker := ec2Worker(ec2Client, 0, 1, map[string]time.Time{
+			"i-laiCh3oo": now.Add(-30 * time.Minute),
+			"i-As0iugan": now.Add(-time.Hour),
+			"i-Qui6josh": now.Add(-time.Hour),
+		}, now)
+		worker.Handle(context.TODO())
+
+		assert.DeepEqual(t, []string{"i-laiCh3oo"}, ec2Client.terminated)
+	})
+
+	t.Run("it should terminate instances whose runner never showed up", func(t *testing.T) {
+		ec2Client := &fakeEC2{}
+		ec2Client.instance("i-laiCh3oo", now.Add(-time.Hour), managedRunner)
+		ec2Client.instance("i-As0iugan", now.Add(-time.Minute), managedRunner)
+
+		worker := ec2Worker(ec2Client, 0, 0, nil, now)
+		worker.Handle(context.TODO())
+
+		assert.DeepEqual(t, []string{"i-laiCh3oo"}, ec2Client.terminated)
+	})
+
+	t.Run("it should not touch any instance in dry run", func(t *testing.T) {
+		ec2Client := &fakeEC2{}
+		ec2Client.instance("i-laiCh3oo", now.Add(-time.Hour), managedRunner)
+
+		worker := ec2Worker(ec2Client, 0, 0, map[string]time.Time{"i-laiCh3oo": now.Add(-time.Hour)}, now)
+		worker.DryRun = true
+		worker.Handle(context.TODO())
+		assert.Equal(t, "dry run: no unclaimed tasks, would remove 1 instances", worker.Report().LastDecision)
+
+		worker = ec2Worker(ec2Client, 2, 0, map[string]time.Time{"i-laiCh3oo": now.Add(-time.Hour)}, now)
+		worker.DryRun = true
+		worker.Handle(context.TODO())
+		assert.Equal(t, "dry run: 2 unclaimed tasks, would launch 2 instances from lt-0abc", worker.Report().LastDecision)
+
+		assert.Equal(t, 0, len(ec2Client.terminated))
+		assert.Equal(t, 0, len(ec2Client.launched))
+	})
+}
@@ -0,0 +1,110 @@
+package workers
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/vela-games/circleci-runner-autoscaler/budget"
+	"github.com/vela-games/circleci-runner-autoscaler/client"
+	"github.com/vela-games/circleci-runner-autoscaler/services"
+)
+
+// GCPDiscoveryWorker finds the managed instance groups whose instance template is labelled with a resource class,
+// resource-class-org and resource-class-name as GCP labels can't have slashes, and starts a GCPScalingWorker for each
+type GCPDiscoveryWorker struct {
+	Dispatcher Dispatcher
+
+	// Groups are discovered in every project
+	Targets        []services.ManagedInstanceGroupsTarget
+	CircleCiClient client.ClientWithResponsesInterface
+	Budget         *budget.Budget
+
+	// Most instances of the groups whose template doesn't have a max-instances label
+	MaxInstances int32
+
+	Namespace                 string
+	childWorkersResourceClass []string
+
+	reporter
+}
+
+func (w *GCPDiscoveryWorker) Kind() WorkerKind {
+	return KindDiscovery
+}
+
+func (w *GCPDiscoveryWorker) Report() WorkerReport {
+	report := w.snapshot()
+	report.Backend = "gcp"
+	var names []string
+	for _, target := range w.Targets {
+		names = append(names, target.Name)
+	}
+	report.Target = strings.Join(names, ",")
+	return report
+}
+
+func (w *GCPDiscoveryWorker) Handle(ctx context.Context) {
+	for _, target := range w.Targets {
+		w.discover(ctx, target)
+	}
+	w.decided("scaling %v resource classes", len(w.childWorkersResourceClass))
+}
+
+// discover starts scaling workers for the groups found in the project.
+// If a resource class has groups in several projects or locations only the first one found is scaled.
+func (w *GCPDiscoveryWorker) discover(ctx context.Context, target services.ManagedInstanceGroupsTarget) {
+	groups, err := target.Client.ListGroups(ctx)
+	if err != nil {
+		log.Printf("error getting managed instance groups from %v: %v", target.Name, err)
+		w.failed("getting managed instance groups from %v: %v", target.Name, err)
+		return
+	}
+
+	for _, group := range groups {
+		namespace, ok := group.Labels["resource-class-org"]
+		if !ok || namespace != w.Namespace {
+			continue
+		}
+
+		name, ok := group.Labels["resource-class-name"]
+		if !ok {
+			continue
+		}
+
+		className := namespace + "/" + name
+		found := false
+		for _, c := range w.childWorkersResourceClass {
+			if className == c {
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+
+		maxInstances := w.MaxInstances
+		if value, ok := group.Labels[maxInstancesTagKey]; ok {
+			max, err := strconv.Atoi(value)
+			if err == nil && max >= 0 {
+				maxInstances = int32(max)
+			} else {
+				log.Printf("ignoring invalid %v label %q of group %v", maxInstancesTagKey, value, group.Name)
+			}
+		}
+
+		w.childWorkersResourceClass = append(w.childWorkersResourceClass, className)
+		log.Printf("Found new resource class %v with managed instance group %v/%v in %v, starting scaling worker for it", className, group.Location, group.Name, target.Name)
+		w.Dispatcher.Start(ctx, &GCPScalingWorker{
+			ResourceClass:  className,
+			Target:         target.Name,
+			Group:          group,
+			GroupsService:  target.Client,
+			CircleCiClient: w.CircleCiClient,
+			MaxInstances:   maxInstances,
+			Budget:         w.Budget,
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package workers
+
+import (
+	"context"
+	"time"
+
+	"github.com/vela-games/circleci-runner-autoscaler/budget"
+	circleci_client "github.com/vela-games/circleci-runner-autoscaler/client"
+	"github.com/vela-games/circleci-runner-autoscaler/services"
+)
+
+// GCPScalingWorker resizes the managed instance group of a resource class from its unclaimed tasks. Runners are
+// expected to be named after their instance, and to delete their own instance from the group when they're idle.
+type GCPScalingWorker struct {
+	ResourceClass string
+	// Project the group lives in
+	Target string
+	// Group as discovered, its size is described again on every run
+	Group         services.ManagedInstanceGroup
+	GroupsService services.ManagedInstanceGroupsAPI
+
+	CircleCiClient circleci_client.ClientWithResponsesInterface
+
+	// Most instances the group can be resized to, groups have no max size unless an autoscaler is attached
+	MaxInstances int32
+
+	// Optional, scale-outs are limited to the capacity the budget grants
+	Budget *budget.Budget
+
+	// Only decide how to scale, without resizing the group
+	DryRun bool
+
+	reporter
+	capacityLimit
+}
+
+func (w *GCPScalingWorker) Kind() WorkerKind {
+	return KindScaling
+}
+
+func (w *GCPScalingWorker) ResourceClassName() string {
+	return w.ResourceClass
+}
+
+func (w *GCPScalingWorker) Report() WorkerReport {
+	report := w.snapshot()
+	report.Backend = "gcp"
+	report.Target = w.Target
+	report.ResourceClass = w.ResourceClass
+	w.reportLimit(&report, time.Now())
+	return report
+}
+
+func (w *GCPScalingWorker) Handle(ctx context.Context) {
+	scaleGroup[services.ManagedInstanceGroup](ctx, w.scaling(), w)
+}
+
+func (w *GCPScalingWorker) Inspect(ctx context.Context) (ClassState, error) {
+	state := ClassState{
+		ResourceClass: w.ResourceClass,
+		Backend:       "gcp",
+		Target:        w.Target,
+		Group:         w.Group.Name,
+		MaxSize:       w.MaxInstances,
+	}
+	err := inspectGroup[services.ManagedInstanceGroup](ctx, w.scaling(), w, &state)
+	return state, err
+}
+
+func (w *GCPScalingWorker) scaling() groupScaling {
+	return groupScaling{
+		resourceClass:  w.ResourceClass,
+		circleCiClient: w.CircleCiClient,
+		maxInstances:   w.MaxInstances,
+		budget:         w.Budget,
+		dryRun:         w.DryRun,
+		kind:           "managed instance group",
+		group:          w.Group.Name,
+		reporter:       &w.reporter,
+		limit:          &w.capacityLimit,
+	}
+}
+
+func (w *GCPScalingWorker) getGroup(ctx context.Context) (services.ManagedInstanceGroup, groupSize, error) {
+	group, err := w.GroupsService.GetGroup(ctx, w.Group.Location, w.Group.Regional, w.Group.Name)
+	return group, groupSize{name: group.Name, size: group.TargetSize, machineType: group.MachineType}, err
+}
+
+// listMachines returns the instances of the group, runners are named after them
+func (w *GCPScalingWorker) listMachines(ctx context.Context, group services.ManagedInstanceGroup) ([]groupMachine, error) {
+	instances, err := w.GroupsService.ListInstances(ctx, group)
+	if err != nil {
+		return nil, err
+	}
+
+	var machines []groupMachine
+	for _, instance := range instances {
+		machines = append(machines, groupMachine{
+			names:   []string{instance.Name},
+			leaving: instance.CurrentAction == "DELETING" || instance.CurrentAction == "ABANDONING",
+			ready:   instance.Status == "RUNNING" && instance.CurrentAction == "NONE",
+		})
+	}
+	return machines, nil
+}
+
+func (w *GCPScalingWorker) resize(ctx context.Context, group services.ManagedInstanceGroup, size int32) error {
+	return w.GroupsService.Resize(ctx, group, size)
+}
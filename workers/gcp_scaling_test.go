@@ -0,0 +1,56 @@
+package workers_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	circleci_client "github.com/vela-games/circleci-runner-autoscaler/client"
+	"github.com/vela-games/circleci-runner-autoscaler/services"
+	"github.com/vela-games/circleci-runner-autoscaler/workers"
+	"gotest.tools/v3/assert"
+)
+
+// namedRunnersCircleCiClient has the given unclaimed tasks and a runner for every named instance
+func namedRunnersCircleCiClient(unclaimed int, runnerNames ...string) *mockCircleCiClient {
+	client := inspectCircleCiClient(unclaimed)
+	client.MockGetRunnersWithResponse = func(ctx context.Context, params *circleci_client.GetRunnersParams, reqEditors ...circleci_client.RequestEditorFn) (*circleci_client.GetRunnersResponse, error) {
+		var runners []circleci_client.Agent
+		for _, name := range runnerNames {
+			runners = append(runners, circleci_client.Agent{Name: stringPointer(name)})
+		}
+		return &circleci_client.GetRunnersResponse{
+			HTTPResponse: &http.Response{StatusCode: 200},
+			JSON200:      &circleci_client.AgentList{Items: &runners},
+		}, nil
+	}
+	return client
+}
+
+func TestGCPDiscoveryWorker(t *testing.T) {
+	migs := &fakeCloudGroups{groups: []cloudGroup{
+		{name: "gce-large", class: "vela-games/gce-large", maxInstances: "8"},
+		{name: "gce-small", class: "vela-games/gce-small"},
+		{name: "other", class: "other-namespace/gce-large"},
+		{name: "unlabelled"},
+	}}
+	dispatcher := &WorkerDispatcherTest{}
+
+	discovery := &workers.GCPDiscoveryWorker{
+		Dispatcher:   dispatcher,
+		Namespace:    "vela-games",
+		Targets:      []services.ManagedInstanceGroupsTarget{{Name: "vela-runners", Client: migs}},
+		MaxInstances: 5,
+	}
+	discovery.Handle(context.TODO())
+	discovery.Handle(context.TODO())
+
+	assert.Equal(t, 2, dispatcher.Count)
+	assert.Equal(t, "scaling 2 resource classes", discovery.Report().LastDecision)
+
+	large := dispatcher.Workers[0].(*workers.GCPScalingWorker)
+	assert.Equal(t, "vela-games/gce-large", large.ResourceClass)
+	assert.Equal(t, "vela-runners", large.Target)
+	assert.Equal(t, int32(8), large.MaxInstances)
+	assert.Equal(t, int32(5), dispatcher.Workers[1].(*workers.GCPScalingWorker).MaxInstances)
+}
@@ -0,0 +1,195 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/vela-games/circleci-runner-autoscaler/budget"
+	circleci_client "github.com/vela-games/circleci-runner-autoscaler/client"
+)
+
+// groupSize is what the scaling loop needs to know about a group of runner machines
+type groupSize struct {
+	name string
+	size int32
+	// Machine type of the group, for its budget weight
+	machineType string
+}
+
+// groupMachine is a machine of a group, with the names its runner can register with
+type groupMachine struct {
+	names []string
+	// The group is deleting it, its runner won't take tasks
+	leaving bool
+	// Up and running
+	ready bool
+}
+
+// groupBackend reads and resizes the group of machines of a resource class, G being how the cloud describes it
+type groupBackend[G any] interface {
+	getGroup(ctx context.Context) (G, groupSize, error)
+	listMachines(ctx context.Context, group G) ([]groupMachine, error)
+	resize(ctx context.Context, group G, size int32) error
+}
+
+// groupScaling is the scaling loop of the backends that only raise the size of a group, e.g. GCP managed instance
+// groups and Azure scale sets. The cloud creates the machines and the runners delete their own when they're idle.
+type groupScaling struct {
+	resourceClass  string
+	circleCiClient circleci_client.ClientWithResponsesInterface
+	maxInstances   int32
+	budget         *budget.Budget
+	dryRun         bool
+	// What the group is called in logs, e.g. scale set, and its name as discovered
+	kind  string
+	group string
+
+	reporter *reporter
+	limit    *capacityLimit
+}
+
+func scaleGroup[G any](ctx context.Context, s groupScaling, backend groupBackend[G]) {
+	log.Printf("handle scaling of %v", s.resourceClass)
+
+	response, err := s.circleCiClient.GetUnclaimedTasksWithResponse(ctx, &circleci_client.GetUnclaimedTasksParams{
+		ResourceClass: s.resourceClass,
+	})
+	if err != nil {
+		log.Printf("error getting unclaimed tasks by resource class %v: %v", s.resourceClass, err)
+		s.reporter.failed("getting unclaimed tasks: %v", err)
+		return
+	}
+	if response.StatusCode() != 200 || response.JSON200 == nil || response.JSON200.UnclaimedTaskCount == nil {
+		log.Printf("%v: got %v code instead of 200 getting unclaimed tasks", s.resourceClass, response.StatusCode())
+		s.reporter.failed("getting unclaimed tasks: got %v code instead of 200", response.StatusCode())
+		return
+	}
+	unclaimedTaskCount := *response.JSON200.UnclaimedTaskCount
+
+	group, size, err := backend.getGroup(ctx)
+	if err != nil {
+		log.Printf("error getting %v %v: %v", s.kind, s.group, err)
+		s.reporter.failed("getting %v %v: %v", s.kind, s.group, err)
+		return
+	}
+
+	if unclaimedTaskCount == 0 {
+		log.Printf("%v: no unclaimed tasks", s.resourceClass)
+		s.reporter.decided("no unclaimed tasks")
+		s.updateBudget(size, size.size)
+		return
+	}
+
+	active, err := groupRunners(ctx, s, backend, group)
+	if err != nil {
+		log.Printf("%v: error matching runners to the instances of %v: %v", s.resourceClass, size.name, err)
+		s.reporter.failed("matching runners to the instances of %v: %v", size.name, err)
+		return
+	}
+
+	// Instances of the group without a runner are still coming up, they'll take some of the tasks
+	coming := size.size - active
+	if coming < 0 {
+		coming = 0
+	}
+	desired := size.size
+	if missing := int32(unclaimedTaskCount) - coming; missing > 0 {
+		desired += missing
+	}
+	maxInstances := s.limit.capped(s.maxInstances, time.Now())
+	if desired > maxInstances {
+		desired = maxInstances
+	}
+	if desired <= size.size {
+		log.Printf("%v: %v unclaimed tasks, %v %v is at %v instances with %v coming up", s.resourceClass, unclaimedTaskCount, s.kind, size.name, size.size, coming)
+		s.reporter.decided("%v unclaimed tasks but %v is at %v instances of max %v with %v coming up", unclaimedTaskCount, size.name, size.size, maxInstances, coming)
+		s.reporter.pending(coming)
+		s.updateBudget(size, size.size)
+		return
+	}
+
+	if s.budget != nil {
+		desired = s.budget.Claim(s.resourceClass, size.name, size.size, desired, s.budget.Weight(s.resourceClass, size.machineType))
+		if desired <= size.size {
+			log.Printf("%v: budget exhausted, not resizing %v", s.resourceClass, size.name)
+			s.reporter.decided("budget exhausted, %v unclaimed tasks but %v stays at %v", unclaimedTaskCount, size.name, size.size)
+			return
+		}
+	}
+
+	log.Printf("%v has %v unclaimed tasks, resizing %v from %v to %v", s.resourceClass, unclaimedTaskCount, size.name, size.size, desired)
+
+	if s.dryRun {
+		s.reporter.decided("dry run: %v unclaimed tasks, would resize %v from %v to %v", unclaimedTaskCount, size.name, size.size, desired)
+		s.updateBudget(size, size.size)
+		return
+	}
+
+	if err := backend.resize(ctx, group, desired); err != nil {
+		log.Printf("error resizing %v: %v", size.name, err)
+		s.reporter.failed("resizing %v: %v", size.name, err)
+		s.updateBudget(size, size.size)
+		return
+	}
+	s.reporter.decided("%v unclaimed tasks, resized %v from %v to %v", unclaimedTaskCount, size.name, size.size, desired)
+	s.reporter.pending(desired - active)
+}
+
+// inspectGroup fills in the state of the group and how many of its machines are ready
+func inspectGroup[G any](ctx context.Context, s groupScaling, backend groupBackend[G], state *ClassState) error {
+	if err := inspectCircleCi(ctx, s.circleCiClient, state); err != nil {
+		return err
+	}
+
+	group, size, err := backend.getGroup(ctx)
+	if err != nil {
+		return fmt.Errorf("getting %v %v: %w", s.kind, s.group, err)
+	}
+	state.DesiredCapacity = size.size
+
+	machines, err := backend.listMachines(ctx, group)
+	if err != nil {
+		return fmt.Errorf("listing instances of %v: %w", size.name, err)
+	}
+	for _, machine := range machines {
+		if machine.ready {
+			state.Ready++
+		}
+	}
+	return nil
+}
+
+// groupRunners returns how many machines of the group, that aren't on their way out, have a runner
+func groupRunners[G any](ctx context.Context, s groupScaling, backend groupBackend[G], group G) (int32, error) {
+	machines, err := backend.listMachines(ctx, group)
+	if err != nil {
+		return 0, err
+	}
+
+	runners, err := classRunners(ctx, s.circleCiClient, s.resourceClass)
+	if err != nil {
+		return 0, err
+	}
+
+	var active int32
+	for _, machine := range machines {
+		if machine.leaving {
+			continue
+		}
+		for _, runner := range runners {
+			if matchesAny(runner, machine.names) {
+				active++
+				break
+			}
+		}
+	}
+	return active, nil
+}
+
+func (s groupScaling) updateBudget(size groupSize, current int32) {
+	if s.budget != nil {
+		s.budget.Update(s.resourceClass, size.name, current, s.budget.Weight(s.resourceClass, size.machineType))
+	}
+}
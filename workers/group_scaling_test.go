@@ -0,0 +1,270 @@
+package workers_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/vela-games/circleci-runner-autoscaler/services"
+	"github.com/vela-games/circleci-runner-autoscaler/workers"
+	"gotest.tools/v3/assert"
+)
+
+// fakeCloudGroups is a GCP project and an Azure subscription whose groups of runner machines, managed instance
+// groups or scale sets, keep the size they're resized to
+type fakeCloudGroups struct {
+	groups  []cloudGroup
+	resized []int32
+}
+
+// cloudGroup is a group of runner machines of the resource class, labelled with max-instances if it's set
+type cloudGroup struct {
+	name         string
+	class        string
+	maxInstances string
+	size         int32
+	machines     []cloudMachine
+}
+
+// cloudMachine is a machine of a group, either "running", "creating" or "deleting", with the hostname Azure VMs
+// have as computer name
+type cloudMachine struct {
+	name     string
+	hostname string
+	state    string
+}
+
+func (f *fakeCloudGroups) resize(name string, size int32) {
+	for i := range f.groups {
+		if f.groups[i].name == name {
+			f.groups[i].size = size
+		}
+	}
+	f.resized = append(f.resized, size)
+}
+
+func (f *fakeCloudGroups) find(name string) (cloudGroup, error) {
+	for _, group := range f.groups {
+		if group.name == name {
+			return group, nil
+		}
+	}
+	return cloudGroup{}, errors.New("group not found")
+}
+
+func (f *fakeCloudGroups) ListGroups(ctx context.Context) ([]services.ManagedInstanceGroup, error) {
+	var groups []services.ManagedInstanceGroup
+	for _, group := range f.groups {
+		groups = append(groups, group.mig())
+	}
+	return groups, nil
+}
+
+func (f *fakeCloudGroups) GetGroup(ctx context.Context, location string, regional bool, name string) (services.ManagedInstanceGroup, error) {
+	group, err := f.find(name)
+	return group.mig(), err
+}
+
+func (f *fakeCloudGroups) ListInstances(ctx context.Context, group services.ManagedInstanceGroup) ([]services.ManagedInstance, error) {
+	found, err := f.find(group.Name)
+	var instances []services.ManagedInstance
+	for _, machine := range found.machines {
+		instance := services.ManagedInstance{Name: machine.name, CurrentAction: "NONE", Status: "RUNNING"}
+		switch machine.state {
+		case "creating":
+			instance.CurrentAction, instance.Status = "CREATING", ""
+		case "deleting":
+			instance.CurrentAction = "DELETING"
+		}
+		instances = append(instances, instance)
+	}
+	return instances, err
+}
+
+func (f *fakeCloudGroups) Resize(ctx context.Context, group services.ManagedInstanceGroup, size int32) error {
+	f.resize(group.Name, size)
+	return nil
+}
+
+func (f *fakeCloudGroups) ListScaleSets(ctx context.Context) ([]services.ScaleSet, error) {
+	var sets []services.ScaleSet
+	for _, group := range f.groups {
+		sets = append(sets, group.scaleSet())
+	}
+	return sets, nil
+}
+
+func (f *fakeCloudGroups) GetScaleSet(ctx context.Context, resourceGroup string, name string) (services.ScaleSet, error) {
+	group, err := f.find(name)
+	return group.scaleSet(), err
+}
+
+func (f *fakeCloudGroups) ListVMs(ctx context.Context, set services.ScaleSet) ([]services.ScaleSetVM, error) {
+	found, err := f.find(set.Name)
+	var vms []services.ScaleSetVM
+	for _, machine := range found.machines {
+		vm := services.ScaleSetVM{Name: machine.name, ComputerName: machine.hostname, ProvisioningState: "Succeeded"}
+		switch machine.state {
+		case "creating":
+			vm.ProvisioningState = "Creating"
+		case "deleting":
+			vm.ProvisioningState = "Deleting"
+		}
+		vms = append(vms, vm)
+	}
+	return vms, err
+}
+
+func (f *fakeCloudGroups) SetCapacity(ctx context.Context, set services.ScaleSet, capacity int32) error {
+	f.resize(set.Name, capacity)
+	return nil
+}
+
+// mig returns the group as a managed instance group, its instance template labelled with the resource class
+func (g cloudGroup) mig() services.ManagedInstanceGroup {
+	group := services.ManagedInstanceGroup{
+		Name:        g.name,
+		Location:    "europe-west1-b",
+		TargetSize:  g.size,
+		MachineType: "n2-standard-8",
+		Labels:      map[string]string{},
+	}
+	if org, name, ok := strings.Cut(g.class, "/"); ok {
+		group.Labels["resource-class-org"] = org
+		group.Labels["resource-class-name"] = name
+	}
+	if g.maxInstances != "" {
+		group.Labels["max-instances"] = g.maxInstances
+	}
+	return group
+}
+
+// scaleSet returns the group as a scale set tagged with the resource class
+func (g cloudGroup) scaleSet() services.ScaleSet {
+	set := services.ScaleSet{
+		Name:          g.name,
+		ResourceGroup: "circleci-runners",
+		Capacity:      g.size,
+		SKU:           "Standard_D8s_v5",
+		Tags:          map[string]string{},
+	}
+	if g.class != "" {
+		set.Tags["resource-class"] = g.class
+	}
+	if g.maxInstances != "" {
+		set.Tags["max-instances"] = g.maxInstances
+	}
+	return set
+}
+
+// groupScalingWorker is the scaling worker of a backend that sizes a group of machines
+type groupScalingWorker interface {
+	workers.Worker
+	workers.Reporter
+	workers.Inspector
+}
+
+// groupWorkers return the scaling worker of every backend for the first group, with a max of 4 instances
+var groupWorkers = map[string]func(groups *fakeCloudGroups, client *mockCircleCiClient, dryRun bool) groupScalingWorker{
+	"gcp": func(groups *fakeCloudGroups, client *mockCircleCiClient, dryRun bool) groupScalingWorker {
+		return &workers.GCPScalingWorker{
+			ResourceClass:  groups.groups[0].class,
+			Target:         "vela-runners",
+			Group:          groups.groups[0].mig(),
+			GroupsService:  groups,
+			CircleCiClient: client,
+			MaxInstances:   4,
+			DryRun:         dryRun,
+		}
+	},
+	"azure": func(groups *fakeCloudGroups, client *mockCircleCiClient, dryRun bool) groupScalingWorker {
+		return &workers.AzureScalingWorker{
+			ResourceClass:    groups.groups[0].class,
+			Target:           "00000000-0000-0000-0000-000000000000",
+			ScaleSet:         groups.groups[0].scaleSet(),
+			ScaleSetsService: groups,
+			CircleCiClient:   client,
+			MaxInstances:     4,
+			DryRun:           dryRun,
+		}
+	},
+}
+
+func TestGroupScalingWorkers(t *testing.T) {
+	for backend, newWorker := range groupWorkers {
+		newWorker := newWorker
+		t.Run(backend, func(t *testing.T) {
+			t.Run("it should resize the group for the unclaimed tasks the coming instances won't take", func(t *testing.T) {
+				groups := &fakeCloudGroups{groups: []cloudGroup{{
+					name:  "runners-large",
+					class: "vela-games/runners-large",
+					size:  2,
+					machines: []cloudMachine{
+						{name: "runners-large-abcd", state: "running"},
+						{name: "runners-large-efgh", state: "creating"},
+					},
+				}}}
+				worker := newWorker(groups, namedRunnersCircleCiClient(2, "runners-large-abcd"), false)
+				worker.Handle(context.TODO())
+
+				assert.DeepEqual(t, []int32{3}, groups.resized)
+				assert.Equal(t, "2 unclaimed tasks, resized runners-large from 2 to 3", worker.Report().LastDecision)
+				assert.Equal(t, int32(2), worker.Report().PendingCapacity)
+			})
+
+			t.Run("it should not count instances being deleted", func(t *testing.T) {
+				groups := &fakeCloudGroups{groups: []cloudGroup{{
+					name:     "runners-large",
+					class:    "vela-games/runners-large",
+					size:     1,
+					machines: []cloudMachine{{name: "runners-large-abcd", state: "deleting"}},
+				}}}
+				worker := newWorker(groups, namedRunnersCircleCiClient(1, "runners-large-abcd"), false)
+				worker.Handle(context.TODO())
+
+				// The instance being deleted is still part of the size, the one replacing it is coming
+				assert.Equal(t, 0, len(groups.resized))
+			})
+
+			t.Run("it should not go over the max instances", func(t *testing.T) {
+				groups := &fakeCloudGroups{groups: []cloudGroup{{name: "runners-large", class: "vela-games/runners-large"}}}
+				worker := newWorker(groups, namedRunnersCircleCiClient(10), false)
+				worker.Handle(context.TODO())
+				worker.Handle(context.TODO())
+
+				assert.DeepEqual(t, []int32{4}, groups.resized)
+				assert.Equal(t, "10 unclaimed tasks but runners-large is at 4 instances of max 4 with 4 coming up", worker.Report().LastDecision)
+			})
+
+			t.Run("it should not resize the group in dry run", func(t *testing.T) {
+				groups := &fakeCloudGroups{groups: []cloudGroup{{name: "runners-large", class: "vela-games/runners-large"}}}
+				worker := newWorker(groups, namedRunnersCircleCiClient(1), true)
+				worker.Handle(context.TODO())
+
+				assert.Equal(t, 0, len(groups.resized))
+				assert.Equal(t, "dry run: 1 unclaimed tasks, would resize runners-large from 0 to 1", worker.Report().LastDecision)
+			})
+
+			t.Run("it should describe the state of the group", func(t *testing.T) {
+				groups := &fakeCloudGroups{groups: []cloudGroup{{
+					name:  "runners-large",
+					class: "vela-games/runners-large",
+					size:  2,
+					machines: []cloudMachine{
+						{name: "runners-large-abcd", state: "running"},
+						{name: "runners-large-efgh", state: "creating"},
+					},
+				}}}
+				state, err := newWorker(groups, namedRunnersCircleCiClient(0, "runners-large-abcd"), false).Inspect(context.TODO())
+				assert.NilError(t, err)
+
+				assert.Equal(t, backend, state.Backend)
+				assert.Equal(t, "runners-large", state.Group)
+				assert.Equal(t, int32(2), state.DesiredCapacity)
+				assert.Equal(t, int32(1), state.Ready)
+				assert.Equal(t, int32(4), state.MaxSize)
+			})
+		})
+	}
+}
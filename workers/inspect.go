@@ -0,0 +1,180 @@
+package workers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	circleci_client "github.com/vela-games/circleci-runner-autoscaler/client"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// ClassState is the state of a resource class in CircleCI and in the backend running its runners
+type ClassState struct {
+	ResourceClass string `json:"resourceClass"`
+	Backend       string `json:"backend"`
+	Target        string `json:"target"`
+
+	UnclaimedTasks int `json:"unclaimedTasks"`
+	RunningTasks   int `json:"runningTasks"`
+	Runners        int `json:"runners"`
+
+	// ASG or CronJob the runners are created from
+	Group string `json:"group"`
+	// Instances or pods asked for, and how many of them are InService or Running
+	DesiredCapacity int32 `json:"desiredCapacity"`
+	MinSize         int32 `json:"minSize,omitempty"`
+	MaxSize         int32 `json:"maxSize,omitempty"`
+	Ready           int32 `json:"ready"`
+}
+
+// Workers that can describe the state of their resource class without changing it
+type Inspector interface {
+	Inspect(context.Context) (ClassState, error)
+}
+
+func (w *AWSScalingWorker) Inspect(ctx context.Context) (ClassState, error) {
+	state := ClassState{
+		ResourceClass: w.ResourceClass,
+		Backend:       "aws",
+		Target:        w.Target,
+		Group:         w.activeGroupName(),
+	}
+
+	if err := inspectCircleCi(ctx, w.CircleCiClient, &state); err != nil {
+		return state, err
+	}
+
+	asg, err := w.AsgAwsService.DescribeAutoScalingGroups(ctx, &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: []string{
+			state.Group,
+		},
+	})
+	if err != nil {
+		return state, fmt.Errorf("describing ASG %v: %w", state.Group, err)
+	}
+
+	if len(asg.AutoScalingGroups) == 0 {
+		return state, fmt.Errorf("AWS api didn't return the ASG %v", state.Group)
+	}
+
+	group := asg.AutoScalingGroups[0]
+	state.DesiredCapacity = *group.DesiredCapacity
+	state.MinSize = *group.MinSize
+	state.MaxSize = *group.MaxSize
+	for _, instance := range group.Instances {
+		if instance.LifecycleState == types.LifecycleStateInService && (w.Matcher == nil || !w.Matcher.Interruptions.Interrupted(aws.ToString(instance.InstanceId))) {
+			state.Ready++
+		}
+	}
+
+	return state, nil
+}
+
+func (w *K8sScalingWorker) Inspect(ctx context.Context) (ClassState, error) {
+	state := ClassState{
+		ResourceClass: w.ResourceClass,
+		Backend:       "kubernetes",
+		Target:        w.SourceNamespace,
+		Group:         w.SourceName,
+	}
+
+	if err := inspectCircleCi(ctx, w.CircleCiClient, &state); err != nil {
+		return state, err
+	}
+
+	source, err := w.getSource(ctx)
+	if err != nil {
+		return state, fmt.Errorf("getting %v %v: %w", w.sourceKind(), w.SourceName, err)
+	}
+
+	podList, err := w.ClientSet.CoreV1().Pods(w.SourceNamespace).List(ctx, v1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(map[string]string{
+			"resource-class-org":  source.labels["resource-class-org"],
+			"resource-class-name": source.labels["resource-class-name"],
+		}).String(),
+	})
+	if err != nil {
+		return state, fmt.Errorf("listing pods of %v: %w", w.ResourceClass, err)
+	}
+
+	for _, pod := range podList.Items {
+		switch pod.Status.Phase {
+		case corev1.PodPending:
+			state.DesiredCapacity++
+		case corev1.PodRunning:
+			state.DesiredCapacity++
+			state.Ready++
+		}
+	}
+
+	return state, nil
+}
+
+// inspectCircleCi fills in the task and runner counts of the resource class
+func inspectCircleCi(ctx context.Context, client circleci_client.ClientWithResponsesInterface, state *ClassState) error {
+	unclaimed, err := client.GetUnclaimedTasksWithResponse(ctx, &circleci_client.GetUnclaimedTasksParams{
+		ResourceClass: state.ResourceClass,
+	})
+	if err != nil {
+		return fmt.Errorf("getting unclaimed tasks: %w", err)
+	}
+	if unclaimed.StatusCode() != 200 || unclaimed.JSON200 == nil || unclaimed.JSON200.UnclaimedTaskCount == nil {
+		return fmt.Errorf("getting unclaimed tasks: got %v code instead of 200", unclaimed.StatusCode())
+	}
+	state.UnclaimedTasks = *unclaimed.JSON200.UnclaimedTaskCount
+
+	running, err := runningTasks(ctx, client, state.ResourceClass)
+	if err != nil {
+		return err
+	}
+	state.RunningTasks = running
+
+	runners, err := classRunners(ctx, client, state.ResourceClass)
+	if err != nil {
+		return err
+	}
+	state.Runners = len(runners)
+
+	return nil
+}
+
+// classRunners returns the runners registered for the resource class
+func classRunners(ctx context.Context, client circleci_client.ClientWithResponsesInterface, resourceClass string) ([]circleci_client.Agent, error) {
+	runners, err := client.GetRunnersWithResponse(ctx, &circleci_client.GetRunnersParams{
+		ResourceClass: &resourceClass,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("getting runners: %w", err)
+	}
+	if runners.StatusCode() != 200 || runners.JSON200 == nil || runners.JSON200.Items == nil {
+		return nil, fmt.Errorf("getting runners: got %v code instead of 200", runners.StatusCode())
+	}
+	return *runners.JSON200.Items, nil
+}
+
+// runningTasks returns how many tasks of the resource class are running on runners
+func runningTasks(ctx context.Context, client circleci_client.ClientWithResponsesInterface, resourceClass string) (int, error) {
+	running, err := client.GetRunningTasksWithResponse(ctx, &circleci_client.GetRunningTasksParams{
+		ResourceClass: resourceClass,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("getting running tasks: %w", err)
+	}
+	if running.StatusCode() != 200 {
+		return 0, fmt.Errorf("getting running tasks: got %v code instead of 200", running.StatusCode())
+	}
+	// The generated client reuses the unclaimed task model, the API answers with running_runner_tasks
+	var runningCount struct {
+		RunningRunnerTasks int `json:"running_runner_tasks"`
+	}
+	if err := json.Unmarshal(running.Body, &runningCount); err != nil {
+		return 0, fmt.Errorf("decoding running tasks: %w", err)
+	}
+	return runningCount.RunningRunnerTasks, nil
+}
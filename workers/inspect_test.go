@@ -0,0 +1,115 @@
+package workers_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	circleci_client "github.com/vela-games/circleci-runner-autoscaler/client"
+	"github.com/vela-games/circleci-runner-autoscaler/workers"
+	"gotest.tools/v3/assert"
+)
+
+func inspectCircleCiClient(unclaimed int) *mockCircleCiClient {
+	return &mockCircleCiClient{
+		MockGetUnclaimedTasksWithResponse: func(ctx context.Context, params *circleci_client.GetUnclaimedTasksParams, reqEditors ...circleci_client.RequestEditorFn) (*circleci_client.GetUnclaimedTasksResponse, error) {
+			return &circleci_client.GetUnclaimedTasksResponse{
+				HTTPResponse: &http.Response{
+					StatusCode: 200,
+				},
+				JSON200: &circleci_client.UnclaimedTaskCount{
+					UnclaimedTaskCount: intPointer(unclaimed),
+				},
+			}, nil
+		},
+		MockGetRunningTasksWithResponse: func(ctx context.Context, params *circleci_client.GetRunningTasksParams, reqEditors ...circleci_client.RequestEditorFn) (*circleci_client.GetRunningTasksResponse, error) {
+			return &circleci_client.GetRunningTasksResponse{
+				Body: []byte(`{"running_runner_tasks": 2}`),
+				HTTPResponse: &http.Response{
+					StatusCode: 200,
+				},
+			}, nil
+		},
+		MockGetRunnersWithResponse: func(ctx context.Context, params *circleci_client.GetRunnersParams, reqEditors ...circleci_client.RequestEditorFn) (*circleci_client.GetRunnersResponse, error) {
+			return &circleci_client.GetRunnersResponse{
+				HTTPResponse: &http.Response{
+					StatusCode: 200,
+				},
+				JSON200: &circleci_client.AgentList{
+					Items: &[]circleci_client.Agent{
+						{Name: stringPointer("i-laiCh3oo")},
+						{Name: stringPointer("i-As0iugan")},
+					},
+				},
+			}, nil
+		},
+	}
+}
+
+func inspectAutoScalingGroupsAPI(t *testing.T) *mockAutoScalingGroupsAPI {
+	return &mockAutoScalingGroupsAPI{
+		MockDescribeAutoScalingGroupsAPI: func(ctx context.Context, params *autoscaling.DescribeAutoScalingGroupsInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+			return &autoscaling.DescribeAutoScalingGroupsOutput{
+				AutoScalingGroups: []types.AutoScalingGroup{
+					{
+						AutoScalingGroupName: stringPointer("vela-games/my-resource-class"),
+						DesiredCapacity:      int32Pointer(3),
+						MaxSize:              int32Pointer(10),
+						MinSize:              int32Pointer(1),
+						Instances: []types.Instance{
+							{InstanceId: stringPointer("i-laiCh3oo"), LifecycleState: "InService"},
+							{InstanceId: stringPointer("i-As0iugan"), LifecycleState: "InService"},
+							{InstanceId: stringPointer("i-Qui6josh"), LifecycleState: "Pending"},
+						},
+					},
+				},
+			}, nil
+		},
+		MockSetDesiredCapacityAPI: func(ctx context.Context, params *autoscaling.SetDesiredCapacityInput, optFns ...func(*autoscaling.Options)) (*autoscaling.SetDesiredCapacityOutput, error) {
+			t.Error("SetDesiredCapacity was called")
+			return nil, nil
+		},
+	}
+}
+
+func TestAWSScalingWorkerInspect(t *testing.T) {
+	scaling := &workers.AWSScalingWorker{
+		ResourceClass:  "vela-games/my-resource-class",
+		Target:         "eu-west-1",
+		AsgAwsService:  inspectAutoScalingGroupsAPI(t),
+		CircleCiClient: inspectCircleCiClient(4),
+	}
+
+	state, err := scaling.Inspect(context.TODO())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, workers.ClassState{
+		ResourceClass:   "vela-games/my-resource-class",
+		Backend:         "aws",
+		Target:          "eu-west-1",
+		UnclaimedTasks:  4,
+		RunningTasks:    2,
+		Runners:         2,
+		Group:           "vela-games/my-resource-class",
+		DesiredCapacity: 3,
+		MinSize:         1,
+		MaxSize:         10,
+		Ready:           2,
+	}, state)
+}
+
+func TestAWSScalingWorkerDryRun(t *testing.T) {
+	scaling := &workers.AWSScalingWorker{
+		ResourceClass:  "vela-games/my-resource-class",
+		AsgAwsService:  inspectAutoScalingGroupsAPI(t),
+		CircleCiClient: inspectCircleCiClient(4),
+		DryRun:         true,
+	}
+
+	scaling.Handle(context.TODO())
+
+	report := scaling.Report()
+	assert.Equal(t, "dry run: 4 unclaimed tasks, would scale out vela-games/my-resource-class from 3 to 7", report.LastDecision)
+	assert.Equal(t, "", report.LastError)
+}
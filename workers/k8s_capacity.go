@@ -0,0 +1,369 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	EventCapacityThrottled = "CapacityThrottled"
+
+	clusterCacheResync      = 10 * time.Minute
+	clusterCacheSyncTimeout = 5 * time.Second
+)
+
+// fitCapacity estimates how many runner pods of the template fit in the ResourceQuotas of the namespace and, if
+// nodes is set, in the allocatable resources of the nodes its pods can be scheduled on. It returns how many of the
+// wanted pods to create and why they were throttled if they don't all fit. The estimate fails open, if quotas or
+// nodes can't be read every pod is created.
+func fitCapacity(ctx context.Context, client kubernetes.Interface, namespace string, template corev1.PodTemplateSpec, wanted int, nodes bool) (int, string) {
+	fit, reason := wanted, ""
+
+	if quotaFit, quotaReason, err := fitQuotas(ctx, client, namespace, template); err != nil {
+		log.Printf("error reading ResourceQuotas of namespace %v, not limiting runners by them: %v", namespace, err)
+	} else if quotaFit >= 0 && quotaFit < fit {
+		fit, reason = quotaFit, quotaReason
+	}
+
+	if nodes {
+		if nodeFit, nodeReason, err := fitNodes(ctx, client, template); err != nil {
+			log.Printf("error reading node capacity, not limiting runners by it: %v", err)
+		} else if nodeFit >= 0 && nodeFit < fit {
+			fit, reason = nodeFit, nodeReason
+		}
+	}
+
+	return fit, reason
+}
+
+// fitQuotas returns how many pods of the template fit in what's left of the hard limits of every ResourceQuota,
+// -1 if no quota limits them. Quota scopes aren't evaluated, every quota of the namespace is assumed to apply.
+func fitQuotas(ctx context.Context, client kubernetes.Interface, namespace string, template corev1.PodTemplateSpec) (int, string, error) {
+	quotas, err := freeQuotas(ctx, client, namespace)
+	if err != nil {
+		return 0, "", err
+	}
+
+	requests, limits := podResources(template.Spec)
+	fit, reason := -1, ""
+	for _, quota := range quotas {
+		for name, left := range quota.left {
+			perPod, ok := quotaUsage(name, requests, limits)
+			if !ok {
+				continue
+			}
+			if count := fitCount(left, perPod); count >= 0 && (fit < 0 || count < fit) {
+				fit = count
+				reason = fmt.Sprintf("ResourceQuota %v has room for %v more runners by %v", quota.name, count, name)
+			}
+		}
+	}
+
+	return fit, reason, nil
+}
+
+// quotaRoom is what's left of the hard limits of a ResourceQuota
+type quotaRoom struct {
+	name string
+	left corev1.ResourceList
+}
+
+func freeQuotas(ctx context.Context, client kubernetes.Interface, namespace string) ([]quotaRoom, error) {
+	quotas, err := client.CoreV1().ResourceQuotas(namespace).List(ctx, v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var rooms []quotaRoom
+	for _, quota := range quotas.Items {
+		room := quotaRoom{name: quota.Name, left: corev1.ResourceList{}}
+		for name, hard := range quota.Spec.Hard {
+			left := hard.DeepCopy()
+			left.Sub(quota.Status.Used[name])
+			room.left[name] = left
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, nil
+}
+
+// quotaUsage returns how much of a quota resource every runner pod uses, false if the quota isn't about pods
+func quotaUsage(name corev1.ResourceName, requests corev1.ResourceList, limits corev1.ResourceList) (resource.Quantity, bool) {
+	switch {
+	case name == corev1.ResourcePods || name == "count/pods" || name == "count/jobs.batch":
+		return resource.MustParse("1"), true
+	case strings.HasPrefix(string(name), "requests."):
+		return requests[corev1.ResourceName(strings.TrimPrefix(string(name), "requests."))], true
+	case strings.HasPrefix(string(name), "limits."):
+		return limits[corev1.ResourceName(strings.TrimPrefix(string(name), "limits."))], true
+	case name == corev1.ResourceCPU || name == corev1.ResourceMemory || name == corev1.ResourceEphemeralStorage:
+		return requests[name], true
+	}
+	return resource.Quantity{}, false
+}
+
+// fitNodes returns how many pods of the template fit in what isn't requested yet of the nodes its pods can be
+// scheduled on, -1 if the template doesn't request any resources
+func fitNodes(ctx context.Context, client kubernetes.Interface, template corev1.PodTemplateSpec) (int, string, error) {
+	perPod, _ := podResources(template.Spec)
+	if len(perPod) == 0 {
+		return -1, "", nil
+	}
+
+	nodes, err := freeNodes(ctx, client)
+	if err != nil {
+		return 0, "", err
+	}
+
+	fit, matching := 0, 0
+	for _, node := range nodes {
+		if !schedulable(node.node, template.Spec) {
+			continue
+		}
+		matching++
+
+		nodeFit := -1
+		for name, quantity := range perPod {
+			if count := fitCount(node.left[name], quantity); count >= 0 && (nodeFit < 0 || count < nodeFit) {
+				nodeFit = count
+			}
+		}
+		if nodeFit > 0 {
+			fit += nodeFit
+		}
+	}
+
+	return fit, fmt.Sprintf("%v matching nodes have room for %v more runners", matching, fit), nil
+}
+
+// nodeRoom is what isn't requested yet of the allocatable resources of a node
+type nodeRoom struct {
+	node *corev1.Node
+	left corev1.ResourceList
+}
+
+func freeNodes(ctx context.Context, client kubernetes.Interface) ([]nodeRoom, error) {
+	cluster, err := clusterCacheOf(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, err := cluster.nodes.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	pods, err := cluster.pods.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	requested := map[string]corev1.ResourceList{}
+	for _, pod := range pods {
+		// The fake clientset ignores field selectors
+		if pod.Spec.NodeName == "" || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		podRequests, _ := podResources(pod.Spec)
+		if requested[pod.Spec.NodeName] == nil {
+			requested[pod.Spec.NodeName] = corev1.ResourceList{}
+		}
+		addResources(requested[pod.Spec.NodeName], podRequests)
+	}
+
+	rooms := make([]nodeRoom, 0, len(nodes))
+	for _, node := range nodes {
+		room := nodeRoom{node: node, left: corev1.ResourceList{}}
+		for name, allocatable := range node.Status.Allocatable {
+			left := allocatable.DeepCopy()
+			left.Sub(requested[node.Name][name])
+			room.left[name] = left
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, nil
+}
+
+// schedulable tells if pods with the spec can be scheduled on the node: it isn't cordoned, it matches the node
+// selector and required node affinity and its NoSchedule and NoExecute taints are tolerated
+func schedulable(node *corev1.Node, spec corev1.PodSpec) bool {
+	if node.Spec.Unschedulable || !labels.SelectorFromSet(spec.NodeSelector).Matches(labels.Set(node.Labels)) {
+		return false
+	}
+
+	for i := range node.Spec.Taints {
+		taint := &node.Spec.Taints[i]
+		if taint.Effect == corev1.TaintEffectPreferNoSchedule {
+			continue
+		}
+		tolerated := false
+		for j := range spec.Tolerations {
+			if spec.Tolerations[j].ToleratesTaint(taint) {
+				tolerated = true
+				break
+			}
+		}
+		if !tolerated {
+			return false
+		}
+	}
+
+	if spec.Affinity == nil || spec.Affinity.NodeAffinity == nil || spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return true
+	}
+	// The terms are ORed, the requirements of a term ANDed
+	for _, term := range spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+		if matchesTerm(node, term) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesTerm(node *corev1.Node, term corev1.NodeSelectorTerm) bool {
+	if len(term.MatchExpressions) == 0 && len(term.MatchFields) == 0 {
+		return false
+	}
+	for _, requirement := range term.MatchExpressions {
+		if !matchesRequirement(node.Labels, requirement) {
+			return false
+		}
+	}
+	// metadata.name is the only field nodes can be selected by
+	for _, requirement := range term.MatchFields {
+		if requirement.Key != "metadata.name" || !matchesRequirement(map[string]string{"metadata.name": node.Name}, requirement) {
+			return false
+		}
+	}
+	return true
+}
+
+var nodeSelectorOperators = map[corev1.NodeSelectorOperator]selection.Operator{
+	corev1.NodeSelectorOpIn:           selection.In,
+	corev1.NodeSelectorOpNotIn:        selection.NotIn,
+	corev1.NodeSelectorOpExists:       selection.Exists,
+	corev1.NodeSelectorOpDoesNotExist: selection.DoesNotExist,
+	corev1.NodeSelectorOpGt:           selection.GreaterThan,
+	corev1.NodeSelectorOpLt:           selection.LessThan,
+}
+
+func matchesRequirement(values map[string]string, requirement corev1.NodeSelectorRequirement) bool {
+	operator, ok := nodeSelectorOperators[requirement.Operator]
+	if !ok {
+		return false
+	}
+	parsed, err := labels.NewRequirement(requirement.Key, operator, requirement.Values)
+	if err != nil {
+		return false
+	}
+	return parsed.Matches(labels.Set(values))
+}
+
+// clusterCache keeps the nodes and scheduled pods of a cluster from informers shared by every worker of a client,
+// so fitting runners in the nodes doesn't list every pod of the cluster on each tick
+type clusterCache struct {
+	nodes  corelisters.NodeLister
+	pods   corelisters.PodLister
+	synced []cache.InformerSynced
+}
+
+var (
+	clusterCachesMu sync.Mutex
+	clusterCaches   = map[kubernetes.Interface]*clusterCache{}
+)
+
+// clusterCacheOf returns the cache of the client, starting its informers the first time. It waits a few seconds
+// for them to sync and fails if they don't, so the workers don't block on a cluster they can't list.
+func clusterCacheOf(ctx context.Context, client kubernetes.Interface) (*clusterCache, error) {
+	clusterCachesMu.Lock()
+	cluster, ok := clusterCaches[client]
+	if !ok {
+		factory := informers.NewSharedInformerFactory(client, clusterCacheResync)
+		nodes := factory.Core().V1().Nodes()
+		pods := factory.InformerFor(&corev1.Pod{}, func(client kubernetes.Interface, resync time.Duration) cache.SharedIndexInformer {
+			return coreinformers.NewFilteredPodInformer(client, v1.NamespaceAll, resync, cache.Indexers{}, func(options *v1.ListOptions) {
+				options.FieldSelector = fields.AndSelectors(
+					fields.OneTermNotEqualSelector("spec.nodeName", ""),
+					fields.OneTermNotEqualSelector("status.phase", string(corev1.PodSucceeded)),
+					fields.OneTermNotEqualSelector("status.phase", string(corev1.PodFailed)),
+				).String()
+			})
+		})
+
+		cluster = &clusterCache{
+			nodes:  nodes.Lister(),
+			pods:   corelisters.NewPodLister(pods.GetIndexer()),
+			synced: []cache.InformerSynced{nodes.Informer().HasSynced, pods.HasSynced},
+		}
+		factory.Start(wait.NeverStop)
+		clusterCaches[client] = cluster
+	}
+	clusterCachesMu.Unlock()
+
+	syncCtx, cancel := context.WithTimeout(ctx, clusterCacheSyncTimeout)
+	defer cancel()
+	if !cache.WaitForCacheSync(syncCtx.Done(), cluster.synced...) {
+		return nil, errors.New("nodes and pods not synced yet")
+	}
+	return cluster, nil
+}
+
+// podResources sums the requests and limits of the containers of a pod, init containers run one at a time
+// so only the largest of them counts if it's over the sum
+func podResources(spec corev1.PodSpec) (corev1.ResourceList, corev1.ResourceList) {
+	requests, limits := corev1.ResourceList{}, corev1.ResourceList{}
+	for _, container := range spec.Containers {
+		addResources(requests, container.Resources.Requests)
+		addResources(limits, container.Resources.Limits)
+	}
+	for _, container := range spec.InitContainers {
+		maxResources(requests, container.Resources.Requests)
+		maxResources(limits, container.Resources.Limits)
+	}
+	return requests, limits
+}
+
+func addResources(total corev1.ResourceList, list corev1.ResourceList) {
+	for name, quantity := range list {
+		sum := total[name]
+		sum.Add(quantity)
+		total[name] = sum
+	}
+}
+
+func maxResources(total corev1.ResourceList, list corev1.ResourceList) {
+	for name, quantity := range list {
+		if current, ok := total[name]; !ok || quantity.Cmp(current) > 0 {
+			total[name] = quantity.DeepCopy()
+		}
+	}
+}
+
+// fitCount returns how many times perPod fits in left, or -1 if the pods don't use the resource
+func fitCount(left resource.Quantity, perPod resource.Quantity) int {
+	if perPod.IsZero() {
+		return -1
+	}
+	if left.Sign() <= 0 {
+		return 0
+	}
+	return int(left.MilliValue() / perPod.MilliValue())
+}
@@ -0,0 +1,207 @@
+package workers_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/vela-games/circleci-runner-autoscaler/budget"
+	"github.com/vela-games/circleci-runner-autoscaler/workers"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testclient "k8s.io/client-go/kubernetes/fake"
+)
+
+func capacityPool(t *testing.T, unclaimed int, checkNodes bool, objects ...any) (*workers.RunnerPoolScalingWorker, *testclient.Clientset) {
+	dynamicClient := fakeDynamicClient(runnerPool("small", "circleci-runners", map[string]any{
+		"resourceClass": "vela-games/k8s-small",
+		"template": map[string]any{
+			"spec": map[string]any{
+				"nodeSelector": map[string]any{"pool": "runners"},
+				"tolerations": []any{
+					map[string]any{"key": "dedicated", "operator": "Equal", "value": "runners", "effect": "NoSchedule"},
+				},
+				"affinity": map[string]any{
+					"nodeAffinity": map[string]any{
+						"requiredDuringSchedulingIgnoredDuringExecution": map[string]any{
+							"nodeSelectorTerms": []any{
+								map[string]any{
+									"matchExpressions": []any{
+										map[string]any{"key": "kubernetes.io/arch", "operator": "NotIn", "values": []any{"arm64"}},
+									},
+								},
+							},
+						},
+					},
+				},
+				"containers": []any{
+					map[string]any{
+						"name":  "runner",
+						"image": "circleci-image:latest",
+						"resources": map[string]any{
+							"requests": map[string]any{"cpu": "1", "memory": "1Gi"},
+							"limits":   map[string]any{"cpu": "2", "memory": "1Gi"},
+						},
+					},
+				},
+			},
+		},
+	}))
+
+	k8sClient := testclient.NewSimpleClientset()
+	for _, object := range objects {
+		var err error
+		switch o := object.(type) {
+		case *corev1.ResourceQuota:
+			_, err = k8sClient.CoreV1().ResourceQuotas(o.Namespace).Create(context.TODO(), o, metav1.CreateOptions{})
+		case *corev1.Node:
+			_, err = k8sClient.CoreV1().Nodes().Create(context.TODO(), o, metav1.CreateOptions{})
+		case *corev1.Pod:
+			_, err = k8sClient.CoreV1().Pods(o.Namespace).Create(context.TODO(), o, metav1.CreateOptions{})
+		}
+		assert.NilError(t, err)
+	}
+
+	return &workers.RunnerPoolScalingWorker{
+		ResourceClass:      "vela-games/k8s-small",
+		PoolName:           "small",
+		PoolNamespace:      "circleci-runners",
+		DynamicClient:      dynamicClient,
+		ClientSet:          k8sClient,
+		CircleCiClient:     poolCircleCiClient(unclaimed, 0),
+		CheckNodeCapacity:  checkNodes,
+		TimestampGenerator: func() int64 { return 1700000000 },
+	}, k8sClient
+}
+
+func resourceQuota(hard corev1.ResourceList, used corev1.ResourceList) *corev1.ResourceQuota {
+	return &corev1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "compute-resources", Namespace: "circleci-runners"},
+		Spec:       corev1.ResourceQuotaSpec{Hard: hard},
+		Status:     corev1.ResourceQuotaStatus{Hard: hard, Used: used},
+	}
+}
+
+func runnerNode(name string, cpu string, unschedulable bool, labels map[string]string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+		Spec:       corev1.NodeSpec{Unschedulable: unschedulable},
+		Status: corev1.NodeStatus{
+			Allocatable: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse(cpu),
+				corev1.ResourceMemory: resource.MustParse("16Gi"),
+			},
+		},
+	}
+}
+
+func taintedNode(node *corev1.Node, taints ...corev1.Taint) *corev1.Node {
+	node.Spec.Taints = taints
+	return node
+}
+
+func createdJobs(t *testing.T, k8sClient *testclient.Clientset) int {
+	jobs, err := k8sClient.BatchV1().Jobs("circleci-runners").List(context.TODO(), metav1.ListOptions{})
+	assert.NilError(t, err)
+	return len(jobs.Items)
+}
+
+func TestCapacityPreflight(t *testing.T) {
+	t.Run("it should only create the jobs that fit in the ResourceQuota", func(t *testing.T) {
+		scaling, k8sClient := capacityPool(t, 6, false, resourceQuota(
+			corev1.ResourceList{
+				corev1.ResourcePods:           resource.MustParse("10"),
+				corev1.ResourceRequestsCPU:    resource.MustParse("8"),
+				corev1.ResourceLimitsCPU:      resource.MustParse("12"),
+				corev1.ResourceRequestsMemory: resource.MustParse("64Gi"),
+			},
+			corev1.ResourceList{
+				corev1.ResourcePods:           resource.MustParse("3"),
+				corev1.ResourceRequestsCPU:    resource.MustParse("3"),
+				corev1.ResourceLimitsCPU:      resource.MustParse("4500m"),
+				corev1.ResourceRequestsMemory: resource.MustParse("3Gi"),
+			},
+		))
+
+		scaling.Handle(context.TODO())
+
+		// 7.5 CPUs of limits left fit 3 runners with a limit of 2 CPUs
+		assert.Equal(t, 3, createdJobs(t, k8sClient))
+
+		events := recordedEvents(t, k8sClient, "circleci-runners", 2)
+		messages := map[string]string{}
+		for _, event := range events {
+			messages[event.Reason] = event.Message
+		}
+		assert.Equal(t, "Only 3 of 6 jobs fit: ResourceQuota compute-resources has room for 3 more runners by limits.cpu", messages[workers.EventCapacityThrottled])
+	})
+
+	t.Run("it should not create jobs when the quota is used up", func(t *testing.T) {
+		scaling, k8sClient := capacityPool(t, 2, false, resourceQuota(
+			corev1.ResourceList{"count/jobs.batch": resource.MustParse("20")},
+			corev1.ResourceList{"count/jobs.batch": resource.MustParse("20")},
+		))
+
+		scaling.Handle(context.TODO())
+
+		assert.Equal(t, 0, createdJobs(t, k8sClient))
+		assert.Equal(t, "wanted 2 runners but no capacity left: ResourceQuota compute-resources has room for 0 more runners by count/jobs.batch", scaling.Report().LastDecision)
+	})
+
+	t.Run("it should create every job without quotas", func(t *testing.T) {
+		scaling, k8sClient := capacityPool(t, 4, false)
+
+		scaling.Handle(context.TODO())
+
+		assert.Equal(t, 4, createdJobs(t, k8sClient))
+	})
+
+	t.Run("it should only create the jobs that fit in the matching nodes", func(t *testing.T) {
+		scaling, k8sClient := capacityPool(t, 8, true,
+			runnerNode("node-a", "4", false, map[string]string{"pool": "runners"}),
+			runnerNode("node-b", "2500m", false, map[string]string{"pool": "runners"}),
+			runnerNode("node-c", "64", true, map[string]string{"pool": "runners"}),
+			runnerNode("node-d", "64", false, map[string]string{"pool": "other"}),
+			runnerNode("node-e", "64", false, map[string]string{"pool": "runners", "kubernetes.io/arch": "arm64"}),
+			taintedNode(runnerNode("node-f", "64", false, map[string]string{"pool": "runners"}),
+				corev1.Taint{Key: "dedicated", Value: "gpu", Effect: corev1.TaintEffectNoSchedule}),
+			taintedNode(runnerNode("node-g", "1", false, map[string]string{"pool": "runners"}),
+				corev1.Taint{Key: "dedicated", Value: "runners", Effect: corev1.TaintEffectNoSchedule},
+				corev1.Taint{Key: "spot", Effect: corev1.TaintEffectPreferNoSchedule}),
+			&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "busy", Namespace: "default"},
+				Spec: corev1.PodSpec{
+					NodeName: "node-a",
+					Containers: []corev1.Container{{
+						Name: "busy",
+						Resources: corev1.ResourceRequirements{
+							Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("3")},
+						},
+					}},
+				},
+				Status: corev1.PodStatus{Phase: corev1.PodRunning},
+			},
+		)
+
+		scaling.Handle(context.TODO())
+
+		// 1 runner on node-a next to the busy pod, 2 on node-b and 1 on node-g whose taint is tolerated
+		assert.Equal(t, 4, createdJobs(t, k8sClient))
+	})
+
+	t.Run("it should only claim the budget of the jobs that fit", func(t *testing.T) {
+		scaling, k8sClient := capacityPool(t, 6, false, resourceQuota(
+			corev1.ResourceList{corev1.ResourcePods: resource.MustParse("4")},
+			corev1.ResourceList{corev1.ResourcePods: resource.MustParse("4")},
+		))
+		spendBudget := &budget.Budget{Limit: 10, OnExhausted: func(budget.Exhausted) {}}
+		scaling.Budget = spendBudget
+
+		scaling.Handle(context.TODO())
+
+		assert.Equal(t, 0, createdJobs(t, k8sClient))
+		// The runners throttled by the quota are left to the other classes
+		assert.Equal(t, int32(10), spendBudget.Claim("vela-games/other", "other", 0, 10, 1))
+	})
+}
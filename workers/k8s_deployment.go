@@ -0,0 +1,278 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/vela-games/circleci-runner-autoscaler/budget"
+	circleci_client "github.com/vela-games/circleci-runner-autoscaler/client"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// Optional annotations on runner Deployments bounding the replicas the autoscaler sets
+	MinReplicasAnnotation = "circleci-runner-autoscaler/min-replicas"
+	MaxReplicasAnnotation = "circleci-runner-autoscaler/max-replicas"
+
+	EventScaledDown  = "ScaledDown"
+	EventScaleFailed = "ScaleFailed"
+)
+
+// K8sDeploymentScalingWorker scales the replicas of a Deployment of long running runners through its scale subresource
+type K8sDeploymentScalingWorker struct {
+	ResourceClass string
+
+	DeploymentName      string
+	DeploymentNamespace string
+
+	ClientSet      kubernetes.Interface
+	CircleCiClient circleci_client.ClientWithResponsesInterface
+
+	// Optional, scaling out is limited to the capacity the budget grants
+	Budget *budget.Budget
+
+	// Replicas are always limited to the ResourceQuotas of the namespace, this also limits them to the node capacity
+	CheckNodeCapacity bool
+	// Optional, shares the cluster capacity with the other resource classes by priority and weight
+	Scheduler *ClassScheduler
+
+	// Only decide how to scale, without changing the replicas
+	DryRun bool
+
+	// Last status written to the Deployment annotation
+	status CronJobStatus
+
+	reporter
+	capacityLimit
+}
+
+func (w *K8sDeploymentScalingWorker) Kind() WorkerKind {
+	return KindScaling
+}
+
+func (w *K8sDeploymentScalingWorker) ResourceClassName() string {
+	return w.ResourceClass
+}
+
+func (w *K8sDeploymentScalingWorker) Report() WorkerReport {
+	report := w.snapshot()
+	report.Backend = "kubernetes"
+	report.Target = w.DeploymentNamespace + "/" + w.DeploymentName
+	report.ResourceClass = w.ResourceClass
+	w.reportLimit(&report, time.Now())
+	return report
+}
+
+// Handle sets the replicas of the Deployment to the running and unclaimed tasks of the resource class, within the
+// bounds of its annotations and the capacity of the cluster. Kubernetes picks the pods removed when scaling in and
+// CircleCI doesn't tell which runners are busy, so the Deployment is only scaled in once no task is running.
+func (w *K8sDeploymentScalingWorker) Handle(ctx context.Context) {
+	log.Printf("handle scaling of %v", w.ResourceClass)
+
+	deployment, err := w.ClientSet.AppsV1().Deployments(w.DeploymentNamespace).Get(ctx, w.DeploymentName, v1.GetOptions{})
+	if err != nil {
+		log.Printf("error trying to get Deployment %v: %v", w.ResourceClass, err)
+		w.failed("getting Deployment %v: %v", w.DeploymentName, err)
+		return
+	}
+	reference := deploymentReference(deployment)
+
+	response, err := w.CircleCiClient.GetUnclaimedTasksWithResponse(ctx, &circleci_client.GetUnclaimedTasksParams{
+		ResourceClass: w.ResourceClass,
+	})
+	if err != nil {
+		log.Printf("error getting unclaimed tasks by resource class %v: %v", w.ResourceClass, err)
+		w.failed("getting unclaimed tasks: %v", err)
+		return
+	}
+
+	if response.StatusCode() != 200 || response.JSON200 == nil || response.JSON200.UnclaimedTaskCount == nil {
+		log.Printf("got %v code instead of 200", response.StatusCode())
+		w.failed("getting unclaimed tasks: got %v code instead of 200", response.StatusCode())
+		return
+	}
+	unclaimed := int32(*response.JSON200.UnclaimedTaskCount)
+
+	running, err := runningTasks(ctx, w.CircleCiClient, w.ResourceClass)
+	if err != nil {
+		log.Printf("error getting running tasks of %v: %v", w.ResourceClass, err)
+		w.failed("%v", err)
+		return
+	}
+
+	scale, err := w.ClientSet.AppsV1().Deployments(w.DeploymentNamespace).GetScale(ctx, w.DeploymentName, v1.GetOptions{})
+	if err != nil {
+		log.Printf("error getting scale of Deployment %v: %v", w.DeploymentName, err)
+		w.failed("getting scale of Deployment %v: %v", w.DeploymentName, err)
+		return
+	}
+	current := scale.Spec.Replicas
+
+	minReplicas, maxReplicas := replicaBounds(deployment)
+	desired := int32(running) + unclaimed
+	if desired < minReplicas {
+		desired = minReplicas
+	}
+	if maxReplicas > 0 && desired > maxReplicas {
+		desired = maxReplicas
+	}
+	// The capacity limit only holds scale-outs back, it doesn't scale the Deployment in
+	if limit, _, ok := w.limit(time.Now()); ok && desired > current && desired > limit {
+		desired = limit
+		if desired < current {
+			desired = current
+		}
+	}
+	if desired < current && running > 0 {
+		log.Printf("%v: %v tasks running, not scaling in from %v to %v replicas", w.ResourceClass, running, current, desired)
+		desired = current
+	}
+
+	if desired > current {
+		wanted := int(desired - current)
+		if fit, reason := allocateCapacity(ctx, w.ClientSet, w.Scheduler, w.ResourceClass, w.DeploymentNamespace, deployment.Spec.Template, wanted, w.CheckNodeCapacity); fit < wanted {
+			log.Printf("%v: demand throttled by capacity, %v of %v replicas fit: %v", w.ResourceClass, fit, wanted, reason)
+			if !w.DryRun {
+				recordEvent(w.ClientSet, reference, corev1.EventTypeWarning, EventCapacityThrottled, "Only %v of %v replicas fit: %v", fit, wanted, reason)
+			}
+			if fit == 0 {
+				w.decided("wanted %v replicas but no capacity left: %v", desired, reason)
+				w.pending(pendingReplicas(deployment, current))
+				w.updateBudget(current)
+				return
+			}
+			desired = current + int32(fit)
+		}
+	} else if w.Scheduler != nil {
+		w.Scheduler.Forget(w.ResourceClass)
+	}
+
+	// Only claim the budget for the replicas that fit
+	if desired > current && w.Budget != nil {
+		granted := w.Budget.Claim(w.ResourceClass, w.DeploymentName, current, desired, w.Budget.Weight(w.ResourceClass, ""))
+		if granted <= current {
+			log.Printf("%v: budget exhausted, not scaling out", w.ResourceClass)
+			w.decided("budget exhausted, wanted %v replicas but staying at %v", desired, current)
+			if !w.DryRun {
+				recordEvent(w.ClientSet, reference, corev1.EventTypeWarning, EventBudgetExhausted, "Budget exhausted, wanted %v replicas but staying at %v", desired, current)
+			}
+			return
+		}
+		desired = granted
+	} else {
+		w.updateBudget(desired)
+	}
+
+	if desired == current {
+		log.Printf("%v: staying at %v replicas", w.ResourceClass, current)
+		w.decided("%v running and %v unclaimed tasks, staying at %v replicas", running, unclaimed, current)
+		w.pending(pendingReplicas(deployment, current))
+		return
+	}
+
+	if w.DryRun {
+		w.decided("dry run: %v running and %v unclaimed tasks, would scale Deployment %v from %v to %v replicas", running, unclaimed, w.DeploymentName, current, desired)
+		w.updateBudget(current)
+		return
+	}
+
+	log.Printf("%v: scaling Deployment %v from %v to %v replicas", w.ResourceClass, w.DeploymentName, current, desired)
+	scale.Spec.Replicas = desired
+	if _, err := w.ClientSet.AppsV1().Deployments(w.DeploymentNamespace).UpdateScale(ctx, w.DeploymentName, scale, v1.UpdateOptions{}); err != nil {
+		log.Printf("error scaling Deployment %v: %v", w.DeploymentName, err)
+		w.failed("scaling Deployment %v: %v", w.DeploymentName, err)
+		recordEvent(w.ClientSet, reference, corev1.EventTypeWarning, EventScaleFailed, "Error scaling from %v to %v replicas: %v", current, desired, err)
+		now := time.Now()
+		w.status.LastError = fmt.Sprintf("scaling from %v to %v replicas: %v", current, desired, err)
+		w.status.LastErrorTime = &now
+		patchStatus(ctx, w.ClientSet, reference, w.status)
+		w.updateBudget(current)
+		return
+	}
+
+	w.decided("%v running and %v unclaimed tasks, scaled from %v to %v replicas", running, unclaimed, current, desired)
+	w.pending(pendingReplicas(deployment, desired))
+	if desired > current {
+		recordEvent(w.ClientSet, reference, corev1.EventTypeNormal, EventScaledUp, "Scaled from %v to %v replicas for %v unclaimed tasks", current, desired, unclaimed)
+	} else {
+		recordEvent(w.ClientSet, reference, corev1.EventTypeNormal, EventScaledDown, "Scaled from %v to %v replicas for %v running tasks", current, desired, running)
+	}
+
+	now := time.Now()
+	w.status.LastScaleTime = &now
+	w.status.PendingRunners = pendingReplicas(deployment, desired)
+	patchStatus(ctx, w.ClientSet, reference, w.status)
+}
+
+func (w *K8sDeploymentScalingWorker) Inspect(ctx context.Context) (ClassState, error) {
+	state := ClassState{
+		ResourceClass: w.ResourceClass,
+		Backend:       "kubernetes",
+		Target:        w.DeploymentNamespace,
+		Group:         w.DeploymentName,
+	}
+
+	if err := inspectCircleCi(ctx, w.CircleCiClient, &state); err != nil {
+		return state, err
+	}
+
+	deployment, err := w.ClientSet.AppsV1().Deployments(w.DeploymentNamespace).Get(ctx, w.DeploymentName, v1.GetOptions{})
+	if err != nil {
+		return state, fmt.Errorf("getting Deployment %v: %w", w.DeploymentName, err)
+	}
+
+	state.MinSize, state.MaxSize = replicaBounds(deployment)
+	if deployment.Spec.Replicas != nil {
+		state.DesiredCapacity = *deployment.Spec.Replicas
+	}
+	state.Ready = deployment.Status.ReadyReplicas
+
+	return state, nil
+}
+
+// replicaBounds returns the min and max replicas set in the annotations of the Deployment, 0 if not set
+func replicaBounds(deployment *appsv1.Deployment) (int32, int32) {
+	bound := func(annotation string) int32 {
+		value, ok := deployment.Annotations[annotation]
+		if !ok {
+			return 0
+		}
+		parsed, err := strconv.ParseInt(value, 10, 32)
+		if err != nil || parsed < 0 {
+			log.Printf("ignoring invalid %v annotation %q on Deployment %v", annotation, value, deployment.Name)
+			return 0
+		}
+		return int32(parsed)
+	}
+	return bound(MinReplicasAnnotation), bound(MaxReplicasAnnotation)
+}
+
+func pendingReplicas(deployment *appsv1.Deployment, replicas int32) int32 {
+	if pending := replicas - deployment.Status.ReadyReplicas; pending > 0 {
+		return pending
+	}
+	return 0
+}
+
+func deploymentReference(deployment *appsv1.Deployment) corev1.ObjectReference {
+	return corev1.ObjectReference{
+		APIVersion:      "apps/v1",
+		Kind:            string(SourceDeployment),
+		Name:            deployment.Name,
+		Namespace:       deployment.Namespace,
+		UID:             deployment.UID,
+		ResourceVersion: deployment.ResourceVersion,
+	}
+}
+
+func (w *K8sDeploymentScalingWorker) updateBudget(current int32) {
+	if w.Budget != nil {
+		w.Budget.Update(w.ResourceClass, w.DeploymentName, current, w.Budget.Weight(w.ResourceClass, ""))
+	}
+}
@@ -0,0 +1,231 @@
+package workers_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/vela-games/circleci-runner-autoscaler/budget"
+	"github.com/vela-games/circleci-runner-autoscaler/workers"
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/poll"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// fakeScale serves the scale subresource of a Deployment, which the fake clientset doesn't implement
+func fakeScale(k8sClient *testclient.Clientset, replicas int32) *int32 {
+	k8sClient.PrependReactor("get", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "scale" {
+			return false, nil, nil
+		}
+		return true, &autoscalingv1.Scale{
+			ObjectMeta: metav1.ObjectMeta{Name: "runners", Namespace: "circleci-runners"},
+			Spec:       autoscalingv1.ScaleSpec{Replicas: replicas},
+		}, nil
+	})
+
+	updated := int32(-1)
+	k8sClient.PrependReactor("update", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "scale" {
+			return false, nil, nil
+		}
+		scale := action.(k8stesting.UpdateAction).GetObject().(*autoscalingv1.Scale)
+		updated = scale.Spec.Replicas
+		return true, scale, nil
+	})
+	return &updated
+}
+
+func runnerDeployment(annotations map[string]string) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "runners",
+			Namespace: "circleci-runners",
+			Labels: map[string]string{
+				"resource-class-org":  "vela-games",
+				"resource-class-name": "k8s-deployment",
+			},
+			Annotations: annotations,
+		},
+		Status: appsv1.DeploymentStatus{
+			ReadyReplicas: 2,
+		},
+	}
+}
+
+func TestK8sDeploymentScalingWorker(t *testing.T) {
+	t.Run("it should scale out to the running and unclaimed tasks", func(t *testing.T) {
+		k8sClient := testclient.NewSimpleClientset(runnerDeployment(nil))
+		updated := fakeScale(k8sClient, 2)
+
+		scaling := &workers.K8sDeploymentScalingWorker{
+			ResourceClass:       "vela-games/k8s-deployment",
+			DeploymentName:      "runners",
+			DeploymentNamespace: "circleci-runners",
+			ClientSet:           k8sClient,
+			CircleCiClient:      poolCircleCiClient(3, 2),
+		}
+		scaling.Handle(context.TODO())
+
+		assert.Equal(t, int32(5), *updated)
+		assert.Equal(t, "2 running and 3 unclaimed tasks, scaled from 2 to 5 replicas", scaling.Report().LastDecision)
+		assert.Equal(t, int32(3), scaling.Report().PendingCapacity)
+
+		events := recordedEvents(t, k8sClient, "circleci-runners", 1)
+		assert.Equal(t, 1, len(events))
+		assert.Equal(t, workers.EventScaledUp, events[0].Reason)
+		assert.Equal(t, "Deployment", events[0].InvolvedObject.Kind)
+
+		deployment, err := k8sClient.AppsV1().Deployments("circleci-runners").Get(context.TODO(), "runners", metav1.GetOptions{})
+		assert.NilError(t, err)
+		assert.Assert(t, deployment.Annotations[workers.StatusAnnotation] != "")
+	})
+
+	t.Run("it should scale in to the min replicas", func(t *testing.T) {
+		k8sClient := testclient.NewSimpleClientset(runnerDeployment(map[string]string{
+			workers.MinReplicasAnnotation: "1",
+		}))
+		updated := fakeScale(k8sClient, 4)
+
+		scaling := &workers.K8sDeploymentScalingWorker{
+			ResourceClass:       "vela-games/k8s-deployment",
+			DeploymentName:      "runners",
+			DeploymentNamespace: "circleci-runners",
+			ClientSet:           k8sClient,
+			CircleCiClient:      poolCircleCiClient(0, 0),
+		}
+		scaling.Handle(context.TODO())
+
+		assert.Equal(t, int32(1), *updated)
+	})
+
+	t.Run("it should not scale in while tasks are running", func(t *testing.T) {
+		k8sClient := testclient.NewSimpleClientset(runnerDeployment(nil))
+		updated := fakeScale(k8sClient, 4)
+
+		scaling := &workers.K8sDeploymentScalingWorker{
+			ResourceClass:       "vela-games/k8s-deployment",
+			DeploymentName:      "runners",
+			DeploymentNamespace: "circleci-runners",
+			ClientSet:           k8sClient,
+			CircleCiClient:      poolCircleCiClient(0, 1),
+		}
+		scaling.Handle(context.TODO())
+
+		// Kubernetes could delete the pod running the task
+		assert.Equal(t, int32(-1), *updated)
+		assert.Equal(t, "1 running and 0 unclaimed tasks, staying at 4 replicas", scaling.Report().LastDecision)
+	})
+
+	t.Run("it should only scale out to the replicas that fit in the ResourceQuota", func(t *testing.T) {
+		k8sClient := testclient.NewSimpleClientset(runnerDeployment(nil), resourceQuota(
+			corev1.ResourceList{corev1.ResourcePods: resource.MustParse("4")},
+			corev1.ResourceList{corev1.ResourcePods: resource.MustParse("2")},
+		))
+		updated := fakeScale(k8sClient, 2)
+
+		scaling := &workers.K8sDeploymentScalingWorker{
+			ResourceClass:       "vela-games/k8s-deployment",
+			DeploymentName:      "runners",
+			DeploymentNamespace: "circleci-runners",
+			ClientSet:           k8sClient,
+			CircleCiClient:      poolCircleCiClient(3, 2),
+		}
+		scaling.Handle(context.TODO())
+
+		assert.Equal(t, int32(4), *updated)
+		assert.Equal(t, "2 running and 3 unclaimed tasks, scaled from 2 to 4 replicas", scaling.Report().LastDecision)
+	})
+
+	t.Run("it should cap at the max replicas and leave the replicas alone when they match", func(t *testing.T) {
+		k8sClient := testclient.NewSimpleClientset(runnerDeployment(map[string]string{
+			workers.MaxReplicasAnnotation: "4",
+		}))
+		updated := fakeScale(k8sClient, 4)
+
+		scaling := &workers.K8sDeploymentScalingWorker{
+			ResourceClass:       "vela-games/k8s-deployment",
+			DeploymentName:      "runners",
+			DeploymentNamespace: "circleci-runners",
+			ClientSet:           k8sClient,
+			CircleCiClient:      poolCircleCiClient(8, 3),
+		}
+		scaling.Handle(context.TODO())
+
+		assert.Equal(t, int32(-1), *updated)
+		assert.Equal(t, "3 running and 8 unclaimed tasks, staying at 4 replicas", scaling.Report().LastDecision)
+	})
+	t.Run("it should not scale out past a temporary capacity limit", func(t *testing.T) {
+		k8sClient := testclient.NewSimpleClientset(runnerDeployment(nil))
+		updated := fakeScale(k8sClient, 2)
+
+		scaling := &workers.K8sDeploymentScalingWorker{
+			ResourceClass:       "vela-games/k8s-deployment",
+			DeploymentName:      "runners",
+			DeploymentNamespace: "circleci-runners",
+			ClientSet:           k8sClient,
+			CircleCiClient:      poolCircleCiClient(3, 2),
+		}
+		scaling.LimitCapacity(3, time.Now().Add(time.Hour))
+		scaling.Handle(context.TODO())
+
+		assert.Equal(t, int32(3), *updated)
+		assert.Equal(t, int32(3), *scaling.Report().CapacityLimit)
+	})
+	t.Run("it should count a repeated event instead of recording it again", func(t *testing.T) {
+		k8sClient := testclient.NewSimpleClientset(runnerDeployment(nil))
+		fakeScale(k8sClient, 2)
+
+		scaling := &workers.K8sDeploymentScalingWorker{
+			ResourceClass:       "vela-games/k8s-deployment",
+			DeploymentName:      "runners",
+			DeploymentNamespace: "circleci-runners",
+			ClientSet:           k8sClient,
+			CircleCiClient:      poolCircleCiClient(3, 2),
+			Budget:              &budget.Budget{Limit: 2, OnExhausted: func(budget.Exhausted) {}},
+		}
+		scaling.Handle(context.TODO())
+		scaling.Handle(context.TODO())
+
+		poll.WaitOn(t, func(poll.LogT) poll.Result {
+			events, err := k8sClient.CoreV1().Events("circleci-runners").List(context.TODO(), metav1.ListOptions{})
+			if err != nil {
+				return poll.Error(err)
+			}
+			if len(events.Items) != 1 || events.Items[0].Count != 2 {
+				return poll.Continue("%v events recorded, waiting for one counted twice", len(events.Items))
+			}
+			return poll.Success()
+		}, poll.WithDelay(10*time.Millisecond))
+		assert.Equal(t, workers.EventBudgetExhausted, recordedEvents(t, k8sClient, "circleci-runners", 1)[0].Reason)
+	})
+	t.Run("it should not record events in dry run", func(t *testing.T) {
+		k8sClient := testclient.NewSimpleClientset(runnerDeployment(nil))
+		fakeScale(k8sClient, 2)
+
+		scaling := &workers.K8sDeploymentScalingWorker{
+			ResourceClass:       "vela-games/k8s-deployment",
+			DeploymentName:      "runners",
+			DeploymentNamespace: "circleci-runners",
+			ClientSet:           k8sClient,
+			CircleCiClient:      poolCircleCiClient(3, 2),
+			Budget:              &budget.Budget{Limit: 2, OnExhausted: func(budget.Exhausted) {}},
+			DryRun:              true,
+		}
+		scaling.Handle(context.TODO())
+		assert.Equal(t, "budget exhausted, wanted 5 replicas but staying at 2", scaling.Report().LastDecision)
+
+		// Events are sent in the background
+		time.Sleep(100 * time.Millisecond)
+		events, err := k8sClient.CoreV1().Events("circleci-runners").List(context.TODO(), metav1.ListOptions{})
+		assert.NilError(t, err)
+		assert.Equal(t, 0, len(events.Items))
+	})
+}
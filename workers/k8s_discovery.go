@@ -5,7 +5,9 @@ import (
 	"log"
 	"time"
 
+	"github.com/vela-games/circleci-runner-autoscaler/budget"
 	"github.com/vela-games/circleci-runner-autoscaler/client"
+	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 )
@@ -15,56 +17,135 @@ type K8sDiscoveryWorker struct {
 
 	ClientSet      kubernetes.Interface
 	CircleCiClient client.ClientWithResponsesInterface
+	Budget         *budget.Budget
+
+	// Passed on to the scaling workers
+	InjectRunnerEnv   bool
+	CheckNodeCapacity bool
+	Scheduler         *ClassScheduler
+	// PriorityClass of the runner pods by resource class
+	PriorityClasses map[string]string
 
 	K8sNamespace              string
 	Namespace                 string
 	childWorkersResourceClass []string
+
+	reporter
+}
+
+func (w *K8sDiscoveryWorker) Kind() WorkerKind {
+	return KindDiscovery
 }
 
-// This will discover new k8s resource classes on circleci and start the k8s scaling worker for each one of them
+func (w *K8sDiscoveryWorker) Report() WorkerReport {
+	report := w.snapshot()
+	report.Backend = "kubernetes"
+	report.Target = w.K8sNamespace
+	return report
+}
+
+// This will discover new k8s resource classes on circleci and start the k8s scaling worker for each one of them.
+// Resource classes are declared by labeling a suspended CronJob, a PodTemplate or a Deployment.
 func (w *K8sDiscoveryWorker) Handle(ctx context.Context) {
 	cronJobList, err := w.ClientSet.BatchV1().CronJobs(w.K8sNamespace).List(ctx, v1.ListOptions{})
 	if err != nil {
 		log.Printf("error listing cronjobs in namespace: %v, %v", w.K8sNamespace, err)
+		w.failed("listing cronjobs in namespace %v: %v", w.K8sNamespace, err)
 		return
 	}
 
-	for _, job := range cronJobList.Items {
-		namespace, ok := job.Labels["resource-class-org"]
-		if !ok || namespace != w.Namespace {
-			continue
+	for i := range cronJobList.Items {
+		job := &cronJobList.Items[i]
+		w.discover(ctx, job.Labels, cronJobReference(job), func(class string) Worker {
+			return w.jobScalingWorker(class, SourceCronJob, job.Namespace, job.Name)
+		})
+	}
+
+	podTemplateList, err := w.ClientSet.CoreV1().PodTemplates(w.K8sNamespace).List(ctx, v1.ListOptions{})
+	if err != nil {
+		log.Printf("error listing podtemplates in namespace: %v, %v", w.K8sNamespace, err)
+		w.failed("listing podtemplates in namespace %v: %v", w.K8sNamespace, err)
+	} else {
+		for i := range podTemplateList.Items {
+			template := &podTemplateList.Items[i]
+			reference := corev1.ObjectReference{
+				APIVersion: "v1",
+				Kind:       string(SourcePodTemplate),
+				Name:       template.Name,
+				Namespace:  template.Namespace,
+				UID:        template.UID,
+			}
+			w.discover(ctx, template.Labels, reference, func(class string) Worker {
+				return w.jobScalingWorker(class, SourcePodTemplate, template.Namespace, template.Name)
+			})
 		}
+	}
 
-		name, ok := job.Labels["resource-class-name"]
-		if !ok {
-			continue
+	deploymentList, err := w.ClientSet.AppsV1().Deployments(w.K8sNamespace).List(ctx, v1.ListOptions{})
+	if err != nil {
+		log.Printf("error listing deployments in namespace: %v, %v", w.K8sNamespace, err)
+		w.failed("listing deployments in namespace %v: %v", w.K8sNamespace, err)
+	} else {
+		for i := range deploymentList.Items {
+			deployment := &deploymentList.Items[i]
+			w.discover(ctx, deployment.Labels, deploymentReference(deployment), func(class string) Worker {
+				return &K8sDeploymentScalingWorker{
+					ResourceClass:       class,
+					DeploymentName:      deployment.Name,
+					DeploymentNamespace: deployment.Namespace,
+					ClientSet:           w.ClientSet,
+					CircleCiClient:      w.CircleCiClient,
+					Budget:              w.Budget,
+					CheckNodeCapacity:   w.CheckNodeCapacity,
+					Scheduler:           w.Scheduler,
+				}
+			})
 		}
+	}
 
-		fullClassName := namespace + "/" + name
+	w.decided("scaling %v resource classes", len(w.childWorkersResourceClass))
+}
 
-		found := false
-		for _, c := range w.childWorkersResourceClass {
-			if fullClassName == c {
-				found = true
-				break
-			}
-		}
+// discover starts the scaling worker of the resource class in the labels of a runners source, unless it already has one
+func (w *K8sDiscoveryWorker) discover(ctx context.Context, labels map[string]string, source corev1.ObjectReference, newWorker func(class string) Worker) {
+	namespace, ok := labels["resource-class-org"]
+	if !ok || namespace != w.Namespace {
+		return
+	}
 
-		if !found {
-			w.childWorkersResourceClass = append(w.childWorkersResourceClass, fullClassName)
-			log.Printf("Found new k8s resource class %v, starting scaling worker for it", fullClassName)
-			sc := &K8sScalingWorker{
-				ResourceClass:    fullClassName,
-				CronJobNamespace: job.Namespace,
-				CronJobName:      job.Name,
-				ClientSet:        w.ClientSet,
-				CircleCiClient:   w.CircleCiClient,
-				TimestampGenerator: func() int64 {
-					return time.Now().Unix()
-				},
-			}
-			w.Dispatcher.Start(ctx, sc)
+	name, ok := labels["resource-class-name"]
+	if !ok {
+		return
+	}
+
+	fullClassName := namespace + "/" + name
+	for _, c := range w.childWorkersResourceClass {
+		if fullClassName == c {
+			return
 		}
+	}
+
+	w.childWorkersResourceClass = append(w.childWorkersResourceClass, fullClassName)
+	log.Printf("Found new k8s resource class %v in %v %v, starting scaling worker for it", fullClassName, source.Kind, source.Name)
+	recordEvent(w.ClientSet, source, corev1.EventTypeNormal, EventDiscovered, "Discovered resource class %v, started its scaling worker", fullClassName)
+	w.Dispatcher.Start(ctx, newWorker(fullClassName))
+}
 
+func (w *K8sDiscoveryWorker) jobScalingWorker(class string, source K8sSource, namespace string, name string) Worker {
+	return &K8sScalingWorker{
+		ResourceClass:     class,
+		Source:            source,
+		SourceName:        name,
+		SourceNamespace:   namespace,
+		ClientSet:         w.ClientSet,
+		CircleCiClient:    w.CircleCiClient,
+		Budget:            w.Budget,
+		InjectRunnerEnv:   w.InjectRunnerEnv,
+		CheckNodeCapacity: w.CheckNodeCapacity,
+		Scheduler:         w.Scheduler,
+		PriorityClassName: w.PriorityClasses[class],
+		TimestampGenerator: func() int64 {
+			return time.Now().Unix()
+		},
 	}
 }
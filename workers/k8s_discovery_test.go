@@ -6,7 +6,9 @@ import (
 
 	"github.com/vela-games/circleci-runner-autoscaler/workers"
 	"gotest.tools/v3/assert"
+	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	testclient "k8s.io/client-go/kubernetes/fake"
 )
@@ -76,6 +78,10 @@ func TestK8sDiscoveryWorker(t *testing.T) {
 		discovery.Handle(context.TODO())
 
 		assert.Equal(t, 1, dispatcher.Count)
+
+		events := recordedEvents(t, k8sClient, "circleci-runners", 1)
+		assert.Equal(t, 1, len(events))
+		assert.Equal(t, workers.EventDiscovered, events[0].Reason)
 	})
 
 	t.Run("it should start two k8s scaling worker once", func(t *testing.T) {
@@ -159,4 +165,63 @@ func TestK8sDiscoveryWorker(t *testing.T) {
 
 		assert.Equal(t, 2, dispatcher.Count)
 	})
+
+	t.Run("it should start scaling workers for PodTemplates and Deployments", func(t *testing.T) {
+		classLabels := func(name string) map[string]string {
+			return map[string]string{
+				"resource-class-org":  "vela-games",
+				"resource-class-name": name,
+			}
+		}
+
+		k8sClient := testclient.NewSimpleClientset(
+			&v1.CronJob{
+				ObjectMeta: metav1.ObjectMeta{Name: "cronjob", Namespace: "circleci-runners", Labels: classLabels("k8s-cronjob")},
+			},
+			&corev1.PodTemplate{
+				ObjectMeta: metav1.ObjectMeta{Name: "template", Namespace: "circleci-runners", Labels: classLabels("k8s-template")},
+			},
+			&corev1.PodTemplate{
+				ObjectMeta: metav1.ObjectMeta{Name: "duplicate", Namespace: "circleci-runners", Labels: classLabels("k8s-cronjob")},
+			},
+			&appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Name: "deployment", Namespace: "circleci-runners", Labels: classLabels("k8s-deployment")},
+			},
+		)
+
+		dispatcher := &collectingDispatcherTest{}
+
+		discovery := workers.K8sDiscoveryWorker{
+			Dispatcher:   dispatcher,
+			Namespace:    "vela-games",
+			ClientSet:    k8sClient,
+			K8sNamespace: "circleci-runners",
+		}
+
+		discovery.Handle(context.TODO())
+		discovery.Handle(context.TODO())
+
+		assert.Equal(t, 3, len(dispatcher.workers))
+
+		cronJob := dispatcher.workers[0].(*workers.K8sScalingWorker)
+		assert.Equal(t, "vela-games/k8s-cronjob", cronJob.ResourceClass)
+		assert.Equal(t, workers.SourceCronJob, cronJob.Source)
+
+		template := dispatcher.workers[1].(*workers.K8sScalingWorker)
+		assert.Equal(t, "vela-games/k8s-template", template.ResourceClass)
+		assert.Equal(t, workers.SourcePodTemplate, template.Source)
+		assert.Equal(t, "template", template.SourceName)
+
+		deployment := dispatcher.workers[2].(*workers.K8sDeploymentScalingWorker)
+		assert.Equal(t, "vela-games/k8s-deployment", deployment.ResourceClass)
+		assert.Equal(t, "deployment", deployment.DeploymentName)
+	})
+}
+
+type collectingDispatcherTest struct {
+	workers []workers.Worker
+}
+
+func (d *collectingDispatcherTest) Start(ctx context.Context, w workers.Worker) {
+	d.workers = append(d.workers, w)
 }
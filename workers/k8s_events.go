@@ -0,0 +1,117 @@
+package workers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	eventComponent = "circleci-runner-autoscaler"
+
+	// Annotation on the runners source with what the autoscaler last did, see CronJobStatus
+	StatusAnnotation = "circleci-runner-autoscaler/status"
+
+	EventDiscovered      = "Discovered"
+	EventScaledUp        = "ScaledUp"
+	EventJobCreateFailed = "JobCreateFailed"
+	EventRunnerTimeout   = "RunnerTimeout"
+	EventBudgetExhausted = "BudgetExhausted"
+)
+
+// CronJobStatus is the autoscaler state written to the StatusAnnotation of the CronJob, PodTemplate or Deployment of the runners
+type CronJobStatus struct {
+	LastScaleTime  *time.Time `json:"lastScaleTime,omitempty"`
+	PendingRunners int32      `json:"pendingRunners"`
+	LastError      string     `json:"lastError,omitempty"`
+	LastErrorTime  *time.Time `json:"lastErrorTime,omitempty"`
+}
+
+// recorderKey is a client and the namespace its recorder sends events to
+type recorderKey struct {
+	client    kubernetes.Interface
+	namespace string
+}
+
+var (
+	recordersMu sync.Mutex
+	recorders   = map[recorderKey]record.EventRecorder{}
+)
+
+// recordEvent records an Event on the object running the runners (a template CronJob or a RunnerPool) so operators
+// see what the autoscaler did in kubectl describe. Events are sent in the background by the recorder of the client,
+// which counts repeated events as one, and failing to send them only gets logged, it shouldn't stop scaling.
+func recordEvent(client kubernetes.Interface, object corev1.ObjectReference, eventType string, reason string, format string, args ...any) {
+	eventRecorder(client, object.Namespace).Eventf(&object, eventType, reason, format, args...)
+}
+
+// eventRecorder returns the recorder sending the events of the client to the namespace, starting it the first time
+func eventRecorder(client kubernetes.Interface, namespace string) record.EventRecorder {
+	recordersMu.Lock()
+	defer recordersMu.Unlock()
+
+	key := recorderKey{client, namespace}
+	if recorder, ok := recorders[key]; ok {
+		return recorder
+	}
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events(namespace)})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent})
+	recorders[key] = recorder
+	return recorder
+}
+
+func cronJobReference(cronJob *batchv1.CronJob) corev1.ObjectReference {
+	return corev1.ObjectReference{
+		APIVersion:      "batch/v1",
+		Kind:            "CronJob",
+		Name:            cronJob.Name,
+		Namespace:       cronJob.Namespace,
+		UID:             cronJob.UID,
+		ResourceVersion: cronJob.ResourceVersion,
+	}
+}
+
+// patchStatus writes the status annotation of the CronJob, PodTemplate or Deployment the runners are created from
+func patchStatus(ctx context.Context, client kubernetes.Interface, object corev1.ObjectReference, status CronJobStatus) {
+	value, err := json.Marshal(status)
+	if err != nil {
+		log.Printf("error encoding status of %v %v: %v", object.Kind, object.Name, err)
+		return
+	}
+
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]string{
+				StatusAnnotation: string(value),
+			},
+		},
+	})
+	if err != nil {
+		log.Printf("error encoding status patch of %v %v: %v", object.Kind, object.Name, err)
+		return
+	}
+
+	switch K8sSource(object.Kind) {
+	case SourcePodTemplate:
+		_, err = client.CoreV1().PodTemplates(object.Namespace).Patch(ctx, object.Name, k8stypes.MergePatchType, patch, v1.PatchOptions{})
+	case SourceDeployment:
+		_, err = client.AppsV1().Deployments(object.Namespace).Patch(ctx, object.Name, k8stypes.MergePatchType, patch, v1.PatchOptions{})
+	default:
+		_, err = client.BatchV1().CronJobs(object.Namespace).Patch(ctx, object.Name, k8stypes.MergePatchType, patch, v1.PatchOptions{})
+	}
+	if err != nil {
+		log.Printf("error patching status of %v %v: %v", object.Kind, object.Name, err)
+	}
+}
@@ -0,0 +1,177 @@
+package workers
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	EventQuotaExceeded = "QuotaExceeded"
+
+	// Set on the runner jobs and their pods to trace them back to the scale out that created them
+	ManagedByLabel          = "app.kubernetes.io/managed-by"
+	ScaleEventLabel         = "circleci-runner-autoscaler/scale-event"
+	ResourceClassAnnotation = "circleci-runner-autoscaler/resource-class"
+	ReasonAnnotation        = "circleci-runner-autoscaler/reason"
+	RequestedAtAnnotation   = "circleci-runner-autoscaler/requested-at"
+)
+
+// Job names end up in the job-name label of their pods, which can't be longer than 63 characters
+const maxJobNamePrefix = 52
+
+// jobName names the i-th job of a scale out of the source at the given second. The name is the same for the same
+// scale out, so if it's attempted twice, by two replicas of the autoscaler or after a restart, the duplicated
+// jobs fail with AlreadyExists instead of creating runners twice.
+func jobName(prefix string, source types.UID, timestamp int64, i int) string {
+	if len(prefix) > maxJobNamePrefix {
+		prefix = strings.TrimRight(prefix[:maxJobNamePrefix], "-.")
+	}
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%v/%v/%v/%v", prefix, source, timestamp, i)))
+	return fmt.Sprintf("%v-%x", prefix, hash[:5])
+}
+
+// scaleEventID identifies the scale out of the source at the given second, like jobName it's the same for
+// every attempt of the same scale out
+func scaleEventID(prefix string, source types.UID, timestamp int64) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%v/%v/%v", prefix, source, timestamp)))
+	return fmt.Sprintf("%x", hash[:6])
+}
+
+// scaleEvent describes the scale out a runner job is created by
+type scaleEvent struct {
+	id            string
+	resourceClass string
+	reason        string
+	requestedAt   time.Time
+	priorityClass string
+
+	// Also pass it to the runner containers as environment variables
+	env bool
+}
+
+// stamp labels and annotates the job and its pods with the scale event, and sets the PriorityClass and the
+// environment variables of the runner containers if enabled. What the template already sets is left alone.
+func (e scaleEvent) stamp(job *batchv1.Job) {
+	// The jobs of a scale out share the template of their source
+	job.Spec = *job.Spec.DeepCopy()
+
+	labels := map[string]string{
+		ManagedByLabel:  eventComponent,
+		ScaleEventLabel: e.id,
+	}
+	annotations := map[string]string{
+		ResourceClassAnnotation: e.resourceClass,
+		ReasonAnnotation:        e.reason,
+		RequestedAtAnnotation:   e.requestedAt.UTC().Format(time.RFC3339),
+	}
+
+	job.Labels = mergeStrings(job.Labels, labels)
+	job.Annotations = mergeStrings(job.Annotations, annotations)
+	job.Spec.Template.Labels = mergeStrings(job.Spec.Template.Labels, labels)
+	job.Spec.Template.Annotations = mergeStrings(job.Spec.Template.Annotations, annotations)
+
+	if job.Spec.Template.Spec.PriorityClassName == "" {
+		job.Spec.Template.Spec.PriorityClassName = e.priorityClass
+	}
+
+	if !e.env {
+		return
+	}
+
+	env := []corev1.EnvVar{
+		{Name: "CIRCLECI_RUNNER_SCALE_EVENT", Value: e.id},
+		{Name: "CIRCLECI_RUNNER_RESOURCE_CLASS", Value: e.resourceClass},
+		{Name: "CIRCLECI_RUNNER_NAME_PREFIX", Value: job.Name},
+	}
+	for i := range job.Spec.Template.Spec.Containers {
+		container := &job.Spec.Template.Spec.Containers[i]
+		for _, variable := range env {
+			if !hasEnv(container, variable.Name) {
+				container.Env = append(container.Env, variable)
+			}
+		}
+	}
+}
+
+// mergeStrings returns a copy of the map with the values added
+func mergeStrings(m map[string]string, values map[string]string) map[string]string {
+	merged := make(map[string]string, len(m)+len(values))
+	for k, v := range m {
+		merged[k] = v
+	}
+	for k, v := range values {
+		merged[k] = v
+	}
+	return merged
+}
+
+func hasEnv(container *corev1.Container, name string) bool {
+	for _, variable := range container.Env {
+		if variable.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// jobCreation is what came out of creating the jobs of a scale out
+type jobCreation struct {
+	// Jobs created, and jobs that already existed because the scale out was already done
+	created  int
+	existing int
+	// Jobs that couldn't be created, not counted as pending runners
+	failures []jobFailure
+	// Jobs not attempted once the namespace ran out of quota
+	skipped int
+}
+
+type jobFailure struct {
+	job           string
+	err           error
+	quotaExceeded bool
+}
+
+func (f jobFailure) reason() string {
+	if f.quotaExceeded {
+		return EventQuotaExceeded
+	}
+	return EventJobCreateFailed
+}
+
+// createJobs creates the jobs and sorts out the errors, it stops at the first one going over a ResourceQuota
+// as the rest would go over it too
+func createJobs(ctx context.Context, client kubernetes.Interface, jobs []*batchv1.Job) jobCreation {
+	result := jobCreation{}
+	for i, job := range jobs {
+		_, err := client.BatchV1().Jobs(job.Namespace).Create(ctx, job, v1.CreateOptions{})
+		switch {
+		case err == nil:
+			result.created++
+		case k8serrors.IsAlreadyExists(err):
+			log.Printf("job %v already exists, it was created by a previous attempt", job.Name)
+			result.existing++
+		case isQuotaExceeded(err):
+			result.failures = append(result.failures, jobFailure{job: job.Name, err: err, quotaExceeded: true})
+			result.skipped = len(jobs) - i - 1
+			return result
+		default:
+			result.failures = append(result.failures, jobFailure{job: job.Name, err: err})
+		}
+	}
+	return result
+}
+
+func isQuotaExceeded(err error) bool {
+	return k8serrors.IsForbidden(err) && strings.Contains(err.Error(), "exceeded quota")
+}
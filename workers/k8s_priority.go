@@ -0,0 +1,279 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ClassScheduler splits the capacity of a cluster shared by several resource classes when it can't fit all of
+// their demand. Classes with a higher priority get their demand first, what's left is split between the classes
+// of the same priority in proportion to their weights.
+//
+// Every scaling worker records its demand on each tick. The split is planned once for every class, with the pod
+// template and namespace of each, and the classes take their share of the same plan so that the ones ticking first
+// don't get more. A class taking its share a second time plans the split again with what's left of the cluster.
+type ClassScheduler struct {
+	// Higher priorities are served first, 0 if not set
+	Priorities map[string]int
+	// Share of the capacity left at the priority of the class, 1 if not set
+	Weights map[string]float64
+	// Demand not recorded again for this long is forgotten, e.g. of a worker that stopped, 1 minute if not set
+	DemandTTL time.Duration
+
+	mu      sync.Mutex
+	demands map[string]classDemand
+	plan    *capacityPlan
+}
+
+type classDemand struct {
+	wanted    int
+	namespace string
+	template  corev1.PodTemplateSpec
+	at        time.Time
+}
+
+// capacityPlan is how the capacity left in the cluster was split between the classes that wanted it
+type capacityPlan struct {
+	shares map[string]int
+	taken  map[string]bool
+	wanted int
+	fit    int
+	at     time.Time
+}
+
+func (s *ClassScheduler) Weight(class string) float64 {
+	if weight, ok := s.Weights[class]; ok && weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+// Demand records the runners the resource class wants to create from the template in the namespace
+func (s *ClassScheduler) Demand(class string, namespace string, template corev1.PodTemplateSpec, wanted int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+
+	s.demands[class] = classDemand{wanted: wanted, namespace: namespace, template: template, at: time.Now()}
+}
+
+// Forget drops the demand of a resource class that doesn't want runners anymore
+func (s *ClassScheduler) Forget(class string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.demands, class)
+}
+
+// allocate records the demand of the resource class and returns its share of the current plan, planning the
+// split again if the class already took its share or wasn't part of it
+func (s *ClassScheduler) allocate(ctx context.Context, client kubernetes.Interface, class string, namespace string, template corev1.PodTemplateSpec, wanted int, nodes bool) (int, string) {
+	s.Demand(class, namespace, template, wanted)
+
+	s.mu.Lock()
+	plan := s.plan
+	if plan == nil || plan.taken[class] || time.Since(plan.at) > s.demandTTL() {
+		plan = nil
+	} else if _, ok := plan.shares[class]; !ok {
+		plan = nil
+	}
+	demands := map[string]classDemand{}
+	for other, demand := range s.demands {
+		demands[other] = demand
+	}
+	s.mu.Unlock()
+
+	if plan == nil {
+		plan = s.split(demands, readClusterRoom(ctx, client, demands, nodes))
+		s.mu.Lock()
+		s.plan = plan
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	plan.taken[class] = true
+	s.mu.Unlock()
+
+	share := plan.shares[class]
+	if share >= wanted {
+		return wanted, ""
+	}
+	return share, fmt.Sprintf("the cluster has room for %v of the %v runners wanted across resource classes", plan.fit, plan.wanted)
+}
+
+// split places the runners the classes want in the room left one at a time, the highest priority first and within
+// a priority to the class with the fewest runners for its weight, until the room left fits none of them
+func (s *ClassScheduler) split(demands map[string]classDemand, room *clusterRoom) *capacityPlan {
+	plan := &capacityPlan{shares: map[string]int{}, taken: map[string]bool{}, at: time.Now()}
+
+	levels := map[int][]string{}
+	for class, demand := range demands {
+		plan.shares[class] = 0
+		plan.wanted += demand.wanted
+		if demand.wanted > 0 {
+			priority := s.Priorities[class]
+			levels[priority] = append(levels[priority], class)
+		}
+	}
+
+	priorities := make([]int, 0, len(levels))
+	for priority := range levels {
+		priorities = append(priorities, priority)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(priorities)))
+
+	for _, priority := range priorities {
+		classes := levels[priority]
+		// Ties go to the heaviest classes, then by name so that the plan doesn't depend on the map order
+		sort.Slice(classes, func(i, j int) bool {
+			if s.Weight(classes[i]) != s.Weight(classes[j]) {
+				return s.Weight(classes[i]) > s.Weight(classes[j])
+			}
+			return classes[i] < classes[j]
+		})
+
+		full := map[string]bool{}
+		for {
+			next := ""
+			for _, class := range classes {
+				if full[class] || plan.shares[class] >= demands[class].wanted {
+					continue
+				}
+				if next == "" || float64(plan.shares[class]+1)/s.Weight(class) < float64(plan.shares[next]+1)/s.Weight(next) {
+					next = class
+				}
+			}
+			if next == "" {
+				break
+			}
+
+			if room.place(demands[next].namespace, demands[next].template.Spec) {
+				plan.shares[next]++
+				plan.fit++
+			} else {
+				full[next] = true
+			}
+		}
+	}
+	return plan
+}
+
+func (s *ClassScheduler) demandTTL() time.Duration {
+	if s.DemandTTL <= 0 {
+		return time.Minute
+	}
+	return s.DemandTTL
+}
+
+func (s *ClassScheduler) expire() {
+	if s.demands == nil {
+		s.demands = map[string]classDemand{}
+	}
+
+	for class, demand := range s.demands {
+		if time.Since(demand.at) > s.demandTTL() {
+			delete(s.demands, class)
+		}
+	}
+}
+
+// clusterRoom is what's left of the ResourceQuotas of the namespaces and, if nodes are checked, of the nodes
+type clusterRoom struct {
+	quotas map[string][]quotaRoom
+	nodes  []nodeRoom
+	// Without it the nodes aren't checked
+	checkNodes bool
+}
+
+// readClusterRoom reads the room left for the classes, failing open like fitCapacity
+func readClusterRoom(ctx context.Context, client kubernetes.Interface, demands map[string]classDemand, nodes bool) *clusterRoom {
+	room := &clusterRoom{quotas: map[string][]quotaRoom{}}
+	for _, demand := range demands {
+		if _, ok := room.quotas[demand.namespace]; ok {
+			continue
+		}
+		quotas, err := freeQuotas(ctx, client, demand.namespace)
+		if err != nil {
+			log.Printf("error reading ResourceQuotas of namespace %v, not limiting runners by them: %v", demand.namespace, err)
+		}
+		room.quotas[demand.namespace] = quotas
+	}
+
+	if nodes {
+		if free, err := freeNodes(ctx, client); err != nil {
+			log.Printf("error reading node capacity, not limiting runners by it: %v", err)
+		} else {
+			room.nodes, room.checkNodes = free, true
+		}
+	}
+	return room
+}
+
+// place takes the room of a pod with the spec in the namespace, and tells if it fit
+func (r *clusterRoom) place(namespace string, spec corev1.PodSpec) bool {
+	requests, limits := podResources(spec)
+
+	for _, quota := range r.quotas[namespace] {
+		for name, left := range quota.left {
+			if perPod, ok := quotaUsage(name, requests, limits); ok && fitCount(left, perPod) == 0 {
+				return false
+			}
+		}
+	}
+
+	node := -1
+	if r.checkNodes && len(requests) > 0 {
+		for i := range r.nodes {
+			if !schedulable(r.nodes[i].node, spec) {
+				continue
+			}
+			fits := true
+			for name, quantity := range requests {
+				if fitCount(r.nodes[i].left[name], quantity) == 0 {
+					fits = false
+					break
+				}
+			}
+			if fits {
+				node = i
+				break
+			}
+		}
+		if node < 0 {
+			return false
+		}
+	}
+
+	for _, quota := range r.quotas[namespace] {
+		for name, left := range quota.left {
+			if perPod, ok := quotaUsage(name, requests, limits); ok {
+				left.Sub(perPod)
+				quota.left[name] = left
+			}
+		}
+	}
+	if node >= 0 {
+		for name, quantity := range requests {
+			left := r.nodes[node].left[name]
+			left.Sub(quantity)
+			r.nodes[node].left[name] = left
+		}
+	}
+	return true
+}
+
+// allocateCapacity returns how many of the runners the resource class wants fit in the cluster and why they were
+// throttled if they don't all fit. With a scheduler the capacity is shared with the other classes that want it.
+func allocateCapacity(ctx context.Context, client kubernetes.Interface, scheduler *ClassScheduler, class string, namespace string, template corev1.PodTemplateSpec, wanted int, nodes bool) (int, string) {
+	if scheduler == nil {
+		return fitCapacity(ctx, client, namespace, template, wanted, nodes)
+	}
+	return scheduler.allocate(ctx, client, class, namespace, template, wanted, nodes)
+}
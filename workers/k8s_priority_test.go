@@ -0,0 +1,244 @@
+package workers_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/vela-games/circleci-runner-autoscaler/workers"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	testclient "k8s.io/client-go/kubernetes/fake"
+)
+
+// contestedPool is a RunnerPool of a cluster shared with other pools, named after the last part of its resource class
+type contestedPool struct {
+	name      string
+	namespace string
+	cpu       string
+	unclaimed int
+}
+
+func runnerTemplate(cpu string) corev1.PodTemplateSpec {
+	return corev1.PodTemplateSpec{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name:  "runner",
+				Image: "circleci-image:latest",
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse(cpu)},
+				},
+			}},
+		},
+	}
+}
+
+// contestedPools returns the scaling workers of the pools, sharing the scheduler and a cluster with the quota
+func contestedPools(t *testing.T, scheduler *workers.ClassScheduler, quota *corev1.ResourceQuota, pools ...contestedPool) (map[string]*workers.RunnerPoolScalingWorker, *testclient.Clientset) {
+	var objects []runtime.Object
+	for _, pool := range pools {
+		template := runnerTemplate(pool.cpu)
+		unstructuredTemplate, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&template)
+		assert.NilError(t, err)
+		objects = append(objects, runnerPool(pool.name, pool.namespace, map[string]any{
+			"resourceClass": "vela-games/" + pool.name,
+			"template":      unstructuredTemplate,
+		}))
+	}
+	dynamicClient := fakeDynamicClient(objects...)
+
+	k8sClient := testclient.NewSimpleClientset()
+	_, err := k8sClient.CoreV1().ResourceQuotas(quota.Namespace).Create(context.TODO(), quota, metav1.CreateOptions{})
+	assert.NilError(t, err)
+
+	scaling := map[string]*workers.RunnerPoolScalingWorker{}
+	for _, pool := range pools {
+		scaling[pool.name] = &workers.RunnerPoolScalingWorker{
+			ResourceClass:      "vela-games/" + pool.name,
+			PoolName:           pool.name,
+			PoolNamespace:      pool.namespace,
+			DynamicClient:      dynamicClient,
+			ClientSet:          k8sClient,
+			CircleCiClient:     poolCircleCiClient(pool.unclaimed, 0),
+			Scheduler:          scheduler,
+			TimestampGenerator: func() int64 { return 1700000000 },
+		}
+	}
+	return scaling, k8sClient
+}
+
+func poolJobs(t *testing.T, k8sClient *testclient.Clientset, namespace string, pool string) int {
+	jobs, err := k8sClient.BatchV1().Jobs(namespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(map[string]string{workers.RunnerPoolLabel: pool}).String(),
+	})
+	assert.NilError(t, err)
+	return len(jobs.Items)
+}
+
+func podQuota(pods string) *corev1.ResourceQuota {
+	return resourceQuota(corev1.ResourceList{corev1.ResourcePods: resource.MustParse(pods)}, corev1.ResourceList{})
+}
+
+func TestClassScheduler(t *testing.T) {
+	t.Run("it should give every class its demand when it fits", func(t *testing.T) {
+		scheduler := &workers.ClassScheduler{}
+		scaling, k8sClient := contestedPools(t, scheduler, podQuota("5"),
+			contestedPool{name: "small", namespace: "circleci-runners", cpu: "1", unclaimed: 2},
+			contestedPool{name: "large", namespace: "circleci-runners", cpu: "1", unclaimed: 3},
+		)
+		scheduler.Demand("vela-games/large", "circleci-runners", runnerTemplate("1"), 3)
+
+		scaling["small"].Handle(context.TODO())
+		scaling["large"].Handle(context.TODO())
+
+		assert.Equal(t, 2, poolJobs(t, k8sClient, "circleci-runners", "small"))
+		assert.Equal(t, 3, poolJobs(t, k8sClient, "circleci-runners", "large"))
+	})
+
+	t.Run("it should split contested capacity by weight", func(t *testing.T) {
+		scheduler := &workers.ClassScheduler{
+			Weights: map[string]float64{"vela-games/large": 3},
+		}
+		scaling, k8sClient := contestedPools(t, scheduler, podQuota("8"),
+			contestedPool{name: "small", namespace: "circleci-runners", cpu: "1", unclaimed: 10},
+			contestedPool{name: "large", namespace: "circleci-runners", cpu: "1", unclaimed: 10},
+		)
+		scheduler.Demand("vela-games/large", "circleci-runners", runnerTemplate("1"), 10)
+
+		scaling["small"].Handle(context.TODO())
+		scaling["large"].Handle(context.TODO())
+
+		assert.Equal(t, 2, poolJobs(t, k8sClient, "circleci-runners", "small"))
+		assert.Equal(t, 6, poolJobs(t, k8sClient, "circleci-runners", "large"))
+	})
+
+	t.Run("it should give the capacity a class doesn't need to the others", func(t *testing.T) {
+		scheduler := &workers.ClassScheduler{}
+		scaling, k8sClient := contestedPools(t, scheduler, podQuota("9"),
+			contestedPool{name: "small", namespace: "circleci-runners", cpu: "1", unclaimed: 1},
+			contestedPool{name: "medium", namespace: "circleci-runners", cpu: "1", unclaimed: 10},
+			contestedPool{name: "large", namespace: "circleci-runners", cpu: "1", unclaimed: 10},
+		)
+		scheduler.Demand("vela-games/medium", "circleci-runners", runnerTemplate("1"), 10)
+		scheduler.Demand("vela-games/large", "circleci-runners", runnerTemplate("1"), 10)
+
+		for _, pool := range []string{"small", "medium", "large"} {
+			scaling[pool].Handle(context.TODO())
+		}
+
+		assert.Equal(t, 1, poolJobs(t, k8sClient, "circleci-runners", "small"))
+		assert.Equal(t, 4, poolJobs(t, k8sClient, "circleci-runners", "medium"))
+		assert.Equal(t, 4, poolJobs(t, k8sClient, "circleci-runners", "large"))
+	})
+
+	t.Run("it should serve higher priorities first", func(t *testing.T) {
+		scheduler := &workers.ClassScheduler{
+			Priorities: map[string]int{"vela-games/release": 10},
+		}
+		scaling, k8sClient := contestedPools(t, scheduler, podQuota("6"),
+			contestedPool{name: "small", namespace: "circleci-runners", cpu: "1", unclaimed: 4},
+			contestedPool{name: "release", namespace: "circleci-runners", cpu: "1", unclaimed: 4},
+			contestedPool{name: "large", namespace: "circleci-runners", cpu: "1", unclaimed: 4},
+		)
+		scheduler.Demand("vela-games/release", "circleci-runners", runnerTemplate("1"), 4)
+		scheduler.Demand("vela-games/large", "circleci-runners", runnerTemplate("1"), 4)
+
+		for _, pool := range []string{"small", "release", "large"} {
+			scaling[pool].Handle(context.TODO())
+		}
+
+		assert.Equal(t, 4, poolJobs(t, k8sClient, "circleci-runners", "release"))
+		assert.Equal(t, 1, poolJobs(t, k8sClient, "circleci-runners", "small"))
+		assert.Equal(t, 1, poolJobs(t, k8sClient, "circleci-runners", "large"))
+	})
+
+	t.Run("it should fit every class with its own pod template and namespace", func(t *testing.T) {
+		scheduler := &workers.ClassScheduler{}
+		scaling, k8sClient := contestedPools(t, scheduler, resourceQuota(
+			corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("8")},
+			corev1.ResourceList{},
+		),
+			contestedPool{name: "small", namespace: "circleci-runners", cpu: "1", unclaimed: 10},
+			contestedPool{name: "large", namespace: "circleci-runners", cpu: "2", unclaimed: 10},
+			contestedPool{name: "other", namespace: "other-runners", cpu: "2", unclaimed: 5},
+		)
+		scheduler.Demand("vela-games/large", "circleci-runners", runnerTemplate("2"), 10)
+		scheduler.Demand("vela-games/other", "other-runners", runnerTemplate("2"), 5)
+
+		for _, pool := range []string{"small", "large", "other"} {
+			scaling[pool].Handle(context.TODO())
+		}
+
+		// The 8 CPUs of the quota fit 3 large and 2 small runners, the other namespace has no quota
+		assert.Equal(t, 2, poolJobs(t, k8sClient, "circleci-runners", "small"))
+		assert.Equal(t, 3, poolJobs(t, k8sClient, "circleci-runners", "large"))
+		assert.Equal(t, 5, poolJobs(t, k8sClient, "other-runners", "other"))
+	})
+
+	t.Run("it should keep the shares of the classes ticking after the first", func(t *testing.T) {
+		scheduler := &workers.ClassScheduler{}
+		quota := podQuota("8")
+		scaling, k8sClient := contestedPools(t, scheduler, quota,
+			contestedPool{name: "small", namespace: "circleci-runners", cpu: "1", unclaimed: 10},
+			contestedPool{name: "large", namespace: "circleci-runners", cpu: "1", unclaimed: 10},
+		)
+		scheduler.Demand("vela-games/large", "circleci-runners", runnerTemplate("1"), 10)
+
+		scaling["small"].Handle(context.TODO())
+		assert.Equal(t, 4, poolJobs(t, k8sClient, "circleci-runners", "small"))
+
+		// The runners of the first class now use part of the quota
+		quota.Status.Used = corev1.ResourceList{corev1.ResourcePods: resource.MustParse("4")}
+		_, err := k8sClient.CoreV1().ResourceQuotas(quota.Namespace).UpdateStatus(context.TODO(), quota, metav1.UpdateOptions{})
+		assert.NilError(t, err)
+
+		scaling["large"].Handle(context.TODO())
+		assert.Equal(t, 4, poolJobs(t, k8sClient, "circleci-runners", "large"))
+	})
+
+	t.Run("it should forget classes that no longer want runners", func(t *testing.T) {
+		scheduler := &workers.ClassScheduler{}
+		scaling, k8sClient := contestedPools(t, scheduler, podQuota("4"),
+			contestedPool{name: "large", namespace: "circleci-runners", cpu: "1", unclaimed: 5},
+		)
+		scheduler.Demand("vela-games/small", "circleci-runners", runnerTemplate("1"), 5)
+		scheduler.Forget("vela-games/small")
+
+		scaling["large"].Handle(context.TODO())
+
+		assert.Equal(t, 4, poolJobs(t, k8sClient, "circleci-runners", "large"))
+	})
+}
+
+func TestRunnerPoolPriority(t *testing.T) {
+	t.Run("it should only take its share of contested quota", func(t *testing.T) {
+		scaling, k8sClient := capacityPool(t, 6, false, resourceQuota(
+			corev1.ResourceList{corev1.ResourcePods: resource.MustParse("10")},
+			corev1.ResourceList{corev1.ResourcePods: resource.MustParse("6")},
+		))
+		scaling.Scheduler = &workers.ClassScheduler{
+			Priorities: map[string]int{"vela-games/release": 1},
+		}
+		scaling.Scheduler.Demand("vela-games/release", "circleci-runners", runnerTemplate("1"), 3)
+
+		scaling.Handle(context.TODO())
+
+		// The release class gets 3 of the 4 pods left
+		assert.Equal(t, 1, createdJobs(t, k8sClient))
+	})
+
+	t.Run("it should set the PriorityClass of the runner pods", func(t *testing.T) {
+		scaling, k8sClient := capacityPool(t, 1, false)
+		scaling.PriorityClassName = "circleci-release"
+
+		scaling.Handle(context.TODO())
+
+		jobs, err := k8sClient.BatchV1().Jobs("circleci-runners").List(context.TODO(), metav1.ListOptions{})
+		assert.NilError(t, err)
+		assert.Equal(t, 1, len(jobs.Items))
+		assert.Equal(t, "circleci-release", jobs.Items[0].Spec.Template.Spec.PriorityClassName)
+	})
+}
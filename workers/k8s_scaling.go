@@ -5,12 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"strconv"
+	"strings"
 	"time"
 
 	backoff "github.com/cenkalti/backoff/v4"
+	"github.com/vela-games/circleci-runner-autoscaler/budget"
 	circleci_client "github.com/vela-games/circleci-runner-autoscaler/client"
 	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
@@ -19,13 +21,55 @@ import (
 type K8sScalingWorker struct {
 	ResourceClass string
 
-	CronJobName      string
-	CronJobNamespace string
+	// CronJob or PodTemplate the runner jobs are created from, CronJob if not set
+	Source          K8sSource
+	SourceName      string
+	SourceNamespace string
 
 	TimestampGenerator func() int64
 
 	ClientSet      kubernetes.Interface
 	CircleCiClient circleci_client.ClientWithResponsesInterface
+
+	// Optional, the jobs created are limited to the capacity the budget grants
+	Budget *budget.Budget
+
+	// Only decide how to scale, without creating any job
+	DryRun bool
+
+	// Pass the scale event of the runners to their containers as environment variables
+	InjectRunnerEnv bool
+
+	// Besides the ResourceQuotas, only create the jobs that fit in the nodes matching their node selector
+	CheckNodeCapacity bool
+
+	// Optional, shares the capacity of the cluster with the other resource classes when it's contested
+	Scheduler *ClassScheduler
+	// PriorityClass of the runner pods, unless their template sets one
+	PriorityClassName string
+
+	// Last status written to the source annotation
+	status CronJobStatus
+
+	reporter
+	capacityLimit
+}
+
+func (w *K8sScalingWorker) Kind() WorkerKind {
+	return KindScaling
+}
+
+func (w *K8sScalingWorker) ResourceClassName() string {
+	return w.ResourceClass
+}
+
+func (w *K8sScalingWorker) Report() WorkerReport {
+	report := w.snapshot()
+	report.Backend = "kubernetes"
+	report.Target = w.SourceNamespace + "/" + w.SourceName
+	report.ResourceClass = w.ResourceClass
+	w.reportLimit(&report, time.Now())
+	return report
 }
 
 // Handle autoscaling for the ResourceClass defined in the struct
@@ -39,60 +83,133 @@ func (w *K8sScalingWorker) Handle(ctx context.Context) {
 
 	if err != nil {
 		log.Printf("error getting unclaimed tasks by resource class %v: %v", w.ResourceClass, err)
+		w.failed("getting unclaimed tasks: %v", err)
 		return
 	}
 
 	if response.StatusCode() != 200 {
 		log.Printf("got %v code instead of 200", response.StatusCode())
+		w.failed("getting unclaimed tasks: got %v code instead of 200", response.StatusCode())
+		return
+	}
+
+	if response.JSON200 == nil || response.JSON200.UnclaimedTaskCount == nil {
+		log.Printf("%v: unclaimed tasks response is missing the task count", w.ResourceClass)
+		w.failed("unclaimed tasks response is missing the task count")
 		return
 	}
 
 	unclaimedTaskCount := *response.JSON200.UnclaimedTaskCount
 	if unclaimedTaskCount > 0 {
-		// Get CronJob associated with ResourceClass
-		cronJob, err := w.ClientSet.BatchV1().CronJobs(w.CronJobNamespace).Get(ctx, w.CronJobName, v1.GetOptions{})
+		// Get the CronJob or PodTemplate associated with ResourceClass
+		source, err := w.getSource(ctx)
 		if err != nil {
-			log.Printf("error trying to get CronJob %v: %v", w.ResourceClass, err)
+			log.Printf("error trying to get %v %v: %v", w.sourceKind(), w.ResourceClass, err)
+			w.failed("getting %v %v: %v", w.sourceKind(), w.SourceName, err)
 			return
 		}
 
+		limit, _, limited := w.limit(time.Now())
+		var current int32
+		if limited || w.Budget != nil {
+			current, err = w.activePods(ctx)
+			if err != nil {
+				log.Printf("error counting pods of %v: %v", w.ResourceClass, err)
+				w.failed("counting pods: %v", err)
+				return
+			}
+		}
+
+		if limited && current+int32(unclaimedTaskCount) > limit {
+			if current >= limit {
+				log.Printf("%v: at the capacity limit of %v pods, not creating jobs", w.ResourceClass, limit)
+				w.decided("%v unclaimed tasks but %v pods is the capacity limit of %v", unclaimedTaskCount, current, limit)
+				return
+			}
+			unclaimedTaskCount = int(limit - current)
+		}
+
+		if fit, reason := allocateCapacity(ctx, w.ClientSet, w.Scheduler, w.ResourceClass, w.SourceNamespace, source.spec.Template, unclaimedTaskCount, w.CheckNodeCapacity); fit < unclaimedTaskCount {
+			log.Printf("%v: demand throttled by capacity, %v of %v jobs fit: %v", w.ResourceClass, fit, unclaimedTaskCount, reason)
+			if !w.DryRun {
+				recordEvent(w.ClientSet, source.reference, corev1.EventTypeWarning, EventCapacityThrottled, "Only %v of %v jobs fit: %v", fit, unclaimedTaskCount, reason)
+			}
+			if fit == 0 {
+				w.decided("%v unclaimed tasks but no capacity left: %v", unclaimedTaskCount, reason)
+				return
+			}
+			unclaimedTaskCount = fit
+		}
+
+		// Only claim the budget for the jobs that fit
+		if w.Budget != nil {
+			granted := w.Budget.Claim(w.ResourceClass, w.SourceName, current, current+int32(unclaimedTaskCount), w.Budget.Weight(w.ResourceClass, ""))
+			if granted <= current {
+				log.Printf("%v: budget exhausted, not creating jobs", w.ResourceClass)
+				w.decided("budget exhausted, %v unclaimed tasks but staying at %v pods", unclaimedTaskCount, current)
+				if !w.DryRun {
+					recordEvent(w.ClientSet, source.reference, corev1.EventTypeWarning, EventBudgetExhausted, "Budget exhausted, %v unclaimed tasks but staying at %v pods", unclaimedTaskCount, current)
+				}
+				return
+			}
+			unclaimedTaskCount = int(granted - current)
+		}
+
 		var jobs []*batchv1.Job
 
 		timestamp := w.TimestampGenerator()
+		event := scaleEvent{
+			id:            scaleEventID(w.SourceName, source.reference.UID, timestamp),
+			resourceClass: w.ResourceClass,
+			reason:        fmt.Sprintf("%v unclaimed tasks", unclaimedTaskCount),
+			requestedAt:   time.Unix(timestamp, 0),
+			env:           w.InjectRunnerEnv,
+			priorityClass: w.PriorityClassName,
+		}
 
 		for i := 0; i < unclaimedTaskCount; i++ {
-			job := &batchv1.Job{
-				TypeMeta: v1.TypeMeta{
-					APIVersion: "batch/v1",
-					Kind:       "Job",
-				},
-				ObjectMeta: v1.ObjectMeta{
-					Name:      cronJob.Name + "-" + strconv.FormatInt(timestamp, 10) + "-" + strconv.Itoa(i),
-					Namespace: cronJob.Namespace,
-					OwnerReferences: []v1.OwnerReference{
-						{
-							APIVersion: "batch/v1",
-							Kind:       "CronJob",
-							Name:       cronJob.Name,
-							UID:        cronJob.UID,
-						},
-					},
-					Annotations: map[string]string{
-						"cronjob.kubernetes.io/instantiate": "manual",
-					},
-				},
-				Spec: cronJob.Spec.JobTemplate.Spec,
-			}
+			job := source.job(jobName(w.SourceName, source.reference.UID, timestamp, i))
+			event.stamp(job)
 			jobs = append(jobs, job)
 		}
 
-		log.Printf("%v has %v unclaimed tasks creating k8s jobs", w.ResourceClass, unclaimedTaskCount)
+		if w.DryRun {
+			w.decided("dry run: %v unclaimed tasks, would create %v jobs from %v %v", unclaimedTaskCount, len(jobs), w.sourceKind(), w.SourceName)
+			w.updateBudget(current)
+			return
+		}
+
+		log.Printf("%v has %v unclaimed tasks creating k8s jobs for scale event %v", w.ResourceClass, unclaimedTaskCount, event.id)
 
-		for _, job := range jobs {
-			_, err := w.ClientSet.BatchV1().Jobs(job.Namespace).Create(ctx, job, v1.CreateOptions{})
-			if err != nil {
-				log.Printf("error creating job %v for %v: %v", job.Name, w.ResourceClass, err)
-			}
+		result := createJobs(ctx, w.ClientSet, jobs)
+		for _, failure := range result.failures {
+			log.Printf("error creating job %v for %v: %v", failure.job, w.ResourceClass, failure.err)
+			w.failed("creating job %v: %v", failure.job, failure.err)
+			recordEvent(w.ClientSet, source.reference, corev1.EventTypeWarning, failure.reason(), "Error creating job %v: %v", failure.job, failure.err)
+			w.statusError(fmt.Sprintf("creating job %v: %v", failure.job, failure.err))
+		}
+		if result.skipped > 0 {
+			log.Printf("%v: quota exceeded, skipped the other %v jobs", w.ResourceClass, result.skipped)
+		}
+		// Give back the budget claimed for the jobs that weren't created
+		w.updateBudget(current + int32(result.created))
+
+		// Jobs that already existed were created by a previous attempt, their runners are on the way too
+		coming := result.created + result.existing
+		w.decided("%v unclaimed tasks, created %v jobs, %v already existed, %v failed", unclaimedTaskCount, result.created, result.existing, len(result.failures)+result.skipped)
+		w.pending(int32(coming))
+
+		if result.created > 0 {
+			recordEvent(w.ClientSet, source.reference, corev1.EventTypeNormal, EventScaledUp, "Created %v jobs for %v unclaimed tasks, scale event %v", result.created, unclaimedTaskCount, event.id)
+			now := time.Now()
+			w.status.LastScaleTime = &now
+		}
+		w.status.PendingRunners = int32(coming)
+		patchStatus(ctx, w.ClientSet, source.reference, w.status)
+
+		// There are no runners to wait for if every job failed
+		if coming == 0 {
+			return
 		}
 
 		// We check that the pods are running and ready to recieve tasks before exiting the func, as if Handle() get executed immediately after
@@ -112,14 +229,18 @@ func (w *K8sScalingWorker) Handle(ctx context.Context) {
 				return errors.New(message)
 			}
 
+			if runners.JSON200 == nil || runners.JSON200.Items == nil {
+				return fmt.Errorf("runners response for %v is missing the runners", w.ResourceClass)
+			}
+
 			labelMap, _ := v1.LabelSelectorAsMap(&v1.LabelSelector{
 				MatchLabels: map[string]string{
-					"resource-class-org":  cronJob.Labels["resource-class-org"],
-					"resource-class-name": cronJob.Labels["resource-class-name"],
+					"resource-class-org":  source.labels["resource-class-org"],
+					"resource-class-name": source.labels["resource-class-name"],
 				},
 			})
 
-			podList, err := w.ClientSet.CoreV1().Pods(w.CronJobNamespace).List(ctx, v1.ListOptions{
+			podList, err := w.ClientSet.CoreV1().Pods(w.SourceNamespace).List(ctx, v1.ListOptions{
 				LabelSelector: labels.SelectorFromSet(labelMap).String(),
 			})
 
@@ -151,6 +272,8 @@ func (w *K8sScalingWorker) Handle(ctx context.Context) {
 				}
 			}
 
+			w.pending(int32(targetCount - foundCount))
+			w.status.PendingRunners = int32(targetCount - foundCount)
 			if foundCount == 0 || (foundCount < targetCount) {
 				return errors.New("waiting for all runners to come up")
 			}
@@ -177,10 +300,61 @@ func (w *K8sScalingWorker) Handle(ctx context.Context) {
 		})
 		if err != nil {
 			log.Printf("%v: unrecoverable error %v", w.ResourceClass, err)
+			w.failed("waiting for runners: %v", err)
+			recordEvent(w.ClientSet, source.reference, corev1.EventTypeWarning, EventRunnerTimeout, "Runners didn't come up in time: %v", err)
+			w.statusError(fmt.Sprintf("waiting for runners: %v", err))
+			patchStatus(ctx, w.ClientSet, source.reference, w.status)
 			return
 		}
+		w.pending(0)
+		w.status.PendingRunners = 0
+		patchStatus(ctx, w.ClientSet, source.reference, w.status)
 
 	} else {
 		log.Printf("%v: no unclaimed tasks", w.ResourceClass)
+		w.decided("no unclaimed tasks")
+		if w.Scheduler != nil {
+			w.Scheduler.Forget(w.ResourceClass)
+		}
+		if w.Budget != nil {
+			if current, err := w.activePods(ctx); err == nil {
+				w.updateBudget(current)
+			}
+		}
+	}
+}
+
+func (w *K8sScalingWorker) updateBudget(current int32) {
+	if w.Budget != nil {
+		w.Budget.Update(w.ResourceClass, w.SourceName, current, w.Budget.Weight(w.ResourceClass, ""))
+	}
+}
+
+// statusError records an error in the status annotation, it's written with the next patch
+func (w *K8sScalingWorker) statusError(message string) {
+	now := time.Now()
+	w.status.LastError = message
+	w.status.LastErrorTime = &now
+}
+
+// activePods counts the runner pods of the resource class that are pending or running
+func (w *K8sScalingWorker) activePods(ctx context.Context) (int32, error) {
+	org, name, _ := strings.Cut(w.ResourceClass, "/")
+	podList, err := w.ClientSet.CoreV1().Pods(w.SourceNamespace).List(ctx, v1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(map[string]string{
+			"resource-class-org":  org,
+			"resource-class-name": name,
+		}).String(),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	active := int32(0)
+	for _, pod := range podList.Items {
+		if pod.Status.Phase == corev1.PodPending || pod.Status.Phase == corev1.PodRunning {
+			active++
+		}
 	}
+	return active, nil
 }
@@ -2,6 +2,8 @@ package workers_test
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 	"testing"
@@ -10,6 +12,8 @@ import (
 	circleci_client "github.com/vela-games/circleci-runner-autoscaler/client"
 	"github.com/vela-games/circleci-runner-autoscaler/workers"
 	"gotest.tools/v3/assert"
+	"gotest.tools/v3/assert/cmp"
+	"gotest.tools/v3/poll"
 	v1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -18,6 +22,24 @@ import (
 	k8stesting "k8s.io/client-go/testing"
 )
 
+// recordedEvents waits for the event recorder to send at least count events to the namespace, and returns them
+func recordedEvents(t *testing.T, k8sClient *testclient.Clientset, namespace string, count int) []corev1.Event {
+	t.Helper()
+	var events []corev1.Event
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		list, err := k8sClient.CoreV1().Events(namespace).List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			return poll.Error(err)
+		}
+		events = list.Items
+		if len(events) < count {
+			return poll.Continue("%v of %v events recorded", len(events), count)
+		}
+		return poll.Success()
+	}, poll.WithDelay(10*time.Millisecond))
+	return events
+}
+
 func TestK8sScalingWorker(t *testing.T) {
 	t.Run("it should do nothing", func(t *testing.T) {
 		k8sClient := testclient.NewSimpleClientset(&v1.CronJobList{
@@ -83,10 +105,10 @@ func TestK8sScalingWorker(t *testing.T) {
 		})
 
 		scaling := &workers.K8sScalingWorker{
-			ResourceClass:    "vela-games/my-resource-class",
-			CronJobName:      "cronjob-class",
-			CronJobNamespace: "cronjob-namespace",
-			ClientSet:        k8sClient,
+			ResourceClass:   "vela-games/my-resource-class",
+			SourceName:      "cronjob-class",
+			SourceNamespace: "cronjob-namespace",
+			ClientSet:       k8sClient,
 		}
 
 		ciClient := &mockCircleCiClient{
@@ -302,9 +324,9 @@ func TestK8sScalingWorker(t *testing.T) {
 		})
 
 		scaling := &workers.K8sScalingWorker{
-			ResourceClass:    "vela-games/my-resource-class",
-			CronJobName:      "cronjob-class",
-			CronJobNamespace: "cronjob-namespace",
+			ResourceClass:   "vela-games/my-resource-class",
+			SourceName:      "cronjob-class",
+			SourceNamespace: "cronjob-namespace",
 			TimestampGenerator: func() int64 {
 				return sec
 			},
@@ -361,5 +383,173 @@ func TestK8sScalingWorker(t *testing.T) {
 		assert.Equal(t, 4, jobCreatedCount)
 		assert.Equal(t, 1, getJobCount)
 		assert.Equal(t, 1, podListCount)
+
+		events := recordedEvents(t, k8sClient, "cronjob-namespace", 1)
+		assert.Equal(t, 1, len(events))
+		assert.Equal(t, workers.EventScaledUp, events[0].Reason)
+		assert.Equal(t, "cronjob-class", events[0].InvolvedObject.Name)
+		assert.Assert(t, cmp.Regexp("^Created 4 jobs for 4 unclaimed tasks, scale event [0-9a-f]{12}$", events[0].Message))
+
+		cronJob, err := k8sClient.BatchV1().CronJobs("cronjob-namespace").Get(context.TODO(), "cronjob-class", metav1.GetOptions{})
+		assert.NilError(t, err)
+		var status workers.CronJobStatus
+		assert.NilError(t, json.Unmarshal([]byte(cronJob.Annotations[workers.StatusAnnotation]), &status))
+		assert.Equal(t, int32(0), status.PendingRunners)
+		assert.Assert(t, status.LastScaleTime != nil)
+		assert.Equal(t, "", status.LastError)
+	})
+
+	t.Run("it should record failed job creations", func(t *testing.T) {
+		k8sClient := testclient.NewSimpleClientset(&v1.CronJob{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "cronjob-class",
+				Namespace: "cronjob-namespace",
+				Labels: map[string]string{
+					"resource-class-org":  "vela-games",
+					"resource-class-name": "my-resource-class",
+				},
+			},
+		})
+
+		k8sClient.PrependReactor("create", "jobs", func(action k8stesting.Action) (handled bool, ret runtime.Object, err error) {
+			return true, nil, errors.New("exceeded quota")
+		})
+
+		scaling := &workers.K8sScalingWorker{
+			ResourceClass:   "vela-games/my-resource-class",
+			SourceName:      "cronjob-class",
+			SourceNamespace: "cronjob-namespace",
+			TimestampGenerator: func() int64 {
+				return 1
+			},
+			ClientSet: k8sClient,
+			CircleCiClient: &mockCircleCiClient{
+				MockGetUnclaimedTasksWithResponse: func(ctx context.Context, params *circleci_client.GetUnclaimedTasksParams, reqEditors ...circleci_client.RequestEditorFn) (*circleci_client.GetUnclaimedTasksResponse, error) {
+					return &circleci_client.GetUnclaimedTasksResponse{
+						HTTPResponse: &http.Response{
+							StatusCode: 200,
+						},
+						JSON200: &circleci_client.UnclaimedTaskCount{
+							UnclaimedTaskCount: intPointer(1),
+						},
+					}, nil
+				},
+				MockGetRunnersWithResponse: func(ctx context.Context, params *circleci_client.GetRunnersParams, reqEditors ...circleci_client.RequestEditorFn) (*circleci_client.GetRunnersResponse, error) {
+					t.Error("GetRunners was called without any job created")
+					return nil, nil
+				},
+			},
+		}
+
+		scaling.Handle(context.TODO())
+
+		events := recordedEvents(t, k8sClient, "cronjob-namespace", 1)
+		var reasons []string
+		for _, event := range events {
+			assert.Equal(t, corev1.EventTypeWarning, event.Type)
+			reasons = append(reasons, event.Reason)
+		}
+		assert.DeepEqual(t, []string{workers.EventJobCreateFailed}, reasons)
+
+		cronJob, err := k8sClient.BatchV1().CronJobs("cronjob-namespace").Get(context.TODO(), "cronjob-class", metav1.GetOptions{})
+		assert.NilError(t, err)
+		var status workers.CronJobStatus
+		assert.NilError(t, json.Unmarshal([]byte(cronJob.Annotations[workers.StatusAnnotation]), &status))
+		assert.Assert(t, cmp.Regexp("^creating job cronjob-class-[0-9a-f]{10}: exceeded quota$", status.LastError))
+		assert.Assert(t, status.LastScaleTime == nil)
+	})
+
+	t.Run("it should create bare jobs from a PodTemplate", func(t *testing.T) {
+		k8sClient := testclient.NewSimpleClientset(
+			&corev1.PodTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "template-class",
+					Namespace: "circleci-runners",
+					Labels: map[string]string{
+						"resource-class-org":  "vela-games",
+						"resource-class-name": "my-resource-class",
+					},
+				},
+				Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{{Name: "runner", Image: "circleci-image:latest"}},
+					},
+				},
+			},
+			&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "template-class-pod",
+					Namespace: "circleci-runners",
+					Labels: map[string]string{
+						"resource-class-org":  "vela-games",
+						"resource-class-name": "my-resource-class",
+					},
+				},
+				Status: corev1.PodStatus{Phase: corev1.PodRunning},
+			},
+		)
+
+		ciClient := inspectCircleCiClient(2)
+		ciClient.MockGetRunnersWithResponse = func(ctx context.Context, params *circleci_client.GetRunnersParams, reqEditors ...circleci_client.RequestEditorFn) (*circleci_client.GetRunnersResponse, error) {
+			return &circleci_client.GetRunnersResponse{
+				HTTPResponse: &http.Response{
+					StatusCode: 200,
+				},
+				JSON200: &circleci_client.AgentList{
+					Items: &[]circleci_client.Agent{{Name: stringPointer("template-class-pod")}},
+				},
+			}, nil
+		}
+
+		scaling := &workers.K8sScalingWorker{
+			ResourceClass:   "vela-games/my-resource-class",
+			Source:          workers.SourcePodTemplate,
+			SourceName:      "template-class",
+			SourceNamespace: "circleci-runners",
+			TimestampGenerator: func() int64 {
+				return 1
+			},
+			ClientSet:       k8sClient,
+			CircleCiClient:  ciClient,
+			InjectRunnerEnv: true,
+		}
+
+		scaling.Handle(context.TODO())
+
+		jobs, err := k8sClient.BatchV1().Jobs("circleci-runners").List(context.TODO(), metav1.ListOptions{})
+		assert.NilError(t, err)
+		assert.Equal(t, 2, len(jobs.Items))
+
+		job := jobs.Items[0]
+		assert.Assert(t, cmp.Regexp("^template-class-[0-9a-f]{10}$", job.Name))
+		// Finished jobs are cleaned up, and so are all of them with the template
+		assert.Equal(t, int32(3600), *job.Spec.TTLSecondsAfterFinished)
+		assert.Equal(t, 1, len(job.OwnerReferences))
+		assert.Equal(t, "PodTemplate", job.OwnerReferences[0].Kind)
+		assert.Equal(t, "template-class", job.OwnerReferences[0].Name)
+		assert.Equal(t, "my-resource-class", job.Spec.Template.Labels["resource-class-name"])
+		assert.Equal(t, corev1.RestartPolicyOnFailure, job.Spec.Template.Spec.RestartPolicy)
+
+		// Both jobs come from the same scale event, which their pods can trace back to
+		event := job.Labels[workers.ScaleEventLabel]
+		assert.Assert(t, cmp.Regexp("^[0-9a-f]{12}$", event))
+		assert.Equal(t, event, jobs.Items[1].Labels[workers.ScaleEventLabel])
+		assert.Equal(t, event, job.Spec.Template.Labels[workers.ScaleEventLabel])
+		assert.Equal(t, "circleci-runner-autoscaler", job.Spec.Template.Labels[workers.ManagedByLabel])
+		assert.DeepEqual(t, map[string]string{
+			workers.ResourceClassAnnotation: "vela-games/my-resource-class",
+			workers.ReasonAnnotation:        "2 unclaimed tasks",
+			workers.RequestedAtAnnotation:   "1970-01-01T00:00:01Z",
+		}, job.Spec.Template.Annotations)
+		assert.DeepEqual(t, []corev1.EnvVar{
+			{Name: "CIRCLECI_RUNNER_SCALE_EVENT", Value: event},
+			{Name: "CIRCLECI_RUNNER_RESOURCE_CLASS", Value: "vela-games/my-resource-class"},
+			{Name: "CIRCLECI_RUNNER_NAME_PREFIX", Value: job.Name},
+		}, job.Spec.Template.Spec.Containers[0].Env)
+
+		podTemplate, err := k8sClient.CoreV1().PodTemplates("circleci-runners").Get(context.TODO(), "template-class", metav1.GetOptions{})
+		assert.NilError(t, err)
+		assert.Assert(t, podTemplate.Annotations[workers.StatusAnnotation] != "")
+		assert.Equal(t, 0, len(podTemplate.Template.Spec.Containers[0].Env))
 	})
 }
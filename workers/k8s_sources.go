@@ -0,0 +1,126 @@
+package workers
+
+import (
+	"context"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// K8sSource is the kind of object labeled with a resource class that the runners are created from
+type K8sSource string
+
+const (
+	// Suspended CronJob used as a job template
+	SourceCronJob K8sSource = "CronJob"
+	// PodTemplate the runner jobs are created from
+	SourcePodTemplate K8sSource = "PodTemplate"
+	// Deployment of long running runners, scaled through its replicas
+	SourceDeployment K8sSource = "Deployment"
+)
+
+// Finished jobs created from a PodTemplate are deleted after this long, as no controller cleans them up
+const podTemplateJobTTL int32 = 3600
+
+// jobSource is the object the runner jobs of a K8sScalingWorker are created from
+type jobSource struct {
+	reference corev1.ObjectReference
+	labels    map[string]string
+
+	spec        batchv1.JobSpec
+	owner       *v1.OwnerReference
+	annotations map[string]string
+}
+
+func (s *jobSource) job(name string) *batchv1.Job {
+	job := &batchv1.Job{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "batch/v1",
+			Kind:       "Job",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:        name,
+			Namespace:   s.reference.Namespace,
+			Annotations: s.annotations,
+		},
+		Spec: s.spec,
+	}
+	if s.owner != nil {
+		job.OwnerReferences = []v1.OwnerReference{*s.owner}
+	}
+	return job
+}
+
+// getSource gets the CronJob or PodTemplate the worker creates jobs from
+func (w *K8sScalingWorker) getSource(ctx context.Context) (*jobSource, error) {
+	if w.Source == SourcePodTemplate {
+		podTemplate, err := w.ClientSet.CoreV1().PodTemplates(w.SourceNamespace).Get(ctx, w.SourceName, v1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+
+		// The runner pods are found by the resource class labels of the template
+		template := *podTemplate.Template.DeepCopy()
+		if template.Labels == nil {
+			template.Labels = map[string]string{}
+		}
+		template.Labels["resource-class-org"] = podTemplate.Labels["resource-class-org"]
+		template.Labels["resource-class-name"] = podTemplate.Labels["resource-class-name"]
+		// Jobs don't allow the Always default of pods
+		if template.Spec.RestartPolicy == "" {
+			template.Spec.RestartPolicy = corev1.RestartPolicyOnFailure
+		}
+
+		ttl := podTemplateJobTTL
+		return &jobSource{
+			reference: corev1.ObjectReference{
+				APIVersion:      "v1",
+				Kind:            string(SourcePodTemplate),
+				Name:            podTemplate.Name,
+				Namespace:       podTemplate.Namespace,
+				UID:             podTemplate.UID,
+				ResourceVersion: podTemplate.ResourceVersion,
+			},
+			labels: podTemplate.Labels,
+			spec: batchv1.JobSpec{
+				Template:                template,
+				TTLSecondsAfterFinished: &ttl,
+			},
+			// Deleting the template deletes its jobs
+			owner: &v1.OwnerReference{
+				APIVersion: "v1",
+				Kind:       string(SourcePodTemplate),
+				Name:       podTemplate.Name,
+				UID:        podTemplate.UID,
+			},
+		}, nil
+	}
+
+	cronJob, err := w.ClientSet.BatchV1().CronJobs(w.SourceNamespace).Get(ctx, w.SourceName, v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return &jobSource{
+		reference: cronJobReference(cronJob),
+		labels:    cronJob.Labels,
+		spec:      cronJob.Spec.JobTemplate.Spec,
+		owner: &v1.OwnerReference{
+			APIVersion: "batch/v1",
+			Kind:       "CronJob",
+			Name:       cronJob.Name,
+			UID:        cronJob.UID,
+		},
+		annotations: map[string]string{
+			"cronjob.kubernetes.io/instantiate": "manual",
+		},
+	}, nil
+}
+
+func (w *K8sScalingWorker) sourceKind() K8sSource {
+	if w.Source == "" {
+		return SourceCronJob
+	}
+	return w.Source
+}
@@ -0,0 +1,285 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/vela-games/circleci-runner-autoscaler/budget"
+	circleci_client "github.com/vela-games/circleci-runner-autoscaler/client"
+)
+
+// launchedMachine is a machine the autoscaler launched for a resource class, with the runner running on it if it
+// connected already
+type launchedMachine struct {
+	id string
+	// Name of the machine in logs
+	name     string
+	launched time.Time
+	// Machine type of the machine, for its budget weight
+	machineType string
+
+	// It exited and only needs cleaning up
+	gone bool
+	// Up and running
+	ready bool
+	// The runner set RunnerStateTag to idle on its machine
+	saysIdle bool
+
+	runner *circleci_client.Agent
+}
+
+// launchBackend lists, launches and removes the machines of a resource class
+type launchBackend interface {
+	listMachines(ctx context.Context) ([]launchedMachine, error)
+	// launch launches up to count machines, and returns how many it launched even if it failed
+	launch(ctx context.Context, count int32) (int32, error)
+	// remove gives the machines the chance to exit on their own if graceful
+	remove(ctx context.Context, machines []launchedMachine, graceful bool) error
+}
+
+// launchScaling is the scaling loop of the backends that launch every machine themselves, e.g. EC2 launch templates
+// and Docker engines, and remove them once their runner is idle for idleTimeout
+type launchScaling struct {
+	resourceClass  string
+	circleCiClient circleci_client.ClientWithResponsesInterface
+	backend        launchBackend
+
+	maxMachines   int32
+	idleTimeout   time.Duration
+	launchTimeout time.Duration
+	budget        *budget.Budget
+	dryRun        bool
+	now           time.Time
+
+	// What the machines are launched from, e.g. the launch template, and what they're called in logs
+	source string
+	unit   string
+	// Machine type of the machines when there are none yet
+	machineType string
+
+	reporter *reporter
+	limit    *capacityLimit
+}
+
+func (s launchScaling) handle(ctx context.Context) {
+	log.Printf("handle scaling of %v", s.resourceClass)
+
+	response, err := s.circleCiClient.GetUnclaimedTasksWithResponse(ctx, &circleci_client.GetUnclaimedTasksParams{
+		ResourceClass: s.resourceClass,
+	})
+	if err != nil {
+		log.Printf("error getting unclaimed tasks by resource class %v: %v", s.resourceClass, err)
+		s.reporter.failed("getting unclaimed tasks: %v", err)
+		return
+	}
+	if response.StatusCode() != 200 || response.JSON200 == nil || response.JSON200.UnclaimedTaskCount == nil {
+		log.Printf("%v: got %v code instead of 200 getting unclaimed tasks", s.resourceClass, response.StatusCode())
+		s.reporter.failed("getting unclaimed tasks: got %v code instead of 200", response.StatusCode())
+		return
+	}
+	unclaimedTaskCount := *response.JSON200.UnclaimedTaskCount
+
+	machines, err := s.backend.listMachines(ctx)
+	if err != nil {
+		log.Printf("%v: error getting %v: %v", s.resourceClass, s.unit, err)
+		s.reporter.failed("getting %v: %v", s.unit, err)
+		return
+	}
+
+	// Machines without a runner are still starting, unless they have been at it for longer than launchTimeout.
+	// Machines that exited and weren't cleaned up are removed.
+	var active, starting int32
+	var remove []launchedMachine
+	for _, machine := range machines {
+		switch {
+		case machine.gone:
+			remove = append(remove, machine)
+		case machine.runner != nil:
+			active++
+		case s.launchTimeout > 0 && s.now.Sub(machine.launched) > s.launchTimeout:
+			log.Printf("%v: runner of %v didn't show up after %v, removing it", s.resourceClass, machine.name, s.launchTimeout)
+			remove = append(remove, machine)
+		default:
+			starting++
+		}
+	}
+	current := active + starting
+
+	if err := s.remove(ctx, remove, false); err != nil {
+		return
+	}
+
+	if unclaimedTaskCount == 0 {
+		idle, err := s.idleMachines(ctx, machines)
+		if err != nil {
+			log.Printf("%v: error looking for idle runners: %v", s.resourceClass, err)
+			s.reporter.failed("looking for idle runners: %v", err)
+		}
+		current -= int32(len(idle))
+
+		if err := s.remove(ctx, idle, true); err != nil {
+			return
+		}
+		s.updateBudget(current, machines)
+		s.reporter.pending(starting)
+
+		if s.dryRun {
+			s.reporter.decided("dry run: no unclaimed tasks, would remove %v %v", len(remove)+len(idle), s.unit)
+			return
+		}
+		s.reporter.decided("no unclaimed tasks, removed %v %v", len(remove)+len(idle), s.unit)
+		return
+	}
+
+	// The machines still starting will take some of the tasks
+	desired := current
+	if missing := int32(unclaimedTaskCount) - starting; missing > 0 {
+		desired += missing
+	}
+	maxMachines := s.limit.capped(s.maxMachines, s.now)
+	if desired > maxMachines {
+		desired = maxMachines
+	}
+	if desired <= current {
+		log.Printf("%v: %v unclaimed tasks, %v %v at max of %v", s.resourceClass, unclaimedTaskCount, current, s.unit, maxMachines)
+		s.reporter.decided("%v unclaimed tasks but %v %v is the max of %v", unclaimedTaskCount, current, s.unit, maxMachines)
+		s.updateBudget(current, machines)
+		s.reporter.pending(starting)
+		return
+	}
+
+	if s.budget != nil {
+		desired = s.budget.Claim(s.resourceClass, s.source, current, desired, s.budgetWeight(machines))
+		if desired <= current {
+			log.Printf("%v: budget exhausted, not launching %v", s.resourceClass, s.unit)
+			s.reporter.decided("budget exhausted, %v unclaimed tasks but staying at %v %v", unclaimedTaskCount, current, s.unit)
+			return
+		}
+	}
+
+	launch := desired - current
+	log.Printf("%v has %v unclaimed tasks and %v %v, launching %v from %v", s.resourceClass, unclaimedTaskCount, current, s.unit, launch, s.source)
+
+	if s.dryRun {
+		s.reporter.decided("dry run: %v unclaimed tasks, would launch %v %v from %v", unclaimedTaskCount, launch, s.unit, s.source)
+		s.updateBudget(current, machines)
+		return
+	}
+
+	launched, err := s.backend.launch(ctx, launch)
+	// The backend can launch fewer machines than asked for
+	s.updateBudget(current+launched, machines)
+	s.reporter.pending(starting + launched)
+	if err != nil {
+		log.Printf("%v: error launching %v from %v: %v", s.resourceClass, s.unit, s.source, err)
+		s.reporter.failed("launched %v of %v %v from %v: %v", launched, launch, s.unit, s.source, err)
+		return
+	}
+	s.reporter.decided("%v unclaimed tasks, launched %v %v from %v", unclaimedTaskCount, launched, s.unit, s.source)
+}
+
+// inspect fills in how many machines the resource class has and how many of them are ready
+func (s launchScaling) inspect(ctx context.Context, state *ClassState) error {
+	if err := inspectCircleCi(ctx, s.circleCiClient, state); err != nil {
+		return err
+	}
+
+	machines, err := s.backend.listMachines(ctx)
+	if err != nil {
+		return fmt.Errorf("getting %v: %w", s.unit, err)
+	}
+	for _, machine := range machines {
+		if machine.gone {
+			continue
+		}
+		state.DesiredCapacity++
+		if machine.ready {
+			state.Ready++
+		}
+	}
+	return nil
+}
+
+// idleMachines returns the ready machines whose runner didn't run a task for idleTimeout and isn't running one now
+func (s launchScaling) idleMachines(ctx context.Context, machines []launchedMachine) ([]launchedMachine, error) {
+	if s.idleTimeout <= 0 {
+		return nil, nil
+	}
+
+	withRunner := false
+	for _, machine := range machines {
+		withRunner = withRunner || machine.runner != nil
+	}
+	if !withRunner {
+		return nil, nil
+	}
+
+	running, err := runningTasks(ctx, s.circleCiClient, s.resourceClass)
+	if err != nil {
+		return nil, err
+	}
+
+	var idle []launchedMachine
+	for _, machine := range machines {
+		if !machine.ready || machine.runner == nil {
+			continue
+		}
+		// CircleCI doesn't tell which runners run the tasks, only the ones that said they're idle are known not to
+		if running > 0 && !machine.saysIdle {
+			continue
+		}
+
+		lastActive, isIdle := idleRunner(*machine.runner, s.now, s.idleTimeout)
+		if !isIdle {
+			continue
+		}
+
+		log.Printf("%v: runner of %v is idle since %v, removing it", s.resourceClass, machine.name, lastActive.Format(time.RFC3339))
+		idle = append(idle, machine)
+	}
+
+	return idle, nil
+}
+
+// idleRunner returns when the runner last ran a task, or connected if it never did, and whether that's longer ago
+// than timeout
+func idleRunner(runner circleci_client.Agent, now time.Time, timeout time.Duration) (time.Time, bool) {
+	lastActive := runner.LastUsed
+	if lastActive == nil {
+		lastActive = runner.FirstConnected
+	}
+	if lastActive == nil || now.Sub(*lastActive) < timeout {
+		return time.Time{}, false
+	}
+	return *lastActive, true
+}
+
+func (s launchScaling) remove(ctx context.Context, machines []launchedMachine, graceful bool) error {
+	if len(machines) == 0 || s.dryRun {
+		return nil
+	}
+
+	if err := s.backend.remove(ctx, machines, graceful); err != nil {
+		log.Printf("%v: error removing %v: %v", s.resourceClass, s.unit, err)
+		s.reporter.failed("removing %v: %v", s.unit, err)
+		return err
+	}
+	return nil
+}
+
+func (s launchScaling) updateBudget(current int32, machines []launchedMachine) {
+	if s.budget != nil {
+		s.budget.Update(s.resourceClass, s.source, current, s.budgetWeight(machines))
+	}
+}
+
+// budgetWeight returns the cost units of a machine of the resource class, going by the type of its machines
+func (s launchScaling) budgetWeight(machines []launchedMachine) float64 {
+	machineType := s.machineType
+	if len(machines) > 0 && machines[0].machineType != "" {
+		machineType = machines[0].machineType
+	}
+	return s.budget.Weight(s.resourceClass, machineType)
+}
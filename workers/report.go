@@ -0,0 +1,114 @@
+package workers
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// WorkerReport is what a worker is managing and what it last did
+type WorkerReport struct {
+	Backend       string
+	Target        string
+	ResourceClass string
+
+	LastDecision   string
+	LastDecisionAt time.Time
+	LastError      string
+	LastErrorAt    time.Time
+	// Capacity requested from the backend that doesn't have a runner yet
+	PendingCapacity int32
+
+	// Temporary limit on the capacity of the resource class, set through the admin API
+	CapacityLimit      *int32
+	CapacityLimitUntil time.Time
+}
+
+// Workers that report what they're doing
+type Reporter interface {
+	Report() WorkerReport
+}
+
+// Workers whose capacity can be limited for a while
+type CapacityLimiter interface {
+	LimitCapacity(max int32, until time.Time)
+	ClearCapacityLimit()
+}
+
+// reporter records the decisions of a worker, it's safe to read while the worker is running
+type reporter struct {
+	reportMu sync.Mutex
+	report   WorkerReport
+}
+
+func (r *reporter) snapshot() WorkerReport {
+	r.reportMu.Lock()
+	defer r.reportMu.Unlock()
+	return r.report
+}
+
+func (r *reporter) decided(format string, args ...any) {
+	r.reportMu.Lock()
+	defer r.reportMu.Unlock()
+	r.report.LastDecision = fmt.Sprintf(format, args...)
+	r.report.LastDecisionAt = time.Now()
+}
+
+func (r *reporter) failed(format string, args ...any) {
+	r.reportMu.Lock()
+	defer r.reportMu.Unlock()
+	r.report.LastError = fmt.Sprintf(format, args...)
+	r.report.LastErrorAt = time.Now()
+}
+
+func (r *reporter) pending(capacity int32) {
+	r.reportMu.Lock()
+	defer r.reportMu.Unlock()
+	r.report.PendingCapacity = capacity
+}
+
+// capacityLimit is a temporary limit on the capacity a worker scales to
+type capacityLimit struct {
+	limitMu sync.Mutex
+	max     int32
+	until   time.Time
+}
+
+func (c *capacityLimit) LimitCapacity(max int32, until time.Time) {
+	c.limitMu.Lock()
+	defer c.limitMu.Unlock()
+	c.max = max
+	c.until = until
+}
+
+func (c *capacityLimit) ClearCapacityLimit() {
+	c.limitMu.Lock()
+	defer c.limitMu.Unlock()
+	c.until = time.Time{}
+}
+
+// limit returns the capacity limit in place at the time, if any
+func (c *capacityLimit) limit(now time.Time) (int32, time.Time, bool) {
+	c.limitMu.Lock()
+	defer c.limitMu.Unlock()
+	if !now.Before(c.until) {
+		return 0, time.Time{}, false
+	}
+	return c.max, c.until, true
+}
+
+// capped lowers max to the capacity limit in place at the time, if any
+func (c *capacityLimit) capped(max int32, now time.Time) int32 {
+	if limit, _, ok := c.limit(now); ok && limit < max {
+		return limit
+	}
+	return max
+}
+
+// reportLimit adds the capacity limit in place at the time to the report, if any
+func (c *capacityLimit) reportLimit(report *WorkerReport, now time.Time) {
+	if max, until, ok := c.limit(now); ok {
+		report.CapacityLimit = &max
+		report.CapacityLimitUntil = until
+	}
+}
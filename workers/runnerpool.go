@@ -0,0 +1,406 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/vela-games/circleci-runner-autoscaler/budget"
+	circleci_client "github.com/vela-games/circleci-runner-autoscaler/client"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Label set on the jobs and pods of a RunnerPool with the name of the pool
+const RunnerPoolLabel = "runners.vela.games/pool"
+
+var RunnerPoolResource = schema.GroupVersionResource{
+	Group:    "runners.vela.games",
+	Version:  "v1alpha1",
+	Resource: "runnerpools",
+}
+
+// RunnerPool declares the runners of a resource class on Kubernetes, see install/helm/circleci-runner-autoscaler/crds
+type RunnerPool struct {
+	v1.TypeMeta   `json:",inline"`
+	v1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   RunnerPoolSpec   `json:"spec"`
+	Status RunnerPoolStatus `json:"status,omitempty"`
+}
+
+type RunnerPoolSpec struct {
+	// Full name of the resource class, e.g. vela-games/k8s-small
+	ResourceClass string `json:"resourceClass"`
+	// Runners always kept up, even without tasks
+	MinRunners int32 `json:"minRunners,omitempty"`
+	// Runners that can be up at once, 0 means no limit
+	MaxRunners int32 `json:"maxRunners,omitempty"`
+	// Runners kept up on top of the running and unclaimed tasks, so new tasks don't wait for a pod to start
+	IdleRunners int32 `json:"idleRunners,omitempty"`
+
+	Template corev1.PodTemplateSpec `json:"template"`
+}
+
+type RunnerPoolStatus struct {
+	ReadyRunners   int32    `json:"readyRunners"`
+	PendingRunners int32    `json:"pendingRunners"`
+	DesiredRunners int32    `json:"desiredRunners"`
+	LastScaleTime  *v1.Time `json:"lastScaleTime,omitempty"`
+	LastError      string   `json:"lastError,omitempty"`
+	LastErrorTime  *v1.Time `json:"lastErrorTime,omitempty"`
+}
+
+// RunnerPoolScalingWorker scales the runners of a RunnerPool, it replaces the K8sScalingWorker for resource classes
+// declared as pools instead of template CronJobs
+type RunnerPoolScalingWorker struct {
+	ResourceClass string
+
+	PoolName      string
+	PoolNamespace string
+
+	TimestampGenerator func() int64
+
+	DynamicClient  dynamic.Interface
+	ClientSet      kubernetes.Interface
+	CircleCiClient circleci_client.ClientWithResponsesInterface
+
+	// Optional, the jobs created are limited to the capacity the budget grants
+	Budget *budget.Budget
+
+	// Only decide how to scale, without creating any job
+	DryRun bool
+
+	// Pass the scale event of the runners to their containers as environment variables
+	InjectRunnerEnv bool
+
+	// Besides the ResourceQuotas, only create the jobs that fit in the nodes matching their node selector
+	CheckNodeCapacity bool
+
+	// Optional, shares the capacity of the cluster with the other resource classes when it's contested
+	Scheduler *ClassScheduler
+	// PriorityClass of the runner pods, unless their template sets one
+	PriorityClassName string
+
+	reporter
+	capacityLimit
+}
+
+func (w *RunnerPoolScalingWorker) Kind() WorkerKind {
+	return KindScaling
+}
+
+func (w *RunnerPoolScalingWorker) ResourceClassName() string {
+	return w.ResourceClass
+}
+
+func (w *RunnerPoolScalingWorker) Report() WorkerReport {
+	report := w.snapshot()
+	report.Backend = "kubernetes"
+	report.Target = w.PoolNamespace + "/" + w.PoolName
+	report.ResourceClass = w.ResourceClass
+	w.reportLimit(&report, time.Now())
+	return report
+}
+
+// Handle scales the pool to the running and unclaimed tasks plus its idle runners, within its min and max runners.
+// Pending pods count as runners, so unlike the K8sScalingWorker it doesn't have to wait for them to come up.
+func (w *RunnerPoolScalingWorker) Handle(ctx context.Context) {
+	log.Printf("handle scaling of %v", w.ResourceClass)
+
+	pool, err := w.getPool(ctx)
+	if k8serrors.IsNotFound(err) {
+		log.Printf("%v: RunnerPool %v was deleted", w.ResourceClass, w.PoolName)
+		w.decided("RunnerPool %v was deleted", w.PoolName)
+		return
+	}
+	if err != nil {
+		log.Printf("error getting RunnerPool %v: %v", w.PoolName, err)
+		w.failed("getting RunnerPool %v: %v", w.PoolName, err)
+		return
+	}
+
+	response, err := w.CircleCiClient.GetUnclaimedTasksWithResponse(ctx, &circleci_client.GetUnclaimedTasksParams{
+		ResourceClass: w.ResourceClass,
+	})
+	if err != nil {
+		log.Printf("error getting unclaimed tasks by resource class %v: %v", w.ResourceClass, err)
+		w.failed("getting unclaimed tasks: %v", err)
+		return
+	}
+
+	if response.StatusCode() != 200 || response.JSON200 == nil || response.JSON200.UnclaimedTaskCount == nil {
+		log.Printf("got %v code instead of 200", response.StatusCode())
+		w.failed("getting unclaimed tasks: got %v code instead of 200", response.StatusCode())
+		return
+	}
+	unclaimed := int32(*response.JSON200.UnclaimedTaskCount)
+
+	running, err := runningTasks(ctx, w.CircleCiClient, w.ResourceClass)
+	if err != nil {
+		log.Printf("error getting running tasks of %v: %v", w.ResourceClass, err)
+		w.failed("%v", err)
+		return
+	}
+
+	ready, pending, err := w.countPods(ctx)
+	if err != nil {
+		log.Printf("error listing pods of RunnerPool %v: %v", w.PoolName, err)
+		w.failed("listing pods of RunnerPool %v: %v", w.PoolName, err)
+		return
+	}
+	current := ready + pending
+
+	desired := int32(running) + unclaimed + pool.Spec.IdleRunners
+	if desired < pool.Spec.MinRunners {
+		desired = pool.Spec.MinRunners
+	}
+	if pool.Spec.MaxRunners > 0 && desired > pool.Spec.MaxRunners {
+		desired = pool.Spec.MaxRunners
+	}
+	if limit, _, ok := w.limit(time.Now()); ok && desired > limit {
+		desired = limit
+	}
+
+	pool.Status.ReadyRunners = ready
+	pool.Status.PendingRunners = pending
+	pool.Status.DesiredRunners = desired
+
+	if desired <= current {
+		w.decided("%v running and %v unclaimed tasks, %v runners are enough", running, unclaimed, current)
+		w.pending(pending)
+		if w.Scheduler != nil {
+			w.Scheduler.Forget(w.ResourceClass)
+		}
+		w.updateBudget(current)
+		w.updateStatus(ctx, pool)
+		return
+	}
+
+	wanted := int(desired - current)
+	if fit, reason := allocateCapacity(ctx, w.ClientSet, w.Scheduler, w.ResourceClass, w.PoolNamespace, pool.Spec.Template, wanted, w.CheckNodeCapacity); fit < wanted {
+		log.Printf("%v: demand throttled by capacity, %v of %v jobs fit: %v", w.ResourceClass, fit, wanted, reason)
+		if !w.DryRun {
+			recordEvent(w.ClientSet, poolReference(pool), corev1.EventTypeWarning, EventCapacityThrottled, "Only %v of %v jobs fit: %v", fit, wanted, reason)
+		}
+		if fit == 0 {
+			w.decided("wanted %v runners but no capacity left: %v", desired, reason)
+			w.updateStatus(ctx, pool)
+			return
+		}
+		desired = current + int32(fit)
+	}
+
+	// Only claim the budget for the jobs that fit
+	if w.Budget != nil {
+		granted := w.Budget.Claim(w.ResourceClass, w.PoolName, current, desired, w.Budget.Weight(w.ResourceClass, ""))
+		if granted <= current {
+			log.Printf("%v: budget exhausted, not creating jobs", w.ResourceClass)
+			w.decided("budget exhausted, wanted %v runners but staying at %v", desired, current)
+			if !w.DryRun {
+				recordEvent(w.ClientSet, poolReference(pool), corev1.EventTypeWarning, EventBudgetExhausted, "Budget exhausted, wanted %v runners but staying at %v", desired, current)
+				w.updateStatus(ctx, pool)
+			}
+			return
+		}
+		desired = granted
+	}
+
+	if w.DryRun {
+		w.decided("dry run: %v running and %v unclaimed tasks, would create %v jobs from RunnerPool %v", running, unclaimed, desired-current, w.PoolName)
+		w.updateBudget(current)
+		return
+	}
+
+	timestamp := w.TimestampGenerator()
+	event := scaleEvent{
+		id:            scaleEventID(w.PoolName, pool.UID, timestamp),
+		resourceClass: w.ResourceClass,
+		reason:        fmt.Sprintf("%v running and %v unclaimed tasks, %v idle runners", running, unclaimed, pool.Spec.IdleRunners),
+		requestedAt:   time.Unix(timestamp, 0),
+		env:           w.InjectRunnerEnv,
+		priorityClass: w.PriorityClassName,
+	}
+
+	log.Printf("%v has %v runners and wants %v, creating k8s jobs for scale event %v", w.ResourceClass, current, desired, event.id)
+
+	var jobs []*batchv1.Job
+	for i := 0; i < int(desired-current); i++ {
+		job := poolJob(pool, jobName(w.PoolName, pool.UID, timestamp, i))
+		event.stamp(job)
+		jobs = append(jobs, job)
+	}
+
+	result := createJobs(ctx, w.ClientSet, jobs)
+	// Give back the budget claimed for the jobs that weren't created
+	w.updateBudget(current + int32(result.created))
+	for _, failure := range result.failures {
+		log.Printf("error creating job %v for %v: %v", failure.job, w.ResourceClass, failure.err)
+		w.failed("creating job %v: %v", failure.job, failure.err)
+		recordEvent(w.ClientSet, poolReference(pool), corev1.EventTypeWarning, failure.reason(), "Error creating job %v: %v", failure.job, failure.err)
+		now := v1.Now()
+		pool.Status.LastError = fmt.Sprintf("creating job %v: %v", failure.job, failure.err)
+		pool.Status.LastErrorTime = &now
+	}
+
+	// Jobs that already existed were created by a previous attempt and their pods are counted already
+	w.decided("%v running and %v unclaimed tasks, created %v jobs, %v already existed, %v failed", running, unclaimed, result.created, result.existing, len(result.failures)+result.skipped)
+	w.pending(pending + int32(result.created))
+	pool.Status.PendingRunners = pending + int32(result.created)
+	if result.created > 0 {
+		recordEvent(w.ClientSet, poolReference(pool), corev1.EventTypeNormal, EventScaledUp, "Created %v jobs to go from %v to %v runners, scale event %v", result.created, current, desired, event.id)
+		now := v1.Now()
+		pool.Status.LastScaleTime = &now
+	}
+	w.updateStatus(ctx, pool)
+}
+
+func (w *RunnerPoolScalingWorker) Inspect(ctx context.Context) (ClassState, error) {
+	state := ClassState{
+		ResourceClass: w.ResourceClass,
+		Backend:       "kubernetes",
+		Target:        w.PoolNamespace,
+		Group:         w.PoolName,
+	}
+
+	if err := inspectCircleCi(ctx, w.CircleCiClient, &state); err != nil {
+		return state, err
+	}
+
+	pool, err := w.getPool(ctx)
+	if err != nil {
+		return state, fmt.Errorf("getting RunnerPool %v: %w", w.PoolName, err)
+	}
+	state.MinSize = pool.Spec.MinRunners
+	state.MaxSize = pool.Spec.MaxRunners
+
+	ready, pending, err := w.countPods(ctx)
+	if err != nil {
+		return state, fmt.Errorf("listing pods of RunnerPool %v: %w", w.PoolName, err)
+	}
+	state.DesiredCapacity = ready + pending
+	state.Ready = ready
+
+	return state, nil
+}
+
+func (w *RunnerPoolScalingWorker) updateBudget(current int32) {
+	if w.Budget != nil {
+		w.Budget.Update(w.ResourceClass, w.PoolName, current, w.Budget.Weight(w.ResourceClass, ""))
+	}
+}
+
+func (w *RunnerPoolScalingWorker) getPool(ctx context.Context) (*RunnerPool, error) {
+	object, err := w.DynamicClient.Resource(RunnerPoolResource).Namespace(w.PoolNamespace).Get(ctx, w.PoolName, v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return runnerPoolFromUnstructured(object)
+}
+
+// countPods returns the running and pending pods of the pool
+func (w *RunnerPoolScalingWorker) countPods(ctx context.Context) (int32, int32, error) {
+	podList, err := w.ClientSet.CoreV1().Pods(w.PoolNamespace).List(ctx, v1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(map[string]string{
+			RunnerPoolLabel: w.PoolName,
+		}).String(),
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	ready, pending := int32(0), int32(0)
+	for _, pod := range podList.Items {
+		switch pod.Status.Phase {
+		case corev1.PodPending:
+			pending++
+		case corev1.PodRunning:
+			ready++
+		}
+	}
+	return ready, pending, nil
+}
+
+// updateStatus writes the status subresource of the pool, failing to do so is only logged
+func (w *RunnerPoolScalingWorker) updateStatus(ctx context.Context, pool *RunnerPool) {
+	object, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pool)
+	if err != nil {
+		log.Printf("error encoding status of RunnerPool %v: %v", pool.Name, err)
+		return
+	}
+
+	if _, err := w.DynamicClient.Resource(RunnerPoolResource).Namespace(pool.Namespace).UpdateStatus(ctx, &unstructured.Unstructured{Object: object}, v1.UpdateOptions{}); err != nil {
+		log.Printf("error updating status of RunnerPool %v: %v", pool.Name, err)
+	}
+}
+
+func runnerPoolFromUnstructured(object *unstructured.Unstructured) (*RunnerPool, error) {
+	pool := &RunnerPool{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(object.Object, pool); err != nil {
+		return nil, fmt.Errorf("decoding RunnerPool %v: %w", object.GetName(), err)
+	}
+	return pool, nil
+}
+
+func poolReference(pool *RunnerPool) corev1.ObjectReference {
+	return corev1.ObjectReference{
+		APIVersion:      RunnerPoolResource.GroupVersion().String(),
+		Kind:            "RunnerPool",
+		Name:            pool.Name,
+		Namespace:       pool.Namespace,
+		UID:             pool.UID,
+		ResourceVersion: pool.ResourceVersion,
+	}
+}
+
+// poolJob builds a runner job from the pod template of the pool, labeled with the pool and its resource class
+func poolJob(pool *RunnerPool, name string) *batchv1.Job {
+	org, class, _ := strings.Cut(pool.Spec.ResourceClass, "/")
+
+	template := *pool.Spec.Template.DeepCopy()
+	if template.Labels == nil {
+		template.Labels = map[string]string{}
+	}
+	template.Labels[RunnerPoolLabel] = pool.Name
+	template.Labels["resource-class-org"] = org
+	template.Labels["resource-class-name"] = class
+	// Jobs don't allow the Always default of pods
+	if template.Spec.RestartPolicy == "" {
+		template.Spec.RestartPolicy = corev1.RestartPolicyOnFailure
+	}
+
+	return &batchv1.Job{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: "batch/v1",
+			Kind:       "Job",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:      name,
+			Namespace: pool.Namespace,
+			Labels: map[string]string{
+				RunnerPoolLabel: pool.Name,
+			},
+			OwnerReferences: []v1.OwnerReference{
+				{
+					APIVersion: RunnerPoolResource.GroupVersion().String(),
+					Kind:       "RunnerPool",
+					Name:       pool.Name,
+					UID:        pool.UID,
+				},
+			},
+		},
+		Spec: batchv1.JobSpec{
+			Template: template,
+		},
+	}
+}
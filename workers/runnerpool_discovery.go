@@ -0,0 +1,115 @@
+package workers
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/vela-games/circleci-runner-autoscaler/budget"
+	"github.com/vela-games/circleci-runner-autoscaler/client"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// RunnerPoolDiscoveryWorker starts a RunnerPoolScalingWorker for every RunnerPool of the CircleCI namespace
+type RunnerPoolDiscoveryWorker struct {
+	Dispatcher Dispatcher
+
+	DynamicClient  dynamic.Interface
+	ClientSet      kubernetes.Interface
+	CircleCiClient client.ClientWithResponsesInterface
+	Budget         *budget.Budget
+
+	// Passed on to the scaling workers
+	InjectRunnerEnv   bool
+	CheckNodeCapacity bool
+	Scheduler         *ClassScheduler
+	// PriorityClass of the runner pods by resource class
+	PriorityClasses map[string]string
+
+	K8sNamespace string
+	Namespace    string
+	// Stops the scaling worker of every RunnerPool found, by namespace/name
+	childPools map[string]context.CancelFunc
+
+	reporter
+}
+
+func (w *RunnerPoolDiscoveryWorker) Kind() WorkerKind {
+	return KindDiscovery
+}
+
+func (w *RunnerPoolDiscoveryWorker) Report() WorkerReport {
+	report := w.snapshot()
+	report.Backend = "kubernetes"
+	report.Target = w.K8sNamespace
+	return report
+}
+
+func (w *RunnerPoolDiscoveryWorker) Handle(ctx context.Context) {
+	poolList, err := w.DynamicClient.Resource(RunnerPoolResource).Namespace(w.K8sNamespace).List(ctx, v1.ListOptions{})
+	if err != nil {
+		log.Printf("error listing RunnerPools in namespace: %v, %v", w.K8sNamespace, err)
+		w.failed("listing RunnerPools in namespace %v: %v", w.K8sNamespace, err)
+		return
+	}
+
+	if w.childPools == nil {
+		w.childPools = map[string]context.CancelFunc{}
+	}
+
+	found := map[string]bool{}
+	for i := range poolList.Items {
+		pool, err := runnerPoolFromUnstructured(&poolList.Items[i])
+		if err != nil {
+			log.Printf("%v", err)
+			continue
+		}
+
+		namespace, _, ok := strings.Cut(pool.Spec.ResourceClass, "/")
+		if !ok || namespace != w.Namespace {
+			continue
+		}
+
+		key := pool.Namespace + "/" + pool.Name
+		found[key] = true
+		if _, ok := w.childPools[key]; ok {
+			continue
+		}
+
+		log.Printf("Found new RunnerPool %v for resource class %v, starting scaling worker for it", key, pool.Spec.ResourceClass)
+		sc := &RunnerPoolScalingWorker{
+			ResourceClass:     pool.Spec.ResourceClass,
+			PoolName:          pool.Name,
+			PoolNamespace:     pool.Namespace,
+			DynamicClient:     w.DynamicClient,
+			ClientSet:         w.ClientSet,
+			CircleCiClient:    w.CircleCiClient,
+			Budget:            w.Budget,
+			InjectRunnerEnv:   w.InjectRunnerEnv,
+			CheckNodeCapacity: w.CheckNodeCapacity,
+			Scheduler:         w.Scheduler,
+			PriorityClassName: w.PriorityClasses[pool.Spec.ResourceClass],
+			TimestampGenerator: func() int64 {
+				return time.Now().Unix()
+			},
+		}
+		recordEvent(w.ClientSet, poolReference(pool), corev1.EventTypeNormal, EventDiscovered, "Discovered resource class %v, started its scaling worker", pool.Spec.ResourceClass)
+		poolCtx, stop := context.WithCancel(ctx)
+		w.childPools[key] = stop
+		w.Dispatcher.Start(poolCtx, sc)
+	}
+
+	for key, stop := range w.childPools {
+		if found[key] {
+			continue
+		}
+		log.Printf("RunnerPool %v is gone, stopping its scaling worker", key)
+		stop()
+		delete(w.childPools, key)
+	}
+	w.decided("scaling %v RunnerPools", len(w.childPools))
+}
@@ -0,0 +1,352 @@
+package workers_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	circleci_client "github.com/vela-games/circleci-runner-autoscaler/client"
+	"github.com/vela-games/circleci-runner-autoscaler/workers"
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/assert/cmp"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func runnerPool(name string, namespace string, spec map[string]any) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]any{
+			"apiVersion": "runners.vela.games/v1alpha1",
+			"kind":       "RunnerPool",
+			"metadata": map[string]any{
+				"name":      name,
+				"namespace": namespace,
+			},
+			"spec": spec,
+		},
+	}
+}
+
+func fakeDynamicClient(objects ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		workers.RunnerPoolResource: "RunnerPoolList",
+	}, objects...)
+}
+
+func runnerPod(name string, pool string, phase corev1.PodPhase) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "circleci-runners",
+			Labels: map[string]string{
+				workers.RunnerPoolLabel: pool,
+			},
+		},
+		Status: corev1.PodStatus{
+			Phase: phase,
+		},
+	}
+}
+
+func poolCircleCiClient(unclaimed int, running int) *mockCircleCiClient {
+	client := inspectCircleCiClient(unclaimed)
+	client.MockGetRunningTasksWithResponse = func(ctx context.Context, params *circleci_client.GetRunningTasksParams, reqEditors ...circleci_client.RequestEditorFn) (*circleci_client.GetRunningTasksResponse, error) {
+		return &circleci_client.GetRunningTasksResponse{
+			Body: []byte(`{"running_runner_tasks": ` + strconv.Itoa(running) + `}`),
+			HTTPResponse: &http.Response{
+				StatusCode: 200,
+			},
+		}, nil
+	}
+	return client
+}
+
+func TestRunnerPoolDiscoveryWorker(t *testing.T) {
+	dynamicClient := fakeDynamicClient(
+		runnerPool("small", "circleci-runners", map[string]any{"resourceClass": "vela-games/k8s-small"}),
+		runnerPool("large", "circleci-runners", map[string]any{"resourceClass": "vela-games/k8s-large"}),
+		runnerPool("other", "circleci-runners", map[string]any{"resourceClass": "unknown-namespace/k8s-small"}),
+		runnerPool("small", "other-namespace", map[string]any{"resourceClass": "vela-games/k8s-small"}),
+	)
+	k8sClient := testclient.NewSimpleClientset()
+	dispatcher := &WorkerDispatcherTest{}
+
+	discovery := &workers.RunnerPoolDiscoveryWorker{
+		Dispatcher:    dispatcher,
+		Namespace:     "vela-games",
+		DynamicClient: dynamicClient,
+		ClientSet:     k8sClient,
+		K8sNamespace:  "circleci-runners",
+	}
+
+	discovery.Handle(context.TODO())
+	discovery.Handle(context.TODO())
+
+	assert.Equal(t, 2, dispatcher.Count)
+	assert.Equal(t, "scaling 2 RunnerPools", discovery.Report().LastDecision)
+
+	events := recordedEvents(t, k8sClient, "circleci-runners", 2)
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, "RunnerPool", events[0].InvolvedObject.Kind)
+
+	// The worker of a deleted pool is stopped
+	err := dynamicClient.Resource(workers.RunnerPoolResource).Namespace("circleci-runners").Delete(context.TODO(), "small", metav1.DeleteOptions{})
+	assert.NilError(t, err)
+	discovery.Handle(context.TODO())
+
+	assert.Equal(t, 2, dispatcher.Count)
+	assert.Equal(t, "scaling 1 RunnerPools", discovery.Report().LastDecision)
+	for i, worker := range dispatcher.Workers {
+		stopped := dispatcher.Contexts[i].Err() != nil
+		assert.Equal(t, worker.(*workers.RunnerPoolScalingWorker).PoolName == "small", stopped)
+	}
+}
+
+func TestRunnerPoolScalingWorker(t *testing.T) {
+	t.Run("it should create jobs for the tasks and idle runners", func(t *testing.T) {
+		dynamicClient := fakeDynamicClient(runnerPool("small", "circleci-runners", map[string]any{
+			"resourceClass": "vela-games/k8s-small",
+			"maxRunners":    int64(10),
+			"idleRunners":   int64(1),
+			"template": map[string]any{
+				"spec": map[string]any{
+					"containers": []any{
+						map[string]any{"name": "runner", "image": "circleci-image:latest"},
+					},
+				},
+			},
+		}))
+		k8sClient := testclient.NewSimpleClientset(
+			runnerPod("small-1", "small", corev1.PodRunning),
+			runnerPod("small-2", "small", corev1.PodRunning),
+			runnerPod("small-3", "small", corev1.PodPending),
+			runnerPod("small-4", "small", corev1.PodSucceeded),
+		)
+
+		scaling := &workers.RunnerPoolScalingWorker{
+			ResourceClass:      "vela-games/k8s-small",
+			PoolName:           "small",
+			PoolNamespace:      "circleci-runners",
+			DynamicClient:      dynamicClient,
+			ClientSet:          k8sClient,
+			CircleCiClient:     poolCircleCiClient(4, 2),
+			TimestampGenerator: func() int64 { return 1700000000 },
+		}
+
+		scaling.Handle(context.TODO())
+
+		// 2 running tasks, 4 unclaimed and 1 idle runner, with 3 runners up or coming
+		jobs, err := k8sClient.BatchV1().Jobs("circleci-runners").List(context.TODO(), metav1.ListOptions{})
+		assert.NilError(t, err)
+		assert.Equal(t, 4, len(jobs.Items))
+
+		job := jobs.Items[0]
+		assert.Assert(t, cmp.Regexp("^small-[0-9a-f]{10}$", job.Name))
+		assert.Equal(t, "RunnerPool", job.OwnerReferences[0].Kind)
+		assert.Equal(t, "small", job.Spec.Template.Labels[workers.RunnerPoolLabel])
+		assert.Equal(t, "vela-games", job.Spec.Template.Labels["resource-class-org"])
+		assert.Equal(t, "k8s-small", job.Spec.Template.Labels["resource-class-name"])
+		assert.Equal(t, corev1.RestartPolicyOnFailure, job.Spec.Template.Spec.RestartPolicy)
+		assert.Equal(t, "2 running and 4 unclaimed tasks, 1 idle runners", job.Annotations[workers.ReasonAnnotation])
+		assert.Equal(t, "2023-11-14T22:13:20Z", job.Spec.Template.Annotations[workers.RequestedAtAnnotation])
+		assert.Assert(t, job.Spec.Template.Labels[workers.ScaleEventLabel] != "")
+		assert.Equal(t, 0, len(job.Spec.Template.Spec.Containers[0].Env))
+
+		object, err := dynamicClient.Resource(workers.RunnerPoolResource).Namespace("circleci-runners").Get(context.TODO(), "small", metav1.GetOptions{})
+		assert.NilError(t, err)
+		status, _, _ := unstructured.NestedMap(object.Object, "status")
+		assert.Equal(t, int64(2), status["readyRunners"])
+		assert.Equal(t, int64(5), status["pendingRunners"])
+		assert.Equal(t, int64(7), status["desiredRunners"])
+		assert.Assert(t, status["lastScaleTime"] != nil)
+
+		assert.Equal(t, "2 running and 4 unclaimed tasks, created 4 jobs, 0 already existed, 0 failed", scaling.Report().LastDecision)
+	})
+
+	t.Run("it should keep the min runners and cap at the max runners", func(t *testing.T) {
+		dynamicClient := fakeDynamicClient(
+			runnerPool("idle", "circleci-runners", map[string]any{"resourceClass": "vela-games/k8s-idle", "minRunners": int64(2)}),
+			runnerPool("busy", "circleci-runners", map[string]any{"resourceClass": "vela-games/k8s-busy", "maxRunners": int64(3)}),
+		)
+		k8sClient := testclient.NewSimpleClientset(runnerPod("busy-1", "busy", corev1.PodRunning))
+
+		idle := &workers.RunnerPoolScalingWorker{
+			ResourceClass:      "vela-games/k8s-idle",
+			PoolName:           "idle",
+			PoolNamespace:      "circleci-runners",
+			DynamicClient:      dynamicClient,
+			ClientSet:          k8sClient,
+			CircleCiClient:     poolCircleCiClient(0, 0),
+			TimestampGenerator: func() int64 { return 1700000000 },
+		}
+		idle.Handle(context.TODO())
+
+		busy := &workers.RunnerPoolScalingWorker{
+			ResourceClass:      "vela-games/k8s-busy",
+			PoolName:           "busy",
+			PoolNamespace:      "circleci-runners",
+			DynamicClient:      dynamicClient,
+			ClientSet:          k8sClient,
+			CircleCiClient:     poolCircleCiClient(9, 1),
+			TimestampGenerator: func() int64 { return 1700000000 },
+		}
+		busy.Handle(context.TODO())
+
+		jobs, err := k8sClient.BatchV1().Jobs("circleci-runners").List(context.TODO(), metav1.ListOptions{})
+		assert.NilError(t, err)
+		pools := map[string]int{}
+		for _, job := range jobs.Items {
+			pools[job.Labels[workers.RunnerPoolLabel]]++
+		}
+		assert.DeepEqual(t, map[string]int{"busy": 2, "idle": 2}, pools)
+	})
+
+	t.Run("it should not scale out past a temporary capacity limit", func(t *testing.T) {
+		dynamicClient := fakeDynamicClient(runnerPool("small", "circleci-runners", map[string]any{"resourceClass": "vela-games/k8s-small"}))
+		k8sClient := testclient.NewSimpleClientset(runnerPod("small-1", "small", corev1.PodRunning))
+
+		scaling := &workers.RunnerPoolScalingWorker{
+			ResourceClass:      "vela-games/k8s-small",
+			PoolName:           "small",
+			PoolNamespace:      "circleci-runners",
+			DynamicClient:      dynamicClient,
+			ClientSet:          k8sClient,
+			CircleCiClient:     poolCircleCiClient(4, 1),
+			TimestampGenerator: func() int64 { return 1700000000 },
+		}
+		scaling.LimitCapacity(3, time.Now().Add(time.Hour))
+		scaling.Handle(context.TODO())
+
+		jobs, err := k8sClient.BatchV1().Jobs("circleci-runners").List(context.TODO(), metav1.ListOptions{})
+		assert.NilError(t, err)
+		assert.Equal(t, 2, len(jobs.Items))
+		assert.Equal(t, int32(3), *scaling.Report().CapacityLimit)
+	})
+
+	t.Run("it should record failed job creations in the status", func(t *testing.T) {
+		dynamicClient := fakeDynamicClient(runnerPool("small", "circleci-runners", map[string]any{"resourceClass": "vela-games/k8s-small"}))
+		k8sClient := testclient.NewSimpleClientset()
+		k8sClient.PrependReactor("create", "jobs", func(action k8stesting.Action) (handled bool, ret runtime.Object, err error) {
+			return true, nil, errors.New("exceeded quota")
+		})
+
+		scaling := &workers.RunnerPoolScalingWorker{
+			ResourceClass:      "vela-games/k8s-small",
+			PoolName:           "small",
+			PoolNamespace:      "circleci-runners",
+			DynamicClient:      dynamicClient,
+			ClientSet:          k8sClient,
+			CircleCiClient:     poolCircleCiClient(1, 0),
+			TimestampGenerator: func() int64 { return 1700000000 },
+		}
+		scaling.Handle(context.TODO())
+
+		object, err := dynamicClient.Resource(workers.RunnerPoolResource).Namespace("circleci-runners").Get(context.TODO(), "small", metav1.GetOptions{})
+		assert.NilError(t, err)
+		lastError, _, _ := unstructured.NestedString(object.Object, "status", "lastError")
+		assert.Assert(t, cmp.Regexp("^creating job small-[0-9a-f]{10}: exceeded quota$", lastError))
+
+		events := recordedEvents(t, k8sClient, "circleci-runners", 1)
+		assert.Equal(t, 1, len(events))
+		assert.Equal(t, workers.EventJobCreateFailed, events[0].Reason)
+	})
+
+	t.Run("it should do nothing once the pool is deleted", func(t *testing.T) {
+		k8sClient := testclient.NewSimpleClientset()
+		k8sClient.PrependReactor("create", "jobs", func(action k8stesting.Action) (handled bool, ret runtime.Object, err error) {
+			t.Error("CreateJob was called")
+			return true, nil, nil
+		})
+
+		scaling := &workers.RunnerPoolScalingWorker{
+			ResourceClass:  "vela-games/k8s-small",
+			PoolName:       "small",
+			PoolNamespace:  "circleci-runners",
+			DynamicClient:  fakeDynamicClient(),
+			ClientSet:      k8sClient,
+			CircleCiClient: poolCircleCiClient(1, 0),
+		}
+		scaling.Handle(context.TODO())
+
+		assert.Equal(t, "RunnerPool small was deleted", scaling.Report().LastDecision)
+	})
+
+	t.Run("it should not create runners twice for the same scale out", func(t *testing.T) {
+		name := strings.Repeat("long-pool-name-", 4) + "one"
+		dynamicClient := fakeDynamicClient(runnerPool(name, "circleci-runners", map[string]any{"resourceClass": "vela-games/k8s-small"}))
+		k8sClient := testclient.NewSimpleClientset()
+
+		// Two replicas of the autoscaler scaling out in the same second
+		for i := 0; i < 2; i++ {
+			scaling := &workers.RunnerPoolScalingWorker{
+				ResourceClass:      "vela-games/k8s-small",
+				PoolName:           name,
+				PoolNamespace:      "circleci-runners",
+				DynamicClient:      dynamicClient,
+				ClientSet:          k8sClient,
+				CircleCiClient:     poolCircleCiClient(3, 0),
+				TimestampGenerator: func() int64 { return 1700000000 },
+			}
+			scaling.Handle(context.TODO())
+
+			if i == 1 {
+				assert.Equal(t, "0 running and 3 unclaimed tasks, created 0 jobs, 3 already existed, 0 failed", scaling.Report().LastDecision)
+				assert.Equal(t, "", scaling.Report().LastError)
+			}
+		}
+
+		jobs, err := k8sClient.BatchV1().Jobs("circleci-runners").List(context.TODO(), metav1.ListOptions{})
+		assert.NilError(t, err)
+		assert.Equal(t, 3, len(jobs.Items))
+		for _, job := range jobs.Items {
+			assert.Assert(t, len(job.Name) <= 63, job.Name)
+		}
+	})
+
+	t.Run("it should stop creating jobs once the quota is exceeded", func(t *testing.T) {
+		dynamicClient := fakeDynamicClient(runnerPool("small", "circleci-runners", map[string]any{"resourceClass": "vela-games/k8s-small"}))
+		k8sClient := testclient.NewSimpleClientset()
+		attempts := 0
+		k8sClient.PrependReactor("create", "jobs", func(action k8stesting.Action) (handled bool, ret runtime.Object, err error) {
+			attempts++
+			if attempts == 1 {
+				return false, nil, nil
+			}
+			return true, nil, k8serrors.NewForbidden(schema.GroupResource{Group: "batch", Resource: "jobs"}, "small", errors.New("exceeded quota: compute-resources"))
+		})
+
+		scaling := &workers.RunnerPoolScalingWorker{
+			ResourceClass:      "vela-games/k8s-small",
+			PoolName:           "small",
+			PoolNamespace:      "circleci-runners",
+			DynamicClient:      dynamicClient,
+			ClientSet:          k8sClient,
+			CircleCiClient:     poolCircleCiClient(4, 0),
+			TimestampGenerator: func() int64 { return 1700000000 },
+		}
+		scaling.Handle(context.TODO())
+
+		assert.Equal(t, 2, attempts)
+		assert.Equal(t, "0 running and 4 unclaimed tasks, created 1 jobs, 0 already existed, 3 failed", scaling.Report().LastDecision)
+		assert.Equal(t, int32(1), scaling.Report().PendingCapacity)
+
+		events := recordedEvents(t, k8sClient, "circleci-runners", 2)
+		var reasons []string
+		for _, event := range events {
+			reasons = append(reasons, event.Reason)
+		}
+		assert.Assert(t, cmp.Contains(reasons, workers.EventQuotaExceeded))
+		assert.Assert(t, cmp.Contains(reasons, workers.EventScaledUp))
+	})
+}
@@ -2,6 +2,9 @@ package workers
 
 import (
 	"context"
+	"sync"
+
+	"github.com/vela-games/circleci-runner-autoscaler/config"
 )
 
 // Interface for all workers to implement
@@ -12,3 +15,30 @@ type Worker interface {
 type Dispatcher interface {
 	Start(context.Context, Worker)
 }
+
+// Workers that can pick up configuration changes without being restarted
+type Reconfigurable interface {
+	Reconfigure(*config.Configuration)
+}
+
+// pendingConfiguration hands a new configuration over to a worker, which applies it at the start of its next Handle
+// so it never changes under a running Handle
+type pendingConfiguration struct {
+	mu     sync.Mutex
+	config *config.Configuration
+}
+
+func (p *pendingConfiguration) Reconfigure(c *config.Configuration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.config = c
+}
+
+// take returns the configuration waiting to be applied, if any
+func (p *pendingConfiguration) take() *config.Configuration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c := p.config
+	p.config = nil
+	return c
+}